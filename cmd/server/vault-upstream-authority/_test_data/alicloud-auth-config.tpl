@@ -0,0 +1,9 @@
+vault_addr  = "{{ .Addr }}"
+pki_mount_point = "test-pki"
+ca_cert_path = "../../../pkg/fake/_test_data/ca.pem"
+alicloud_auth_config {
+   alicloud_auth_mount_point = "test-auth"
+   role = "test-role"
+   access_key_id = "test-access-key-id"
+   access_key_secret = "test-access-key-secret"
+}
@@ -0,0 +1,7 @@
+vault_addr  = "{{ .Addr }}"
+pki_mount_point = "test-pki"
+ca_cert_path = "../../../pkg/fake/_test_data/ca.pem"
+approle_auth_config {
+   approle_auth_mount_point = "test-auth"
+   kv_path = "secret/data/test-approle"
+}
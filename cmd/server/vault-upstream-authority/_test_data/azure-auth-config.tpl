@@ -0,0 +1,10 @@
+vault_addr  = "{{ .Addr }}"
+pki_mount_point = "test-pki"
+ca_cert_path = "../../../pkg/fake/_test_data/ca.pem"
+imds_endpoint = "{{ .IMDSAddr }}"
+login_timeout = "30s"
+azure_auth_config {
+   azure_auth_mount_point = "test-auth"
+   role = "test-role"
+   resource = "https://vault.example.com/"
+}
@@ -0,0 +1,11 @@
+vault_addr  = "{{ .Addr }}"
+pki_mount_point = "test-pki"
+ca_cert_path = "../../../pkg/fake/_test_data/ca.pem"
+create_child_token = true
+child_token_policies = ["pki-sign"]
+child_token_ttl = "10m"
+cert_auth_config {
+   cert_auth_mount_point = "test-auth"
+   client_cert_path = "../../../pkg/fake/_test_data/client.pem"
+   client_key_path = "../../../pkg/fake/_test_data/client-key.pem"
+}
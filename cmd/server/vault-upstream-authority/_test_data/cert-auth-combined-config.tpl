@@ -0,0 +1,7 @@
+vault_addr  = "{{ .Addr }}"
+pki_mount_point = "test-pki"
+ca_cert_path = "../../../pkg/fake/_test_data/ca.pem"
+cert_auth_config {
+   cert_auth_mount_point = "test-auth"
+   client_cert_key_path = "../../../pkg/fake/_test_data/client-cert-key.pem"
+}
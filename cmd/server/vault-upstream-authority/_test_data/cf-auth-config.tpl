@@ -0,0 +1,9 @@
+vault_addr  = "{{ .Addr }}"
+pki_mount_point = "test-pki"
+ca_cert_path = "../../../pkg/fake/_test_data/ca.pem"
+cf_auth_config {
+   cf_auth_mount_point = "test-auth"
+   role = "test-role"
+   instance_cert_path = "../../../pkg/fake/_test_data/cf-instance.pem"
+   instance_key_path = "../../../pkg/fake/_test_data/cf-instance-key.pem"
+}
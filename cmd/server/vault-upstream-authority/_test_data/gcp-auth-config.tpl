@@ -0,0 +1,10 @@
+vault_addr  = "{{ .Addr }}"
+pki_mount_point = "test-pki"
+ca_cert_path = "../../../pkg/fake/_test_data/ca.pem"
+imds_endpoint = "{{ .IMDSAddr }}"
+login_timeout = "30s"
+gcp_auth_config {
+   gcp_auth_mount_point = "test-auth"
+   role = "test-role"
+   service_account = "spire@test-project.iam.gserviceaccount.com"
+}
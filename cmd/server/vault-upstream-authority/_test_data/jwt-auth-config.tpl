@@ -0,0 +1,9 @@
+vault_addr  = "{{ .Addr }}"
+pki_mount_point = "test-pki"
+ca_cert_path = "../../../pkg/fake/_test_data/ca.pem"
+jwt_auth_config {
+   jwt_auth_mount_point = "test-auth"
+   role = "test-role"
+   jwt_path = "../../../pkg/fake/_test_data/jwt"
+   audience = "vault"
+}
@@ -0,0 +1,11 @@
+vault_addr  = "{{ .Addr }}"
+pki_mount_point = "test-pki"
+ca_cert_path = "../../../pkg/fake/_test_data/ca.pem"
+kerberos_auth_config {
+   kerberos_auth_mount_point = "test-auth"
+   username = "spire-server"
+   realm = "EXAMPLE.ORG"
+   service = "HTTP/vault.example.org"
+   keytab_path = "../../../pkg/fake/_test_data/kerberos.keytab"
+   krb5conf_path = "../../../pkg/fake/_test_data/krb5.conf"
+}
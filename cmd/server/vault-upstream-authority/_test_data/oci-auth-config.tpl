@@ -0,0 +1,9 @@
+vault_addr  = "{{ .Addr }}"
+pki_mount_point = "test-pki"
+ca_cert_path = "../../../pkg/fake/_test_data/ca.pem"
+oci_auth_config {
+   oci_auth_mount_point = "test-auth"
+   role = "test-role"
+   metadata_endpoint = "{{ .OCIAddr }}/opc/v2"
+   federation_endpoint = "{{ .OCIAddr }}/v1/x509"
+}
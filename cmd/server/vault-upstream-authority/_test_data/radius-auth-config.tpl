@@ -0,0 +1,8 @@
+vault_addr  = "{{ .Addr }}"
+pki_mount_point = "test-pki"
+ca_cert_path = "../../../pkg/fake/_test_data/ca.pem"
+radius_auth_config {
+   radius_auth_mount_point = "test-auth"
+   username = "test-user"
+   password = "test-password"
+}
@@ -0,0 +1,13 @@
+vault_addr  = "{{ .Addr }}"
+pki_mount_point = "test-pki"
+ca_cert_path = "../../../pkg/fake/_test_data/ca.pem"
+auth_method = "token"
+fallback_auth_method = "cert"
+token_auth_config {
+   token  = "test-token"
+}
+cert_auth_config {
+   cert_auth_mount_point = "test-auth"
+   client_cert_path = "../../../pkg/fake/_test_data/client.pem"
+   client_key_path  = "../../../pkg/fake/_test_data/client-key.pem"
+}
@@ -0,0 +1,6 @@
+vault_addr  = "{{ .Addr }}"
+pki_mount_point = "test-pki"
+ca_cert_path = "../../../pkg/fake/_test_data/ca.pem"
+token_auth_config {
+   token_from_stdin = true
+}
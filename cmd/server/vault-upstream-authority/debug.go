@@ -0,0 +1,111 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+const (
+	debugConfigPath = "/debug/config"
+	redactedValue   = "<redacted>"
+)
+
+// sensitiveConfigKeys are the configuration keys whose values are masked by the debug endpoint.
+// The values of vault_headers are also masked since these may carry API keys.
+var sensitiveConfigKeys = map[string]bool{
+	"token":             true,
+	"approle_secret_id": true,
+	"access_key_id":     true,
+	"access_key_secret": true,
+	"security_token":    true,
+	"password":          true,
+	"nonce":             true,
+	"vault_headers":     true,
+}
+
+// startDebugServer serves the effective configuration with secrets redacted on the address.
+func (p *VaultPlugin) startDebugServer(addr string) (*http.Server, net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(debugConfigPath, p.serveDebugConfig)
+	server := &http.Server{Handler: mux}
+	logger := p.logger
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			logger.Warn("Debug server is stopped", "err", err.Error())
+		}
+	}()
+	return server, l, nil
+}
+
+func (p *VaultPlugin) serveDebugConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p.mtx.RLock()
+	config := p.config
+	p.mtx.RUnlock()
+	if config == nil {
+		http.Error(w, "plugin is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(redactConfig(reflect.ValueOf(*config)))
+}
+
+// redactConfig converts the configuration struct to a map keyed by the hcl names,
+// and masks the values of sensitiveConfigKeys.
+func redactConfig(v reflect.Value) map[string]interface{} {
+	out := make(map[string]interface{})
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("hcl"), ",")[0]
+		if name == "" {
+			continue
+		}
+		f := v.Field(i)
+		switch {
+		case sensitiveConfigKeys[name]:
+			out[name] = redactValue(f)
+		case f.Kind() == reflect.Struct:
+			out[name] = redactConfig(f)
+		case f.Kind() == reflect.Ptr && !f.IsNil():
+			out[name] = f.Elem().Interface()
+		case f.Kind() == reflect.Ptr:
+			out[name] = nil
+		default:
+			out[name] = f.Interface()
+		}
+	}
+	return out
+}
+
+// redactValue masks the value, or each value if it is a map. Empty values are kept to show that they are not set.
+func redactValue(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Map {
+		m := make(map[string]string, v.Len())
+		for _, k := range v.MapKeys() {
+			m[k.String()] = redactedValue
+		}
+		return m
+	}
+	if v.IsZero() {
+		return v.Interface()
+	}
+	return redactedValue
+}
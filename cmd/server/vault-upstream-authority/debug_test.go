@@ -0,0 +1,279 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zlabjp/spire-vault-plugin/pkg/fake"
+)
+
+func TestDebugConfig(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/token-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+	req.Configuration += `
+debug_addr = "127.0.0.1:0"
+vault_headers {
+   X-Api-Gateway-Key = "test-gateway-key"
+}
+`
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	if _, err := p.Configure(ctx, req); err != nil {
+		t.Fatalf("error from Configure(): %v", err)
+	}
+	defer p.debugServer.Close()
+
+	resp, err := http.Get(fmt.Sprintf("http://%v%v", p.debugListener.Addr(), debugConfigPath))
+	if err != nil {
+		t.Fatalf("failed to request debug endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v, want %v: %s", resp.StatusCode, http.StatusOK, body)
+	}
+
+	for _, secret := range []string{"test-token", "test-gateway-key"} {
+		if strings.Contains(string(body), secret) {
+			t.Errorf("secret %q is not masked: %s", secret, body)
+		}
+	}
+
+	var got struct {
+		VaultAddr       string            `json:"vault_addr"`
+		VaultHeaders    map[string]string `json:"vault_headers"`
+		TokenAuthConfig struct {
+			Token string `json:"token"`
+		} `json:"token_auth_config"`
+		AppRoleAuthConfig struct {
+			SecretID string `json:"approle_secret_id"`
+		} `json:"approle_auth_config"`
+	}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if got.VaultAddr != fmt.Sprintf("https://%v/", addr) {
+		t.Errorf("got vault_addr %v, want %v", got.VaultAddr, fmt.Sprintf("https://%v/", addr))
+	}
+	if got.TokenAuthConfig.Token != redactedValue {
+		t.Errorf("got token %q, want %q", got.TokenAuthConfig.Token, redactedValue)
+	}
+	if got.VaultHeaders["X-Api-Gateway-Key"] != redactedValue {
+		t.Errorf("got vault_headers %v, want the value to be masked", got.VaultHeaders)
+	}
+	// Unset secrets are kept empty to show that they are not configured
+	if got.AppRoleAuthConfig.SecretID != "" {
+		t.Errorf("got approle_secret_id %q, want empty", got.AppRoleAuthConfig.SecretID)
+	}
+}
+
+func TestConfigureErrorDebugServerKeepsClient(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+	vc.RevokeResponseCode = 204
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	// The debug server can't listen on the address in use
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/cert-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+	req.Configuration += "\nrevoke_on_shutdown = true\n"
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	if _, err := p.Configure(ctx, req); err != nil {
+		t.Fatalf("error from Configure(): %v", err)
+	}
+	prev := p.vc
+
+	req.Configuration += fmt.Sprintf("\ndebug_addr = %q\n", l.Addr().String())
+	_, err = p.Configure(ctx, req)
+	wantErrPrefix := "failed to start debug server on"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+
+	// The previous client is neither replaced nor revoked, so that it still mints
+	if p.vc != prev {
+		t.Errorf("client is replaced by the failed configure")
+	}
+	if got := vc.LastRevokeRequest(); got != nil {
+		t.Errorf("token of the previous client is revoked by the failed configure")
+	}
+	mintReq, err := getFakeMintX509CARequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+	stream := &fake.UpstreamAuthorityMintX509CAServer{Ctx: ctx}
+	if err := p.MintX509CA(mintReq, stream); err != nil {
+		t.Errorf("unexpected error from MintX509CA: %v", err)
+	}
+}
+
+func TestConfigureErrorDebugServerKeepsCAWatch(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	serverCA, err := ioutil.ReadFile(fakeCaCert)
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+	rotatedCA, err := ioutil.ReadFile("../../../pkg/fake/_test_data/rotated-ca.pem")
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "vault-upstream-authority-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caPath := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caPath, serverCA, 0600); err != nil {
+		t.Fatalf("failed to write CA certificate: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/cert-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+	req.Configuration = strings.Replace(req.Configuration, fakeCaCert, caPath, 1) + "\nwatch_ca_cert = true\n"
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	defer p.Close()
+	ctx := context.Background()
+	if _, err := p.Configure(ctx, req); err != nil {
+		t.Fatalf("error from Configure(): %v", err)
+	}
+	req.Configuration += fmt.Sprintf("\ndebug_addr = %q\n", l.Addr().String())
+	if _, err := p.Configure(ctx, req); err == nil {
+		t.Fatal("expected got an error")
+	}
+
+	// The watcher of the previous client still reloads ca_cert_path, so the rotated CA rejects the server
+	tmpPath := filepath.Join(dir, "ca.pem.tmp")
+	if err := ioutil.WriteFile(tmpPath, rotatedCA, 0600); err != nil {
+		t.Fatalf("failed to write CA certificate: %v", err)
+	}
+	if err := os.Rename(tmpPath, caPath); err != nil {
+		t.Fatalf("failed to replace CA certificate: %v", err)
+	}
+
+	mintReq, err := getFakeMintX509CARequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := p.MintX509CA(mintReq, &fake.UpstreamAuthorityMintX509CAServer{Ctx: ctx}); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("CA certificate is not reloaded after the failed configure")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
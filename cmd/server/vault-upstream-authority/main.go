@@ -8,11 +8,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/pem"
+	"crypto/x509"
 	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,7 +32,10 @@ import (
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/hcl"
 	"github.com/spiffe/spire/pkg/common/catalog"
+	"github.com/spiffe/spire/pkg/common/hostservices/metricsservice"
+	"github.com/spiffe/spire/pkg/common/idutil"
 	"github.com/spiffe/spire/pkg/common/pemutil"
+	"github.com/spiffe/spire/pkg/common/plugin/hostservices"
 	upi "github.com/spiffe/spire/pkg/server/plugin/upstreamauthority"
 	spi "github.com/spiffe/spire/proto/spire/common/plugin"
 	"github.com/spiffe/spire/proto/spire/server/upstreamauthority"
@@ -31,31 +44,281 @@ import (
 	"github.com/zlabjp/spire-vault-plugin/pkg/vault"
 )
 
+const (
+	// defaultConfigureRetryTimeout is the time to keep retrying the authentication on Configure.
+	defaultConfigureRetryTimeout = time.Minute
+	// defaultConfigureRetryDelay is the first delay before retrying the authentication, which is doubled on each retry.
+	defaultConfigureRetryDelay = time.Second
+	// maxConfigureRetryDelay is the maximum delay before retrying the authentication.
+	maxConfigureRetryDelay = 16 * time.Second
+	// revokeTimeout bounds the revocation of the token, so that it doesn't block the shutdown.
+	revokeTimeout = 5 * time.Second
+)
+
 type VaultPluginConfig struct {
 	// A URL of Vault server. (e.g., https://vault.example.com:8443/)
 	VaultAddr string `hcl:"vault_addr"`
+	// Path prefix of the Vault API behind a reverse proxy, which replaces /v1 in the request URLs. (e.g., /vault/v1)
+	// If the value is empty, use /v1.
+	APIPrefix string `hcl:"api_prefix"`
 	// Name of mount point where PKI secret engine is mounted. (e.g., /<mount_point>/ca/pem)
 	PKIMountPoint string `hcl:"pki_mount_point"`
+	// Name of mount point of PKI secret engine to read the upstream bundle from. (e.g., the mount of the root CA)
+	// If the value is empty, the CA chain returned by pki_mount_point on signing is used.
+	BundlePKIMountPoint string `hcl:"bundle_pki_mount_point"`
+	// If true, the plugin verifies that pki_mount_point, bundle_pki_mount_point and the ones of trust_domains
+	// are PKI secret engines on Configure, so that a wrong mount fails with a clear error.
+	CheckMountType bool `hcl:"check_mount_type"`
+	// Overrides of pki_mount_point and issuer_ref per SPIFFE trust domain, which is selected by the URI SAN of the CSR.
+	// If the trust domain of the CSR is not configured, pki_mount_point and issuer_ref are used.
+	TrustDomains map[string]VaultTrustDomainConfig `hcl:"trust_domains"`
+	// Name of the auth method to use. (token, cert, approle, alicloud, oci, cf, radius, jwt, kerberos, aws, gcp or azure)
+	// If the value is empty, the auth method is selected by the configured auth block.
+	AuthMethod string `hcl:"auth_method"`
+	// Name of the auth method to try when the login with the primary auth method fails. (e.g., cert)
+	// The corresponding auth block must be configured. If the value is empty, the login is not retried.
+	FallbackAuthMethod string `hcl:"fallback_auth_method"`
 	// Configuration parameters to use token auth method
 	TokenAuthConfig VaultTokenAuthConfig `hcl:"token_auth_config"`
 	// Configuration parameters to use TLS certificate auth method
 	CertAuthConfig VaultCertAuthConfig `hcl:"cert_auth_config"`
 	// Configuration parameters to use AppRole auth method
 	AppRoleAuthConfig VaultAppRoleAuthConfig `hcl:"approle_auth_config"`
-	// Path to a CA certificate file that the client verifies the server certificate.
-	// Only PEM format is supported.
+	// Configuration parameters to use AliCloud auth method
+	AliCloudAuthConfig VaultAliCloudAuthConfig `hcl:"alicloud_auth_config"`
+	// Configuration parameters to use OCI auth method
+	OCIAuthConfig VaultOCIAuthConfig `hcl:"oci_auth_config"`
+	// Configuration parameters to use CF auth method
+	CFAuthConfig VaultCFAuthConfig `hcl:"cf_auth_config"`
+	// Configuration parameters to use RADIUS auth method
+	RADIUSAuthConfig VaultRADIUSAuthConfig `hcl:"radius_auth_config"`
+	// Configuration parameters to use JWT auth method
+	JWTAuthConfig VaultJWTAuthConfig `hcl:"jwt_auth_config"`
+	// Configuration parameters to use Kerberos auth method
+	KerberosAuthConfig VaultKerberosAuthConfig `hcl:"kerberos_auth_config"`
+	// Configuration parameters to use AWS auth method
+	AWSAuthConfig VaultAWSAuthConfig `hcl:"aws_auth_config"`
+	// Configuration parameters to use GCP auth method
+	GCPAuthConfig VaultGCPAuthConfig `hcl:"gcp_auth_config"`
+	// Configuration parameters to use Azure auth method
+	AzureAuthConfig VaultAzureAuthConfig `hcl:"azure_auth_config"`
+	// Address of the instance metadata service that AWS, GCP and Azure auth methods read the credentials from.
+	// (e.g., http://169.254.169.254) If the value is empty, the default address of each cloud is used.
+	IMDSEndpoint string `hcl:"imds_endpoint"`
+	// Path to a CA certificate file, or a directory of them, that the client verifies the server certificate.
+	// Only PEM format is supported. If the value is empty, the system trust store is used.
 	CACertPath string `hcl:"ca_cert_path"`
-	// (Deprecated) Request to issue a certificate with the specified TTL (Go-style time duration)
+	// If true, the certificates in ca_cert_path are trusted in addition to the system trust store.
+	AppendCAToSystemPool bool `hcl:"append_ca_to_system_pool"`
+	// If true, ca_cert_path is watched, and the new connections to Vault are verified with the reloaded certificates.
+	WatchCACert bool `hcl:"watch_ca_cert"`
+	// Path to a CA certificate file that the client verifies the certificate of the HTTPS proxy (HTTPS_PROXY). (PEM or a directory of PEM files)
+	// If the value is empty, the proxy is verified in the same way as Vault.
+	ProxyCACertPath string `hcl:"proxy_ca_cert_path"`
+	// (Deprecated) Request to issue a certificate with the specified TTL (Go-style time duration, "d" and "w" units are also accepted)
+	// If max_ttl is set, it is used as the default TTL when SPIRE server doesn't prefer one.
 	TTL string `hcl:"ttl"`
+	// Maximum TTL of the certificate. The preferred TTL from SPIRE server is capped by the value.
+	MaxTTL string `hcl:"max_ttl"`
 	// If true, vault client accepts any server certificates.
 	// It should be used only test environment so on.
 	TLSSkipVerify bool `hcl:"tls_skip_verify"`
+	// If true, the plugin creates a child token with child_token_policies and child_token_ttl after authentication,
+	// and uses the child token to sign intermediate certificates.
+	CreateChildToken bool `hcl:"create_child_token"`
+	// Policies of the child token. If the value is empty, the child token inherits the policies of the parent.
+	ChildTokenPolicies []string `hcl:"child_token_policies"`
+	// TTL of the child token. (e.g., 1h)
+	// If the value is empty, use default TTL of the token auth method
+	ChildTokenTTL string `hcl:"child_token_ttl"`
+	// Type of the token. (service, batch or default)
+	// It is requested on creating the child token. If the value is batch, the token is never renewed.
+	TokenType string `hcl:"token_type"`
+	// Name to use as the SNI host and to verify the server certificate. (e.g., vault.example.internal)
+	// If the value is empty, the host in vault_addr is used.
+	TLSServerName string `hcl:"tls_server_name"`
+	// Names of the cipher suites to offer to Vault. (e.g., TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+	// It affects only TLS 1.2, since cipher suites of TLS 1.3 can not be configured. Insecure ones and the ones of TLS 1.3 are rejected.
+	// If the value is empty, the default of Go is used.
+	TLSCipherSuites []string `hcl:"tls_cipher_suites"`
+	// Static HTTP headers to set on every request to Vault. (e.g., X-Api-Gateway-Key)
+	VaultHeaders map[string]string `hcl:"vault_headers"`
+	// Name of the header to identify the SPIRE server on sign requests to Vault. (e.g., X-Spire-Identity)
+	// If the value is empty, no header is added.
+	ForwardIdentityHeader string `hcl:"forward_identity_header"`
+	// Value of forward_identity_header. (e.g., example.org)
+	// If the value is empty, the SPIFFE ID of the CSR is used.
+	ForwardIdentityValue string `hcl:"forward_identity_value"`
+	// Vault Enterprise namespace to send requests to. (e.g., team-a/)
+	// If the value is empty, use ${VAULT_NAMESPACE}
+	Namespace string `hcl:"namespace"`
+	// Maximum number of idle (keep-alive) connections to Vault.
+	// If the value is 0, use default value of hashicorp/vault/api
+	MaxIdleConns int `hcl:"max_idle_conns"`
+	// Maximum amount of time an idle connection to Vault remains open. (e.g., 90s)
+	// If the value is empty, use default value of hashicorp/vault/api
+	IdleConnTimeout string `hcl:"idle_conn_timeout"`
+	// Maximum amount of time to wait for a connection to Vault. (e.g., 5s)
+	// If the value is empty, 30s is used.
+	DialTimeout string `hcl:"dial_timeout"`
+	// Interval between TCP keep-alive probes of the connections to Vault. (e.g., 15s)
+	// If the value is empty, 30s is used.
+	KeepAlive string `hcl:"keep_alive"`
+	// Maximum amount of time to wait for the TLS handshake with Vault. (e.g., 5s)
+	// If the value is empty, 10s is used.
+	TLSHandshakeTimeout string `hcl:"tls_handshake_timeout"`
+	// Maximum amount of time for a request to Vault. (e.g., 30s)
+	// If the value is empty, VAULT_CLIENT_TIMEOUT or 60s is used.
+	VaultRequestTimeout string `hcl:"vault_request_timeout"`
+	// Maximum amount of time for a login request to the auth method. (e.g., 10s)
+	// If the value is empty, vault_request_timeout is used.
+	AuthTimeout string `hcl:"auth_timeout"`
+	// Maximum amount of time for each login, including the requests to the instance metadata service. (e.g., 30s)
+	// If the value is empty, only each of the requests times out.
+	LoginTimeout string `hcl:"login_timeout"`
+	// Maximum amount of time for each attempt of a sign request. (e.g., 2m)
+	// If the value is empty, vault_request_timeout is used.
+	SignTimeout string `hcl:"sign_timeout"`
+	// Maximum size of a response body read from Vault, in bytes.
+	// If the value is 0, 4MiB is used.
+	MaxResponseBytes int64 `hcl:"max_response_bytes"`
+	// Remaining lease of the token at which the plugin renews the token. (e.g., 5m)
+	// If the value is empty, 10% of the lease (at least 1m) is used.
+	RenewalGrace string `hcl:"renewal_grace"`
+	// If true, the token obtained by the auth method is revoked when the plugin is closed or reconfigured,
+	// instead of lingering until the TTL. A failure of the revocation is logged and doesn't block the shutdown.
+	RevokeOnShutdown bool `hcl:"revoke_on_shutdown"`
+	// Format of certificates that Vault returns. (pem, pem_bundle or der)
+	// If the value is empty, Vault uses its default (pem).
+	SignFormat string `hcl:"sign_format"`
+	// Encoding of the body of sign-intermediate and login requests. (json or form)
+	// Set form for Vault-compatible gateways that reject JSON bodies. If the value is empty, json is used.
+	RequestEncoding string `hcl:"request_encoding"`
+	// If true, certificates are requested in DER format and parsed directly without PEM encoding,
+	// which saves the overhead of PEM at scale. sign_format must be empty or der.
+	ResponseDER bool `hcl:"response_der"`
+	// Maximum number of sign requests per second to Vault. If the value is 0, requests are not limited.
+	RequestsPerSecond float64 `hcl:"requests_per_second"`
+	// Maximum number of sign requests that can be sent at once. If the value is 0, 1 is used.
+	RequestsBurst int `hcl:"requests_burst"`
+	// Maximum path length of the basic constraints of the intermediate certificate.
+	// If the value is 0, the intermediate can not issue further CA certificates.
+	// If the value is not set, the path length is decided by Vault.
+	MaxPathLength *int `hcl:"max_path_length"`
+	// Duration by which to backdate notBefore of the intermediate certificate. (e.g., 5m)
+	// If the value is empty, the default of Vault is used.
+	NotBeforeDuration string `hcl:"not_before_duration"`
+	// URLs of CRL distribution points to set into the intermediate certificate.
+	// It overrides the URLs configured in the PKI secret engine if Vault allows.
+	CRLDistributionPoints []string `hcl:"crl_distribution_points"`
+	// URLs of OCSP servers to set into the intermediate certificate.
+	// It overrides the URLs configured in the PKI secret engine if Vault allows.
+	OCSPServers []string `hcl:"ocsp_servers"`
+	// DNS domains to set into the name constraints of the intermediate certificate. (e.g., example.org or .example.org)
+	// The roles of the PKI secret engine must allow to set it.
+	PermittedDNSDomains []string `hcl:"permitted_dns_domains"`
+	// Metadata to stamp on the intermediate certificate for audit, where the PKI secret engine accepts cert_metadata.
+	// If the value is empty, the metadata is not sent.
+	CertMetadata map[string]string `hcl:"cert_metadata"`
+	// SPIFFE ID to set into the intermediate certificate as the URI SAN. (e.g., spiffe://example.org)
+	// The roles of the PKI secret engine must allow the URI SAN.
+	URISAN string `hcl:"uri_san"`
+	// Log level of the plugin. (trace, debug, info, warn or error)
+	// If the value is empty, the level of SPIRE server is used.
+	LogLevel string `hcl:"log_level"`
+	// If true, method and path of each request to Vault are logged at debug level.
+	LogRequests bool `hcl:"log_requests"`
+	// Name prefixed to the keys of all metrics of the plugin (e.g., tenant_a), so that multiple plugin instances in one process
+	// don't collide. Only letters, digits and underscores are allowed. If the value is empty, the keys are not prefixed.
+	MetricsNamespace string `hcl:"metrics_namespace"`
+	// Common name of the intermediate certificate.
+	// If the value is empty, use the common name in the CSR from SPIRE server.
+	CommonName string `hcl:"common_name"`
+	// If true, use the common name in the CSR from SPIRE server,
+	// and common_name is used only if the CSR has no common name.
+	CommonNameFromCSR bool `hcl:"common_name_from_csr"`
+	// If true, Vault uses the subject and SANs in the CSR from SPIRE server instead of the values of the PKI role.
+	// common_name and common_name_from_csr are ignored.
+	UseCSRValues bool `hcl:"use_csr_values"`
+	// SAN types of the CSR from SPIRE server that must not be forwarded to the intermediate CA. (dns or email)
+	// The CSR can't be re-signed, so Vault is requested not to add them. It can't be used with use_csr_values.
+	StripCSRSANs []string `hcl:"strip_csr_sans"`
+	// Reference (name or ID) of the issuer that signs the intermediate certificate.
+	// If the value is empty, use default issuer of the PKI secret engine.
+	IssuerRef string `hcl:"issuer_ref"`
+	// Number of times to retry the request when Vault returns 412,
+	// which happens when a performance standby has not replicated the state yet.
+	// If the value is not set, use default value (3)
+	StandbyRetries *int `hcl:"standby_retries"`
+	// Number of times to retry the sign request when Vault returns 429 by a rate limit quota.
+	// If the value is not set, use default value (3)
+	RateLimitRetries *int `hcl:"rate_limit_retries"`
+	// Maximum delay before retrying the sign request failed with 429, which caps Retry-After of Vault. (e.g., 10s)
+	// If the value is empty, use default value (30s)
+	MaxRetryAfter string `hcl:"max_retry_after"`
+	// Maximum amount of time to spend retrying a sign request. (e.g., 30s)
+	// Once it is exceeded, the last error is returned even if retries remain.
+	// If the value is empty, retries are limited only by the number of retries.
+	RetryDeadline string `hcl:"retry_deadline"`
+	// If true, sign requests which timed out after being sent are also retried.
+	// Vault may have issued the certificate for the timed out request, so a retry may waste a serial number.
+	RetryOnTimeout bool `hcl:"retry_on_timeout"`
+	// If true, Configure retries the authentication with backoff while Vault is unreachable or unavailable,
+	// e.g., when SPIRE server starts before Vault during cluster boot.
+	ConfigureRetry bool `hcl:"configure_retry"`
+	// Maximum amount of time to keep retrying the authentication on Configure. (e.g., 5m)
+	// If the value is empty, use default value (1m)
+	ConfigureRetryTimeout string `hcl:"configure_retry_timeout"`
+	// User-Agent header to set on every request to Vault.
+	// If the value is empty, use "spire-vault-plugin/<version>"
+	UserAgent string `hcl:"user_agent"`
+	// If true, the plugin verifies that the signed certificate chains to the CA certificates returned from Vault.
+	// If the value is not set, true is used.
+	VerifyChain *bool `hcl:"verify_chain"`
+	// If true, MintX509CA fails when Vault returns no CA certificate for the upstream bundle.
+	// If the value is not set, true is used.
+	RequireBundle *bool `hcl:"require_bundle"`
+	// If true, certificates in ca_chain returned from Vault which can't be parsed are logged and skipped,
+	// instead of failing MintX509CA. The valid ones are still included.
+	SkipInvalidChainCerts bool `hcl:"skip_invalid_chain_certs"`
+	// Allowed clock skew between SPIRE server and Vault on the chain verification. (e.g., 30s)
+	// If the value is empty, the certificate must be valid at the time of the verification.
+	ClockSkew string `hcl:"clock_skew"`
+	// Maximum number of CA certificates accepted in the chain returned from Vault.
+	// If the value is 0, use default value (10)
+	MaxChainLength int `hcl:"max_chain_length"`
+	// If true, the plugin logs a warning instead of failing when the signed certificate is not a CA.
+	AllowNonCA bool `hcl:"allow_non_ca"`
+	// Subjects of the root CA that the minted chain is allowed to chain up to, in RFC 2253 form. (e.g., CN=Example Root CA,O=Example,C=JP)
+	// If the value is empty, any root CA is accepted.
+	AllowedCASubjects []string `hcl:"allowed_ca_subjects"`
+	// If true, the certificates which have already expired (e.g., an old cross-signed root in ca_chain) are
+	// dropped from the upstream bundle. Otherwise the bundle has every certificate returned from Vault.
+	DropExpiredBundleCerts bool `hcl:"drop_expired_bundle_certs"`
+	// Interval to poll the CA chain of the PKI secret engine after MintX509CA, to send the updated bundle on the stream. (e.g., 10m)
+	// If the value is empty, the bundle is not refreshed.
+	BundleRefreshInterval string `hcl:"bundle_refresh_interval"`
+	// Time to serve the CA chain read from the PKI secret engine from the cache. (e.g., 5m)
+	// If the value is empty, the CA chain is read from Vault each time the bundle is needed.
+	BundleCacheTTL string `hcl:"bundle_cache_ttl"`
+	// URL to POST the summary of each minted intermediate CA as JSON. (e.g., https://hooks.example.org/spire)
+	// If the value is empty, no notification is sent. A failure of the notification doesn't fail the mint.
+	NotifyURL string `hcl:"notify_url"`
+	// Timeout of the request to notify_url. (e.g., 5s)
+	// If the value is empty, defaultNotifyTimeout is used.
+	NotifyTimeout string `hcl:"notify_timeout"`
+	// Address to serve the effective configuration with secrets redacted at /debug/config. (e.g., 127.0.0.1:8090)
+	// If the value is empty, the debug endpoint is disabled.
+	DebugAddr string `hcl:"debug_addr"`
 }
 
 // VaultTokenAuthConfig represents parameters for token auth method
 type VaultTokenAuthConfig struct {
 	// Token string to set into "X-Vault-Token" header
 	Token string `hcl:"token"`
+	// If true, the token is read from the first line of stdin on the first Configure, instead of token.
+	// It must be set explicitly, since reading stdin blocks until the line is written.
+	TokenFromStdin bool `hcl:"token_from_stdin"`
 }
 
 // VaultCertAuthConfig represents parameters for cert auth method
@@ -67,11 +330,14 @@ type VaultCertAuthConfig struct {
 	// If the value is empty, use default mount point (/auth/cert)
 	CertAuthMountPoint string `hcl:"cert_auth_mount_point"`
 	// Path to a client certificate file.
-	// Only PEM format is supported.
+	// Only PEM format is supported. The file may have intermediates after the client certificate.
 	ClientCertPath string `hcl:"client_cert_path"`
 	// Path to a client private key file.
 	// Only PEM format is supported.
 	ClientKeyPath string `hcl:"client_key_path"`
+	// Path to a file that has both the client certificate and private key.
+	// Only PEM format is supported. It can't be used with client_cert_path and client_key_path.
+	ClientCertKeyPath string `hcl:"client_cert_key_path"`
 }
 
 // VaultAppRoleAuthConfig represents parameters for AppRole auth method.
@@ -83,13 +349,193 @@ type VaultAppRoleAuthConfig struct {
 	RoleID string `hcl:"approle_id"`
 	// A credential that is required for login.
 	SecretID string `hcl:"approle_secret_id"`
+	// Path to a KV secret that holds 'role_id' and 'secret_id'. (e.g., secret/data/<path>)
+	// If the value is set, the credentials are read from the path with ${VAULT_TOKEN} before login.
+	KVPath string `hcl:"kv_path"`
+}
+
+// VaultAliCloudAuthConfig represents parameters for AliCloud auth method.
+type VaultAliCloudAuthConfig struct {
+	// Name of mount point where AliCloud auth method is mounted. (e.g., /auth/<mount_point>/login)
+	// If the value is empty, use default mount point (/auth/alicloud)
+	AliCloudMountPoint string `hcl:"alicloud_auth_mount_point"`
+	// Name of the role in AliCloud auth method
+	Role string `hcl:"role"`
+	// Region of STS endpoint which is used to sign the identity request.
+	// If the value is empty, use global endpoint (sts.aliyuncs.com)
+	Region string `hcl:"region"`
+	// Access key ID of the RAM user or role.
+	// If the value is empty, use ${ALICLOUD_ACCESS_KEY}
+	AccessKeyID string `hcl:"access_key_id"`
+	// Access key secret of the RAM user or role.
+	// If the value is empty, use ${ALICLOUD_SECRET_KEY}
+	AccessKeySecret string `hcl:"access_key_secret"`
+	// Security token of STS, which is required for temporary access key.
+	// If the value is empty, use ${ALICLOUD_SECURITY_TOKEN}
+	SecurityToken string `hcl:"security_token"`
+}
+
+// VaultOCIAuthConfig represents parameters for OCI auth method with instance principal.
+type VaultOCIAuthConfig struct {
+	// Name of mount point where OCI auth method is mounted. (e.g., /auth/<mount_point>/login/<role>)
+	// If the value is empty, use default mount point (/auth/oci)
+	OCIMountPoint string `hcl:"oci_auth_mount_point"`
+	// Name of the role in OCI auth method
+	Role string `hcl:"role"`
+	// Region of the federation endpoint of instance principal.
+	// If the value is empty, use the region of the instance.
+	Region string `hcl:"region"`
+	// Endpoint of the instance metadata service.
+	// If the value is empty, use default endpoint (http://169.254.169.254/opc/v2)
+	MetadataEndpoint string `hcl:"metadata_endpoint"`
+	// Maximum amount of time to get a security token from the instance metadata service and the federation endpoint
+	// on each login (e.g., 5s). If the value is empty, only each of the requests times out after 10 seconds.
+	MetadataTimeout string `hcl:"metadata_timeout"`
+	// URL of the federation endpoint of instance principal.
+	// If the value is empty, use https://auth.<region>.oraclecloud.com/v1/x509
+	FederationEndpoint string `hcl:"federation_endpoint"`
+}
+
+// VaultTrustDomainConfig represents the PKI secret engine to sign the CSRs of a trust domain.
+type VaultTrustDomainConfig struct {
+	// Name of mount point where PKI secret engine is mounted.
+	// If the value is empty, use pki_mount_point.
+	PKIMountPoint string `hcl:"pki_mount_point"`
+	// Name or ID of the issuer to sign the CSR.
+	// If the value is empty, use issuer_ref.
+	IssuerRef string `hcl:"issuer_ref"`
+}
+
+// VaultCFAuthConfig represents parameters for CF auth method.
+type VaultCFAuthConfig struct {
+	// Name of mount point where CF auth method is mounted. (e.g., /auth/<mount_point>/login)
+	// If the value is empty, use default mount point (/auth/cf)
+	CFMountPoint string `hcl:"cf_auth_mount_point"`
+	// Name of the role in CF auth method
+	Role string `hcl:"role"`
+	// Path to the instance identity certificate.
+	// If the value is empty, use ${CF_INSTANCE_CERT}
+	InstanceCertPath string `hcl:"instance_cert_path"`
+	// Path to the instance identity private key.
+	// If the value is empty, use ${CF_INSTANCE_KEY}
+	InstanceKeyPath string `hcl:"instance_key_path"`
+}
+
+// VaultRADIUSAuthConfig represents parameters for RADIUS auth method.
+type VaultRADIUSAuthConfig struct {
+	// Name of mount point where RADIUS auth method is mounted. (e.g., /auth/<mount_point>/login/<username>)
+	// If the value is empty, use default mount point (/auth/radius)
+	RADIUSMountPoint string `hcl:"radius_auth_mount_point"`
+	// Name of the user in RADIUS auth method
+	Username string `hcl:"username"`
+	// Password of the user
+	Password string `hcl:"password"`
+	// Path to a file that holds the password of the user.
+	// The file is read on each login, so that the password can be rotated.
+	PasswordFile string `hcl:"password_file"`
+}
+
+// VaultJWTAuthConfig represents parameters for JWT auth method.
+type VaultJWTAuthConfig struct {
+	// Name of mount point where JWT auth method is mounted. (e.g., /auth/<mount_point>/login)
+	// If the value is empty, use default mount point (/auth/jwt)
+	JWTMountPoint string `hcl:"jwt_auth_mount_point"`
+	// Name of the role in JWT auth method
+	Role string `hcl:"role"`
+	// Path to a file that holds the JWT. The file is read on each login, so that the token can be rotated.
+	JWTPath string `hcl:"jwt_path"`
+	// Audience that the aud claim of the JWT must have.
+	// It is checked before login to tell the mismatch with bound_audiences of the role.
+	Audience string `hcl:"audience"`
+}
+
+// VaultKerberosAuthConfig represents parameters for Kerberos auth method.
+type VaultKerberosAuthConfig struct {
+	// Name of mount point where Kerberos auth method is mounted. (e.g., /auth/<mount_point>/login)
+	// If the value is empty, use default mount point (/auth/kerberos)
+	KerberosMountPoint string `hcl:"kerberos_auth_mount_point"`
+	// Path to the keytab which has the key of the user.
+	// The keytab is read on each login, so that it can be rotated.
+	KeytabPath string `hcl:"keytab_path"`
+	// Path to krb5.conf which tells the KDC of the realm.
+	// If the value is empty, use default path (/etc/krb5.conf)
+	Krb5ConfPath string `hcl:"krb5conf_path"`
+	// Name of the user in the keytab
+	Username string `hcl:"username"`
+	// Kerberos realm of the user (e.g., EXAMPLE.COM)
+	Realm string `hcl:"realm"`
+	// Service principal name of Vault (e.g., HTTP/vault.example.com)
+	Service string `hcl:"service"`
+	// If true, FAST negotiation is disabled, which is required for Active Directory.
+	DisableFASTNegotiation bool `hcl:"disable_fast_negotiation"`
+}
+
+// VaultAWSAuthConfig represents parameters for AWS auth method with the EC2 instance identity document.
+type VaultAWSAuthConfig struct {
+	// Name of mount point where AWS auth method is mounted. (e.g., /auth/<mount_point>/login)
+	// If the value is empty, use default mount point (/auth/aws)
+	AWSMountPoint string `hcl:"aws_auth_mount_point"`
+	// Name of the role in AWS auth method
+	Role string `hcl:"role"`
+	// Nonce that Vault requires on each login after the first one from the instance.
+	// If the value is empty, a random nonce is generated on each start of the plugin.
+	Nonce string `hcl:"nonce"`
+}
+
+// VaultGCPAuthConfig represents parameters for GCP auth method with the identity token of the GCE instance.
+type VaultGCPAuthConfig struct {
+	// Name of mount point where GCP auth method is mounted. (e.g., /auth/<mount_point>/login)
+	// If the value is empty, use default mount point (/auth/gcp)
+	GCPMountPoint string `hcl:"gcp_auth_mount_point"`
+	// Name of the role in GCP auth method
+	Role string `hcl:"role"`
+	// Service account of the instance to get the identity token.
+	// If the value is empty, use the default service account.
+	ServiceAccount string `hcl:"service_account"`
+}
+
+// VaultAzureAuthConfig represents parameters for Azure auth method with the managed identity of the VM.
+type VaultAzureAuthConfig struct {
+	// Name of mount point where Azure auth method is mounted. (e.g., /auth/<mount_point>/login)
+	// If the value is empty, use default mount point (/auth/azure)
+	AzureMountPoint string `hcl:"azure_auth_mount_point"`
+	// Name of the role in Azure auth method
+	Role string `hcl:"role"`
+	// Resource of the managed identity token, which must be the one configured in Azure auth method.
+	// If the value is empty, use https://management.azure.com/
+	Resource string `hcl:"resource"`
 }
 
 type VaultPlugin struct {
-	mtx     *sync.RWMutex
-	logger  hclog.Logger
-	vc      *vault.Client
-	certTTL time.Duration
+	mtx                 *sync.RWMutex
+	logger              hclog.Logger
+	vc                  *vault.Client
+	certTTL             time.Duration
+	maxTTL              time.Duration
+	verifyChain         bool
+	requireBundle       bool
+	clockSkew           time.Duration
+	maxChainLength      int
+	allowNonCA          bool
+	allowedCASubjects   []string
+	dropExpired         bool
+	bundleRefresh       time.Duration
+	signTarget          *vault.SignTarget
+	signTargets         map[string]*vault.SignTarget
+	bundleFromMount     bool
+	notifier            *notifier
+	revokeOnShutdown    bool
+	metrics             hostservices.MetricsService
+	config              *VaultPluginConfig
+	debugAddr           string
+	debugServer         *http.Server
+	debugListener       net.Listener
+	configureRetryDelay time.Duration
+	// Token read from stdin for token_from_stdin
+	stdinToken string
+	// Logger given by SetLogger, and its level before log_level raises it
+	hostLogger hclog.Logger
+	hostLevel  hclog.Level
 }
 
 // BuiltIn constructs a catalog Plugin using a new instance of this plugin.
@@ -103,128 +549,912 @@ func builtin(p *VaultPlugin) catalog.Plugin {
 
 func New() *VaultPlugin {
 	return &VaultPlugin{
-		mtx: &sync.RWMutex{},
+		mtx:                 &sync.RWMutex{},
+		verifyChain:         true,
+		requireBundle:       true,
+		maxChainLength:      vault.DefaultMaxChainLength,
+		configureRetryDelay: defaultConfigureRetryDelay,
 	}
 }
 
 func (p *VaultPlugin) SetLogger(log hclog.Logger) {
 	p.logger = log
+	p.hostLogger = log
+	p.hostLevel = common.LoggerLevel(log)
 }
 
-func (p *VaultPlugin) Configure(ctx context.Context, req *spi.ConfigureRequest) (*spi.ConfigureResponse, error) {
+// BrokerHostServices obtains MetricsService of SPIRE server to emit metrics of the vault client.
+func (p *VaultPlugin) BrokerHostServices(broker catalog.HostServiceBroker) error {
+	has, err := broker.GetHostService(hostservices.MetricsServiceHostServiceClient(&p.metrics))
+	if err != nil {
+		return err
+	}
+	if !has {
+		p.metrics = nil
+	}
+	return nil
+}
+
+// NewFromConfig returns the plugin configured with the config, which is not decoded from HCL,
+// so that the plugin can be embedded in tests and tools.
+// Environment variables in the values are not expanded, but the defaults of the vault client (e.g., VAULT_ADDR) are used.
+func NewFromConfig(config *VaultPluginConfig, logger hclog.Logger) (*VaultPlugin, error) {
+	p := New()
+	p.SetLogger(logger)
+	if err := p.configure(context.Background(), config); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ParseConfig decodes the HCL configuration of the plugin after expanding environment variables as Configure does,
+// and returns the validation errors of the decoded configuration, so that the configuration can be checked without SPIRE.
+// The error is returned only if the configuration can't be decoded.
+func ParseConfig(b []byte) (*VaultPluginConfig, []string, error) {
+	configuration, err := common.ExpandEnv(string(b))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to expand configuration: %v", err)
+	}
 	config := new(VaultPluginConfig)
-	if err := hcl.Decode(config, req.Configuration); err != nil {
-		return nil, fmt.Errorf("failed to decode configuration file: %v", err)
+	if err := hcl.Decode(config, configuration); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode configuration file: %v", err)
+	}
+	return config, validatePluginConfig(config), nil
+}
+
+func (p *VaultPlugin) Configure(ctx context.Context, req *spi.ConfigureRequest) (*spi.ConfigureResponse, error) {
+	// The validation errors are returned by configure
+	config, _, err := ParseConfig([]byte(req.Configuration))
+	if err != nil {
+		return nil, err
+	}
+	if err := p.configure(ctx, config); err != nil {
+		return nil, err
+	}
+	return &spi.ConfigureResponse{}, nil
+}
+
+// configure validates the config, authenticates to Vault, and replaces the configuration of the plugin.
+func (p *VaultPlugin) configure(ctx context.Context, config *VaultPluginConfig) (err error) {
+	if errs := validatePluginConfig(config); len(errs) != 0 {
+		return errors.New(strings.Join(errs, "."))
 	}
 
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
 
-	var (
-		ttl time.Duration
-		err error
-	)
+	// The logger is replaced along with the rest of the configuration, so that a failed configure keeps the level.
+	// The host logger is raised before authenticating to log the requests, and it is restored if configure fails.
+	level := p.hostLevel
+	if config.LogLevel != "" {
+		level = hclog.LevelFromString(config.LogLevel)
+	}
+	logger := common.NewLevelLogger(p.hostLogger, level)
+	prevLevel := common.LoggerLevel(p.hostLogger)
+	p.setHostLevel(level)
+	defer func() {
+		if err != nil {
+			p.setHostLevel(prevLevel)
+		}
+	}()
 
+	var ttl time.Duration
 	if config.TTL != "" {
-		p.logger.Warn("the configuration value 'ttl' is deprecated. " +
-			"When unset, the plugin will use the preferred TTL from SPIRE server, " +
-			"corresponding to the SPIRE server ca_ttl configurable")
-		ttl, err = time.ParseDuration(config.TTL)
+		if config.MaxTTL == "" {
+			logger.Warn("the configuration value 'ttl' is deprecated. " +
+				"When unset, the plugin will use the preferred TTL from SPIRE server, " +
+				"corresponding to the SPIRE server ca_ttl configurable")
+		}
+		ttl, err = common.ParseDuration(config.TTL)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse TTL value: %v", err)
+			return fmt.Errorf("failed to parse TTL value: %v", err)
+		}
+	}
+	var maxTTL time.Duration
+	if config.MaxTTL != "" {
+		maxTTL, err = common.ParseDuration(config.MaxTTL)
+		if err != nil {
+			return fmt.Errorf("failed to parse max_ttl value: %v", err)
 		}
 	}
 
+	if config.UseCSRValues && (config.CommonName != "" || config.CommonNameFromCSR) {
+		logger.Warn("'common_name' and 'common_name_from_csr' are ignored since 'use_csr_values' is true, so the subject in the CSR is used.")
+	}
+
+	var idleConnTimeout time.Duration
+	if config.IdleConnTimeout != "" {
+		idleConnTimeout, err = time.ParseDuration(config.IdleConnTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse idle_conn_timeout value: %v", err)
+		}
+	}
+	var dialTimeout time.Duration
+	if config.DialTimeout != "" {
+		dialTimeout, err = time.ParseDuration(config.DialTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse dial_timeout value: %v", err)
+		}
+	}
+	var keepAlive time.Duration
+	if config.KeepAlive != "" {
+		keepAlive, err = time.ParseDuration(config.KeepAlive)
+		if err != nil {
+			return fmt.Errorf("failed to parse keep_alive value: %v", err)
+		}
+	}
+	var tlsHandshakeTimeout time.Duration
+	if config.TLSHandshakeTimeout != "" {
+		tlsHandshakeTimeout, err = time.ParseDuration(config.TLSHandshakeTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse tls_handshake_timeout value: %v", err)
+		}
+	}
+	var requestTimeout time.Duration
+	if config.VaultRequestTimeout != "" {
+		requestTimeout, err = time.ParseDuration(config.VaultRequestTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse vault_request_timeout value: %v", err)
+		}
+	}
+	var authTimeout time.Duration
+	if config.AuthTimeout != "" {
+		authTimeout, err = time.ParseDuration(config.AuthTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse auth_timeout value: %v", err)
+		}
+	}
+	var loginTimeout time.Duration
+	if config.LoginTimeout != "" {
+		loginTimeout, err = time.ParseDuration(config.LoginTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse login_timeout value: %v", err)
+		}
+	}
+	var ociMetadataTimeout time.Duration
+	if config.OCIAuthConfig.MetadataTimeout != "" {
+		ociMetadataTimeout, err = time.ParseDuration(config.OCIAuthConfig.MetadataTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse metadata_timeout value of oci_auth_config: %v", err)
+		}
+	}
+	var signTimeout time.Duration
+	if config.SignTimeout != "" {
+		signTimeout, err = time.ParseDuration(config.SignTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse sign_timeout value: %v", err)
+		}
+	}
+	var notBeforeDuration time.Duration
+	if config.NotBeforeDuration != "" {
+		notBeforeDuration, err = time.ParseDuration(config.NotBeforeDuration)
+		if err != nil {
+			return fmt.Errorf("failed to parse not_before_duration value: %v", err)
+		}
+	}
+	var retryDeadline time.Duration
+	if config.RetryDeadline != "" {
+		retryDeadline, err = time.ParseDuration(config.RetryDeadline)
+		if err != nil {
+			return fmt.Errorf("failed to parse retry_deadline value: %v", err)
+		}
+	}
+	var maxRetryAfter time.Duration
+	if config.MaxRetryAfter != "" {
+		maxRetryAfter, err = time.ParseDuration(config.MaxRetryAfter)
+		if err != nil {
+			return fmt.Errorf("failed to parse max_retry_after value: %v", err)
+		}
+	}
+	var bundleRefreshInterval time.Duration
+	if config.BundleRefreshInterval != "" {
+		bundleRefreshInterval, err = time.ParseDuration(config.BundleRefreshInterval)
+		if err != nil {
+			return fmt.Errorf("failed to parse bundle_refresh_interval value: %v", err)
+		}
+	}
+	requireBundle := config.RequireBundle == nil || *config.RequireBundle
+	tlsCipherSuites, err := vault.ParseCipherSuites(config.TLSCipherSuites)
+	if err != nil {
+		return fmt.Errorf("failed to parse tls_cipher_suites value: %v", err)
+	}
+	var bundleCacheTTL time.Duration
+	if config.BundleCacheTTL != "" {
+		bundleCacheTTL, err = time.ParseDuration(config.BundleCacheTTL)
+		if err != nil {
+			return fmt.Errorf("failed to parse bundle_cache_ttl value: %v", err)
+		}
+	}
+	var clockSkew time.Duration
+	if config.ClockSkew != "" {
+		clockSkew, err = time.ParseDuration(config.ClockSkew)
+		if err != nil {
+			return fmt.Errorf("failed to parse clock_skew value: %v", err)
+		}
+	}
+	notifyTimeout := defaultNotifyTimeout
+	if config.NotifyTimeout != "" {
+		notifyTimeout, err = time.ParseDuration(config.NotifyTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse notify_timeout value: %v", err)
+		}
+	}
+	configureRetryTimeout := defaultConfigureRetryTimeout
+	if config.ConfigureRetryTimeout != "" {
+		configureRetryTimeout, err = time.ParseDuration(config.ConfigureRetryTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse configure_retry_timeout value: %v", err)
+		}
+	}
+	var renewalGrace time.Duration
+	if config.RenewalGrace != "" {
+		renewalGrace, err = time.ParseDuration(config.RenewalGrace)
+		if err != nil {
+			return fmt.Errorf("failed to parse renewal_grace value: %v", err)
+		}
+	}
+
+	if p.vc != nil && p.config != nil && onlySignParamsChanged(p.config, config) {
+		// The credentials and the connection are unchanged, so the client is kept without authenticating again.
+		if config.CheckMountType {
+			if err := checkMountTypes(p.vc, config); err != nil {
+				return err
+			}
+		}
+		p.vc.SetSignTarget(vault.SignTarget{PKIMountPoint: config.PKIMountPoint, IssuerRef: config.IssuerRef})
+		p.config = config
+		p.certTTL = ttl
+		p.maxTTL = maxTTL
+		p.setSignTargets(config)
+		p.notifier = nil
+		if config.NotifyURL != "" {
+			p.notifier = newNotifier(config.NotifyURL, notifyTimeout, config.PKIMountPoint)
+		}
+		p.logger = logger
+		logger.Info("Reloaded the sign parameters without authenticating again", "pki_mount_point", config.PKIMountPoint, "issuer_ref", config.IssuerRef)
+		return nil
+	}
+
 	certAuthMountPoint := config.CertAuthConfig.CertAuthMountPoint
 	if config.CertAuthConfig.TLSAuthMountPoint != "" {
-		p.logger.Warn("'tls_auth_mount_point' is deprecated, so use 'cert_auth_mount_point' instead.")
+		logger.Warn("'tls_auth_mount_point' is deprecated, so use 'cert_auth_mount_point' instead.")
 		certAuthMountPoint = config.CertAuthConfig.TLSAuthMountPoint
 	}
 
 	am, err := parseAuthMethod(config)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	token := config.TokenAuthConfig.Token
+	if config.TokenAuthConfig.TokenFromStdin {
+		if token, err = p.readStdinToken(); err != nil {
+			return err
+		}
 	}
 
 	vaultConfig := vault.New(am).WithEnvVar()
-	vaultConfig.Logger = p.logger
+	if config.FallbackAuthMethod != "" {
+		vaultConfig.WithFallback(authMethods[config.FallbackAuthMethod].method)
+	}
+	vaultConfig.Logger = logger
+	if p.metrics != nil {
+		vaultConfig.Metrics = vault.NamespacedMetrics(metricsservice.WrapPluginMetrics(p.metrics, logger), config.MetricsNamespace)
+	}
 	cp := &vault.ClientParams{
-		VaultAddr:             config.VaultAddr,
-		CACertPath:            config.CACertPath,
-		Token:                 config.TokenAuthConfig.Token,
-		PKIMountPoint:         config.PKIMountPoint,
-		CertAuthMountPoint:    certAuthMountPoint,
-		ClientKeyPath:         config.CertAuthConfig.ClientKeyPath,
-		ClientCertPath:        config.CertAuthConfig.ClientCertPath,
-		AppRoleAuthMountPoint: config.AppRoleAuthConfig.AppRoleMountPoint,
-		AppRoleID:             config.AppRoleAuthConfig.RoleID,
-		AppRoleSecretID:       config.AppRoleAuthConfig.SecretID,
-		TLSSKipVerify:         config.TLSSkipVerify,
+		VaultAddr:               config.VaultAddr,
+		APIPrefix:               config.APIPrefix,
+		CACertPath:              config.CACertPath,
+		AppendCAToSystemPool:    config.AppendCAToSystemPool,
+		WatchCACert:             config.WatchCACert,
+		ProxyCACertPath:         config.ProxyCACertPath,
+		Token:                   token,
+		PKIMountPoint:           config.PKIMountPoint,
+		BundlePKIMountPoint:     config.BundlePKIMountPoint,
+		CertAuthMountPoint:      certAuthMountPoint,
+		ClientKeyPath:           config.CertAuthConfig.ClientKeyPath,
+		ClientCertPath:          config.CertAuthConfig.ClientCertPath,
+		ClientCertKeyPath:       config.CertAuthConfig.ClientCertKeyPath,
+		AppRoleAuthMountPoint:   config.AppRoleAuthConfig.AppRoleMountPoint,
+		AppRoleID:               config.AppRoleAuthConfig.RoleID,
+		AppRoleSecretID:         config.AppRoleAuthConfig.SecretID,
+		AppRoleKVPath:           config.AppRoleAuthConfig.KVPath,
+		AliCloudAuthMountPoint:  config.AliCloudAuthConfig.AliCloudMountPoint,
+		AliCloudRole:            config.AliCloudAuthConfig.Role,
+		AliCloudRegion:          config.AliCloudAuthConfig.Region,
+		AliCloudAccessKeyID:     config.AliCloudAuthConfig.AccessKeyID,
+		AliCloudAccessKeySecret: config.AliCloudAuthConfig.AccessKeySecret,
+		AliCloudSecurityToken:   config.AliCloudAuthConfig.SecurityToken,
+		OCIAuthMountPoint:       config.OCIAuthConfig.OCIMountPoint,
+		OCIRole:                 config.OCIAuthConfig.Role,
+		OCIRegion:               config.OCIAuthConfig.Region,
+		OCIMetadataEndpoint:     config.OCIAuthConfig.MetadataEndpoint,
+		OCIMetadataTimeout:      ociMetadataTimeout,
+		OCIFederationEndpoint:   config.OCIAuthConfig.FederationEndpoint,
+		CFAuthMountPoint:        config.CFAuthConfig.CFMountPoint,
+		CFRole:                  config.CFAuthConfig.Role,
+		CFInstanceCertPath:      config.CFAuthConfig.InstanceCertPath,
+		CFInstanceKeyPath:       config.CFAuthConfig.InstanceKeyPath,
+		RADIUSAuthMountPoint:    config.RADIUSAuthConfig.RADIUSMountPoint,
+		RADIUSUsername:          config.RADIUSAuthConfig.Username,
+		RADIUSPassword:          config.RADIUSAuthConfig.Password,
+		RADIUSPasswordFile:      config.RADIUSAuthConfig.PasswordFile,
+		JWTAuthMountPoint:       config.JWTAuthConfig.JWTMountPoint,
+		JWTRole:                 config.JWTAuthConfig.Role,
+		JWTPath:                 config.JWTAuthConfig.JWTPath,
+		JWTAudience:             config.JWTAuthConfig.Audience,
+		KerberosAuthMountPoint:  config.KerberosAuthConfig.KerberosMountPoint,
+		KerberosKeytabPath:      config.KerberosAuthConfig.KeytabPath,
+		KerberosKrb5ConfPath:    config.KerberosAuthConfig.Krb5ConfPath,
+		KerberosUsername:        config.KerberosAuthConfig.Username,
+		KerberosRealm:           config.KerberosAuthConfig.Realm,
+		KerberosService:         config.KerberosAuthConfig.Service,
+		KerberosDisableFAST:     config.KerberosAuthConfig.DisableFASTNegotiation,
+		AWSAuthMountPoint:       config.AWSAuthConfig.AWSMountPoint,
+		AWSRole:                 config.AWSAuthConfig.Role,
+		AWSNonce:                config.AWSAuthConfig.Nonce,
+		GCPAuthMountPoint:       config.GCPAuthConfig.GCPMountPoint,
+		GCPRole:                 config.GCPAuthConfig.Role,
+		GCPServiceAccount:       config.GCPAuthConfig.ServiceAccount,
+		AzureAuthMountPoint:     config.AzureAuthConfig.AzureMountPoint,
+		AzureRole:               config.AzureAuthConfig.Role,
+		AzureResource:           config.AzureAuthConfig.Resource,
+		IMDSEndpoint:            config.IMDSEndpoint,
+		CreateChildToken:        config.CreateChildToken,
+		ChildTokenPolicies:      config.ChildTokenPolicies,
+		ChildTokenTTL:           config.ChildTokenTTL,
+		TokenType:               config.TokenType,
+		TLSSKipVerify:           config.TLSSkipVerify,
+		TLSServerName:           config.TLSServerName,
+		TLSCipherSuites:         tlsCipherSuites,
+		VaultHeaders:            config.VaultHeaders,
+		ForwardIdentityHeader:   config.ForwardIdentityHeader,
+		ForwardIdentityValue:    config.ForwardIdentityValue,
+		Namespace:               config.Namespace,
+		MaxIdleConns:            config.MaxIdleConns,
+		IdleConnTimeout:         idleConnTimeout,
+		DialTimeout:             dialTimeout,
+		KeepAlive:               keepAlive,
+		TLSHandshakeTimeout:     tlsHandshakeTimeout,
+		RequestTimeout:          requestTimeout,
+		AuthTimeout:             authTimeout,
+		LoginTimeout:            loginTimeout,
+		SignTimeout:             signTimeout,
+		MaxResponseBytes:        config.MaxResponseBytes,
+		RenewalGrace:            renewalGrace,
+		SignFormat:              config.SignFormat,
+		RequestEncoding:         config.RequestEncoding,
+		ResponseDER:             config.ResponseDER,
+		AllowEmptyCAChain:       !requireBundle,
+		SkipInvalidChainCerts:   config.SkipInvalidChainCerts,
+		RequestsPerSecond:       config.RequestsPerSecond,
+		RequestsBurst:           config.RequestsBurst,
+		MaxPathLength:           config.MaxPathLength,
+		NotBeforeDuration:       notBeforeDuration,
+		CRLDistributionPoints:   config.CRLDistributionPoints,
+		OCSPServers:             config.OCSPServers,
+		PermittedDNSDomains:     config.PermittedDNSDomains,
+		CertMetadata:            config.CertMetadata,
+		URISAN:                  config.URISAN,
+		LogRequests:             config.LogRequests,
+		UserAgent:               config.UserAgent,
+		StandbyRetries:          config.StandbyRetries,
+		RateLimitRetries:        config.RateLimitRetries,
+		MaxRetryAfter:           maxRetryAfter,
+		RetryDeadline:           retryDeadline,
+		RetryOnTimeout:          config.RetryOnTimeout,
+		BundleCacheTTL:          bundleCacheTTL,
+		IssuerRef:               config.IssuerRef,
+		CommonName:              config.CommonName,
+		CommonNameFromCSR:       config.CommonNameFromCSR,
+		UseCSRValues:            config.UseCSRValues,
+		StripCSRSANs:            config.StripCSRSANs,
 	}
 	if err := vaultConfig.SetClientParams(cp); err != nil {
-		return nil, fmt.Errorf("failetd to prepare vault client")
+		return fmt.Errorf("failetd to prepare vault client")
 	}
 
 	vc, err := vaultConfig.NewAuthenticatedClient()
+	if err != nil && config.ConfigureRetry {
+		vc, err = p.retryAuthentication(ctx, vaultConfig, err, configureRetryTimeout)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to prepare vault authentication: %v", err)
+		return authenticationError(err)
+	}
+	if config.CheckMountType {
+		if err := checkMountTypes(vc, config); err != nil {
+			vc.Close()
+			return err
+		}
+	}
+
+	// The debug server is started before the swap, so that the previous state is kept if it fails.
+	var (
+		debugServer   *http.Server
+		debugListener net.Listener
+	)
+	if config.DebugAddr != p.debugAddr && config.DebugAddr != "" {
+		debugServer, debugListener, err = p.startDebugServer(config.DebugAddr)
+		if err != nil {
+			vc.Close()
+			return fmt.Errorf("failed to start debug server on %v: %v", config.DebugAddr, err)
+		}
+	}
+	if config.DebugAddr != p.debugAddr {
+		if p.debugServer != nil {
+			p.debugServer.Close()
+		}
+		p.debugServer, p.debugListener, p.debugAddr = debugServer, debugListener, config.DebugAddr
 	}
 
+	// The previous client is closed after the swap, since it is still in use until then.
+	prevVC, revokePrev := p.vc, p.vc != nil && p.revokeOnShutdown
 	p.vc = vc
+	p.config = config
+	p.revokeOnShutdown = config.RevokeOnShutdown
 	p.certTTL = ttl
+	p.maxTTL = maxTTL
+	p.verifyChain = config.VerifyChain == nil || *config.VerifyChain
+	p.requireBundle = requireBundle
+	p.clockSkew = clockSkew
+	p.allowNonCA = config.AllowNonCA
+	p.allowedCASubjects = config.AllowedCASubjects
+	p.dropExpired = config.DropExpiredBundleCerts
+	p.bundleRefresh = bundleRefreshInterval
+	p.bundleFromMount = config.BundlePKIMountPoint != ""
+	p.setSignTargets(config)
+	p.notifier = nil
+	if config.NotifyURL != "" {
+		p.notifier = newNotifier(config.NotifyURL, notifyTimeout, config.PKIMountPoint)
+	}
+	p.maxChainLength = vault.DefaultMaxChainLength
+	if config.MaxChainLength > 0 {
+		p.maxChainLength = config.MaxChainLength
+	}
+	p.logger = logger
 
-	return &spi.ConfigureResponse{}, nil
+	if revokePrev {
+		// The token of the previous client is no longer used.
+		p.revokeToken(prevVC)
+	}
+	if prevVC != nil {
+		prevVC.Close()
+	}
+
+	return nil
+}
+
+// setHostLevel raises the host logger to the level if it is more verbose than the own level of the host logger,
+// and otherwise restores the own level, so that removing log_level resets the level. It must be called with mtx held.
+// Messages below log_level are dropped by the logger of the plugin.
+func (p *VaultPlugin) setHostLevel(level hclog.Level) {
+	if level == hclog.NoLevel || (p.hostLevel != hclog.NoLevel && level > p.hostLevel) {
+		level = p.hostLevel
+	}
+	if level != hclog.NoLevel {
+		p.hostLogger.SetLevel(level)
+	}
+}
+
+// setSignTargets sets the global sign target and the ones of the trust domains.
+// Empty values of the trust domains are filled with the global ones, so that a mint doesn't depend on the defaults of the client,
+// which are replaced by a reload of the sign parameters.
+func (p *VaultPlugin) setSignTargets(config *VaultPluginConfig) {
+	p.signTarget = &vault.SignTarget{
+		PKIMountPoint: config.PKIMountPoint,
+		IssuerRef:     config.IssuerRef,
+	}
+	p.signTargets = make(map[string]*vault.SignTarget, len(config.TrustDomains))
+	for td, c := range config.TrustDomains {
+		target := &vault.SignTarget{
+			PKIMountPoint: c.PKIMountPoint,
+			IssuerRef:     c.IssuerRef,
+		}
+		if target.PKIMountPoint == "" {
+			target.PKIMountPoint = config.PKIMountPoint
+		}
+		if target.IssuerRef == "" {
+			target.IssuerRef = config.IssuerRef
+		}
+		p.signTargets[strings.ToLower(td)] = target
+	}
+}
+
+// checkMountTypes returns an error if a mount point in the config is not a PKI secret engine.
+func checkMountTypes(vc *vault.Client, config *VaultPluginConfig) error {
+	pkiMountPoint := config.PKIMountPoint
+	if pkiMountPoint == "" {
+		pkiMountPoint = vault.DefaultPKIMountPoint
+	}
+	type mount struct {
+		key        string
+		mountPoint string
+	}
+	mounts := []mount{{"pki_mount_point", pkiMountPoint}}
+	if config.BundlePKIMountPoint != "" {
+		mounts = append(mounts, mount{"bundle_pki_mount_point", config.BundlePKIMountPoint})
+	}
+	tds := make([]string, 0, len(config.TrustDomains))
+	for td := range config.TrustDomains {
+		tds = append(tds, td)
+	}
+	sort.Strings(tds)
+	for _, td := range tds {
+		if c := config.TrustDomains[td]; c.PKIMountPoint != "" {
+			mounts = append(mounts, mount{fmt.Sprintf("pki_mount_point of trust domain %q", td), c.PKIMountPoint})
+		}
+	}
+
+	for _, m := range mounts {
+		mountType, err := vc.MountType(m.mountPoint)
+		if err != nil {
+			return fmt.Errorf("failed to check the type of %v %q: %v", m.key, m.mountPoint, err)
+		}
+		if mountType != "pki" {
+			return fmt.Errorf("%v %q is a %v mount, not a PKI secret engine", m.key, m.mountPoint, mountType)
+		}
+	}
+	return nil
+}
+
+// onlySignParamsChanged returns true if the configs differ only in the sign parameters
+// (pki_mount_point, issuer_ref, ttl, max_ttl and trust_domains), which can be reloaded without a new client.
+func onlySignParamsChanged(prev, next *VaultPluginConfig) bool {
+	a, b := *prev, *next
+	for _, c := range []*VaultPluginConfig{&a, &b} {
+		c.PKIMountPoint, c.IssuerRef, c.TTL, c.MaxTTL, c.TrustDomains = "", "", "", "", nil
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Close revokes the token if revoke_on_shutdown is set, and stops the debug server and the watcher of ca_cert_path.
+func (p *VaultPlugin) Close() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.vc != nil && p.revokeOnShutdown {
+		p.revokeToken(p.vc)
+	}
+	if p.vc != nil {
+		p.vc.Close()
+	}
+	p.vc = nil
+	if p.debugServer != nil {
+		p.debugServer.Close()
+		p.debugServer, p.debugListener, p.debugAddr = nil, nil, ""
+	}
+	return nil
+}
+
+// revokeToken revokes the token of the client within revokeTimeout. Errors are only logged.
+func (p *VaultPlugin) revokeToken(vc *vault.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), revokeTimeout)
+	defer cancel()
+	if err := vc.RevokeSelf(ctx); err != nil {
+		p.logger.Warn("Failed to revoke the Vault token", "error", err)
+		return
+	}
+	p.logger.Debug("Revoked the Vault token")
 }
 
 func (p *VaultPlugin) MintX509CA(req *upstreamauthority.MintX509CARequest, stream upstreamauthority.UpstreamAuthority_MintX509CAServer) error {
-	certReq := &pem.Block{Type: "CERTIFICATE REQUEST", Bytes: req.Csr}
-	pemData := pem.EncodeToMemory(certReq)
+	csrPEM, err := common.EncodeCSRPEM(req.Csr)
+	if err != nil {
+		return fmt.Errorf("MintX509CA request is invalid: %w", err)
+	}
+	// The targets are resolved once, so that the notification and the refresh use the target which signs the CSR.
+	p.mtx.RLock()
+	bundleRefresh := p.bundleRefresh
+	notifier := p.notifier
+	logger := p.logger
+	tdTarget, target := p.resolveSignTargets(csrPEM)
+	p.mtx.RUnlock()
+
+	resp, err := p.mintX509CA(stream.Context(), req.Csr, req.PreferredTtl, target)
+	if err != nil {
+		return err
+	}
 
-	var ttl string
-	if p.certTTL != time.Duration(0) {
-		ttl = fmt.Sprintf("%d", int64(p.certTTL/time.Second))
-	} else {
-		ttl = strconv.Itoa(int(req.PreferredTtl))
+	if err := stream.Send(resp); err != nil {
+		return err
 	}
+	// The certificate has been parsed by mintX509CA
+	cert, _ := x509.ParseCertificate(resp.X509CaChain[0])
+	if notifier != nil {
+		notifier.notify(stream.Context(), logger, cert, tdTarget)
+	}
+	if bundleRefresh <= 0 {
+		return nil
+	}
+	return p.streamBundleUpdates(stream, cert, target, resp.UpstreamX509Roots, bundleRefresh)
+}
 
-	signResp, err := p.vc.SignIntermediate(ttl, pemData)
+// mintX509CA requests Vault to sign the CSR with the target, and verifies the returned certificate and CA chain.
+func (p *VaultPlugin) mintX509CA(ctx context.Context, csr []byte, preferredTTL int32, target *vault.SignTarget) (*upstreamauthority.MintX509CAResponse, error) {
+	pemData, err := common.EncodeCSRPEM(csr)
 	if err != nil {
-		return fmt.Errorf("MintX509CA request is failed: %v", err)
+		return nil, fmt.Errorf("MintX509CA request is invalid: %w", err)
+	}
+
+	// Capture the client and the configuration under the lock, since Configure may swap them.
+	// The lock is not held during the request to Vault.
+	p.mtx.RLock()
+	vc := p.vc
+	logger := p.logger
+	ttl := p.requestTTL(preferredTTL)
+	verifyChain := p.verifyChain
+	bundleOpts := p.bundleOptions()
+	clockSkew := p.clockSkew
+	maxChainLength := p.maxChainLength
+	allowNonCA := p.allowNonCA
+	bundleFromMount := p.bundleFromMount
+	p.mtx.RUnlock()
+	if vc == nil {
+		return nil, errors.New("plugin is not configured")
+	}
+
+	signResp, err := vc.SignIntermediateWithTarget(ctx, target, ttl, pemData)
+	if errors.Is(err, vault.ErrVaultSealed) {
+		logger.Error("Vault is sealed, so the intermediate certificate can not be signed until Vault is unsealed")
+		return nil, makeError(codes.Unavailable, "MintX509CA request is failed: %v", err)
+	}
+	if errors.Is(err, vault.ErrSignEndpointNotFound) {
+		// Vault returns 404 when the mount or the issuer doesn't exist, which is a configuration error.
+		return nil, makeError(codes.FailedPrecondition, "MintX509CA request is failed: %v "+
+			"(check pki_mount_point, issuer_ref and api_prefix, or the ones of trust_domains for the trust domain of the CSR)", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("MintX509CA request is failed: %v", err)
 	}
 	if signResp == nil {
-		return errors.New("MintX509CA response is empty")
+		return nil, errors.New("MintX509CA response is empty")
+	}
+	logger.Debug("Vault signed the intermediate certificate", "vault_addr", signResp.VaultAddr)
+	for _, err := range signResp.SkippedCAChainErrors {
+		logger.Warn("Skipped an invalid certificate in the CA chain returned from Vault", "error", err)
+	}
+	if signResp.CAChainLength() > maxChainLength {
+		return nil, fmt.Errorf("MintX509CA response is invalid: CA chain has %d certificates, exceeds max_chain_length %d", signResp.CAChainLength(), maxChainLength)
 	}
 
 	// Parse PEM format data to get DER format data
-	certificate, err := pemutil.ParseCertificate([]byte(signResp.CertPEM))
+	certificate, err := signResp.ParseCertificate()
 	if err != nil {
-		return fmt.Errorf("failed to parse certificate: %v", err)
+		return nil, fmt.Errorf("MintX509CA response is invalid: %w", err)
 	}
-	certChain := [][]byte{certificate.Raw}
-
-	caCert, err := pemutil.ParseCertificate([]byte(signResp.CACertPEM))
+	caCerts, err := signResp.ParseCACertificates()
 	if err != nil {
-		return fmt.Errorf("failed to parse CA certificate: %v", err)
+		return nil, fmt.Errorf("MintX509CA response is invalid: %w", err)
 	}
-	bundles := [][]byte{caCert.Raw}
 
-	for i := range signResp.CACertChainPEM {
-		c := signResp.CACertChainPEM[i]
-		if c == signResp.CACertPEM {
-			continue
+	if verifyChain {
+		if err := vault.VerifyCertificateChain(certificate, caCerts, clockSkew); err != nil {
+			return nil, fmt.Errorf("MintX509CA response is invalid: %v", err)
 		}
+	}
+	if err := vault.VerifyCACertificate(certificate); err != nil {
+		if !allowNonCA {
+			return nil, fmt.Errorf("MintX509CA response is invalid: %v", err)
+		}
+		logger.Warn("The signed certificate is not a valid CA, SPIRE server may fail to sign SVIDs with it", "error", err)
+	}
 
-		b, err := pemutil.ParseCertificate([]byte(c))
-		if err != nil {
-			return fmt.Errorf("failed to parse upstream bundle certificates: %v", err)
+	certChain := [][]byte{certificate.Raw}
+	bundleCerts := caCerts
+	if bundleFromMount {
+		// The bundle is read from bundle_pki_mount_point instead of the CA chain of the signing mount,
+		// and the chain of the signing mount is still checked against allowed_ca_subjects.
+		if err := checkRootSubject(vault.OrderCAChain(certificate, caCerts), bundleOpts.allowedCASubjects); err != nil {
+			return nil, fmt.Errorf("MintX509CA response is invalid: %v", err)
+		}
+		if bundleCerts, err = vc.GetBundle(); err != nil {
+			return nil, fmt.Errorf("MintX509CA request is failed: failed to fetch upstream bundle: %v", err)
 		}
-		bundles = append(bundles, b.Raw)
+	}
+	bundles, err := upstreamBundle(certificate, bundleCerts, bundleOpts, logger)
+	if err != nil {
+		return nil, fmt.Errorf("MintX509CA response is invalid: %v", err)
 	}
 
-	return stream.Send(&upstreamauthority.MintX509CAResponse{
+	// Serial numbers are logged instead of metric labels, which would be unbounded.
+	logger.Info("Minted an intermediate CA", "serial_number", common.SerialNumber(certificate), "authority_key_id", common.AuthorityKeyID(certificate), "not_after", certificate.NotAfter.UTC().Format(time.RFC3339))
+
+	return &upstreamauthority.MintX509CAResponse{
 		X509CaChain:       certChain,
 		UpstreamX509Roots: bundles,
-	})
+	}, nil
+}
+
+// streamBundleUpdates polls the CA chain of the PKI secret engine at the interval,
+// and sends the bundle on the stream when it changes until the stream is closed.
+// The bundle is built from the CA chain for the leaf in the same way as the first response, and invalid ones are not sent.
+// The CA chain is read from the PKI secret engine of the target which signed the leaf, unless bundle_pki_mount_point is set.
+func (p *VaultPlugin) streamBundleUpdates(stream upstreamauthority.UpstreamAuthority_MintX509CAServer, leaf *x509.Certificate, target *vault.SignTarget, bundles [][]byte, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		latest, err := p.fetchUpstreamBundle(leaf, target)
+		if err != nil {
+			p.mtx.RLock()
+			logger := p.logger
+			p.mtx.RUnlock()
+			logger.Warn("Failed to refresh upstream bundle, retrying on the next interval", "err", err.Error())
+			continue
+		}
+		if equalBundles(bundles, latest) {
+			continue
+		}
+		if err := stream.Send(&upstreamauthority.MintX509CAResponse{
+			UpstreamX509Roots: latest,
+		}); err != nil {
+			return err
+		}
+		bundles = latest
+	}
+}
+
+// equalBundles returns true if both have the same certificates in the same order.
+func equalBundles(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveSignTargets returns the sign target of the trust domain of the CSR, or nil if it is not configured,
+// and the target to sign the CSR with, which falls back to the global one. It must be called with mtx held.
+func (p *VaultPlugin) resolveSignTargets(csrPEM []byte) (tdTarget, target *vault.SignTarget) {
+	tdTarget = signTarget(p.signTargets, csrPEM)
+	if tdTarget == nil {
+		return nil, p.signTarget
+	}
+	return tdTarget, tdTarget
+}
+
+// signTarget returns the sign target of the SPIFFE trust domain in the URI SAN of the CSR.
+// If the trust domain is not configured or the CSR has no SPIFFE ID, nil is returned to use the global configuration.
+func signTarget(targets map[string]*vault.SignTarget, csrPEM []byte) *vault.SignTarget {
+	if len(targets) == 0 {
+		return nil
+	}
+	csr, err := pemutil.ParseCertificateRequest(csrPEM)
+	if err != nil {
+		// SignIntermediate tells the error
+		return nil
+	}
+	for _, u := range csr.URIs {
+		if u.Scheme == "spiffe" {
+			return targets[strings.ToLower(u.Host)]
+		}
+	}
+	return nil
+}
+
+// requestTTL returns the TTL in seconds to request to Vault.
+// If max_ttl is configured, the preferred TTL from SPIRE server is capped by max_ttl,
+// and ttl (or max_ttl if unset) is used when SPIRE server doesn't prefer one.
+// Otherwise, ttl overrides the preferred TTL.
+func (p *VaultPlugin) requestTTL(preferredTTL int32) string {
+	if p.maxTTL == time.Duration(0) {
+		if p.certTTL != time.Duration(0) {
+			return fmt.Sprintf("%d", int64(p.certTTL/time.Second))
+		}
+		return strconv.Itoa(int(preferredTTL))
+	}
+
+	ttl := p.maxTTL
+	switch {
+	case preferredTTL > 0:
+		if preferred := time.Duration(preferredTTL) * time.Second; preferred < ttl {
+			ttl = preferred
+		}
+	case p.certTTL != time.Duration(0):
+		ttl = p.certTTL
+	}
+	return fmt.Sprintf("%d", int64(ttl/time.Second))
+}
+
+// fetchUpstreamBundle returns DER format certificates of the CA chain in the PKI secret engine of the target
+// as the upstream bundle for the leaf.
+func (p *VaultPlugin) fetchUpstreamBundle(leaf *x509.Certificate, target *vault.SignTarget) ([][]byte, error) {
+	p.mtx.RLock()
+	vc := p.vc
+	logger := p.logger
+	opts := p.bundleOptions()
+	p.mtx.RUnlock()
+	if vc == nil {
+		return nil, errors.New("plugin is not configured")
+	}
+
+	certs, err := vc.GetBundleWithTarget(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch upstream bundle: %v", err)
+	}
+	bundles, err := upstreamBundle(leaf, certs, opts, logger)
+	if err != nil {
+		return nil, fmt.Errorf("upstream bundle is invalid: %v", err)
+	}
+	return bundles, nil
+}
+
+// bundleOptions configures how the upstream bundle is built from the CA certificates returned from Vault.
+type bundleOptions struct {
+	requireBundle     bool
+	allowedCASubjects []string
+	dropExpired       bool
+}
+
+// bundleOptions returns the current options of the upstream bundle. It must be called with mtx held.
+func (p *VaultPlugin) bundleOptions() bundleOptions {
+	return bundleOptions{
+		requireBundle:     p.requireBundle,
+		allowedCASubjects: p.allowedCASubjects,
+		dropExpired:       p.dropExpired,
+	}
+}
+
+// upstreamBundle orders the CA certificates from the issuer of the leaf to the root removing duplicates
+// (e.g., issuing_ca is also in ca_chain), and validates them as the upstream bundle.
+// Both the first response of MintX509CA and the refreshes use it, so that the same certificates make the same bundle.
+func upstreamBundle(leaf *x509.Certificate, certs []*x509.Certificate, opts bundleOptions, logger hclog.Logger) ([][]byte, error) {
+	certs = vault.OrderCAChain(leaf, certs)
+	if opts.dropExpired {
+		certs = dropExpiredCerts(certs, time.Now(), logger)
+	}
+	if len(certs) == 0 {
+		if opts.requireBundle {
+			return nil, errors.New("no CA certificate is returned for the upstream bundle")
+		}
+		logger.Warn("Vault returned no CA certificate, so the upstream bundle is empty")
+	}
+	if err := checkRootSubject(certs, opts.allowedCASubjects); err != nil {
+		return nil, err
+	}
+
+	bundles := make([][]byte, 0, len(certs))
+	for _, c := range certs {
+		bundles = append(bundles, c.Raw)
+	}
+	return bundles, nil
+}
+
+// checkRootSubject checks that the top of the ordered chain has one of the allowed subjects, if any.
+func checkRootSubject(chain []*x509.Certificate, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	if len(chain) == 0 {
+		return errors.New("no root CA is returned to check allowed_ca_subjects")
+	}
+	// The last certificate of the ordered chain is the top of the chain
+	root := chain[len(chain)-1]
+	if !contains(allowed, root.Subject.String()) {
+		return fmt.Errorf("subject of the root CA %q is not in allowed_ca_subjects", root.Subject.String())
+	}
+	return nil
+}
+
+// dropExpiredCerts returns the certificates which have not expired at now, and logs the dropped ones.
+func dropExpiredCerts(certs []*x509.Certificate, now time.Time, logger hclog.Logger) []*x509.Certificate {
+	valid := make([]*x509.Certificate, 0, len(certs))
+	for _, c := range certs {
+		if now.After(c.NotAfter) {
+			logger.Warn("Dropped an expired certificate from the upstream bundle", "subject", c.Subject.String(), "serial_number", common.SerialNumber(c), "not_after", c.NotAfter.UTC().Format(time.RFC3339))
+			continue
+		}
+		valid = append(valid, c)
+	}
+	return valid
 }
 
 func (*VaultPlugin) GetPluginInfo(context.Context, *spi.GetPluginInfoRequest) (*spi.GetPluginInfoResponse, error) {
@@ -236,24 +1466,471 @@ func (*VaultPlugin) PublishJWTKey(*upstreamauthority.PublishJWTKeyRequest, upstr
 	return makeError(codes.Unimplemented, "publishing upstream is unsupported")
 }
 
+// retryAuthentication retries the authentication with exponential backoff while the error is temporary.
+// Once the next retry would exceed the timeout, the last error is returned.
+func (p *VaultPlugin) retryAuthentication(ctx context.Context, vaultConfig *vault.Config, err error, timeout time.Duration) (*vault.Client, error) {
+	deadline := time.Now().Add(timeout)
+	delay := p.configureRetryDelay
+	for attempt := 1; vault.IsTemporary(err); attempt++ {
+		if time.Now().Add(delay).After(deadline) {
+			break
+		}
+		p.logger.Warn("Vault is not ready, retrying authentication", "attempt", attempt, "delay", delay.String(), "err", err.Error())
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+
+		var vc *vault.Client
+		vc, err = vaultConfig.NewAuthenticatedClient()
+		if err == nil {
+			return vc, nil
+		}
+		delay *= 2
+		if delay > maxConfigureRetryDelay {
+			delay = maxConfigureRetryDelay
+		}
+	}
+	return nil, err
+}
+
 func makeError(code codes.Code, format string, args ...interface{}) error {
 	return status.Errorf(code, "vault: "+format, args...)
 }
 
+// authMethods maps the names of auth_method to the auth methods and their configuration blocks.
+var authMethods = map[string]struct {
+	method     vault.AuthMethod
+	block      string
+	configured func(*VaultPluginConfig) bool
+}{
+	"token": {vault.TOKEN, "token_auth_config", func(c *VaultPluginConfig) bool {
+		return c.TokenAuthConfig.Token != "" || c.TokenAuthConfig.TokenFromStdin
+	}},
+	"cert": {vault.CERT, "cert_auth_config", func(c *VaultPluginConfig) bool {
+		return c.CertAuthConfig.ClientCertPath != "" || c.CertAuthConfig.ClientCertKeyPath != ""
+	}},
+	"approle": {vault.APPROLE, "approle_auth_config", func(c *VaultPluginConfig) bool {
+		return c.AppRoleAuthConfig.RoleID != "" || c.AppRoleAuthConfig.KVPath != ""
+	}},
+	"alicloud": {vault.ALICLOUD, "alicloud_auth_config", func(c *VaultPluginConfig) bool {
+		return c.AliCloudAuthConfig.Role != ""
+	}},
+	"oci": {vault.OCI, "oci_auth_config", func(c *VaultPluginConfig) bool {
+		return c.OCIAuthConfig.Role != ""
+	}},
+	"cf": {vault.CF, "cf_auth_config", func(c *VaultPluginConfig) bool {
+		return c.CFAuthConfig.Role != ""
+	}},
+	"radius": {vault.RADIUS, "radius_auth_config", func(c *VaultPluginConfig) bool {
+		return c.RADIUSAuthConfig.Username != ""
+	}},
+	"jwt": {vault.JWT, "jwt_auth_config", func(c *VaultPluginConfig) bool {
+		return c.JWTAuthConfig.Role != ""
+	}},
+	"kerberos": {vault.KERBEROS, "kerberos_auth_config", func(c *VaultPluginConfig) bool {
+		return c.KerberosAuthConfig.Username != ""
+	}},
+	"aws": {vault.AWS, "aws_auth_config", func(c *VaultPluginConfig) bool {
+		return c.AWSAuthConfig.Role != ""
+	}},
+	"gcp": {vault.GCP, "gcp_auth_config", func(c *VaultPluginConfig) bool {
+		return c.GCPAuthConfig.Role != ""
+	}},
+	"azure": {vault.AZURE, "azure_auth_config", func(c *VaultPluginConfig) bool {
+		return c.AzureAuthConfig.Role != ""
+	}},
+}
+
+// authMethodNames is the names of authMethods in the order of the documentation.
+var authMethodNames = []string{"token", "cert", "approle", "alicloud", "oci", "cf", "radius", "jwt", "kerberos", "aws", "gcp", "azure"}
+
 func parseAuthMethod(config *VaultPluginConfig) (vault.AuthMethod, error) {
-	if config.TokenAuthConfig.Token != "" {
+	if config.AuthMethod != "" {
+		// validatePluginConfig has already checked the name and the configuration block
+		return authMethods[config.AuthMethod].method, nil
+	}
+	if config.TokenAuthConfig.Token != "" || config.TokenAuthConfig.TokenFromStdin {
 		return vault.TOKEN, nil
 	}
-	if config.CertAuthConfig.ClientCertPath != "" {
+	if config.CertAuthConfig.ClientCertPath != "" || config.CertAuthConfig.ClientCertKeyPath != "" {
 		return vault.CERT, nil
 	}
-	if config.AppRoleAuthConfig.RoleID != "" {
+	if config.AppRoleAuthConfig.RoleID != "" || config.AppRoleAuthConfig.KVPath != "" {
 		return vault.APPROLE, nil
 	}
+	if config.AliCloudAuthConfig.Role != "" {
+		return vault.ALICLOUD, nil
+	}
+	if config.OCIAuthConfig.Role != "" {
+		return vault.OCI, nil
+	}
+	if config.CFAuthConfig.Role != "" {
+		return vault.CF, nil
+	}
+	if config.RADIUSAuthConfig.Username != "" {
+		return vault.RADIUS, nil
+	}
+	if config.JWTAuthConfig.Role != "" {
+		return vault.JWT, nil
+	}
+	if config.KerberosAuthConfig.Username != "" {
+		return vault.KERBEROS, nil
+	}
+	if config.AWSAuthConfig.Role != "" {
+		return vault.AWS, nil
+	}
+	if config.GCPAuthConfig.Role != "" {
+		return vault.GCP, nil
+	}
+	if config.AzureAuthConfig.Role != "" {
+		return vault.AZURE, nil
+	}
+
+	return 0, errors.New("must be configured one of these authentication method 'Token or Cert or AppRole or AliCloud or OCI or CF or RADIUS or JWT or Kerberos or AWS or GCP or Azure'")
+}
 
-	return 0, errors.New("must be configured one of these authentication method 'Token or Cert or AppRole'")
+// authenticationError returns an error which tells the cause of the authentication failure
+func authenticationError(err error) error {
+	switch {
+	case errors.Is(err, vault.ErrUntrustedServer):
+		return fmt.Errorf("failed to prepare vault authentication, the server certificate is not trusted (check ca_cert_path): %v", err)
+	case errors.Is(err, vault.ErrUnreachable):
+		return fmt.Errorf("failed to prepare vault authentication, the server is unreachable (check vault_addr): %v", err)
+	case errors.Is(err, vault.ErrAuthRejected):
+		return fmt.Errorf("failed to prepare vault authentication, the credentials are rejected: %v", err)
+	default:
+		return fmt.Errorf("failed to prepare vault authentication: %v", err)
+	}
+}
+
+// validatePluginConfig validates value of VaultPluginConfig
+func validatePluginConfig(c *VaultPluginConfig) []string {
+	var errs []string
+
+	if c.LogLevel != "" && hclog.LevelFromString(c.LogLevel) == hclog.NoLevel {
+		errs = append(errs, fmt.Sprintf("log_level must be one of trace, debug, info, warn or error, but got %q", c.LogLevel))
+	}
+	if c.AuthMethod != "" {
+		if m, ok := authMethods[c.AuthMethod]; !ok {
+			errs = append(errs, fmt.Sprintf("auth_method must be one of %v, but got %q", authMethodNames, c.AuthMethod))
+		} else if !m.configured(c) {
+			msg := fmt.Sprintf("auth_method is %q, but %v is not configured", c.AuthMethod, m.block)
+			var others []string
+			for _, name := range authMethodNames {
+				if authMethods[name].configured(c) {
+					others = append(others, authMethods[name].block)
+				}
+			}
+			if len(others) != 0 {
+				msg += fmt.Sprintf(" (configured: %v)", strings.Join(others, ", "))
+			}
+			errs = append(errs, msg)
+		}
+	}
+	if c.FallbackAuthMethod != "" {
+		if m, ok := authMethods[c.FallbackAuthMethod]; !ok {
+			errs = append(errs, fmt.Sprintf("fallback_auth_method must be one of %v, but got %q", authMethodNames, c.FallbackAuthMethod))
+		} else if !m.configured(c) {
+			errs = append(errs, fmt.Sprintf("fallback_auth_method is %q, but %v is not configured", c.FallbackAuthMethod, m.block))
+		} else if am, err := parseAuthMethod(c); err == nil && am == m.method {
+			errs = append(errs, fmt.Sprintf("fallback_auth_method must be different from the primary auth method, but both are %q", c.FallbackAuthMethod))
+		}
+	}
+	if c.MetricsNamespace != "" && !isValidMetricsNamespace(c.MetricsNamespace) {
+		errs = append(errs, fmt.Sprintf("metrics_namespace must consist of letters, digits and underscores, but got %q", c.MetricsNamespace))
+	}
+	if c.URISAN != "" {
+		if err := idutil.ValidateSpiffeID(c.URISAN, idutil.AllowAny()); err != nil {
+			errs = append(errs, fmt.Sprintf("uri_san must be a SPIFFE ID: %v", err))
+		}
+	}
+	if c.WatchCACert && c.CACertPath == "" {
+		errs = append(errs, "watch_ca_cert requires ca_cert_path")
+	}
+	if c.TokenType != "" && !contains(vault.TokenTypes, c.TokenType) {
+		errs = append(errs, fmt.Sprintf("token_type must be one of %v, but got %q", vault.TokenTypes, c.TokenType))
+	}
+	if c.SignFormat != "" && !contains(vault.SignFormats, c.SignFormat) {
+		errs = append(errs, fmt.Sprintf("sign_format must be one of %v, but got %q", vault.SignFormats, c.SignFormat))
+	}
+	for _, t := range c.StripCSRSANs {
+		if t == "ip" || t == "uri" {
+			errs = append(errs, fmt.Sprintf("strip_csr_sans can't strip %q SANs, since Vault has no parameter for it; Vault copies them only with use_csr_values", t))
+		} else if !contains(vault.SANTypes, t) {
+			errs = append(errs, fmt.Sprintf("strip_csr_sans must be a list of %v, but got %q", vault.SANTypes, t))
+		}
+	}
+	if len(c.StripCSRSANs) != 0 && c.UseCSRValues {
+		errs = append(errs, "strip_csr_sans can't be used with use_csr_values, since Vault copies all SANs of the CSR")
+	}
+	if c.RequestEncoding != "" && !contains(vault.RequestEncodings, c.RequestEncoding) {
+		errs = append(errs, fmt.Sprintf("request_encoding must be one of %v, but got %q", vault.RequestEncodings, c.RequestEncoding))
+	}
+	if c.ResponseDER && c.SignFormat != "" && c.SignFormat != vault.SignFormatDER {
+		errs = append(errs, fmt.Sprintf("sign_format must be empty or %v if response_der is true, but got %q", vault.SignFormatDER, c.SignFormat))
+	}
+
+	if strings.Contains(c.IssuerRef, "/") {
+		errs = append(errs, fmt.Sprintf("issuer_ref must not contain '/', but got %q", c.IssuerRef))
+	}
+	var trustDomains []string
+	for td := range c.TrustDomains {
+		trustDomains = append(trustDomains, td)
+	}
+	sort.Strings(trustDomains)
+	for _, td := range trustDomains {
+		if issuerRef := c.TrustDomains[td].IssuerRef; strings.Contains(issuerRef, "/") {
+			errs = append(errs, fmt.Sprintf("issuer_ref of trust domain %q must not contain '/', but got %q", td, issuerRef))
+		}
+	}
+
+	if c.TTL != "" && c.MaxTTL != "" {
+		ttl, ttlErr := common.ParseDuration(c.TTL)
+		maxTTL, maxTTLErr := common.ParseDuration(c.MaxTTL)
+		if ttlErr == nil && maxTTLErr == nil && ttl > maxTTL {
+			errs = append(errs, fmt.Sprintf("ttl (%v) must not be greater than max_ttl (%v)", c.TTL, c.MaxTTL))
+		}
+	}
+	if c.StandbyRetries != nil && *c.StandbyRetries < 0 {
+		errs = append(errs, "standby_retries must not be negative")
+	}
+	if c.RateLimitRetries != nil && *c.RateLimitRetries < 0 {
+		errs = append(errs, "rate_limit_retries must not be negative")
+	}
+	if c.MaxChainLength < 0 {
+		errs = append(errs, "max_chain_length must not be negative")
+	}
+	if c.MaxPathLength != nil && *c.MaxPathLength < 0 {
+		errs = append(errs, "max_path_length must not be negative")
+	}
+	if c.NotBeforeDuration != "" {
+		if d, err := time.ParseDuration(c.NotBeforeDuration); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("not_before_duration must be a non-negative duration, but got %q", c.NotBeforeDuration))
+		}
+	}
+	if c.RequestsPerSecond < 0 {
+		errs = append(errs, "requests_per_second must not be negative")
+	}
+	if c.RequestsBurst < 0 {
+		errs = append(errs, "requests_burst must not be negative")
+	}
+	if c.ChildTokenTTL != "" {
+		if _, err := time.ParseDuration(c.ChildTokenTTL); err != nil {
+			errs = append(errs, fmt.Sprintf("child_token_ttl must be a duration (e.g., 1h), but got %q", c.ChildTokenTTL))
+		}
+	}
+	if !c.CreateChildToken && (len(c.ChildTokenPolicies) != 0 || c.ChildTokenTTL != "") {
+		errs = append(errs, "child_token_policies and child_token_ttl require create_child_token")
+	}
+	if c.MaxIdleConns < 0 {
+		errs = append(errs, "max_idle_conns must not be negative")
+	}
+	if c.IdleConnTimeout != "" {
+		if d, err := time.ParseDuration(c.IdleConnTimeout); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("idle_conn_timeout must be a non-negative duration, but got %q", c.IdleConnTimeout))
+		}
+	}
+	if c.DialTimeout != "" {
+		if d, err := time.ParseDuration(c.DialTimeout); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("dial_timeout must be a non-negative duration, but got %q", c.DialTimeout))
+		}
+	}
+	if c.KeepAlive != "" {
+		if d, err := time.ParseDuration(c.KeepAlive); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("keep_alive must be a non-negative duration, but got %q", c.KeepAlive))
+		}
+	}
+	if c.TLSHandshakeTimeout != "" {
+		if d, err := time.ParseDuration(c.TLSHandshakeTimeout); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("tls_handshake_timeout must be a non-negative duration, but got %q", c.TLSHandshakeTimeout))
+		}
+	}
+	if c.VaultRequestTimeout != "" {
+		if d, err := time.ParseDuration(c.VaultRequestTimeout); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("vault_request_timeout must be a non-negative duration, but got %q", c.VaultRequestTimeout))
+		}
+	}
+	if c.AuthTimeout != "" {
+		if d, err := time.ParseDuration(c.AuthTimeout); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("auth_timeout must be a non-negative duration, but got %q", c.AuthTimeout))
+		}
+	}
+	if c.LoginTimeout != "" {
+		if d, err := time.ParseDuration(c.LoginTimeout); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("login_timeout must be a non-negative duration, but got %q", c.LoginTimeout))
+		}
+	}
+	if c.OCIAuthConfig.MetadataTimeout != "" {
+		if d, err := time.ParseDuration(c.OCIAuthConfig.MetadataTimeout); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("metadata_timeout of oci_auth_config must be a non-negative duration, but got %q", c.OCIAuthConfig.MetadataTimeout))
+		}
+	}
+	if c.SignTimeout != "" {
+		if d, err := time.ParseDuration(c.SignTimeout); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("sign_timeout must be a non-negative duration, but got %q", c.SignTimeout))
+		}
+	}
+	if c.MaxResponseBytes < 0 {
+		errs = append(errs, "max_response_bytes must not be negative")
+	}
+	if c.RetryDeadline != "" {
+		if d, err := time.ParseDuration(c.RetryDeadline); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("retry_deadline must be a non-negative duration, but got %q", c.RetryDeadline))
+		}
+	}
+	if c.MaxRetryAfter != "" {
+		if d, err := time.ParseDuration(c.MaxRetryAfter); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("max_retry_after must be a non-negative duration, but got %q", c.MaxRetryAfter))
+		}
+	}
+	if c.BundleRefreshInterval != "" {
+		if d, err := time.ParseDuration(c.BundleRefreshInterval); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("bundle_refresh_interval must be a non-negative duration, but got %q", c.BundleRefreshInterval))
+		}
+	}
+	if c.BundleCacheTTL != "" {
+		if d, err := time.ParseDuration(c.BundleCacheTTL); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("bundle_cache_ttl must be a non-negative duration, but got %q", c.BundleCacheTTL))
+		}
+	}
+	if _, err := vault.ParseCipherSuites(c.TLSCipherSuites); err != nil {
+		errs = append(errs, fmt.Sprintf("tls_cipher_suites has %v", err))
+	}
+	if c.APIPrefix != "" && !strings.HasPrefix(c.APIPrefix, "/") {
+		errs = append(errs, fmt.Sprintf("api_prefix must start with /, but got %q", c.APIPrefix))
+	}
+	if c.IMDSEndpoint != "" && !isValidURL(c.IMDSEndpoint) {
+		errs = append(errs, fmt.Sprintf("imds_endpoint has invalid URL %q", c.IMDSEndpoint))
+	}
+	if c.NotifyURL != "" && !isValidURL(c.NotifyURL) {
+		errs = append(errs, fmt.Sprintf("notify_url has invalid URL %q", c.NotifyURL))
+	}
+	if c.ClockSkew != "" {
+		if d, err := time.ParseDuration(c.ClockSkew); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("clock_skew must be a non-negative duration, but got %q", c.ClockSkew))
+		}
+	}
+	if c.NotifyTimeout != "" {
+		if d, err := time.ParseDuration(c.NotifyTimeout); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("notify_timeout must be a non-negative duration, but got %q", c.NotifyTimeout))
+		}
+	}
+	if c.ConfigureRetryTimeout != "" {
+		if d, err := time.ParseDuration(c.ConfigureRetryTimeout); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("configure_retry_timeout must be a non-negative duration, but got %q", c.ConfigureRetryTimeout))
+		}
+	}
+	if c.RenewalGrace != "" {
+		if d, err := time.ParseDuration(c.RenewalGrace); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("renewal_grace must be a non-negative duration, but got %q", c.RenewalGrace))
+		}
+	}
+
+	if c.CertAuthConfig.ClientCertKeyPath != "" && (c.CertAuthConfig.ClientCertPath != "" || c.CertAuthConfig.ClientKeyPath != "") {
+		errs = append(errs, "client_cert_key_path can't be used with client_cert_path and client_key_path")
+	}
+	if c.TokenAuthConfig.Token != "" && c.TokenAuthConfig.TokenFromStdin {
+		errs = append(errs, "token and token_from_stdin of token_auth_config are mutually exclusive")
+	}
+	if c.RADIUSAuthConfig.Password != "" && c.RADIUSAuthConfig.PasswordFile != "" {
+		errs = append(errs, "password and password_file of radius_auth_config are mutually exclusive")
+	}
+	if c.RADIUSAuthConfig.Username != "" && c.RADIUSAuthConfig.Password == "" && c.RADIUSAuthConfig.PasswordFile == "" {
+		errs = append(errs, "username of radius_auth_config requires password or password_file")
+	}
+	if c.JWTAuthConfig.Role != "" && c.JWTAuthConfig.JWTPath == "" {
+		errs = append(errs, "role of jwt_auth_config requires jwt_path")
+	}
+	if k := c.KerberosAuthConfig; k.Username != "" && (k.KeytabPath == "" || k.Realm == "" || k.Service == "") {
+		errs = append(errs, "username of kerberos_auth_config requires keytab_path, realm and service")
+	}
+	if c.ForwardIdentityValue != "" && c.ForwardIdentityHeader == "" {
+		errs = append(errs, "forward_identity_value requires forward_identity_header")
+	}
+
+	for _, u := range c.CRLDistributionPoints {
+		if !isValidURL(u) {
+			errs = append(errs, fmt.Sprintf("crl_distribution_points has invalid URL %q", u))
+		}
+	}
+	for _, u := range c.OCSPServers {
+		if !isValidURL(u) {
+			errs = append(errs, fmt.Sprintf("ocsp_servers has invalid URL %q", u))
+		}
+	}
+	for _, d := range c.PermittedDNSDomains {
+		if !isValidDomainPattern(d) {
+			errs = append(errs, fmt.Sprintf("permitted_dns_domains has invalid domain %q", d))
+		}
+	}
+
+	return errs
+}
+
+// isValidURL reports whether v is an absolute URL.
+func isValidURL(v string) bool {
+	u, err := url.Parse(v)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+// isValidDomainPattern reports whether v is a DNS domain of name constraints.
+// A leading dot restricts the constraint to the subdomains, as defined in RFC 5280.
+func isValidDomainPattern(v string) bool {
+	v = strings.TrimPrefix(v, ".")
+	if v == "" || len(v) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(v, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isValidMetricsNamespace returns true if v is usable as a component of the metric names of any sink.
+func isValidMetricsNamespace(v string) bool {
+	for i, r := range v {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, v string) bool {
+	for _, l := range list {
+		if l == v {
+			return true
+		}
+	}
+	return false
 }
 
 func main() {
+	selfTest := flag.Bool("selftest", false, "Mint a throwaway intermediate CA with the configuration to check that Vault signs it, then exit")
+	configPath := flag.String("config", "", "Path to the plugin configuration (the content of plugin_data) for -selftest")
+	trustDomain := flag.String("trust-domain", "", "Trust domain of the CSR for -selftest")
+	flag.Parse()
+
+	if *selfTest {
+		configuration, err := ioutil.ReadFile(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read the configuration: %v\n", err)
+			os.Exit(1)
+		}
+		if err := runSelfTest(context.Background(), string(configuration), *trustDomain, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Self-test is failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	catalog.PluginMain(BuiltIn())
 }
@@ -10,12 +10,20 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"text/template"
+	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/spiffe/spire/pkg/common/pemutil"
@@ -36,7 +44,27 @@ const (
 )
 
 type configParam struct {
-	Addr string
+	Addr     string
+	OCIAddr  string
+	IMDSAddr string
+}
+
+// syncBuffer is a bytes.Buffer which can be read while the token renewer writes logs.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
 }
 
 func getTestLogger() hclog.Logger {
@@ -48,6 +76,10 @@ func getTestLogger() hclog.Logger {
 }
 
 func getFakeConfigureRequest(addr string, fixturePath string) (*plugin.ConfigureRequest, error) {
+	return getFakeConfigureRequestWithParam(&configParam{Addr: addr}, fixturePath)
+}
+
+func getFakeConfigureRequestWithParam(cp *configParam, fixturePath string) (*plugin.ConfigureRequest, error) {
 	file, err := ioutil.ReadFile(fixturePath)
 	if err != nil {
 		return nil, err
@@ -56,9 +88,6 @@ func getFakeConfigureRequest(addr string, fixturePath string) (*plugin.Configure
 	if err != nil {
 		return nil, err
 	}
-	cp := &configParam{
-		Addr: addr,
-	}
 
 	var c bytes.Buffer
 	if err := t.Execute(&c, cp); err != nil {
@@ -100,6 +129,83 @@ func getFakeMintX509CARequest(csr []byte) (*upstreamauthority.MintX509CARequest,
 	}, nil
 }
 
+func TestParseConfig(t *testing.T) {
+	tCases := []struct {
+		name          string
+		configuration string
+		wantErr       string
+		wantErrs      []string
+	}{
+		{
+			name: "Valid",
+			configuration: `
+vault_addr = "https://vault.example.org/"
+pki_mount_point = "test-pki"
+token_auth_config {
+   token = "test-token"
+}`,
+		},
+		{
+			name:          "Broken HCL",
+			configuration: `token_auth_config {`,
+			wantErr:       "failed to decode configuration file",
+		},
+		{
+			name: "Invalid values",
+			configuration: `
+log_level = "verbose"
+dial_timeout = "-5s"
+request_encoding = "xml"`,
+			wantErrs: []string{
+				`log_level must be one of trace, debug, info, warn or error, but got "verbose"`,
+				`request_encoding must be one of [json form], but got "xml"`,
+				`dial_timeout must be a non-negative duration, but got "-5s"`,
+			},
+		},
+		{
+			name: "Auth method without its block",
+			configuration: `
+auth_method = "cert"
+token_auth_config {
+   token = "test-token"
+}`,
+			wantErrs: []string{
+				`auth_method is "cert", but cert_auth_config is not configured (configured: token_auth_config)`,
+			},
+		},
+	}
+
+	for _, tc := range tCases {
+		config, errs, err := ParseConfig([]byte(tc.configuration))
+		if tc.wantErr != "" {
+			if err == nil {
+				t.Errorf("%v: expected got an error", tc.name)
+			} else if !strings.HasPrefix(err.Error(), tc.wantErr) {
+				t.Errorf("%v: got %v, want prefix %v", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error from ParseConfig(): %v", tc.name, err)
+			continue
+		}
+		if config == nil {
+			t.Errorf("%v: config is nil", tc.name)
+		}
+		if !reflect.DeepEqual(errs, tc.wantErrs) {
+			t.Errorf("%v: got validation errors %q, want %q", tc.name, errs, tc.wantErrs)
+		}
+	}
+
+	config, _, err := ParseConfig([]byte(tCases[0].configuration))
+	if err != nil {
+		t.Fatalf("unexpected error from ParseConfig(): %v", err)
+	}
+	if config.VaultAddr != "https://vault.example.org/" || config.PKIMountPoint != "test-pki" || config.TokenAuthConfig.Token != "test-token" {
+		t.Errorf("got %+v, the configuration is not decoded", config)
+	}
+}
+
 func TestConfigureCertConfig(t *testing.T) {
 	vc := fake.NewVaultServerConfig()
 
@@ -121,7 +227,7 @@ func TestConfigureCertConfig(t *testing.T) {
 	defer s.Close()
 
 	p := New()
-	p.logger = getTestLogger()
+	p.SetLogger(getTestLogger())
 
 	ctx := context.Background()
 	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/cert-auth-config.tpl")
@@ -135,6 +241,41 @@ func TestConfigureCertConfig(t *testing.T) {
 	}
 }
 
+func TestConfigureCertCombinedConfig(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.SetLogger(getTestLogger())
+
+	ctx := context.Background()
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/cert-auth-combined-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+
+	_, err = p.Configure(ctx, req)
+	if err != nil {
+		t.Errorf("error from Configure(): %v", err)
+	}
+}
+
 func TestConfigureAppRoleConfig(t *testing.T) {
 	vc := fake.NewVaultServerConfig()
 
@@ -156,7 +297,7 @@ func TestConfigureAppRoleConfig(t *testing.T) {
 	defer s.Close()
 
 	p := New()
-	p.logger = getTestLogger()
+	p.SetLogger(getTestLogger())
 
 	ctx := context.Background()
 	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/approle-auth-config.tpl")
@@ -170,10 +311,24 @@ func TestConfigureAppRoleConfig(t *testing.T) {
 	}
 }
 
-func TestConfigureTokenConfig(t *testing.T) {
+func TestConfigureWithChildToken(t *testing.T) {
 	vc := fake.NewVaultServerConfig()
+
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	tokenCreateResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/token-create-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
 	vc.ServerCertificatePemPath = fakeServerCert
 	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.TokenCreateResponseCode = 200
+	vc.TokenCreateResponse = tokenCreateResp
 
 	s, addr, err := vc.NewTLSServer()
 	if err != nil {
@@ -183,10 +338,10 @@ func TestConfigureTokenConfig(t *testing.T) {
 	defer s.Close()
 
 	p := New()
-	p.logger = getTestLogger()
+	p.SetLogger(getTestLogger())
 
 	ctx := context.Background()
-	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/token-auth-config.tpl")
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/cert-auth-child-token-config.tpl")
 	if err != nil {
 		t.Errorf("failed to prepare request: %v", err)
 	}
@@ -195,147 +350,3392 @@ func TestConfigureTokenConfig(t *testing.T) {
 	if err != nil {
 		t.Errorf("error from Configure(): %v", err)
 	}
-}
 
-func TestConfigureErrorInvalidTTL(t *testing.T) {
-	file, err := ioutil.ReadFile("./_test_data/invalid-ttl.hcl")
-	if err != nil {
-		t.Errorf("failed to read fixture file: %v", err)
+	createReq := vc.LastTokenCreateRequest()
+	if createReq == nil {
+		t.Fatal("token create request is not recorded")
 	}
+	if createReq.Body["ttl"] != "10m" {
+		t.Errorf("got ttl %v, want 10m", createReq.Body["ttl"])
+	}
+}
 
-	req := &plugin.ConfigureRequest{
-		Configuration: string(file),
+func TestConfigureErrorAuthMethodMismatch(t *testing.T) {
+	tokenBlock := `token_auth_config { token = "test-token" }`
+	certBlock := `cert_auth_config { client_cert_path = "/path/to/cert.pem" }`
+
+	tCases := []struct {
+		name          string
+		configuration string
+		wantErrPrefix string
+	}{
+		{
+			name:          "token",
+			configuration: `auth_method = "token"` + "\n" + certBlock,
+			wantErrPrefix: `auth_method is "token", but token_auth_config is not configured (configured: cert_auth_config)`,
+		},
+		{
+			name:          "cert",
+			configuration: `auth_method = "cert"` + "\n" + tokenBlock,
+			wantErrPrefix: `auth_method is "cert", but cert_auth_config is not configured (configured: token_auth_config)`,
+		},
+		{
+			name:          "approle",
+			configuration: `auth_method = "approle"` + "\n" + tokenBlock,
+			wantErrPrefix: `auth_method is "approle", but approle_auth_config is not configured (configured: token_auth_config)`,
+		},
+		{
+			name:          "alicloud",
+			configuration: `auth_method = "alicloud"` + "\n" + tokenBlock,
+			wantErrPrefix: `auth_method is "alicloud", but alicloud_auth_config is not configured (configured: token_auth_config)`,
+		},
+		{
+			name:          "oci",
+			configuration: `auth_method = "oci"` + "\n" + tokenBlock,
+			wantErrPrefix: `auth_method is "oci", but oci_auth_config is not configured (configured: token_auth_config)`,
+		},
+		{
+			name:          "cf",
+			configuration: `auth_method = "cf"` + "\n" + tokenBlock,
+			wantErrPrefix: `auth_method is "cf", but cf_auth_config is not configured (configured: token_auth_config)`,
+		},
+		{
+			name:          "radius",
+			configuration: `auth_method = "radius"` + "\n" + tokenBlock,
+			wantErrPrefix: `auth_method is "radius", but radius_auth_config is not configured (configured: token_auth_config)`,
+		},
+		{
+			name:          "kerberos",
+			configuration: `auth_method = "kerberos"` + "\n" + tokenBlock,
+			wantErrPrefix: `auth_method is "kerberos", but kerberos_auth_config is not configured (configured: token_auth_config)`,
+		},
+		{
+			name:          "no block",
+			configuration: `auth_method = "cert"`,
+			wantErrPrefix: `auth_method is "cert", but cert_auth_config is not configured`,
+		},
+		{
+			name:          "unknown",
+			configuration: `auth_method = "ldap"`,
+			wantErrPrefix: `auth_method must be one of [token cert approle alicloud oci cf radius jwt kerberos aws gcp azure], but got "ldap"`,
+		},
 	}
 
-	p := New()
-	p.logger = getTestLogger()
-	ctx := context.Background()
-	_, err = p.Configure(ctx, req)
+	for _, tc := range tCases {
+		req := &plugin.ConfigureRequest{
+			Configuration: tc.configuration,
+		}
 
-	wantErrPrefix := "failed to parse TTL value: time: missing unit in duration"
-	if err == nil {
-		t.Errorf("expected got an error")
-	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
-		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+		p := New()
+		p.SetLogger(getTestLogger())
+		_, err := p.Configure(context.Background(), req)
+		if err == nil {
+			t.Errorf("%v: expected got an error", tc.name)
+		} else if !strings.HasPrefix(err.Error(), tc.wantErrPrefix) {
+			t.Errorf("%v: got %v, want prefix %v", tc.name, err, tc.wantErrPrefix)
+		}
 	}
 }
 
-func TestConfigureError(t *testing.T) {
-	ctx := context.Background()
-	req := &plugin.ConfigureRequest{
-		Configuration: "invalid-config",
+func TestConfigureWithAuthMethod(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
 	}
+	s.Start()
+	defer s.Close()
 
-	wantErrPrefix := "failed to decode configuration file"
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/token-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+	req.Configuration += "\nauth_method = \"token\"\n"
 
 	p := New()
-	_, err := p.Configure(ctx, req)
-	if err == nil {
-		t.Error("error is empty")
-	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
-		t.Errorf("got %v, want prefix %v", err.Error(), wantErrPrefix)
+	p.SetLogger(getTestLogger())
+	if _, err := p.Configure(context.Background(), req); err != nil {
+		t.Errorf("error from Configure(): %v", err)
 	}
 }
 
-func TestMintX509CA(t *testing.T) {
+func TestConfigureWithFallbackAuthMethod(t *testing.T) {
 	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
 	if err != nil {
 		t.Errorf("failed to load fixture: %v", err)
 	}
-	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.TokenLookupResponseCode = 403
+	vc.TokenLookupResponse = []byte(`{"errors":["permission denied"]}`)
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+
+	s, addr, err := vc.NewTLSServer()
 	if err != nil {
-		t.Errorf("failed to load fixture: %v", err)
+		t.Errorf("failed to prepare test server: %v", err)
 	}
-	renewResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/renew-response.json")
+	s.Start()
+	defer s.Close()
+
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/token-fallback-cert-auth-config.tpl")
 	if err != nil {
-		t.Errorf("failed to load fixture: %v", err)
+		t.Errorf("failed to prepare request: %v", err)
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	if _, err := p.Configure(context.Background(), req); err != nil {
+		t.Errorf("error from Configure(): %v", err)
+	}
+	if vc.LastTokenLookupRequest() == nil {
+		t.Errorf("token lookup request is not sent")
 	}
+	if vc.LastCertAuthRequest() == nil {
+		t.Errorf("cert auth request is not sent")
+	}
+}
+
+func TestConfigureErrorFallbackAuthMethod(t *testing.T) {
+	tokenBlock := `token_auth_config { token = "test-token" }`
+	certBlock := `cert_auth_config { client_cert_path = "/path/to/cert.pem" }`
 
 	tCases := []struct {
-		signIntermediateResponseCode   int
-		signIntermediateResponse       []byte
-		mintX509CAServerStreamResponse error
-		wantError                      error
+		name          string
+		configuration string
+		wantErrPrefix string
 	}{
-		// 0. Sign CSR complete successfully
 		{
-			signIntermediateResponseCode:   200,
-			signIntermediateResponse:       signResp,
-			mintX509CAServerStreamResponse: nil,
-			wantError:                      nil,
+			name:          "unknown",
+			configuration: `fallback_auth_method = "ldap"` + "\n" + tokenBlock,
+			wantErrPrefix: `fallback_auth_method must be one of [token cert approle alicloud oci cf radius jwt kerberos aws gcp azure], but got "ldap"`,
 		},
-		// 1. Error response from Vault
 		{
-			signIntermediateResponseCode:   500,
-			signIntermediateResponse:       []byte("fake error"),
-			mintX509CAServerStreamResponse: nil,
-			wantError:                      errors.New("fake error"),
+			name:          "no block",
+			configuration: `fallback_auth_method = "cert"` + "\n" + tokenBlock,
+			wantErrPrefix: `fallback_auth_method is "cert", but cert_auth_config is not configured`,
 		},
-		// 2. Error from Stream
 		{
-			signIntermediateResponseCode:   200,
-			signIntermediateResponse:       signResp,
-			mintX509CAServerStreamResponse: errors.New("fake error"),
-			wantError:                      errors.New("fake error"),
+			name:          "same as auth_method",
+			configuration: `auth_method = "cert"` + "\n" + `fallback_auth_method = "cert"` + "\n" + tokenBlock + "\n" + certBlock,
+			wantErrPrefix: `fallback_auth_method must be different from the primary auth method, but both are "cert"`,
+		},
+		{
+			name:          "same as selected auth method",
+			configuration: `fallback_auth_method = "token"` + "\n" + tokenBlock + "\n" + certBlock,
+			wantErrPrefix: `fallback_auth_method must be different from the primary auth method, but both are "token"`,
 		},
 	}
 
-	vc := fake.NewVaultServerConfig()
-	vc.ServerCertificatePemPath = fakeServerCert
-	vc.ServerKeyPemPath = fakeServerKey
-	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
-	vc.CertAuthResponseCode = 200
-	vc.CertAuthResponse = certAuthResp
-	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
-	vc.RenewResponseCode = 200
-	vc.RenewResponse = renewResp
-
-	for i, tc := range tCases {
-		vc.SignIntermediateResponseCode = tc.signIntermediateResponseCode
-		vc.SignIntermediateResponse = tc.signIntermediateResponse
-
-		s, addr, err := vc.NewTLSServer()
-		if err != nil {
-			t.Errorf("failed to prepare test server: %v", err)
+	for _, tc := range tCases {
+		req := &plugin.ConfigureRequest{
+			Configuration: tc.configuration,
 		}
-		s.Start()
 
 		p := New()
-		p.logger = getTestLogger()
-		client, err := getFakeVaultClientWithCertAuth(addr, "test-auth", "test-pki")
-		if err != nil {
-			t.Error(err)
-		}
-		p.vc = client
-
-		testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
-		if err != nil {
-			t.Errorf("failed to load fixture: %v", err)
-		}
-
-		testCSRReq, err := getFakeMintX509CARequest(testCSR)
-		if err != nil {
-			t.Errorf("#%v: Failed to get fake CSR: %v", i, err)
+		p.SetLogger(getTestLogger())
+		_, err := p.Configure(context.Background(), req)
+		if err == nil {
+			t.Errorf("%v: expected got an error", tc.name)
+		} else if !strings.HasPrefix(err.Error(), tc.wantErrPrefix) {
+			t.Errorf("%v: got %v, want prefix %v", tc.name, err, tc.wantErrPrefix)
 		}
+	}
+}
 
-		testStream := &fake.UpstreamAuthorityMintX509CAServer{
-			WantError: tc.mintX509CAServerStreamResponse,
-		}
+func TestConfigureErrorChildTokenWithoutCreate(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `child_token_ttl = "10m"`,
+	}
 
-		err = p.MintX509CA(testCSRReq, testStream)
-		if tc.wantError == nil {
-			if err != nil {
-				t.Errorf("#%v: Unexpected error response from MintX509CA: %v", i, err)
-			}
-		} else {
-			if err == nil {
-				t.Errorf("expect some error, got nil")
-			} else if !strings.Contains(err.Error(), tc.wantError.Error()) {
-				t.Errorf("#%v: want %v, got %v", i, tc.wantError, err)
-			}
-		}
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
 
-		s.Close()
+	wantErrPrefix := "child_token_policies and child_token_ttl require create_child_token"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
 	}
+}
 
+func TestConfigureAliCloudConfig(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+
+	aliCloudResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/alicloud-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.AliCloudAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.AliCloudAuthResponseCode = 200
+	vc.AliCloudAuthResponse = aliCloudResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.SetLogger(getTestLogger())
+
+	ctx := context.Background()
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/alicloud-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+
+	_, err = p.Configure(ctx, req)
+	if err != nil {
+		t.Errorf("error from Configure(): %v", err)
+	}
+}
+
+func TestConfigureOCIConfig(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+
+	ociResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/oci-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.OCIAuthReqEndpoint = "/v1/auth/test-auth/login/test-role"
+	vc.OCIAuthResponseCode = 200
+	vc.OCIAuthResponse = ociResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	oc := fake.NewOCIServerConfig()
+	oc.InstanceCertPemPath = "../../../pkg/fake/_test_data/oci-instance.pem"
+	oc.InstanceKeyPemPath = "../../../pkg/fake/_test_data/oci-instance-key.pem"
+	oc.IntermediatePemPath = "../../../pkg/fake/_test_data/intermediate-ca.pem"
+	ociServer, err := oc.NewServer()
+	if err != nil {
+		t.Errorf("failed to prepare fake OCI server: %v", err)
+	}
+	defer ociServer.Close()
+
+	p := New()
+	p.SetLogger(getTestLogger())
+
+	ctx := context.Background()
+	cp := &configParam{
+		Addr:    fmt.Sprintf("https://%v/", addr),
+		OCIAddr: ociServer.URL,
+	}
+	req, err := getFakeConfigureRequestWithParam(cp, "./_test_data/oci-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+
+	_, err = p.Configure(ctx, req)
+	if err != nil {
+		t.Errorf("error from Configure(): %v", err)
+	}
+}
+
+func TestConfigureIMDSAuthConfig(t *testing.T) {
+	tCases := []struct {
+		name     string
+		config   string
+		fixture  string
+		setup    func(vc *fake.VaultServerConfig, resp []byte)
+		lastReq  func(vc *fake.VaultServerConfig) *fake.Request
+		wantBody map[string]interface{}
+	}{
+		{
+			name:    "AWS",
+			config:  "./_test_data/aws-auth-config.tpl",
+			fixture: "../../../pkg/fake/_test_data/aws-auth-response.json",
+			setup: func(vc *fake.VaultServerConfig, resp []byte) {
+				vc.AWSAuthReqEndpoint = "/v1/auth/test-auth/login"
+				vc.AWSAuthResponseCode = 200
+				vc.AWSAuthResponse = resp
+			},
+			lastReq: (*fake.VaultServerConfig).LastAWSAuthRequest,
+			wantBody: map[string]interface{}{
+				"role":  "test-role",
+				"pkcs7": "ZmFrZS1wa2NzNy1zaWduYXR1cmUtb2YtaW5zdGFuY2UtaWRlbnRpdHk=",
+				"nonce": "test-nonce",
+			},
+		},
+		{
+			name:    "GCP",
+			config:  "./_test_data/gcp-auth-config.tpl",
+			fixture: "../../../pkg/fake/_test_data/gcp-auth-response.json",
+			setup: func(vc *fake.VaultServerConfig, resp []byte) {
+				vc.GCPAuthReqEndpoint = "/v1/auth/test-auth/login"
+				vc.GCPAuthResponseCode = 200
+				vc.GCPAuthResponse = resp
+			},
+			lastReq: (*fake.VaultServerConfig).LastGCPAuthRequest,
+			wantBody: map[string]interface{}{
+				"role": "test-role",
+				"jwt":  "fake-gcp-identity-token",
+			},
+		},
+		{
+			name:    "Azure",
+			config:  "./_test_data/azure-auth-config.tpl",
+			fixture: "../../../pkg/fake/_test_data/azure-auth-response.json",
+			setup: func(vc *fake.VaultServerConfig, resp []byte) {
+				vc.AzureAuthReqEndpoint = "/v1/auth/test-auth/login"
+				vc.AzureAuthResponseCode = 200
+				vc.AzureAuthResponse = resp
+			},
+			lastReq: (*fake.VaultServerConfig).LastAzureAuthRequest,
+			wantBody: map[string]interface{}{
+				"role":                "test-role",
+				"jwt":                 "fake-azure-access-token",
+				"subscription_id":     "test-subscription",
+				"resource_group_name": "test-group",
+				"vm_name":             "test-vm",
+			},
+		},
+	}
+
+	for _, tc := range tCases {
+		resp, err := ioutil.ReadFile(tc.fixture)
+		if err != nil {
+			t.Errorf("%v: failed to load fixture: %v", tc.name, err)
+		}
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = fakeServerCert
+		vc.ServerKeyPemPath = fakeServerKey
+		tc.setup(vc, resp)
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		imdsServer := fake.NewIMDSServerConfig().NewServer()
+
+		p := New()
+		p.SetLogger(getTestLogger())
+
+		ctx := context.Background()
+		cp := &configParam{
+			Addr:     fmt.Sprintf("https://%v/", addr),
+			IMDSAddr: imdsServer.URL,
+		}
+		req, err := getFakeConfigureRequestWithParam(cp, tc.config)
+		if err != nil {
+			t.Errorf("%v: failed to prepare request: %v", tc.name, err)
+		}
+
+		_, err = p.Configure(ctx, req)
+		if err != nil {
+			t.Errorf("%v: error from Configure(): %v", tc.name, err)
+		} else if got := tc.lastReq(vc); got == nil || !reflect.DeepEqual(got.Body, tc.wantBody) {
+			t.Errorf("%v: got login request %v, want %v", tc.name, got, tc.wantBody)
+		}
+
+		imdsServer.Close()
+		s.Close()
+	}
+}
+
+func TestConfigureCFConfig(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+
+	cfResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cf-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CFAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CFAuthResponseCode = 200
+	vc.CFAuthResponse = cfResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.SetLogger(getTestLogger())
+
+	ctx := context.Background()
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/cf-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+
+	_, err = p.Configure(ctx, req)
+	if err != nil {
+		t.Errorf("error from Configure(): %v", err)
+	}
+}
+
+func TestConfigureRADIUSConfig(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+
+	radiusResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/radius-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.RADIUSAuthReqEndpoint = "/v1/auth/test-auth/login/test-user"
+	vc.RADIUSAuthResponseCode = 200
+	vc.RADIUSAuthResponse = radiusResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.SetLogger(getTestLogger())
+
+	ctx := context.Background()
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/radius-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+
+	_, err = p.Configure(ctx, req)
+	if err != nil {
+		t.Errorf("error from Configure(): %v", err)
+	}
+}
+
+func TestConfigureJWTConfig(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+
+	jwtResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/jwt-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.JWTAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.JWTAuthResponseCode = 200
+	vc.JWTAuthResponse = jwtResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.SetLogger(getTestLogger())
+
+	ctx := context.Background()
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/jwt-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+
+	_, err = p.Configure(ctx, req)
+	if err != nil {
+		t.Errorf("error from Configure(): %v", err)
+	}
+	if vc.LastJWTAuthRequest() == nil {
+		t.Errorf("login request is not sent to jwt auth endpoint")
+	}
+}
+
+func TestConfigureKerberosConfig(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+
+	kerberosResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/kerberos-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.KerberosAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.KerberosAuthResponseCode = 200
+	vc.KerberosAuthResponse = kerberosResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.SetLogger(getTestLogger())
+
+	ctx := context.Background()
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/kerberos-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+
+	// The keytab is loaded, but the KDC in krb5.conf is not reachable.
+	_, err = p.Configure(ctx, req)
+	wantErr := "failed to login to kerberos KDC"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.Contains(err.Error(), wantErr) {
+		t.Errorf("got %v, want %v", err, wantErr)
+	}
+	if vc.LastKerberosAuthRequest() != nil {
+		t.Errorf("login request must not be sent without the SPNEGO token")
+	}
+}
+
+func TestConfigureErrorKerberosWithoutKeytab(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `
+kerberos_auth_config {
+   username = "spire-server"
+   realm = "EXAMPLE.ORG"
+   service = "HTTP/vault.example.org"
+}`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := "username of kerberos_auth_config requires keytab_path, realm and service"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorRADIUSPasswordAndPasswordFile(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `
+radius_auth_config {
+   username = "test-user"
+   password = "test-password"
+   password_file = "/path/to/password"
+}`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := "password and password_file of radius_auth_config are mutually exclusive"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+	if err != nil && strings.Contains(err.Error(), "test-password") {
+		t.Errorf("password must not be in the error: %v", err)
+	}
+}
+
+func TestConfigureWithConfigureRetry(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	// The vault client sends a request 3 times by default, since it retries server errors twice.
+	const clientAttempts = 3
+
+	tCases := []struct {
+		name         string
+		retry        string
+		wantAttempts int32
+		wantErr      bool
+	}{
+		{
+			name:         "retry until Vault is ready",
+			retry:        "configure_retry = true",
+			wantAttempts: clientAttempts + 1,
+		},
+		{
+			name:         "no retry",
+			wantAttempts: clientAttempts,
+			wantErr:      true,
+		},
+	}
+
+	for _, tc := range tCases {
+		var attempts int32
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = fakeServerCert
+		vc.ServerKeyPemPath = fakeServerKey
+		vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+		vc.CertAuthResponseCode = 200
+		vc.CertAuthResponse = certAuthResp
+		// Vault is unavailable during the first attempt of the authentication
+		vc.CertAuthReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+			return func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&attempts, 1) <= clientAttempts {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(code)
+				_, _ = w.Write(resp)
+			}
+		}
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/cert-auth-config.tpl")
+		if err != nil {
+			t.Errorf("%v: failed to prepare request: %v", tc.name, err)
+		}
+		req.Configuration += "\n" + tc.retry + "\n"
+
+		p := New()
+		p.SetLogger(getTestLogger())
+		p.configureRetryDelay = 10 * time.Millisecond
+		_, err = p.Configure(context.Background(), req)
+		if tc.wantErr && err == nil {
+			t.Errorf("%v: expected got an error", tc.name)
+		}
+		if !tc.wantErr && err != nil {
+			t.Errorf("%v: error from Configure(): %v", tc.name, err)
+		}
+		if got := atomic.LoadInt32(&attempts); got != tc.wantAttempts {
+			t.Errorf("%v: got %v attempts, want %v", tc.name, got, tc.wantAttempts)
+		}
+
+		s.Close()
+	}
+}
+
+func TestConfigureAppRoleKVConfig(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+
+	appRoleResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/approle-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	kvResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/kv-v2-approle-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.AppRoleAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.AppRoleAuthResponseCode = 200
+	vc.AppRoleAuthResponse = appRoleResp
+	vc.KVReqEndpoint = "/v1/secret/data/test-approle"
+	vc.KVResponseCode = 200
+	vc.KVResponse = kvResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.SetLogger(getTestLogger())
+
+	ctx := context.Background()
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/approle-kv-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+
+	_, err = p.Configure(ctx, req)
+	if err != nil {
+		t.Errorf("error from Configure(): %v", err)
+	}
+}
+
+func TestConfigureTokenConfig(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.SetLogger(getTestLogger())
+
+	ctx := context.Background()
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/token-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+
+	_, err = p.Configure(ctx, req)
+	if err != nil {
+		t.Errorf("error from Configure(): %v", err)
+	}
+}
+
+func TestNewFromConfig(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p, err := NewFromConfig(&VaultPluginConfig{
+		VaultAddr:       fmt.Sprintf("https://%v/", addr),
+		PKIMountPoint:   "test-pki",
+		CACertPath:      fakeCaCert,
+		TokenAuthConfig: VaultTokenAuthConfig{Token: "test-token"},
+	}, getTestLogger())
+	if err != nil {
+		t.Fatalf("error from NewFromConfig(): %v", err)
+	}
+
+	req, err := getFakeMintX509CARequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+	stream := &fake.UpstreamAuthorityMintX509CAServer{}
+	if err := p.MintX509CA(req, stream); err != nil {
+		t.Errorf("unexpected error from MintX509CA: %v", err)
+	}
+	if len(stream.Responses()) != 1 {
+		t.Errorf("got %d responses, want 1", len(stream.Responses()))
+	}
+	if got := vc.LastSignIntermediateRequest(); got == nil {
+		t.Error("sign-intermediate request is not sent")
+	} else if got.Header.Get("X-Vault-Token") != "test-token" {
+		t.Errorf("got token %q, want test-token", got.Header.Get("X-Vault-Token"))
+	}
+
+	// The config is validated as Configure does
+	_, err = NewFromConfig(&VaultPluginConfig{SignFormat: "p12"}, getTestLogger())
+	wantErrPrefix := "sign_format must be one of [pem pem_bundle der]"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestMintX509CALogsSerialNumber(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	buf := new(syncBuffer)
+	p, err := NewFromConfig(&VaultPluginConfig{
+		VaultAddr:       fmt.Sprintf("https://%v/", addr),
+		PKIMountPoint:   "test-pki",
+		CACertPath:      fakeCaCert,
+		TokenAuthConfig: VaultTokenAuthConfig{Token: "test-token"},
+	}, hclog.New(&hclog.LoggerOptions{
+		Output: buf,
+		Name:   common.PluginName,
+		Level:  hclog.Info,
+	}))
+	if err != nil {
+		t.Fatalf("error from NewFromConfig(): %v", err)
+	}
+
+	req, err := getFakeMintX509CARequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+	stream := &fake.UpstreamAuthorityMintX509CAServer{}
+	if err := p.MintX509CA(req, stream); err != nil {
+		t.Fatalf("unexpected error from MintX509CA: %v", err)
+	}
+	if len(stream.Responses()) != 1 {
+		t.Fatalf("got %d responses, want 1", len(stream.Responses()))
+	}
+	cert, err := x509.ParseCertificate(stream.Responses()[0].X509CaChain[0])
+	if err != nil {
+		t.Fatalf("failed to parse the minted certificate: %v", err)
+	}
+
+	logs := buf.String()
+	for _, want := range []string{
+		"Minted an intermediate CA",
+		"serial_number=" + common.SerialNumber(cert),
+		"authority_key_id=" + common.AuthorityKeyID(cert),
+	} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("log doesn't have %q: %v", want, logs)
+		}
+	}
+}
+
+func TestMintX509CAWithRequireBundle(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-empty-bundle-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	enabled, disabled := true, false
+	tCases := []struct {
+		name          string
+		requireBundle *bool
+		wantErr       string
+	}{
+		{
+			name:    "Default",
+			wantErr: "both issuing_ca and ca_chain are empty",
+		},
+		{
+			name:          "Required",
+			requireBundle: &enabled,
+			wantErr:       "both issuing_ca and ca_chain are empty",
+		},
+		{
+			name:          "Not required",
+			requireBundle: &disabled,
+		},
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	for _, tc := range tCases {
+		p, err := NewFromConfig(&VaultPluginConfig{
+			VaultAddr:       fmt.Sprintf("https://%v/", addr),
+			PKIMountPoint:   "test-pki",
+			CACertPath:      fakeCaCert,
+			TokenAuthConfig: VaultTokenAuthConfig{Token: "test-token"},
+			// The chain can't be verified without CA certificates
+			VerifyChain:   &disabled,
+			RequireBundle: tc.requireBundle,
+		}, getTestLogger())
+		if err != nil {
+			t.Fatalf("%v: error from NewFromConfig(): %v", tc.name, err)
+		}
+
+		req, err := getFakeMintX509CARequest(testCSR)
+		if err != nil {
+			t.Errorf("%v: failed to get fake CSR: %v", tc.name, err)
+		}
+		stream := &fake.UpstreamAuthorityMintX509CAServer{}
+		err = p.MintX509CA(req, stream)
+		if tc.wantErr != "" {
+			if err == nil {
+				t.Errorf("%v: expected got an error", tc.name)
+			} else if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%v: got %v, want %v", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error from MintX509CA: %v", tc.name, err)
+			continue
+		}
+		if len(stream.Responses()) != 1 {
+			t.Fatalf("%v: got %d responses, want 1", tc.name, len(stream.Responses()))
+		}
+		resp := stream.Responses()[0]
+		if len(resp.X509CaChain) != 1 {
+			t.Errorf("%v: got %d certificates in X509CaChain, want 1", tc.name, len(resp.X509CaChain))
+		}
+		if len(resp.UpstreamX509Roots) != 0 {
+			t.Errorf("%v: got %d upstream roots, want 0", tc.name, len(resp.UpstreamX509Roots))
+		}
+	}
+}
+
+func TestConfigureLogRequests(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		fixturePath string
+		wantLogged  bool
+	}{
+		{fixturePath: "./_test_data/cert-auth-config.tpl", wantLogged: false},
+		{fixturePath: "./_test_data/cert-auth-log-requests-debug-config.tpl", wantLogged: true},
+		{fixturePath: "./_test_data/cert-auth-log-requests-info-config.tpl", wantLogged: false},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = fakeServerCert
+		vc.ServerKeyPemPath = fakeServerKey
+		vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+		vc.CertAuthResponseCode = 200
+		vc.CertAuthResponse = certAuthResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.fixturePath, err)
+		}
+		s.Start()
+
+		buf := new(syncBuffer)
+		p := New()
+		// log_level raises the level of the host logger to log the requests
+		p.SetLogger(hclog.New(&hclog.LoggerOptions{
+			Output: buf,
+			Name:   common.PluginName,
+			Level:  hclog.Info,
+		}))
+
+		ctx := context.Background()
+		req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), tc.fixturePath)
+		if err != nil {
+			t.Errorf("%v: failed to prepare request: %v", tc.fixturePath, err)
+		}
+
+		if _, err := p.Configure(ctx, req); err != nil {
+			t.Errorf("%v: error from Configure(): %v", tc.fixturePath, err)
+		}
+
+		logs := buf.String()
+		logged := strings.Contains(logs, "Sending request to Vault: method=PUT path=/v1/auth/test-auth/login")
+		if logged != tc.wantLogged {
+			t.Errorf("%v: got logged %v, want %v: %v", tc.fixturePath, logged, tc.wantLogged, logs)
+		}
+		if strings.Contains(logs, "cf95f87d-f95b-47ff-b1f5-ba7bff850425") {
+			t.Errorf("%v: token must not be logged: %v", tc.fixturePath, logs)
+		}
+
+		s.Close()
+	}
+}
+
+func TestConfigureLogLevel(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	invalidTTL, err := ioutil.ReadFile("./_test_data/invalid-ttl.hcl")
+	if err != nil {
+		t.Errorf("failed to read fixture file: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	host := hclog.New(&hclog.LoggerOptions{
+		Output: new(syncBuffer),
+		Name:   common.PluginName,
+		Level:  hclog.Info,
+	})
+	p := New()
+	p.SetLogger(host)
+	defer p.Close()
+
+	ctx := context.Background()
+	debugReq, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/cert-auth-log-requests-debug-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+	if _, err := p.Configure(ctx, debugReq); err != nil {
+		t.Errorf("error from Configure(): %v", err)
+	}
+	if !p.logger.IsDebug() || !host.IsDebug() {
+		t.Errorf("log_level = \"debug\" must raise the level of the host logger at info")
+	}
+
+	// A failed configure keeps the level
+	failedReq := &plugin.ConfigureRequest{Configuration: string(invalidTTL) + "\nlog_level = \"error\"\n"}
+	if _, err := p.Configure(ctx, failedReq); err == nil {
+		t.Errorf("expected got an error")
+	}
+	if !p.logger.IsDebug() || !host.IsDebug() {
+		t.Errorf("failed configure must not change the level")
+	}
+
+	// Removing log_level resets the level of the host logger
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/cert-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+	if _, err := p.Configure(ctx, req); err != nil {
+		t.Errorf("error from Configure(): %v", err)
+	}
+	if p.logger.IsDebug() || host.IsDebug() || !p.logger.IsInfo() {
+		t.Errorf("removing log_level must reset the level to info")
+	}
+}
+
+func TestConfigureErrorInvalidTTL(t *testing.T) {
+	file, err := ioutil.ReadFile("./_test_data/invalid-ttl.hcl")
+	if err != nil {
+		t.Errorf("failed to read fixture file: %v", err)
+	}
+
+	req := &plugin.ConfigureRequest{
+		Configuration: string(file),
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err = p.Configure(ctx, req)
+
+	wantErrPrefix := "failed to parse TTL value: time: missing unit in duration"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorInvalidSignFormat(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `sign_format = "p12"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := "sign_format must be one of [pem pem_bundle der]"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorResponseDERWithSignFormat(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: "response_der = true\nsign_format = \"pem\"",
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := "sign_format must be empty or der if response_der is true"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorInvalidStripCSRSANs(t *testing.T) {
+	tCases := []struct {
+		name          string
+		configuration string
+		wantErrPrefix string
+	}{
+		{
+			name:          "Unknown SAN type",
+			configuration: `strip_csr_sans = ["dns", "other"]`,
+			wantErrPrefix: `strip_csr_sans must be a list of [dns email], but got "other"`,
+		},
+		{
+			name:          "IP SAN",
+			configuration: `strip_csr_sans = ["ip"]`,
+			wantErrPrefix: `strip_csr_sans can't strip "ip" SANs, since Vault has no parameter for it`,
+		},
+		{
+			name:          "URI SAN",
+			configuration: `strip_csr_sans = ["uri"]`,
+			wantErrPrefix: `strip_csr_sans can't strip "uri" SANs, since Vault has no parameter for it`,
+		},
+		{
+			name:          "With use_csr_values",
+			configuration: "strip_csr_sans = [\"dns\"]\nuse_csr_values = true",
+			wantErrPrefix: "strip_csr_sans can't be used with use_csr_values",
+		},
+	}
+
+	for _, tc := range tCases {
+		p := New()
+		p.SetLogger(getTestLogger())
+		ctx := context.Background()
+		_, err := p.Configure(ctx, &plugin.ConfigureRequest{Configuration: tc.configuration})
+
+		if err == nil {
+			t.Errorf("%v: expected got an error", tc.name)
+		} else if !strings.HasPrefix(err.Error(), tc.wantErrPrefix) {
+			t.Errorf("%v: got %v, want prefix %v", tc.name, err, tc.wantErrPrefix)
+		}
+	}
+}
+
+func TestConfigureWithEnvInterpolation(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	os.Setenv("SPIRE_VAULT_PLUGIN_TEST_ADDR", fmt.Sprintf("https://%v/", addr))
+	defer os.Unsetenv("SPIRE_VAULT_PLUGIN_TEST_ADDR")
+
+	req, err := getFakeConfigureRequest("${env.SPIRE_VAULT_PLUGIN_TEST_ADDR}", "./_test_data/token-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	if _, err := p.Configure(ctx, req); err != nil {
+		t.Errorf("error from Configure(): %v", err)
+	}
+}
+
+func TestConfigureErrorUndefinedEnv(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `vault_addr = "${env.SPIRE_VAULT_PLUGIN_TEST_UNDEFINED}"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := `failed to expand configuration: environment variable "SPIRE_VAULT_PLUGIN_TEST_UNDEFINED" is not defined`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorTTLGreaterThanMaxTTL(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `
+ttl = "48h"
+max_ttl = "1d"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := "ttl (48h) must not be greater than max_ttl (1d)"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorNegativeMaxPathLength(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `max_path_length = -1`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := "max_path_length must not be negative"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorInvalidTokenType(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `token_type = "periodic"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := `token_type must be one of [service batch default], but got "periodic"`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorInvalidNotBeforeDuration(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `not_before_duration = "30"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := `not_before_duration must be a non-negative duration, but got "30"`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorInvalidRetryDeadline(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `retry_deadline = "-1s"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := `retry_deadline must be a non-negative duration, but got "-1s"`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorInvalidMaxRetryAfter(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `max_retry_after = "-1s"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := `max_retry_after must be a non-negative duration, but got "-1s"`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorInvalidClockSkew(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `clock_skew = "-30s"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := `clock_skew must be a non-negative duration, but got "-30s"`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorInvalidRequestEncoding(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `request_encoding = "xml"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := `request_encoding must be one of [json form], but got "xml"`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorInvalidTLSCipherSuites(t *testing.T) {
+	tCases := []struct {
+		name          string
+		configuration string
+		wantErrPrefix string
+	}{
+		{
+			name:          "insecure cipher suite",
+			configuration: `tls_cipher_suites = ["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA"]`,
+			wantErrPrefix: `tls_cipher_suites has insecure cipher suite "TLS_RSA_WITH_RC4_128_SHA"`,
+		},
+		{
+			name:          "cipher suite of TLS 1.3",
+			configuration: `tls_cipher_suites = ["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_AES_128_GCM_SHA256"]`,
+			wantErrPrefix: `tls_cipher_suites has cipher suite "TLS_AES_128_GCM_SHA256" of TLS 1.3, which can't be configured`,
+		},
+		{
+			name:          "unknown cipher suite",
+			configuration: `tls_cipher_suites = ["TLS_UNKNOWN"]`,
+			wantErrPrefix: `tls_cipher_suites has unknown cipher suite "TLS_UNKNOWN"`,
+		},
+	}
+
+	for _, tc := range tCases {
+		p := New()
+		p.SetLogger(getTestLogger())
+		ctx := context.Background()
+		_, err := p.Configure(ctx, &plugin.ConfigureRequest{Configuration: tc.configuration})
+
+		if err == nil {
+			t.Errorf("%v: expected got an error", tc.name)
+		} else if !strings.HasPrefix(err.Error(), tc.wantErrPrefix) {
+			t.Errorf("%v: got %v, want prefix %v", tc.name, err, tc.wantErrPrefix)
+		}
+	}
+}
+
+func TestConfigureErrorInvalidAPIPrefix(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `api_prefix = "vault/v1"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := `api_prefix must start with /, but got "vault/v1"`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorInvalidBundleCacheTTL(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `bundle_cache_ttl = "-5m"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := `bundle_cache_ttl must be a non-negative duration, but got "-5m"`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorInvalidDialTimeout(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `dial_timeout = "-5s"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := `dial_timeout must be a non-negative duration, but got "-5s"`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorInvalidRequestTimeouts(t *testing.T) {
+	tCases := []struct {
+		name          string
+		configuration string
+		wantErrPrefix string
+	}{
+		{
+			name:          "vault_request_timeout",
+			configuration: `vault_request_timeout = "-5s"`,
+			wantErrPrefix: `vault_request_timeout must be a non-negative duration, but got "-5s"`,
+		},
+		{
+			name:          "auth_timeout",
+			configuration: `auth_timeout = "soon"`,
+			wantErrPrefix: `auth_timeout must be a non-negative duration, but got "soon"`,
+		},
+		{
+			name:          "login_timeout",
+			configuration: `login_timeout = "-10s"`,
+			wantErrPrefix: `login_timeout must be a non-negative duration, but got "-10s"`,
+		},
+		{
+			name:          "sign_timeout",
+			configuration: `sign_timeout = "-1m"`,
+			wantErrPrefix: `sign_timeout must be a non-negative duration, but got "-1m"`,
+		},
+		{
+			name:          "metadata_timeout of oci_auth_config",
+			configuration: `oci_auth_config { metadata_timeout = "-1s" }`,
+			wantErrPrefix: `metadata_timeout of oci_auth_config must be a non-negative duration, but got "-1s"`,
+		},
+	}
+
+	for _, tc := range tCases {
+		req := &plugin.ConfigureRequest{
+			Configuration: tc.configuration,
+		}
+
+		p := New()
+		p.SetLogger(getTestLogger())
+		ctx := context.Background()
+		_, err := p.Configure(ctx, req)
+
+		if err == nil {
+			t.Errorf("%v: expected got an error", tc.name)
+		} else if !strings.HasPrefix(err.Error(), tc.wantErrPrefix) {
+			t.Errorf("%v: got %v, want prefix %v", tc.name, err, tc.wantErrPrefix)
+		}
+	}
+}
+
+func TestConfigureErrorInvalidIMDSEndpoint(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `imds_endpoint = "169.254.169.254"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := `imds_endpoint has invalid URL "169.254.169.254"`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.Contains(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorForwardIdentityValueWithoutHeader(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `forward_identity_value = "example.org"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := "forward_identity_value requires forward_identity_header"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.Contains(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorInvalidRenewalGrace(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `renewal_grace = "soon"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := `renewal_grace must be a non-negative duration, but got "soon"`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorRejectedCredentials(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 403
+	vc.CertAuthResponse = []byte(`{"errors":["permission denied"]}`)
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.SetLogger(getTestLogger())
+
+	ctx := context.Background()
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/cert-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+
+	_, err = p.Configure(ctx, req)
+
+	wantErrPrefix := "failed to prepare vault authentication, the credentials are rejected"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConfigureErrorInvalidDistributionPoints(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `
+crl_distribution_points = ["crl.example.org/ca.crl"]
+ocsp_servers = ["http://ocsp.example.org", "://invalid"]
+`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErr := `crl_distribution_points has invalid URL "crl.example.org/ca.crl".ocsp_servers has invalid URL "://invalid"`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if err.Error() != wantErr {
+		t.Errorf("got %v, want %v", err, wantErr)
+	}
+}
+
+func TestConfigureErrorNegativeMaxResponseBytes(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `max_response_bytes = -1`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErr := "max_response_bytes must not be negative"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if err.Error() != wantErr {
+		t.Errorf("got %v, want %v", err, wantErr)
+	}
+}
+
+func TestConfigureErrorInvalidMetricsNamespace(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `metrics_namespace = "tenant-a"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErr := `metrics_namespace must consist of letters, digits and underscores, but got "tenant-a"`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if err.Error() != wantErr {
+		t.Errorf("got %v, want %v", err, wantErr)
+	}
+}
+
+func TestConfigureErrorInvalidURISAN(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `uri_san = "https://example.org"`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErr := `uri_san must be a SPIFFE ID: "https://example.org" is not a valid SPIFFE ID: invalid scheme`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if err.Error() != wantErr {
+		t.Errorf("got %v, want %v", err, wantErr)
+	}
+}
+
+func TestConfigureErrorWatchCACertWithoutCACertPath(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `watch_ca_cert = true`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErr := "watch_ca_cert requires ca_cert_path"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if err.Error() != wantErr {
+		t.Errorf("got %v, want %v", err, wantErr)
+	}
+}
+
+func TestConfigureErrorInvalidPermittedDNSDomains(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `
+permitted_dns_domains = ["example.org", ".example.com", "*.example.net", "-invalid.example.org", "example..org"]
+`,
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErr := `permitted_dns_domains has invalid domain "*.example.net".` +
+		`permitted_dns_domains has invalid domain "-invalid.example.org".` +
+		`permitted_dns_domains has invalid domain "example..org"`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if err.Error() != wantErr {
+		t.Errorf("got %v, want %v", err, wantErr)
+	}
+}
+
+func TestConfigureError(t *testing.T) {
+	ctx := context.Background()
+	req := &plugin.ConfigureRequest{
+		Configuration: "invalid-config",
+	}
+
+	wantErrPrefix := "failed to decode configuration file"
+
+	p := New()
+	_, err := p.Configure(ctx, req)
+	if err == nil {
+		t.Error("error is empty")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err.Error(), wantErrPrefix)
+	}
+}
+
+func TestCloseWithRevokeOnShutdown(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name               string
+		revokeOnShutdown   bool
+		reconfigure        bool
+		revokeResponseCode int
+		wantRevoke         bool
+	}{
+		{
+			name:               "Revoke on Close",
+			revokeOnShutdown:   true,
+			revokeResponseCode: 204,
+			wantRevoke:         true,
+		},
+		{
+			name:               "Revoke on reconfigure",
+			revokeOnShutdown:   true,
+			reconfigure:        true,
+			revokeResponseCode: 204,
+			wantRevoke:         true,
+		},
+		{
+			// Close must not fail on the revoke error
+			name:               "Revoke failed",
+			revokeOnShutdown:   true,
+			revokeResponseCode: 500,
+			wantRevoke:         true,
+		},
+		{
+			name:               "Disabled",
+			revokeResponseCode: 204,
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = fakeServerCert
+		vc.ServerKeyPemPath = fakeServerKey
+		vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+		vc.CertAuthResponseCode = 200
+		vc.CertAuthResponse = certAuthResp
+		vc.RenewResponseCode = 200
+		vc.RenewResponse = renewResp
+		vc.RevokeResponseCode = tc.revokeResponseCode
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/cert-auth-config.tpl")
+		if err != nil {
+			t.Errorf("%v: failed to prepare request: %v", tc.name, err)
+		}
+		req.Configuration += fmt.Sprintf("\nrevoke_on_shutdown = %v\n", tc.revokeOnShutdown)
+
+		p := New()
+		p.SetLogger(getTestLogger())
+		if _, err := p.Configure(context.Background(), req); err != nil {
+			t.Errorf("%v: error from Configure(): %v", tc.name, err)
+		}
+		if tc.reconfigure {
+			// A change other than the sign parameters replaces the client
+			req.Configuration += "\nuser_agent = \"test-agent\"\n"
+			if _, err := p.Configure(context.Background(), req); err != nil {
+				t.Errorf("%v: error from Configure(): %v", tc.name, err)
+			}
+		} else if err := p.Close(); err != nil {
+			t.Errorf("%v: error from Close(): %v", tc.name, err)
+		}
+
+		got := vc.LastRevokeRequest()
+		switch {
+		case tc.wantRevoke && got == nil:
+			t.Errorf("%v: revoke request is not sent", tc.name)
+		case tc.wantRevoke && got.Header.Get("X-Vault-Token") != "cf95f87d-f95b-47ff-b1f5-ba7bff850425":
+			t.Errorf("%v: got token %q in the revoke request, want the token of cert auth", tc.name, got.Header.Get("X-Vault-Token"))
+		case !tc.wantRevoke && got != nil:
+			t.Errorf("%v: unexpected revoke request", tc.name)
+		}
+
+		s.Close()
+	}
+}
+
+func TestMintX509CA(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	sealedResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sealed-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	mismatchSignResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-mismatch-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	longChainSignResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-long-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	nonCASignResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-non-ca-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		signIntermediateResponseCode   int
+		signIntermediateResponse       []byte
+		mintX509CAServerStreamResponse error
+		disableVerifyChain             bool
+		allowNonCA                     bool
+		wantError                      error
+	}{
+		// 0. Sign CSR complete successfully
+		{
+			signIntermediateResponseCode:   200,
+			signIntermediateResponse:       signResp,
+			mintX509CAServerStreamResponse: nil,
+			wantError:                      nil,
+		},
+		// 1. Error response from Vault
+		{
+			signIntermediateResponseCode:   500,
+			signIntermediateResponse:       []byte("fake error"),
+			mintX509CAServerStreamResponse: nil,
+			wantError:                      errors.New("fake error"),
+		},
+		// 2. Error from Stream
+		{
+			signIntermediateResponseCode:   200,
+			signIntermediateResponse:       signResp,
+			mintX509CAServerStreamResponse: errors.New("fake error"),
+			wantError:                      errors.New("fake error"),
+		},
+		// 3. Vault is sealed
+		{
+			signIntermediateResponseCode:   503,
+			signIntermediateResponse:       sealedResp,
+			mintX509CAServerStreamResponse: nil,
+			wantError:                      vault.ErrVaultSealed,
+		},
+		// 4. Certificate doesn't chain to the CA certificates
+		{
+			signIntermediateResponseCode:   200,
+			signIntermediateResponse:       mismatchSignResp,
+			mintX509CAServerStreamResponse: nil,
+			wantError:                      errors.New("certificate does not chain to the CA certificates"),
+		},
+		// 5. Certificate doesn't chain to the CA certificates, but verification is disabled
+		// (the certificate in the fixture is not a CA)
+		{
+			signIntermediateResponseCode:   200,
+			signIntermediateResponse:       mismatchSignResp,
+			mintX509CAServerStreamResponse: nil,
+			disableVerifyChain:             true,
+			allowNonCA:                     true,
+			wantError:                      nil,
+		},
+		// 6. CA chain is longer than the limit
+		{
+			signIntermediateResponseCode:   200,
+			signIntermediateResponse:       longChainSignResp,
+			mintX509CAServerStreamResponse: nil,
+			wantError:                      errors.New("CA chain has 11 certificates, exceeds max_chain_length 10"),
+		},
+		// 7. Certificate is not a CA
+		{
+			signIntermediateResponseCode:   200,
+			signIntermediateResponse:       nonCASignResp,
+			mintX509CAServerStreamResponse: nil,
+			wantError:                      errors.New("certificate is not a CA certificate"),
+		},
+		// 8. Certificate is not a CA, but it is allowed
+		{
+			signIntermediateResponseCode:   200,
+			signIntermediateResponse:       nonCASignResp,
+			mintX509CAServerStreamResponse: nil,
+			allowNonCA:                     true,
+			wantError:                      nil,
+		},
+		// 9. Sign endpoint is not found
+		{
+			signIntermediateResponseCode:   404,
+			signIntermediateResponse:       []byte(`{"errors":["no handler for route 'test-pki/root/sign-intermediate'"]}`),
+			mintX509CAServerStreamResponse: nil,
+			wantError:                      errors.New(`test-pki/root/sign-intermediate is not found (PKI mount point "test-pki", issuer ""): Error making API request.`),
+		},
+		// 10. Sign endpoint is not found, with the hint of the configuration
+		{
+			signIntermediateResponseCode:   404,
+			signIntermediateResponse:       []byte(`{"errors":[]}`),
+			mintX509CAServerStreamResponse: nil,
+			wantError:                      errors.New("(check pki_mount_point, issuer_ref and api_prefix, or the ones of trust_domains for the trust domain of the CSR)"),
+		},
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	for i, tc := range tCases {
+		vc.SignIntermediateResponseCode = tc.signIntermediateResponseCode
+		vc.SignIntermediateResponse = tc.signIntermediateResponse
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("failed to prepare test server: %v", err)
+		}
+		s.Start()
+
+		p := New()
+		p.SetLogger(getTestLogger())
+		client, err := getFakeVaultClientWithCertAuth(addr, "test-auth", "test-pki")
+		if err != nil {
+			t.Error(err)
+		}
+		p.vc = client
+		p.verifyChain = !tc.disableVerifyChain
+		p.allowNonCA = tc.allowNonCA
+
+		testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+		if err != nil {
+			t.Errorf("failed to load fixture: %v", err)
+		}
+
+		testCSRReq, err := getFakeMintX509CARequest(testCSR)
+		if err != nil {
+			t.Errorf("#%v: Failed to get fake CSR: %v", i, err)
+		}
+
+		testStream := &fake.UpstreamAuthorityMintX509CAServer{
+			WantError: tc.mintX509CAServerStreamResponse,
+		}
+
+		err = p.MintX509CA(testCSRReq, testStream)
+		if tc.wantError == nil {
+			if err != nil {
+				t.Errorf("#%v: Unexpected error response from MintX509CA: %v", i, err)
+			}
+		} else {
+			if err == nil {
+				t.Errorf("expect some error, got nil")
+			} else if !strings.Contains(err.Error(), tc.wantError.Error()) {
+				t.Errorf("#%v: want %v, got %v", i, tc.wantError, err)
+			}
+		}
+
+		s.Close()
+	}
+
+}
+
+func TestMintX509CAWithKeyTypes(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name             string
+		csrPath          string
+		signResponsePath string
+		wantAlgorithm    x509.PublicKeyAlgorithm
+	}{
+		{
+			name:             "RSA",
+			csrPath:          "../../../pkg/fake/_test_data/intermediate-ca.csr",
+			signResponsePath: "../../../pkg/fake/_test_data/sign-intermediate-response.json",
+			wantAlgorithm:    x509.RSA,
+		},
+		{
+			name:             "ECDSA",
+			csrPath:          "../../../pkg/fake/_test_data/ecdsa-intermediate-ca.csr",
+			signResponsePath: "../../../pkg/fake/_test_data/sign-intermediate-ecdsa-response.json",
+			wantAlgorithm:    x509.ECDSA,
+		},
+		{
+			name:             "Ed25519",
+			csrPath:          "../../../pkg/fake/_test_data/ed25519-intermediate-ca.csr",
+			signResponsePath: "../../../pkg/fake/_test_data/sign-intermediate-ed25519-response.json",
+			wantAlgorithm:    x509.Ed25519,
+		},
+	}
+
+	for _, tc := range tCases {
+		signResp, err := ioutil.ReadFile(tc.signResponsePath)
+		if err != nil {
+			t.Errorf("%v: failed to load fixture: %v", tc.name, err)
+		}
+		testCSR, err := ioutil.ReadFile(tc.csrPath)
+		if err != nil {
+			t.Errorf("%v: failed to load fixture: %v", tc.name, err)
+		}
+
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = fakeServerCert
+		vc.ServerKeyPemPath = fakeServerKey
+		vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+		vc.CertAuthResponseCode = 200
+		vc.CertAuthResponse = certAuthResp
+		vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = signResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		p := New()
+		p.SetLogger(getTestLogger())
+		client, err := getFakeVaultClientWithCertAuth(addr, "test-auth", "test-pki")
+		if err != nil {
+			t.Error(err)
+		}
+		p.vc = client
+		p.verifyChain = true
+
+		req, err := getFakeMintX509CARequest(testCSR)
+		if err != nil {
+			t.Errorf("%v: failed to get fake CSR: %v", tc.name, err)
+		}
+
+		stream := &fake.UpstreamAuthorityMintX509CAServer{}
+		if err := p.MintX509CA(req, stream); err != nil {
+			t.Errorf("%v: unexpected error from MintX509CA: %v", tc.name, err)
+		} else {
+			cert, err := x509.ParseCertificate(stream.Responses()[0].X509CaChain[0])
+			if err != nil {
+				t.Errorf("%v: failed to parse minted certificate: %v", tc.name, err)
+			} else if cert.PublicKeyAlgorithm != tc.wantAlgorithm {
+				t.Errorf("%v: got public key algorithm %v, want %v", tc.name, cert.PublicKeyAlgorithm, tc.wantAlgorithm)
+			}
+		}
+
+		got := vc.LastSignIntermediateRequest()
+		if got == nil {
+			t.Errorf("%v: sign-intermediate request is not recorded", tc.name)
+		} else if got.Body["csr"] != strings.TrimSpace(string(testCSR))+"\n" {
+			t.Errorf("%v: got csr %v, want %s", tc.name, got.Body["csr"], testCSR)
+		}
+
+		s.Close()
+	}
+}
+
+func TestMintX509CAWithAllowedCASubjects(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name              string
+		allowedCASubjects []string
+		wantErr           string
+	}{
+		{
+			name:              "allowed root subject",
+			allowedCASubjects: []string{"CN=other root", "OU=bravo,O=alpha,L=Minato-Ku,ST=Tokyo,C=JP"},
+		},
+		{
+			name:              "disallowed root subject",
+			allowedCASubjects: []string{"CN=other root"},
+			wantErr:           `subject of the root CA "OU=bravo,O=alpha,L=Minato-Ku,ST=Tokyo,C=JP" is not in allowed_ca_subjects`,
+		},
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	for _, tc := range tCases {
+		p := New()
+		p.SetLogger(getTestLogger())
+		client, err := getFakeVaultClientWithCertAuth(addr, "test-auth", "test-pki")
+		if err != nil {
+			t.Error(err)
+		}
+		p.vc = client
+		p.allowedCASubjects = tc.allowedCASubjects
+
+		req, err := getFakeMintX509CARequest(testCSR)
+		if err != nil {
+			t.Errorf("%v: failed to get fake CSR: %v", tc.name, err)
+		}
+
+		err = p.MintX509CA(req, &fake.UpstreamAuthorityMintX509CAServer{})
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error from MintX509CA: %v", tc.name, err)
+			}
+		} else if err == nil {
+			t.Errorf("%v: expected got an error", tc.name)
+		} else if !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%v: got %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestMintX509CAWithOverlappingChain(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	// issuing_ca is also in ca_chain, and ca_chain has the root before the intermediate and twice
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-overlapping-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	client, err := getFakeVaultClientWithCertAuth(addr, "test-auth", "test-pki")
+	if err != nil {
+		t.Error(err)
+	}
+	p.vc = client
+	p.allowedCASubjects = []string{"OU=bravo,O=alpha,L=Minato-Ku,ST=Tokyo,C=JP"}
+
+	req, err := getFakeMintX509CARequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+	stream := &fake.UpstreamAuthorityMintX509CAServer{}
+	if err := p.MintX509CA(req, stream); err != nil {
+		t.Fatalf("unexpected error from MintX509CA: %v", err)
+	}
+
+	if len(stream.Responses()) != 1 {
+		t.Fatalf("got %d responses, want 1", len(stream.Responses()))
+	}
+	var got []string
+	for _, b := range stream.Responses()[0].UpstreamX509Roots {
+		cert, err := x509.ParseCertificate(b)
+		if err != nil {
+			t.Fatalf("failed to parse upstream root: %v", err)
+		}
+		got = append(got, cert.Subject.CommonName)
+	}
+	want := []string{"test intermediate ca", ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got upstream roots %v, want %v", got, want)
+	}
+}
+
+func TestMintX509CAWithDropExpiredBundleCerts(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	// ca_chain has the root and an expired cross-signed root
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-expired-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name        string
+		dropExpired bool
+		want        []string
+	}{
+		{
+			name: "Default",
+			want: []string{"", "test rotated ca"},
+		},
+		{
+			name:        "Drop expired certificates",
+			dropExpired: true,
+			want:        []string{""},
+		},
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	for _, tc := range tCases {
+		p := New()
+		p.SetLogger(getTestLogger())
+		client, err := getFakeVaultClientWithCertAuth(addr, "test-auth", "test-pki")
+		if err != nil {
+			t.Error(err)
+		}
+		p.vc = client
+		p.verifyChain = true
+		p.dropExpired = tc.dropExpired
+
+		req, err := getFakeMintX509CARequest(testCSR)
+		if err != nil {
+			t.Errorf("%v: failed to get fake CSR: %v", tc.name, err)
+		}
+		stream := &fake.UpstreamAuthorityMintX509CAServer{}
+		if err := p.MintX509CA(req, stream); err != nil {
+			t.Fatalf("%v: unexpected error from MintX509CA: %v", tc.name, err)
+		}
+
+		if len(stream.Responses()) != 1 {
+			t.Fatalf("%v: got %d responses, want 1", tc.name, len(stream.Responses()))
+		}
+		var got []string
+		for _, b := range stream.Responses()[0].UpstreamX509Roots {
+			cert, err := x509.ParseCertificate(b)
+			if err != nil {
+				t.Fatalf("%v: failed to parse upstream root: %v", tc.name, err)
+			}
+			got = append(got, cert.Subject.CommonName)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: got upstream roots %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMintX509CAWithBundlePKIMountPoint(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	// ca-chain-response.json has the intermediate CA in addition to the root CA in the sign response
+	caChainResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/ca-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+	vc.CAChainReqEndpoint = "/v1/test-root/cert/ca_chain"
+	vc.CAChainResponseCode = 200
+	vc.CAChainResponse = caChainResp
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/cert-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+	req.Configuration += `
+bundle_pki_mount_point = "/test-root/"
+`
+	if _, err := p.Configure(context.Background(), req); err != nil {
+		t.Fatalf("error from Configure(): %v", err)
+	}
+
+	mintReq, err := getFakeMintX509CARequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+	stream := &fake.UpstreamAuthorityMintX509CAServer{}
+	if err := p.MintX509CA(mintReq, stream); err != nil {
+		t.Fatalf("unexpected error from MintX509CA: %v", err)
+	}
+
+	if req := vc.LastSignIntermediateRequest(); req == nil {
+		t.Errorf("sign request is not sent to the signing mount")
+	}
+	if req := vc.LastCAChainRequest(); req == nil {
+		t.Errorf("CA chain request is not sent to the bundle mount")
+	}
+	if len(stream.Responses()) != 1 {
+		t.Fatalf("got %d responses, want 1", len(stream.Responses()))
+	}
+	var got []string
+	for _, b := range stream.Responses()[0].UpstreamX509Roots {
+		cert, err := x509.ParseCertificate(b)
+		if err != nil {
+			t.Fatalf("failed to parse upstream root: %v", err)
+		}
+		got = append(got, cert.Subject.CommonName)
+	}
+	// The signed certificate is issued by the root, so the intermediate which is not in its chain follows the root
+	want := []string{"", "test intermediate ca"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got upstream roots %v, want %v from the bundle mount", got, want)
+	}
+}
+
+func TestMintX509CAWithBundleRefresh(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	// ca-chain-response.json has the intermediate CA in addition to the root CA in the sign response
+	caChainResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/ca-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+	vc.CAChainReqEndpoint = "/v1/test-pki/cert/ca_chain"
+	vc.CAChainResponseCode = 200
+	vc.CAChainResponse = caChainResp
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	client, err := getFakeVaultClientWithCertAuth(addr, "test-auth", "test-pki")
+	if err != nil {
+		t.Error(err)
+	}
+	p.vc = client
+	p.bundleRefresh = 10 * time.Millisecond
+
+	req, err := getFakeMintX509CARequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &fake.UpstreamAuthorityMintX509CAServer{Ctx: ctx}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.MintX509CA(req, stream)
+	}()
+
+	// The bundle is sent only once since it doesn't change after the first refresh
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("unexpected error from MintX509CA: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("MintX509CA doesn't return after the stream is closed")
+	}
+
+	resps := stream.Responses()
+	if len(resps) != 2 {
+		t.Fatalf("got %d responses, want 2", len(resps))
+	}
+	if len(resps[0].X509CaChain) != 1 || len(resps[0].UpstreamX509Roots) != 1 {
+		t.Errorf("unexpected initial response: %d certificates in chain, %d roots", len(resps[0].X509CaChain), len(resps[0].UpstreamX509Roots))
+	}
+	if len(resps[1].X509CaChain) != 0 {
+		t.Errorf("got %d certificates in chain of the bundle update, want 0", len(resps[1].X509CaChain))
+	}
+	if len(resps[1].UpstreamX509Roots) != 2 {
+		t.Errorf("got %d roots in the bundle update, want 2", len(resps[1].UpstreamX509Roots))
+	}
+}
+
+func TestMintX509CAWithBundleRefreshUnchanged(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name              string
+		signResponsePath  string
+		caChainPaths      []string
+		allowedCASubjects []string
+	}{
+		{
+			name:             "Duplicated root",
+			signResponsePath: "../../../pkg/fake/_test_data/sign-intermediate-response.json",
+			caChainPaths:     []string{"ca.pem", "ca.pem"},
+		},
+		{
+			name:             "Different order",
+			signResponsePath: "../../../pkg/fake/_test_data/sign-intermediate-overlapping-response.json",
+			caChainPaths:     []string{"ca.pem", "intermediate-ca.pem"},
+		},
+		{
+			name:              "Root not in allowed_ca_subjects",
+			signResponsePath:  "../../../pkg/fake/_test_data/sign-intermediate-response.json",
+			caChainPaths:      []string{"rotated-ca.pem"},
+			allowedCASubjects: []string{"OU=bravo,O=alpha,L=Minato-Ku,ST=Tokyo,C=JP"},
+		},
+	}
+
+	for _, tc := range tCases {
+		signResp, err := ioutil.ReadFile(tc.signResponsePath)
+		if err != nil {
+			t.Errorf("%v: failed to load fixture: %v", tc.name, err)
+		}
+		var chainPEM []byte
+		for _, path := range tc.caChainPaths {
+			b, err := ioutil.ReadFile("../../../pkg/fake/_test_data/" + path)
+			if err != nil {
+				t.Errorf("%v: failed to load fixture: %v", tc.name, err)
+			}
+			chainPEM = append(chainPEM, b...)
+		}
+		caChainResp, err := json.Marshal(map[string]interface{}{
+			"data": map[string]interface{}{"certificate": string(chainPEM)},
+		})
+		if err != nil {
+			t.Fatalf("%v: failed to encode CA chain response: %v", tc.name, err)
+		}
+
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = fakeServerCert
+		vc.ServerKeyPemPath = fakeServerKey
+		vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+		vc.CertAuthResponseCode = 200
+		vc.CertAuthResponse = certAuthResp
+		vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = signResp
+		vc.CAChainReqEndpoint = "/v1/test-pki/cert/ca_chain"
+		vc.CAChainResponseCode = 200
+		vc.CAChainResponse = caChainResp
+		vc.RenewResponseCode = 200
+		vc.RenewResponse = renewResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		p := New()
+		p.SetLogger(getTestLogger())
+		client, err := getFakeVaultClientWithCertAuth(addr, "test-auth", "test-pki")
+		if err != nil {
+			t.Error(err)
+		}
+		p.vc = client
+		p.bundleRefresh = 10 * time.Millisecond
+		p.allowedCASubjects = tc.allowedCASubjects
+
+		req, err := getFakeMintX509CARequest(testCSR)
+		if err != nil {
+			t.Errorf("%v: failed to get fake CSR: %v", tc.name, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		stream := &fake.UpstreamAuthorityMintX509CAServer{Ctx: ctx}
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- p.MintX509CA(req, stream)
+		}()
+
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Errorf("%v: unexpected error from MintX509CA: %v", tc.name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: MintX509CA doesn't return after the stream is closed", tc.name)
+		}
+
+		if vc.LastCAChainRequest() == nil {
+			t.Errorf("%v: the bundle is not refreshed", tc.name)
+		}
+		if resps := stream.Responses(); len(resps) != 1 {
+			t.Errorf("%v: got %d responses, want only the first one", tc.name, len(resps))
+		}
+		s.Close()
+	}
+}
+
+func TestMintX509CAWithTrustDomains(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name         string
+		csrPath      string
+		wantEndpoint string
+	}{
+		{
+			name:         "mount of the trust domain",
+			csrPath:      "../../../pkg/fake/_test_data/spiffe-example-org.csr",
+			wantEndpoint: "/v1/example-pki/root/sign-intermediate",
+		},
+		{
+			name:         "issuer of the trust domain",
+			csrPath:      "../../../pkg/fake/_test_data/spiffe-another-example-org.csr",
+			wantEndpoint: "/v1/test-pki/issuer/another-issuer/sign-intermediate",
+		},
+		{
+			name:         "fall back to the global configuration",
+			csrPath:      "../../../pkg/fake/_test_data/test-req.csr",
+			wantEndpoint: "/v1/test-pki/root/sign-intermediate",
+		},
+	}
+
+	for _, tc := range tCases {
+		testCSR, err := ioutil.ReadFile(tc.csrPath)
+		if err != nil {
+			t.Errorf("%v: failed to load fixture: %v", tc.name, err)
+		}
+
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = fakeServerCert
+		vc.ServerKeyPemPath = fakeServerKey
+		vc.SignIntermediateReqEndpoint = tc.wantEndpoint
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = signResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/token-auth-config.tpl")
+		if err != nil {
+			t.Errorf("%v: failed to prepare request: %v", tc.name, err)
+		}
+		req.Configuration += `
+trust_domains "example.org" {
+   pki_mount_point = "example-pki"
+}
+trust_domains "another.example.org" {
+   issuer_ref = "another-issuer"
+}
+`
+		p := New()
+		p.SetLogger(getTestLogger())
+		if _, err := p.Configure(context.Background(), req); err != nil {
+			t.Errorf("%v: error from Configure(): %v", tc.name, err)
+		}
+
+		mintReq, err := getFakeMintX509CARequest(testCSR)
+		if err != nil {
+			t.Errorf("%v: failed to get fake CSR: %v", tc.name, err)
+		}
+		if err := p.MintX509CA(mintReq, &fake.UpstreamAuthorityMintX509CAServer{}); err != nil {
+			t.Errorf("%v: unexpected error from MintX509CA: %v", tc.name, err)
+		}
+		if got := vc.LastSignIntermediateRequest(); got == nil {
+			t.Errorf("%v: sign-intermediate request is not sent to %v", tc.name, tc.wantEndpoint)
+		}
+
+		s.Close()
+	}
+}
+
+func TestMintX509CAWithTrustDomainsAndBundleRefresh(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	// ca-chain-response.json has the intermediate CA in addition to the root CA in the sign response
+	caChainResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/ca-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/spiffe-example-org.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	// Only the mount of the trust domain has the CA chain
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.SignIntermediateReqEndpoint = "/v1/example-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+	vc.CAChainReqEndpoint = "/v1/example-pki/cert/ca_chain"
+	vc.CAChainResponseCode = 200
+	vc.CAChainResponse = caChainResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/token-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+	req.Configuration += `
+trust_domains "example.org" {
+   pki_mount_point = "example-pki"
+}
+`
+	p := New()
+	p.SetLogger(getTestLogger())
+	if _, err := p.Configure(context.Background(), req); err != nil {
+		t.Errorf("error from Configure(): %v", err)
+	}
+	p.bundleRefresh = 10 * time.Millisecond
+
+	mintReq, err := getFakeMintX509CARequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &fake.UpstreamAuthorityMintX509CAServer{Ctx: ctx}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.MintX509CA(mintReq, stream)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("unexpected error from MintX509CA: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("MintX509CA doesn't return after the stream is closed")
+	}
+
+	resps := stream.Responses()
+	if len(resps) != 2 {
+		t.Fatalf("got %d responses, want 2", len(resps))
+	}
+	if len(resps[1].UpstreamX509Roots) != 2 {
+		t.Errorf("got %d roots in the bundle update, want 2 of the trust domain", len(resps[1].UpstreamX509Roots))
+	}
+}
+
+func TestConfigureWithCheckMountType(t *testing.T) {
+	pkiMountResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/mount-pki-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	kvMountResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/mount-kv-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name          string
+		checkMount    bool
+		responseCode  int
+		response      []byte
+		wantErrPrefix string
+	}{
+		{
+			name:         "PKI secret engine",
+			checkMount:   true,
+			responseCode: 200,
+			response:     pkiMountResp,
+		},
+		{
+			name:          "KV secret engine",
+			checkMount:    true,
+			responseCode:  200,
+			response:      kvMountResp,
+			wantErrPrefix: `pki_mount_point "test-pki" is a kv mount, not a PKI secret engine`,
+		},
+		{
+			name:          "Mount is not readable",
+			checkMount:    true,
+			responseCode:  403,
+			response:      []byte(`{"errors":["permission denied"]}`),
+			wantErrPrefix: `failed to check the type of pki_mount_point "test-pki"`,
+		},
+		{
+			// The mount is not read unless check_mount_type is set
+			name:         "Check is disabled",
+			responseCode: 200,
+			response:     kvMountResp,
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = fakeServerCert
+		vc.ServerKeyPemPath = fakeServerKey
+		vc.MountResponseCode = tc.responseCode
+		vc.MountResponse = tc.response
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/token-auth-config.tpl")
+		if err != nil {
+			t.Errorf("%v: failed to prepare request: %v", tc.name, err)
+		}
+		req.Configuration += fmt.Sprintf("\ncheck_mount_type = %v\n", tc.checkMount)
+
+		p := New()
+		p.SetLogger(getTestLogger())
+		_, err = p.Configure(context.Background(), req)
+		switch {
+		case tc.wantErrPrefix == "" && err != nil:
+			t.Errorf("%v: error from Configure(): %v", tc.name, err)
+		case tc.wantErrPrefix != "" && err == nil:
+			t.Errorf("%v: expected got an error", tc.name)
+		case tc.wantErrPrefix != "" && !strings.HasPrefix(err.Error(), tc.wantErrPrefix):
+			t.Errorf("%v: got %v, want prefix %v", tc.name, err, tc.wantErrPrefix)
+		}
+
+		got := vc.LastMountRequest()
+		switch {
+		case tc.checkMount && got == nil:
+			t.Errorf("%v: mount request is not sent", tc.name)
+		case tc.checkMount && got.Path != "/v1/sys/internal/ui/mounts/test-pki":
+			t.Errorf("%v: got path %v, want /v1/sys/internal/ui/mounts/test-pki", tc.name, got.Path)
+		case !tc.checkMount && got != nil:
+			t.Errorf("%v: unexpected mount request", tc.name)
+		}
+
+		s.Close()
+	}
+}
+
+func TestConfigureReloadSignParams(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	var logins int32
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.CertAuthReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&logins, 1)
+			w.WriteHeader(code)
+			_, _ = w.Write(resp)
+		}
+	}
+	// Every issuer of the mount is served by the same handler
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/issuer/"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	tCases := []struct {
+		name       string
+		config     string
+		wantPath   string
+		wantTTL    string
+		wantLogins int32
+	}{
+		{
+			name:       "Initial configuration",
+			config:     `issuer_ref = "issuer-a"`,
+			wantPath:   "/v1/test-pki/issuer/issuer-a/sign-intermediate",
+			wantTTL:    "3600",
+			wantLogins: 1,
+		},
+		{
+			name: "Issuer and TTL are reloaded without authentication",
+			config: `issuer_ref = "issuer-b"
+max_ttl = "30m"`,
+			wantPath:   "/v1/test-pki/issuer/issuer-b/sign-intermediate",
+			wantTTL:    "1800",
+			wantLogins: 1,
+		},
+		{
+			name: "Other change authenticates again",
+			config: `issuer_ref = "issuer-b"
+max_ttl = "30m"
+user_agent = "test-agent"`,
+			wantPath:   "/v1/test-pki/issuer/issuer-b/sign-intermediate",
+			wantTTL:    "1800",
+			wantLogins: 2,
+		},
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	for _, tc := range tCases {
+		req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/cert-auth-config.tpl")
+		if err != nil {
+			t.Errorf("%v: failed to prepare request: %v", tc.name, err)
+		}
+		req.Configuration += tc.config
+		if _, err := p.Configure(context.Background(), req); err != nil {
+			t.Errorf("%v: error from Configure(): %v", tc.name, err)
+		}
+		if got := atomic.LoadInt32(&logins); got != tc.wantLogins {
+			t.Errorf("%v: got %d logins, want %d", tc.name, got, tc.wantLogins)
+		}
+
+		mintReq, err := getFakeMintX509CARequest(testCSR)
+		if err != nil {
+			t.Errorf("%v: failed to get fake CSR: %v", tc.name, err)
+		}
+		if err := p.MintX509CA(mintReq, &fake.UpstreamAuthorityMintX509CAServer{}); err != nil {
+			t.Errorf("%v: unexpected error from MintX509CA: %v", tc.name, err)
+		}
+		got := vc.LastSignIntermediateRequest()
+		if got == nil {
+			t.Errorf("%v: sign-intermediate request is not sent", tc.name)
+			continue
+		}
+		if got.Path != tc.wantPath {
+			t.Errorf("%v: got path %v, want %v", tc.name, got.Path, tc.wantPath)
+		}
+		if got.Body["ttl"] != tc.wantTTL {
+			t.Errorf("%v: got ttl %v, want %v", tc.name, got.Body["ttl"], tc.wantTTL)
+		}
+	}
+}
+
+func TestMintX509CAWithSkipInvalidChainCerts(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-malformed-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	caCert, err := pemutil.LoadCertificate(fakeCaCert)
+	if err != nil {
+		t.Errorf("failed to load CA certificate: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	req, err := getFakeMintX509CARequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+
+	tCases := []struct {
+		name          string
+		skip          bool
+		wantErr       error
+		wantErrPrefix string
+	}{
+		{
+			name:          "Strict",
+			wantErr:       vault.ErrInvalidCAChain,
+			wantErrPrefix: "MintX509CA response is invalid: failed to parse certificate #0 of CA chain",
+		},
+		{
+			name: "Skip invalid certificates",
+			skip: true,
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = fakeServerCert
+		vc.ServerKeyPemPath = fakeServerKey
+		vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+		vc.CertAuthResponseCode = 200
+		vc.CertAuthResponse = certAuthResp
+		vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = signResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		retry := 0
+		vaultConfig := vault.New(vault.CERT)
+		cp := &vault.ClientParams{
+			MaxRetries:            &retry,
+			VaultAddr:             fmt.Sprintf("https://%v/", addr),
+			CACertPath:            fakeCaCert,
+			CertAuthMountPoint:    "test-auth",
+			PKIMountPoint:         "test-pki",
+			ClientKeyPath:         fakeClientKey,
+			ClientCertPath:        fakeClientCert,
+			SkipInvalidChainCerts: tc.skip,
+		}
+		if err := vaultConfig.SetClientParams(cp); err != nil {
+			t.Errorf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+		client, err := vaultConfig.NewAuthenticatedClient()
+		if err != nil {
+			t.Errorf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		p := New()
+		p.SetLogger(getTestLogger())
+		p.vc = client
+		p.verifyChain = true
+		p.maxChainLength = vault.DefaultMaxChainLength
+
+		stream := &fake.UpstreamAuthorityMintX509CAServer{}
+		err = p.MintX509CA(req, stream)
+		s.Close()
+		if tc.wantErr != nil {
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("%v: got %v, want %v", tc.name, err, tc.wantErr)
+			} else if !strings.HasPrefix(err.Error(), tc.wantErrPrefix) {
+				t.Errorf("%v: got %v, want prefix %v", tc.name, err, tc.wantErrPrefix)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error from MintX509CA: %v", tc.name, err)
+			continue
+		}
+		// The malformed certificate is skipped, and the valid CA certificate is still sent as the bundle
+		bundle := stream.Responses()[0].UpstreamX509Roots
+		if len(bundle) != 1 || !bytes.Equal(bundle[0], caCert.Raw) {
+			t.Errorf("%v: got %d certificates in the bundle, want only the CA certificate", tc.name, len(bundle))
+		}
+	}
+}
+
+func TestMintX509CAErrorParse(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	invalidCertSignResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-invalid-cert-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	invalidCAChainSignResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-invalid-ca-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSRReq, err := getFakeMintX509CARequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+
+	tCases := []struct {
+		name          string
+		csr           []byte
+		signResponse  []byte
+		wantErr       error
+		wantErrPrefix string
+	}{
+		{
+			name:          "CSR is not a certificate request",
+			csr:           []byte("-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"),
+			signResponse:  signResp,
+			wantErr:       common.ErrInvalidCSR,
+			wantErrPrefix: "MintX509CA request is invalid: failed to encode CSR: unexpected PEM block type CERTIFICATE",
+		},
+		{
+			name:          "signed certificate is broken",
+			csr:           testCSRReq.Csr,
+			signResponse:  invalidCertSignResp,
+			wantErr:       vault.ErrInvalidCertificate,
+			wantErrPrefix: "MintX509CA response is invalid: failed to parse signed certificate",
+		},
+		{
+			name:          "CA chain is broken",
+			csr:           testCSRReq.Csr,
+			signResponse:  invalidCAChainSignResp,
+			wantErr:       vault.ErrInvalidCAChain,
+			wantErrPrefix: "MintX509CA response is invalid: failed to parse certificate #1 of CA chain",
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = fakeServerCert
+		vc.ServerKeyPemPath = fakeServerKey
+		vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+		vc.CertAuthResponseCode = 200
+		vc.CertAuthResponse = certAuthResp
+		vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = tc.signResponse
+		vc.RenewResponseCode = 200
+		vc.RenewResponse = renewResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		p := New()
+		p.SetLogger(getTestLogger())
+		client, err := getFakeVaultClientWithCertAuth(addr, "test-auth", "test-pki")
+		if err != nil {
+			t.Error(err)
+		}
+		p.vc = client
+		p.verifyChain = true
+		p.maxChainLength = vault.DefaultMaxChainLength
+
+		err = p.MintX509CA(&upstreamauthority.MintX509CARequest{Csr: tc.csr}, &fake.UpstreamAuthorityMintX509CAServer{})
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%v: got %v, want %v", tc.name, err, tc.wantErr)
+		} else if !strings.HasPrefix(err.Error(), tc.wantErrPrefix) {
+			t.Errorf("%v: got %v, want prefix %v", tc.name, err, tc.wantErrPrefix)
+		}
+
+		s.Close()
+	}
+}
+
+func TestMintX509CAWithConcurrentConfigure(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.SetLogger(getTestLogger())
+
+	ctx := context.Background()
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/token-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+	if _, err := p.Configure(ctx, req); err != nil {
+		t.Fatalf("error from Configure(): %v", err)
+	}
+
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSRReq, err := getFakeMintX509CARequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+
+	// Configure swaps the client while MintX509CA is in flight. The race detector reports unsafe access.
+	var wg sync.WaitGroup
+	errCh := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Configure(ctx, req); err != nil {
+				errCh <- fmt.Errorf("error from Configure(): %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := p.MintX509CA(testCSRReq, &fake.UpstreamAuthorityMintX509CAServer{}); err != nil {
+				errCh <- fmt.Errorf("error from MintX509CA(): %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		t.Error(err)
+	}
+}
+
+func TestMintX509CAWithMaxTTL(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name         string
+		preferredTTL int32
+		wantTTL      string
+	}{
+		{
+			name:    "no preference",
+			wantTTL: "1800",
+		},
+		{
+			name:         "preference below max_ttl",
+			preferredTTL: 600,
+			wantTTL:      "600",
+		},
+		{
+			name:         "preference above max_ttl",
+			preferredTTL: 7200,
+			wantTTL:      "3600",
+		},
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	for _, tc := range tCases {
+		p := New()
+		p.SetLogger(getTestLogger())
+		client, err := getFakeVaultClientWithCertAuth(addr, "test-auth", "test-pki")
+		if err != nil {
+			t.Error(err)
+		}
+		p.vc = client
+		p.certTTL = 30 * time.Minute
+		p.maxTTL = time.Hour
+
+		req, err := getFakeMintX509CARequest(testCSR)
+		if err != nil {
+			t.Errorf("%v: failed to get fake CSR: %v", tc.name, err)
+		}
+		req.PreferredTtl = tc.preferredTTL
+
+		if err := p.MintX509CA(req, &fake.UpstreamAuthorityMintX509CAServer{}); err != nil {
+			t.Errorf("%v: unexpected error from MintX509CA: %v", tc.name, err)
+		}
+
+		got := vc.LastSignIntermediateRequest()
+		if got == nil {
+			t.Errorf("%v: sign-intermediate request is not recorded", tc.name)
+		} else if got.Body["ttl"] != tc.wantTTL {
+			t.Errorf("%v: got ttl %v, want %v", tc.name, got.Body["ttl"], tc.wantTTL)
+		}
+	}
 }
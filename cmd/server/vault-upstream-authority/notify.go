@@ -0,0 +1,95 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/zlabjp/spire-vault-plugin/pkg/common"
+	"github.com/zlabjp/spire-vault-plugin/pkg/vault"
+)
+
+const defaultNotifyTimeout = 10 * time.Second
+
+// notifyPayload is the JSON body posted to notify_url after an intermediate CA is minted.
+type notifyPayload struct {
+	// Serial number in the same form as Vault. (e.g., 1f:2a:...)
+	SerialNumber string    `json:"serial_number"`
+	CommonName   string    `json:"common_name"`
+	NotAfter     time.Time `json:"not_after"`
+	// PKI mount point which signed the certificate
+	PKIMountPoint string `json:"pki_mount_point"`
+}
+
+// notifier posts the summary of minted intermediate CAs to the webhook.
+type notifier struct {
+	url    string
+	client *http.Client
+	// pkiMountPoint is used if the sign target doesn't have its own mount point
+	pkiMountPoint string
+}
+
+func newNotifier(url string, timeout time.Duration, pkiMountPoint string) *notifier {
+	if pkiMountPoint == "" {
+		pkiMountPoint = vault.DefaultPKIMountPoint
+	}
+	return &notifier{
+		url:           url,
+		client:        &http.Client{Timeout: timeout},
+		pkiMountPoint: pkiMountPoint,
+	}
+}
+
+// notify posts the summary of the certificate. Errors are only logged, since the certificate has already been minted.
+func (n *notifier) notify(ctx context.Context, logger hclog.Logger, cert *x509.Certificate, target *vault.SignTarget) {
+	mount := n.pkiMountPoint
+	if target != nil && target.PKIMountPoint != "" {
+		mount = target.PKIMountPoint
+	}
+	payload := &notifyPayload{
+		SerialNumber:  common.SerialNumber(cert),
+		CommonName:    cert.Subject.CommonName,
+		NotAfter:      cert.NotAfter.UTC(),
+		PKIMountPoint: strings.Trim(mount, "/"),
+	}
+	if err := n.post(ctx, payload); err != nil {
+		logger.Warn("Failed to notify the minted intermediate CA", "notify_url", n.url, "serial_number", payload.SerialNumber, "error", err)
+	}
+}
+
+func (n *notifier) post(ctx context.Context, payload *notifyPayload) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", vault.DefaultUserAgent())
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %v", resp.Status)
+	}
+	return nil
+}
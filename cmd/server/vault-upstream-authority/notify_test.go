@@ -0,0 +1,150 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zlabjp/spire-vault-plugin/pkg/common"
+	"github.com/zlabjp/spire-vault-plugin/pkg/fake"
+)
+
+func TestMintX509CAWithNotifyURL(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name         string
+		responseCode int
+	}{
+		{
+			name:         "Webhook accepted",
+			responseCode: http.StatusNoContent,
+		},
+		{
+			// The mint must not fail on the webhook error
+			name:         "Webhook failed",
+			responseCode: http.StatusInternalServerError,
+		},
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	for _, tc := range tCases {
+		var (
+			mu          sync.Mutex
+			gotMethod   string
+			gotType     string
+			gotPayloads []map[string]interface{}
+		)
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var payload map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				t.Errorf("%v: failed to decode payload: %v", tc.name, err)
+			}
+			mu.Lock()
+			gotMethod, gotType = r.Method, r.Header.Get("Content-Type")
+			gotPayloads = append(gotPayloads, payload)
+			mu.Unlock()
+			w.WriteHeader(tc.responseCode)
+		}))
+
+		p := New()
+		p.SetLogger(getTestLogger())
+		client, err := getFakeVaultClientWithCertAuth(addr, "test-auth", "test-pki")
+		if err != nil {
+			t.Error(err)
+		}
+		p.vc = client
+		p.notifier = newNotifier(receiver.URL, time.Second, "/test-pki/")
+
+		req, err := getFakeMintX509CARequest(testCSR)
+		if err != nil {
+			t.Errorf("%v: failed to get fake CSR: %v", tc.name, err)
+		}
+
+		stream := &fake.UpstreamAuthorityMintX509CAServer{}
+		if err := p.MintX509CA(req, stream); err != nil {
+			t.Errorf("%v: unexpected error from MintX509CA: %v", tc.name, err)
+		}
+		receiver.Close()
+
+		if len(stream.Responses()) != 1 {
+			t.Fatalf("%v: got %d responses, want 1", tc.name, len(stream.Responses()))
+		}
+		cert, err := x509.ParseCertificate(stream.Responses()[0].X509CaChain[0])
+		if err != nil {
+			t.Fatalf("%v: failed to parse the minted certificate: %v", tc.name, err)
+		}
+
+		mu.Lock()
+		if gotMethod != http.MethodPost {
+			t.Errorf("%v: got method %v, want POST", tc.name, gotMethod)
+		}
+		if gotType != "application/json" {
+			t.Errorf("%v: got content type %v, want application/json", tc.name, gotType)
+		}
+		if len(gotPayloads) != 1 {
+			t.Errorf("%v: got %d notifications, want 1", tc.name, len(gotPayloads))
+		} else {
+			want := map[string]interface{}{
+				"serial_number":   common.SerialNumber(cert),
+				"common_name":     cert.Subject.CommonName,
+				"not_after":       cert.NotAfter.UTC().Format(time.RFC3339),
+				"pki_mount_point": "test-pki",
+			}
+			for k, v := range want {
+				if gotPayloads[0][k] != v {
+					t.Errorf("%v: got %v %v, want %v", tc.name, k, gotPayloads[0][k], v)
+				}
+			}
+			if len(gotPayloads[0]) != len(want) {
+				t.Errorf("%v: got payload %v, want keys of %v", tc.name, gotPayloads[0], want)
+			}
+		}
+		mu.Unlock()
+	}
+}
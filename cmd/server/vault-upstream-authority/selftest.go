@@ -0,0 +1,105 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/hashicorp/go-hclog"
+	spi "github.com/spiffe/spire/proto/spire/common/plugin"
+
+	"github.com/zlabjp/spire-vault-plugin/pkg/common"
+)
+
+const selfTestCommonName = "vault-upstream-authority self-test"
+
+// runSelfTest configures the plugin with the configuration (the content of plugin_data),
+// and mints an intermediate CA with an ephemeral key to check that the PKI secret engine actually signs it.
+// The signed certificate is thrown away, and the summary is written to out.
+func runSelfTest(ctx context.Context, configuration string, trustDomain string, out io.Writer) error {
+	p := New()
+	p.SetLogger(hclog.New(&hclog.LoggerOptions{
+		Output: os.Stderr,
+		Name:   common.PluginName,
+	}))
+	if _, err := p.Configure(ctx, &spi.ConfigureRequest{Configuration: configuration}); err != nil {
+		return fmt.Errorf("failed to configure: %v", err)
+	}
+
+	csr, err := selfTestCSR(trustDomain)
+	if err != nil {
+		return fmt.Errorf("failed to create CSR: %v", err)
+	}
+	csrPEM, err := common.EncodeCSRPEM(csr)
+	if err != nil {
+		return fmt.Errorf("failed to encode CSR: %v", err)
+	}
+	p.mtx.RLock()
+	_, target := p.resolveSignTargets(csrPEM)
+	p.mtx.RUnlock()
+	resp, err := p.mintX509CA(ctx, csr, 0, target)
+	if err != nil {
+		return err
+	}
+
+	cert, err := x509.ParseCertificate(resp.X509CaChain[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse the signed certificate: %v", err)
+	}
+	fmt.Fprintf(out, "Subject: %v\n", cert.Subject)
+	fmt.Fprintf(out, "Issuer: %v\n", cert.Issuer)
+	fmt.Fprintf(out, "Serial Number: %v\n", cert.SerialNumber)
+	fmt.Fprintf(out, "Not Before: %v\n", cert.NotBefore)
+	fmt.Fprintf(out, "Not After: %v\n", cert.NotAfter)
+	fmt.Fprintf(out, "Is CA: %v\n", cert.IsCA)
+	for _, u := range cert.URIs {
+		fmt.Fprintf(out, "URI SAN: %v\n", u)
+	}
+	fmt.Fprintln(out, "Upstream Roots:")
+	for _, b := range resp.UpstreamX509Roots {
+		root, err := x509.ParseCertificate(b)
+		if err != nil {
+			return fmt.Errorf("failed to parse the upstream root: %v", err)
+		}
+		fmt.Fprintf(out, "  - %v\n", root.Subject)
+	}
+	return nil
+}
+
+// selfTestCSR returns a CSR in DER format with an ephemeral key.
+// If the trust domain is not empty, the CSR has its SPIFFE ID to select the per trust domain settings.
+func selfTestCSR(trustDomain string) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: selfTestCommonName},
+	}
+	if trustDomain != "" {
+		u, err := url.Parse("spiffe://" + trustDomain)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, errors.New("trust domain is invalid")
+		}
+		tmpl.URIs = []*url.URL{u}
+	}
+	return x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+}
@@ -0,0 +1,108 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/zlabjp/spire-vault-plugin/pkg/fake"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name                         string
+		signIntermediateResponseCode int
+		signIntermediateResponse     []byte
+		wantErr                      string
+		wantOutput                   []string
+	}{
+		{
+			name:                         "Success",
+			signIntermediateResponseCode: 200,
+			signIntermediateResponse:     signResp,
+			wantOutput:                   []string{"Subject: ", "Issuer: ", "Not After: ", "Upstream Roots:\n  - "},
+		},
+		{
+			name:                         "Permission denied",
+			signIntermediateResponseCode: 403,
+			signIntermediateResponse:     []byte(`{"errors":["permission denied"]}`),
+			wantErr:                      "MintX509CA request is failed",
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = fakeServerCert
+		vc.ServerKeyPemPath = fakeServerKey
+		vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+		vc.SignIntermediateResponseCode = tc.signIntermediateResponseCode
+		vc.SignIntermediateResponse = tc.signIntermediateResponse
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/token-auth-config.tpl")
+		if err != nil {
+			t.Errorf("%v: failed to prepare request: %v", tc.name, err)
+		}
+
+		var out bytes.Buffer
+		err = runSelfTest(context.Background(), req.Configuration, "example.org", &out)
+		if tc.wantErr != "" {
+			if err == nil {
+				t.Errorf("%v: expected got an error", tc.name)
+			} else if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%v: got %v, want %v", tc.name, err, tc.wantErr)
+			}
+		} else if err != nil {
+			t.Errorf("%v: unexpected error from runSelfTest(): %v", tc.name, err)
+		}
+		for _, want := range tc.wantOutput {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("%v: output doesn't have %q: %s", tc.name, want, out.String())
+			}
+		}
+
+		signReq := vc.LastSignIntermediateRequest()
+		if signReq == nil {
+			t.Errorf("%v: sign-intermediate request is not sent", tc.name)
+		} else {
+			csrPEM, _ := signReq.Body["csr"].(string)
+			block, _ := pem.Decode([]byte(csrPEM))
+			if block == nil {
+				t.Errorf("%v: csr in the request is not PEM: %v", tc.name, signReq.Body["csr"])
+			} else if csr, err := x509.ParseCertificateRequest(block.Bytes); err != nil {
+				t.Errorf("%v: failed to parse csr in the request: %v", tc.name, err)
+			} else {
+				if csr.Subject.CommonName != selfTestCommonName {
+					t.Errorf("%v: got common name %q, want %q", tc.name, csr.Subject.CommonName, selfTestCommonName)
+				}
+				if len(csr.URIs) != 1 || csr.URIs[0].String() != "spiffe://example.org" {
+					t.Errorf("%v: got URIs %v, want [spiffe://example.org]", tc.name, csr.URIs)
+				}
+			}
+		}
+
+		s.Close()
+	}
+}
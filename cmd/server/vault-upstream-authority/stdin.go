@@ -0,0 +1,45 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// stdin is the reader of token_from_stdin. It is replaced in tests.
+var stdin io.Reader = os.Stdin
+
+// readStdinToken reads the token of token_from_stdin from the first line of stdin.
+// The line can be read only once, so the token is kept for the subsequent configurations.
+// It must be called with mtx held.
+func (p *VaultPlugin) readStdinToken() (string, error) {
+	if p.stdinToken != "" {
+		return p.stdinToken, nil
+	}
+	// A terminal would block Configure until someone types the token.
+	if f, ok := stdin.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			return "", errors.New("token_from_stdin is set, but stdin is a terminal")
+		}
+	}
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read token from stdin: %v", err)
+	}
+	token := strings.TrimSpace(line)
+	if token == "" {
+		return "", errors.New("token_from_stdin is set, but stdin has no token")
+	}
+	p.stdinToken = token
+	return token, nil
+}
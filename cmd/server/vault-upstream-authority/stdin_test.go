@@ -0,0 +1,123 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/spiffe/spire/proto/spire/common/plugin"
+
+	"github.com/zlabjp/spire-vault-plugin/pkg/fake"
+)
+
+func TestConfigureWithTokenFromStdin(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	orig := stdin
+	defer func() { stdin = orig }()
+	stdin = strings.NewReader("  stdin-token \nnext-line\n")
+
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/token-from-stdin-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+
+	p := New()
+	p.SetLogger(getTestLogger())
+	if _, err := p.Configure(context.Background(), req); err != nil {
+		t.Fatalf("error from Configure(): %v", err)
+	}
+	// stdin is read only once, so the token is kept on the configuration again
+	req.Configuration += "\nlog_requests = true\n"
+	if _, err := p.Configure(context.Background(), req); err != nil {
+		t.Fatalf("error from Configure() again: %v", err)
+	}
+
+	mintReq, err := getFakeMintX509CARequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+	if err := p.MintX509CA(mintReq, &fake.UpstreamAuthorityMintX509CAServer{}); err != nil {
+		t.Errorf("unexpected error from MintX509CA: %v", err)
+	}
+	if signReq := vc.LastSignIntermediateRequest(); signReq == nil {
+		t.Errorf("sign request is not sent")
+	} else if got := signReq.Header.Get("X-Vault-Token"); got != "stdin-token" {
+		t.Errorf("got token %q, want stdin-token", got)
+	}
+}
+
+func TestConfigureErrorTokenFromStdin(t *testing.T) {
+	tCases := []struct {
+		name          string
+		stdin         string
+		configuration string
+		wantErr       string
+	}{
+		{
+			name:          "Empty stdin",
+			configuration: `token_auth_config { token_from_stdin = true }`,
+			wantErr:       "token_from_stdin is set, but stdin has no token",
+		},
+		{
+			name:          "Blank line",
+			stdin:         "\n",
+			configuration: `token_auth_config { token_from_stdin = true }`,
+			wantErr:       "token_from_stdin is set, but stdin has no token",
+		},
+		{
+			name:          "With token",
+			stdin:         "stdin-token\n",
+			configuration: `token_auth_config { token = "test-token" token_from_stdin = true }`,
+			wantErr:       "token and token_from_stdin of token_auth_config are mutually exclusive",
+		},
+	}
+
+	orig := stdin
+	defer func() { stdin = orig }()
+	for _, tc := range tCases {
+		stdin = strings.NewReader(tc.stdin)
+		req := &plugin.ConfigureRequest{
+			Configuration: tc.configuration,
+		}
+
+		p := New()
+		p.SetLogger(getTestLogger())
+		_, err := p.Configure(context.Background(), req)
+		if err == nil {
+			t.Errorf("%v: expected got an error", tc.name)
+		} else if err.Error() != tc.wantErr {
+			t.Errorf("%v: got %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
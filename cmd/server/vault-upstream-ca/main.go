@@ -9,7 +9,7 @@ package main
 
 import (
 	"context"
-	"encoding/pem"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"strings"
@@ -19,7 +19,6 @@ import (
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/hcl"
 	"github.com/spiffe/spire/pkg/common/catalog"
-	"github.com/spiffe/spire/pkg/common/pemutil"
 	"github.com/spiffe/spire/pkg/server/plugin/upstreamca"
 	spi "github.com/spiffe/spire/proto/spire/common/plugin"
 
@@ -33,10 +32,11 @@ const (
 
 // VaultPlugin implements UpstreamCA Plugin interface
 type VaultPlugin struct {
-	logger  hclog.Logger
-	config  *VaultPluginConfig
-	vc      *vault.Client
-	certTTL time.Duration
+	logger    hclog.Logger
+	config    *VaultPluginConfig
+	vc        *vault.Client
+	certTTL   time.Duration
+	clockSkew time.Duration
 
 	mu *sync.RWMutex
 }
@@ -52,14 +52,25 @@ type VaultPluginConfig struct {
 	CertAuthConfig VaultCertAuthConfig `hcl:"cert_auth_config"`
 	// Configuration parameters to use AppRole auth method
 	AppRoleAuthConfig VaultAppRoleAuthConfig `hcl:"approle_auth_config"`
-	// Path to a CA certificate file that the client verifies the server certificate.
+	// Path to a CA certificate file, or a directory of them, that the client verifies the server certificate.
 	// Only PEM format is supported.
 	CACertPath string `hcl:"ca_cert_path"`
-	// Request to issue a certificate with the specified TTL (Go-style time duration)
+	// Request to issue a certificate with the specified TTL (Go-style time duration, "d" and "w" units are also accepted)
 	TTL string `hcl:"ttl"`
 	// If true, vault client accepts any server certificates.
 	// It should be used only test environment so on.
 	TLSSkipVerify bool `hcl:"tls_skip_verify"`
+	// If true, the plugin verifies that the signed certificate chains to the CA certificates returned from Vault.
+	// If the value is not set, true is used.
+	VerifyChain *bool `hcl:"verify_chain"`
+	// Allowed clock skew between SPIRE server and Vault on the chain verification. (e.g., 30s)
+	// If the value is empty, the certificate must be valid at the time of the verification.
+	ClockSkew string `hcl:"clock_skew"`
+	// Maximum number of CA certificates accepted in the chain returned from Vault.
+	// If the value is 0, use default value (10)
+	MaxChainLength int `hcl:"max_chain_length"`
+	// If true, the plugin logs a warning instead of failing when the signed certificate is not a CA.
+	AllowNonCA bool `hcl:"allow_non_ca"`
 }
 
 // VaultTokenAuthConfig represents parameters for token auth method
@@ -122,11 +133,18 @@ func (p *VaultPlugin) Configure(ctx context.Context, req *spi.ConfigureRequest)
 
 	var ttl time.Duration
 	if config.TTL != "" {
-		ttl, err = time.ParseDuration(config.TTL)
+		ttl, err = common.ParseDuration(config.TTL)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse TTL value: %v", err)
 		}
 	}
+	var clockSkew time.Duration
+	if config.ClockSkew != "" {
+		clockSkew, err = time.ParseDuration(config.ClockSkew)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse clock_skew value: %v", err)
+		}
+	}
 
 	am, err := parseAuthMethod(config)
 	if err != nil {
@@ -160,63 +178,96 @@ func (p *VaultPlugin) Configure(ctx context.Context, req *spi.ConfigureRequest)
 	p.config = config
 	p.vc = vc
 	p.certTTL = ttl
+	p.clockSkew = clockSkew
 
 	return &spi.ConfigureResponse{}, nil
 }
 
 func (p *VaultPlugin) SubmitCSR(ctx context.Context, req *upstreamca.SubmitCSRRequest) (*upstreamca.SubmitCSRResponse, error) {
-	certReq := &pem.Block{Type: "CERTIFICATE REQUEST", Bytes: req.Csr}
-	pemData := pem.EncodeToMemory(certReq)
+	pemData, err := common.EncodeCSRPEM(req.Csr)
+	if err != nil {
+		return nil, fmt.Errorf("SubmitCSR request is invalid: %w", err)
+	}
+
+	// Capture the client and the configuration under the lock, since Configure may swap them.
+	// The lock is not held during the request to Vault.
+	p.mu.RLock()
+	vc := p.vc
+	config := p.config
+	certTTL := p.certTTL
+	clockSkew := p.clockSkew
+	p.mu.RUnlock()
+	if vc == nil || config == nil {
+		return nil, errors.New("plugin is not configured")
+	}
 
 	var ttl string
-	if p.certTTL != time.Duration(0) {
-		ttl = fmt.Sprintf("%d", int64(p.certTTL/time.Second))
+	if certTTL != time.Duration(0) {
+		ttl = fmt.Sprintf("%d", int64(certTTL/time.Second))
 	}
 
-	signResp, err := p.vc.SignIntermediate(ttl, pemData)
+	signResp, err := vc.SignIntermediate(ctx, ttl, pemData)
 	if err != nil {
 		return nil, fmt.Errorf("SubmitCSR request is failed: %v", err)
 	}
 	if signResp == nil {
 		return nil, errors.New("SubmitCSR response is empty")
 	}
-
-	signedCert := &upstreamca.SignedCertificate{}
-	var certChain []byte
+	maxChainLength := vault.DefaultMaxChainLength
+	if config.MaxChainLength > 0 {
+		maxChainLength = config.MaxChainLength
+	}
+	if signResp.CAChainLength() > maxChainLength {
+		return nil, fmt.Errorf("SubmitCSR response is invalid: CA chain has %d certificates, exceeds max_chain_length %d", signResp.CAChainLength(), maxChainLength)
+	}
 
 	// Parse PEM format data to get DER format data
-	certificate, err := pemutil.ParseCertificate([]byte(signResp.CertPEM))
+	certificate, err := signResp.ParseCertificate()
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse certificate: %v", err)
+		return nil, fmt.Errorf("SubmitCSR response is invalid: %w", err)
 	}
-	certChain = append(certChain, certificate.Raw...)
-
-	signedCert.CertChain = certChain
-
-	var bundles []byte
-	caCert, err := pemutil.ParseCertificate([]byte(signResp.CACertPEM))
+	caCerts, err := signResp.ParseCACertificates()
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse CA certificate: %v", err)
-	}
-	bundles = append(bundles, caCert.Raw...)
-
-	if len(signResp.CACertChainPEM) != 0 {
-		for i := range signResp.CACertChainPEM {
-			c := signResp.CACertChainPEM[i]
-			b, err := pemutil.ParseCertificate([]byte(c))
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse upstream bundle certificates: %v", err)
-			}
-			bundles = append(bundles, b.Raw...)
+		return nil, fmt.Errorf("SubmitCSR response is invalid: %w", err)
+	}
+
+	if config.VerifyChain == nil || *config.VerifyChain {
+		if err := vault.VerifyCertificateChain(certificate, caCerts, clockSkew); err != nil {
+			return nil, fmt.Errorf("SubmitCSR response is invalid: %v", err)
 		}
 	}
-	signedCert.Bundle = bundles
+	if err := vault.VerifyCACertificate(certificate); err != nil {
+		if !config.AllowNonCA {
+			return nil, fmt.Errorf("SubmitCSR response is invalid: %v", err)
+		}
+		p.logger.Warn("The signed certificate is not a valid CA, SPIRE server may fail to sign SVIDs with it", "error", err)
+	}
+
+	signedCert := &upstreamca.SignedCertificate{
+		CertChain: certificate.Raw,
+		Bundle:    concatRaw(vault.OrderCAChain(certificate, caCerts)),
+	}
+
+	p.logger.Info("Signed an intermediate CA", "serial_number", common.SerialNumber(certificate), "authority_key_id", common.AuthorityKeyID(certificate), "not_after", certificate.NotAfter.UTC().Format(time.RFC3339))
 
 	return &upstreamca.SubmitCSRResponse{
 		SignedCertificate: signedCert,
 	}, nil
 }
 
+// concatRaw concatenates DER bytes of the certificates into one slice, which is allocated once for the whole chain.
+func concatRaw(certs []*x509.Certificate) []byte {
+	size := 0
+	for _, c := range certs {
+		size += len(c.Raw)
+	}
+	raw := make([]byte, 0, size)
+	for _, c := range certs {
+		raw = append(raw, c.Raw...)
+	}
+	return raw
+}
+
 func (p *VaultPlugin) SetLogger(log hclog.Logger) {
 	p.logger = log
 }
@@ -243,6 +294,15 @@ func parseAuthMethod(config *VaultPluginConfig) (vault.AuthMethod, error) {
 func validatePluginConfig(c *VaultPluginConfig) []string {
 	var errs []string
 
+	if c.MaxChainLength < 0 {
+		errs = append(errs, "max_chain_length must not be negative")
+	}
+	if c.ClockSkew != "" {
+		if d, err := time.ParseDuration(c.ClockSkew); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("clock_skew must be a non-negative duration, but got %q", c.ClockSkew))
+		}
+	}
+
 	return errs
 }
 
@@ -10,9 +10,12 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"sync"
 	"testing"
 	"text/template"
 	"time"
@@ -220,6 +223,24 @@ func TestConfigureErrorInvalidTTL(t *testing.T) {
 	}
 }
 
+func TestConfigureErrorInvalidClockSkew(t *testing.T) {
+	req := &plugin.ConfigureRequest{
+		Configuration: `clock_skew = "-30s"`,
+	}
+
+	p := New()
+	p.logger = getTestLogger()
+	ctx := context.Background()
+	_, err := p.Configure(ctx, req)
+
+	wantErrPrefix := `clock_skew must be a non-negative duration, but got "-30s"`
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
 func TestConfigureError(t *testing.T) {
 	ctx := context.Background()
 	req := &plugin.ConfigureRequest{
@@ -311,6 +332,143 @@ func TestSubmitCSR(t *testing.T) {
 	}
 }
 
+func TestSubmitCSRWithCSRFormat(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	derReq, err := getFakeSubmitCSRRequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+
+	tCases := []struct {
+		name string
+		csr  []byte
+	}{
+		{name: "DER", csr: derReq.Csr},
+		{name: "PEM", csr: testCSR},
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.logger = getTestLogger()
+
+	ctx := context.Background()
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/token-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+	if _, err := p.Configure(ctx, req); err != nil {
+		t.Fatalf("error from Configure(): %v", err)
+	}
+
+	for _, tc := range tCases {
+		if _, err := p.SubmitCSR(ctx, &upstreamca.SubmitCSRRequest{Csr: tc.csr}); err != nil {
+			t.Errorf("%v: error from SubmitCSR(): %v", tc.name, err)
+		}
+
+		signReq := vc.LastSignIntermediateRequest()
+		if signReq == nil {
+			t.Fatalf("%v: sign-intermediate request is not recorded", tc.name)
+		}
+		csrPEM, _ := signReq.Body["csr"].(string)
+		if n := strings.Count(csrPEM, "-----BEGIN "); n != 1 {
+			t.Errorf("%v: csr has %d PEM blocks, want 1: %v", tc.name, n, csrPEM)
+		}
+		csr, err := pemutil.ParseCertificateRequest([]byte(csrPEM))
+		if err != nil {
+			t.Errorf("%v: csr in the request is malformed: %v", tc.name, err)
+		} else if !bytes.Equal(csr.Raw, derReq.Csr) {
+			t.Errorf("%v: csr in the request is different from the requested one", tc.name)
+		}
+	}
+}
+
+func TestSubmitCSRWithConcurrentConfigure(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.logger = getTestLogger()
+
+	ctx := context.Background()
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/token-auth-config.tpl")
+	if err != nil {
+		t.Errorf("failed to prepare request: %v", err)
+	}
+	if _, err := p.Configure(ctx, req); err != nil {
+		t.Fatalf("error from Configure(): %v", err)
+	}
+
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSRReq, err := getFakeSubmitCSRRequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+
+	// Configure swaps the client while SubmitCSR is in flight. The race detector reports unsafe access.
+	var wg sync.WaitGroup
+	errCh := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Configure(ctx, req); err != nil {
+				errCh <- fmt.Errorf("error from Configure(): %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := p.SubmitCSR(ctx, testCSRReq); err != nil {
+				errCh <- fmt.Errorf("error from SubmitCSR(): %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		t.Error(err)
+	}
+}
+
 func TestSubmitCSRError(t *testing.T) {
 	vc := fake.NewVaultServerConfig()
 
@@ -365,3 +523,390 @@ func TestSubmitCSRError(t *testing.T) {
 		t.Error("error is empty, want to get error")
 	}
 }
+
+func TestSubmitCSRErrorMismatchedChain(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-mismatch-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.logger = getTestLogger()
+	client, err := getFakeVaultClientWithCertAuth(addr, "test-auth", "test-pki")
+	if err != nil {
+		t.Error(err)
+	}
+	p.vc = client
+	p.config = &VaultPluginConfig{}
+
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	testCSRReq, err := getFakeSubmitCSRRequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+
+	ctx := context.Background()
+	_, err = p.SubmitCSR(ctx, testCSRReq)
+
+	wantErrPrefix := "SubmitCSR response is invalid: certificate does not chain to the CA certificates"
+	if err == nil {
+		t.Error("error is empty, want to get error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestSubmitCSRErrorChainTooLong(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-long-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.logger = getTestLogger()
+	client, err := getFakeVaultClientWithCertAuth(addr, "test-auth", "test-pki")
+	if err != nil {
+		t.Error(err)
+	}
+	p.vc = client
+	p.config = &VaultPluginConfig{}
+
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	testCSRReq, err := getFakeSubmitCSRRequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+
+	ctx := context.Background()
+	_, err = p.SubmitCSR(ctx, testCSRReq)
+
+	wantErrPrefix := "SubmitCSR response is invalid: CA chain has 11 certificates, exceeds max_chain_length 10"
+	if err == nil {
+		t.Error("error is empty, want to get error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestSubmitCSRErrorParse(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	invalidCertSignResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-invalid-cert-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	invalidCAChainSignResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-invalid-ca-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	testCSRReq, err := getFakeSubmitCSRRequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+
+	tCases := []struct {
+		name          string
+		csr           []byte
+		signResponse  []byte
+		wantErr       error
+		wantErrPrefix string
+	}{
+		{
+			name:          "CSR is not a certificate request",
+			csr:           []byte("-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"),
+			signResponse:  signResp,
+			wantErr:       common.ErrInvalidCSR,
+			wantErrPrefix: "SubmitCSR request is invalid: failed to encode CSR: unexpected PEM block type CERTIFICATE",
+		},
+		{
+			name:          "signed certificate is broken",
+			csr:           testCSRReq.Csr,
+			signResponse:  invalidCertSignResp,
+			wantErr:       vault.ErrInvalidCertificate,
+			wantErrPrefix: "SubmitCSR response is invalid: failed to parse signed certificate",
+		},
+		{
+			name:          "CA chain is broken",
+			csr:           testCSRReq.Csr,
+			signResponse:  invalidCAChainSignResp,
+			wantErr:       vault.ErrInvalidCAChain,
+			wantErrPrefix: "SubmitCSR response is invalid: failed to parse certificate #1 of CA chain",
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = fakeServerCert
+		vc.ServerKeyPemPath = fakeServerKey
+		vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+		vc.CertAuthResponseCode = 200
+		vc.CertAuthResponse = certAuthResp
+		vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = tc.signResponse
+		vc.RenewResponseCode = 200
+		vc.RenewResponse = renewResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		p := New()
+		p.logger = getTestLogger()
+		client, err := getFakeVaultClientWithCertAuth(addr, "test-auth", "test-pki")
+		if err != nil {
+			t.Error(err)
+		}
+		p.vc = client
+		p.config = &VaultPluginConfig{}
+
+		_, err = p.SubmitCSR(context.Background(), &upstreamca.SubmitCSRRequest{Csr: tc.csr})
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%v: got %v, want %v", tc.name, err, tc.wantErr)
+		} else if !strings.HasPrefix(err.Error(), tc.wantErrPrefix) {
+			t.Errorf("%v: got %v, want prefix %v", tc.name, err, tc.wantErrPrefix)
+		}
+
+		s.Close()
+	}
+}
+
+func TestSubmitCSRErrorNonCA(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+
+	certAuthResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-non-ca-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.CertAuthReqEndpoint = "/v1/auth/test-auth/login"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	p := New()
+	p.logger = getTestLogger()
+	client, err := getFakeVaultClientWithCertAuth(addr, "test-auth", "test-pki")
+	if err != nil {
+		t.Error(err)
+	}
+	p.vc = client
+	p.config = &VaultPluginConfig{}
+
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	testCSRReq, err := getFakeSubmitCSRRequest(testCSR)
+	if err != nil {
+		t.Errorf("failed to get fake CSR: %v", err)
+	}
+
+	ctx := context.Background()
+	_, err = p.SubmitCSR(ctx, testCSRReq)
+
+	wantErrPrefix := "SubmitCSR response is invalid: certificate is not a CA certificate"
+	if err == nil {
+		t.Error("error is empty, want to get error")
+	} else if !strings.HasPrefix(err.Error(), wantErrPrefix) {
+		t.Errorf("got %v, want prefix %v", err, wantErrPrefix)
+	}
+}
+
+func TestConcatRaw(t *testing.T) {
+	certs, err := loadBenchmarkChain()
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+
+	var want []byte
+	for _, c := range certs {
+		want = append(want, c.Raw...)
+	}
+	got := concatRaw(certs)
+	if !bytes.Equal(got, want) {
+		t.Error("concatenated bytes are different from the certificates")
+	}
+	if cap(got) != len(got) {
+		t.Errorf("got capacity %v, want %v", cap(got), len(got))
+	}
+}
+
+// BenchmarkConcatRaw measures building the bundle of a large chain, which is allocated once for the chain.
+func BenchmarkConcatRaw(b *testing.B) {
+	certs, err := loadBenchmarkChain()
+	if err != nil {
+		b.Fatalf("failed to load fixture: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		concatRaw(certs)
+	}
+}
+
+// BenchmarkSubmitCSR measures a whole mint including the request to the fake Vault server.
+func BenchmarkSubmitCSR(b *testing.B) {
+	signResp, err := ioutil.ReadFile("../../../pkg/fake/_test_data/sign-intermediate-overlapping-response.json")
+	if err != nil {
+		b.Fatalf("failed to load fixture: %v", err)
+	}
+	testCSR, err := ioutil.ReadFile("../../../pkg/fake/_test_data/test-req.csr")
+	if err != nil {
+		b.Fatalf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = fakeServerCert
+	vc.ServerKeyPemPath = fakeServerKey
+	vc.SignIntermediateReqEndpoint = "/v1/test-pki/root/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		b.Fatalf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	req, err := getFakeConfigureRequest(fmt.Sprintf("https://%v/", addr), "./_test_data/token-auth-config.tpl")
+	if err != nil {
+		b.Fatalf("failed to prepare request: %v", err)
+	}
+	p := New()
+	p.logger = getTestLogger()
+	if _, err := p.Configure(context.Background(), req); err != nil {
+		b.Fatalf("error from Configure(): %v", err)
+	}
+	csrReq, err := getFakeSubmitCSRRequest(testCSR)
+	if err != nil {
+		b.Fatalf("failed to get fake CSR: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.SubmitCSR(context.Background(), csrReq); err != nil {
+			b.Fatalf("error from SubmitCSR(): %v", err)
+		}
+	}
+}
+
+// loadBenchmarkChain returns a chain of 20 certificates made of the CA certificates in the fixtures.
+func loadBenchmarkChain() ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for i := 0; i < 4; i++ {
+		for _, name := range []string{"ca.pem", "intermediate-ca.pem", "sub-intermediate-ca.pem", "client-root-ca.pem", "client-intermediate-ca.pem"} {
+			cert, err := pemutil.LoadCertificate("../../../pkg/fake/_test_data/" + name)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
@@ -0,0 +1,33 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package common
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// SerialNumber returns the serial number of the certificate in colon separated hex, which is the form Vault shows.
+func SerialNumber(cert *x509.Certificate) string {
+	return colonHex(cert.SerialNumber.Bytes())
+}
+
+// AuthorityKeyID returns the authority key identifier of the certificate in colon separated hex,
+// or empty if the certificate doesn't have it.
+func AuthorityKeyID(cert *x509.Certificate) string {
+	return colonHex(cert.AuthorityKeyId)
+}
+
+func colonHex(b []byte) string {
+	hex := make([]string, len(b))
+	for i, v := range b {
+		hex[i] = fmt.Sprintf("%02x", v)
+	}
+	return strings.Join(hex, ":")
+}
@@ -0,0 +1,48 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package common
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+)
+
+func TestSerialNumber(t *testing.T) {
+	tCases := []struct {
+		name   string
+		serial *big.Int
+		want   string
+	}{
+		{name: "one byte", serial: big.NewInt(0x1f), want: "1f"},
+		{name: "leading zero in a byte", serial: big.NewInt(0x010a), want: "01:0a"},
+	}
+
+	for _, c := range tCases {
+		if got := SerialNumber(&x509.Certificate{SerialNumber: c.serial}); got != c.want {
+			t.Errorf("%v: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestAuthorityKeyID(t *testing.T) {
+	tCases := []struct {
+		name string
+		aki  []byte
+		want string
+	}{
+		{name: "empty", want: ""},
+		{name: "key ID", aki: []byte{0x17, 0xd7, 0xd8, 0x8d}, want: "17:d7:d8:8d"},
+	}
+
+	for _, c := range tCases {
+		if got := AuthorityKeyID(&x509.Certificate{AuthorityKeyId: c.aki}); got != c.want {
+			t.Errorf("%v: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
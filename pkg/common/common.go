@@ -3,3 +3,7 @@ package common
 const (
 	PluginName = "vault"
 )
+
+// Version is the version of the plugin.
+// It is overridden at build time. (e.g., -ldflags "-X github.com/zlabjp/spire-vault-plugin/pkg/common.Version=v0.3.0")
+var Version = "dev"
@@ -0,0 +1,41 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package common
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+var pemPrefix = []byte("-----BEGIN ")
+
+// ErrInvalidCSR is wrapped by errors caused by the CSR from SPIRE server.
+var ErrInvalidCSR = errors.New("failed to encode CSR")
+
+// EncodeCSRPEM returns the CSR in PEM format.
+// The CSR from SPIRE server is DER format, but it is returned as is if it is already PEM format.
+// The returned error wraps ErrInvalidCSR.
+func EncodeCSRPEM(csr []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(csr)
+	if !bytes.HasPrefix(trimmed, pemPrefix) {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}), nil
+	}
+
+	block, _ := pem.Decode(trimmed)
+	if block == nil {
+		return nil, fmt.Errorf("%w: failed to decode PEM data", ErrInvalidCSR)
+	}
+	switch block.Type {
+	case "CERTIFICATE REQUEST", "NEW CERTIFICATE REQUEST":
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: block.Bytes}), nil
+	default:
+		return nil, fmt.Errorf("%w: unexpected PEM block type %v", ErrInvalidCSR, block.Type)
+	}
+}
@@ -0,0 +1,56 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package common
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEncodeCSRPEM(t *testing.T) {
+	csrPEM, err := ioutil.ReadFile("../fake/_test_data/test-req.csr")
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+	block, _ := pem.Decode(csrPEM)
+	if block == nil {
+		t.Fatal("failed to decode fixture")
+	}
+	want := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: block.Bytes})
+
+	tCases := []struct {
+		name    string
+		csr     []byte
+		wantErr bool
+	}{
+		{name: "DER", csr: block.Bytes},
+		{name: "PEM", csr: csrPEM},
+		{name: "PEM with leading spaces", csr: append([]byte("\n  "), csrPEM...)},
+		{name: "legacy PEM type", csr: pem.EncodeToMemory(&pem.Block{Type: "NEW CERTIFICATE REQUEST", Bytes: block.Bytes})},
+		{name: "unexpected PEM type", csr: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: block.Bytes}), wantErr: true},
+		{name: "broken PEM", csr: []byte("-----BEGIN CERTIFICATE REQUEST-----\nAAAA"), wantErr: true},
+	}
+
+	for _, c := range tCases {
+		got, err := EncodeCSRPEM(c.csr)
+		if c.wantErr {
+			if !errors.Is(err, ErrInvalidCSR) {
+				t.Errorf("%v: got %v, want %v", c.name, err, ErrInvalidCSR)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", c.name, err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%v: got %s, want %s", c.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package common
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var vaultDurationUnit = regexp.MustCompile(`([0-9]*\.?[0-9]+)([dw])`)
+
+// ParseDuration parses a duration string like time.ParseDuration,
+// and also accepts "d" (day) and "w" (week) units as Vault does. (e.g., 30d, 2w, 1w2d12h)
+func ParseDuration(s string) (time.Duration, error) {
+	normalized := vaultDurationUnit.ReplaceAllStringFunc(s, func(m string) string {
+		sub := vaultDurationUnit.FindStringSubmatch(m)
+		v, err := strconv.ParseFloat(sub[1], 64)
+		if err != nil {
+			return m
+		}
+		hours := 24.0
+		if sub[2] == "w" {
+			hours = 24.0 * 7
+		}
+		return strconv.FormatFloat(v*hours, 'f', -1, 64) + "h"
+	})
+	return time.ParseDuration(normalized)
+}
@@ -0,0 +1,45 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tCases := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{value: "1h", expected: time.Hour},
+		{value: "30d", expected: 30 * 24 * time.Hour},
+		{value: "2w", expected: 14 * 24 * time.Hour},
+		{value: "1w2d12h", expected: 9*24*time.Hour + 12*time.Hour},
+		{value: "1.5d", expected: 36 * time.Hour},
+	}
+
+	for i, c := range tCases {
+		got, err := ParseDuration(c.value)
+		if err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+			continue
+		}
+		if got != c.expected {
+			t.Errorf("#%v: got %v, want %v", i, got, c.expected)
+		}
+	}
+}
+
+func TestParseDurationError(t *testing.T) {
+	for i, v := range []string{"600", "30x", "d", ""} {
+		if _, err := ParseDuration(v); err == nil {
+			t.Errorf("#%v: expected error for %q", i, v)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const envVarPrefix = "${env."
+
+// ExpandEnv replaces ${env.NAME} in the configuration with the value of the environment variable NAME.
+// "$$" is an escape of a literal "$" (e.g., "$${env.NAME}" is expanded to "${env.NAME}").
+// It returns an error if the variable is not defined.
+func ExpandEnv(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		switch {
+		case strings.HasPrefix(s[i:], "$$"):
+			b.WriteByte('$')
+			i += 2
+		case strings.HasPrefix(s[i:], envVarPrefix):
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated environment variable reference at offset %d", i)
+			}
+			name := s[i+len(envVarPrefix) : i+end]
+			if name == "" {
+				return "", fmt.Errorf("empty environment variable reference at offset %d", i)
+			}
+			v, ok := os.LookupEnv(name)
+			if !ok {
+				return "", fmt.Errorf("environment variable %q is not defined", name)
+			}
+			b.WriteString(v)
+			i += end + 1
+		default:
+			b.WriteByte(s[i])
+			i++
+		}
+	}
+	return b.String(), nil
+}
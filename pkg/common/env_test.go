@@ -0,0 +1,50 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package common
+
+import (
+	"os"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("SPIRE_VAULT_PLUGIN_TEST_ADDR", "https://vault.example.org/")
+	os.Setenv("SPIRE_VAULT_PLUGIN_TEST_EMPTY", "")
+	defer os.Unsetenv("SPIRE_VAULT_PLUGIN_TEST_ADDR")
+	defer os.Unsetenv("SPIRE_VAULT_PLUGIN_TEST_EMPTY")
+
+	tCases := []struct {
+		value    string
+		expected string
+		wantErr  bool
+	}{
+		{value: `vault_addr = "${env.SPIRE_VAULT_PLUGIN_TEST_ADDR}"`, expected: `vault_addr = "https://vault.example.org/"`},
+		{value: `token = "${env.SPIRE_VAULT_PLUGIN_TEST_EMPTY}"`, expected: `token = ""`},
+		{value: `token = "$${env.SPIRE_VAULT_PLUGIN_TEST_ADDR}"`, expected: `token = "${env.SPIRE_VAULT_PLUGIN_TEST_ADDR}"`},
+		{value: `token = "a$b$$c"`, expected: `token = "a$b$c"`},
+		{value: `token = "${VAULT_TOKEN}"`, expected: `token = "${VAULT_TOKEN}"`},
+		{value: `token = "${env.SPIRE_VAULT_PLUGIN_TEST_UNDEFINED}"`, wantErr: true},
+		{value: `token = "${env.SPIRE_VAULT_PLUGIN_TEST_ADDR"`, wantErr: true},
+		{value: `token = "${env.}"`, wantErr: true},
+	}
+
+	for i, c := range tCases {
+		got, err := ExpandEnv(c.value)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("#%v: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+		} else if got != c.expected {
+			t.Errorf("#%v: got %v, want %v", i, got, c.expected)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package common
+
+import (
+	"github.com/hashicorp/go-hclog"
+)
+
+// levelLogger drops messages below the level before passing them to the wrapped logger.
+type levelLogger struct {
+	hclog.Logger
+	level hclog.Level
+}
+
+// NewLevelLogger returns a logger that logs messages at the given level or above.
+// Messages are still filtered by the level of the given logger, so the level of the given logger
+// must be raised with SetLevel to log more verbose messages than it does.
+func NewLevelLogger(logger hclog.Logger, level hclog.Level) hclog.Logger {
+	if l, ok := logger.(*levelLogger); ok {
+		logger = l.Logger
+	}
+	return &levelLogger{
+		Logger: logger,
+		level:  level,
+	}
+}
+
+func (l *levelLogger) Trace(msg string, args ...interface{}) {
+	if l.IsTrace() {
+		l.Logger.Trace(msg, args...)
+	}
+}
+
+func (l *levelLogger) Debug(msg string, args ...interface{}) {
+	if l.IsDebug() {
+		l.Logger.Debug(msg, args...)
+	}
+}
+
+func (l *levelLogger) Info(msg string, args ...interface{}) {
+	if l.IsInfo() {
+		l.Logger.Info(msg, args...)
+	}
+}
+
+func (l *levelLogger) Warn(msg string, args ...interface{}) {
+	if l.IsWarn() {
+		l.Logger.Warn(msg, args...)
+	}
+}
+
+func (l *levelLogger) Error(msg string, args ...interface{}) {
+	if l.IsError() {
+		l.Logger.Error(msg, args...)
+	}
+}
+
+func (l *levelLogger) IsTrace() bool {
+	return l.level <= hclog.Trace && l.Logger.IsTrace()
+}
+
+func (l *levelLogger) IsDebug() bool {
+	return l.level <= hclog.Debug && l.Logger.IsDebug()
+}
+
+func (l *levelLogger) IsInfo() bool {
+	return l.level <= hclog.Info && l.Logger.IsInfo()
+}
+
+func (l *levelLogger) IsWarn() bool {
+	return l.level <= hclog.Warn && l.Logger.IsWarn()
+}
+
+func (l *levelLogger) IsError() bool {
+	return l.level <= hclog.Error && l.Logger.IsError()
+}
+
+func (l *levelLogger) With(args ...interface{}) hclog.Logger {
+	return &levelLogger{Logger: l.Logger.With(args...), level: l.level}
+}
+
+func (l *levelLogger) Named(name string) hclog.Logger {
+	return &levelLogger{Logger: l.Logger.Named(name), level: l.level}
+}
+
+func (l *levelLogger) ResetNamed(name string) hclog.Logger {
+	return &levelLogger{Logger: l.Logger.ResetNamed(name), level: l.level}
+}
+
+func (l *levelLogger) SetLevel(level hclog.Level) {
+	l.level = level
+}
+
+// LoggerLevel returns the most verbose level at which the logger logs messages, or hclog.NoLevel if it logs nothing.
+func LoggerLevel(logger hclog.Logger) hclog.Level {
+	for _, l := range []struct {
+		level   hclog.Level
+		enabled func() bool
+	}{
+		{hclog.Trace, logger.IsTrace},
+		{hclog.Debug, logger.IsDebug},
+		{hclog.Info, logger.IsInfo},
+		{hclog.Warn, logger.IsWarn},
+		{hclog.Error, logger.IsError},
+	} {
+		if l.enabled() {
+			return l.level
+		}
+	}
+	return hclog.NoLevel
+}
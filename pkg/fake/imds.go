@@ -0,0 +1,127 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package fake
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+const (
+	defaultIMDSAWSToken      = "fake-imds-token"
+	defaultIMDSAWSPKCS7      = "ZmFrZS1wa2NzNy1zaWduYXR1cmUt\nb2YtaW5zdGFuY2UtaWRlbnRpdHk=\n"
+	defaultIMDSGCPToken      = "fake-gcp-identity-token"
+	defaultIMDSAzureToken    = "fake-azure-access-token"
+	defaultAzureSubscription = "test-subscription"
+	defaultAzureGroup        = "test-group"
+	defaultAzureVM           = "test-vm"
+)
+
+// IMDSServerConfig is a configuration of a fake server that serves the instance metadata services
+// of AWS (IMDSv2), GCP and Azure, which the auth methods of the clouds read their credentials from.
+type IMDSServerConfig struct {
+	// AWSPKCS7 is the PKCS#7 signature of the instance identity document, with newlines as EC2 returns it.
+	AWSPKCS7 string
+	// GCPToken is the identity token of the service account.
+	GCPToken string
+	// AzureToken is the access token of the managed identity.
+	AzureToken string
+	// Metadata of the Azure VM.
+	AzureSubscriptionID    string
+	AzureResourceGroupName string
+	AzureVMName            string
+	AzureVMScaleSetName    string
+	// Delay delays each response.
+	Delay time.Duration
+
+	mu sync.Mutex
+	// lastQuery is the query of the last request to the identity endpoints of GCP and Azure.
+	lastQuery map[string]string
+}
+
+// NewIMDSServerConfig returns IMDSServerConfig with default values
+func NewIMDSServerConfig() *IMDSServerConfig {
+	return &IMDSServerConfig{
+		AWSPKCS7:               defaultIMDSAWSPKCS7,
+		GCPToken:               defaultIMDSGCPToken,
+		AzureToken:             defaultIMDSAzureToken,
+		AzureSubscriptionID:    defaultAzureSubscription,
+		AzureResourceGroupName: defaultAzureGroup,
+		AzureVMName:            defaultAzureVM,
+		lastQuery:              make(map[string]string),
+	}
+}
+
+// NewServer returns a new fake IMDS server (plain HTTP).
+// The paths of the clouds don't conflict, so one server serves all of them.
+func (c *IMDSServerConfig) NewServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest/api/token", c.handler(http.MethodPut, "X-aws-ec2-metadata-token-ttl-seconds", "", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, defaultIMDSAWSToken)
+	}))
+	mux.HandleFunc("/latest/dynamic/instance-identity/pkcs7", c.handler(http.MethodGet, "X-aws-ec2-metadata-token", defaultIMDSAWSToken, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, c.AWSPKCS7)
+	}))
+	mux.HandleFunc("/computeMetadata/v1/instance/service-accounts/", c.handler(http.MethodGet, "Metadata-Flavor", "Google", func(w http.ResponseWriter, r *http.Request) {
+		c.record("gcp_path", r.URL.Path)
+		c.record("gcp_audience", r.URL.Query().Get("audience"))
+		c.record("gcp_format", r.URL.Query().Get("format"))
+		fmt.Fprint(w, c.GCPToken)
+	}))
+	mux.HandleFunc("/metadata/identity/oauth2/token", c.handler(http.MethodGet, "Metadata", "true", func(w http.ResponseWriter, r *http.Request) {
+		c.record("azure_resource", r.URL.Query().Get("resource"))
+		fmt.Fprintf(w, `{"access_token": %q, "token_type": "Bearer"}`, c.AzureToken)
+	}))
+	mux.HandleFunc("/metadata/instance", c.handler(http.MethodGet, "Metadata", "true", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"compute": {"subscriptionId": %q, "resourceGroupName": %q, "name": %q, "vmScaleSetName": %q}}`,
+			c.AzureSubscriptionID, c.AzureResourceGroupName, c.AzureVMName, c.AzureVMScaleSetName)
+	}))
+
+	return httptest.NewServer(mux)
+}
+
+// LastQuery returns the value recorded by the last request to the identity endpoints of GCP and Azure.
+// (gcp_path, gcp_audience, gcp_format or azure_resource)
+func (c *IMDSServerConfig) LastQuery(key string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastQuery[key]
+}
+
+func (c *IMDSServerConfig) record(key, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastQuery[key] = value
+}
+
+// handler rejects the requests without the header, which the metadata services require.
+// If value is empty, the header only has to be present.
+func (c *IMDSServerConfig) handler(method, header, value string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if got := r.Header.Get(header); got == "" || (value != "" && got != value) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if c.Delay > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(c.Delay):
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		next(w, r)
+	}
+}
@@ -0,0 +1,98 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package fake
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+const (
+	defaultOCIRegion = "us-phoenix-1"
+	defaultOCIToken  = "fake-security-token"
+
+	ociMetadataPrefix  = "/opc/v2"
+	ociFederationPath  = "/v1/x509"
+	ociMetadataAuthHdr = "Bearer Oracle"
+)
+
+// OCIServerConfig is a configuration of a fake server that serves
+// OCI instance metadata service and the federation endpoint of instance principal.
+type OCIServerConfig struct {
+	InstanceCertPemPath    string
+	InstanceKeyPemPath     string
+	IntermediatePemPath    string
+	Region                 string
+	FederationResponseCode int
+	Token                  string
+	// MetadataDelay delays each response of the instance metadata service.
+	MetadataDelay time.Duration
+}
+
+// NewOCIServerConfig returns OCIServerConfig with default values
+func NewOCIServerConfig() *OCIServerConfig {
+	return &OCIServerConfig{
+		Region:                 defaultOCIRegion,
+		FederationResponseCode: http.StatusOK,
+		Token:                  defaultOCIToken,
+	}
+}
+
+// NewServer returns a new fake OCI server (plain HTTP).
+// The metadata endpoint is <URL>/opc/v2 and the federation endpoint is <URL>/v1/x509.
+func (o *OCIServerConfig) NewServer() (*httptest.Server, error) {
+	cert, err := ioutil.ReadFile(o.InstanceCertPemPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load instance certificate: %v", err)
+	}
+	key, err := ioutil.ReadFile(o.InstanceKeyPemPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load instance key: %v", err)
+	}
+	intermediate, err := ioutil.ReadFile(o.IntermediatePemPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load intermediate certificate: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(ociMetadataPrefix+"/identity/cert.pem", o.ociMetadataHandler(cert))
+	mux.HandleFunc(ociMetadataPrefix+"/identity/key.pem", o.ociMetadataHandler(key))
+	mux.HandleFunc(ociMetadataPrefix+"/identity/intermediate.pem", o.ociMetadataHandler(intermediate))
+	mux.HandleFunc(ociMetadataPrefix+"/instance/canonicalRegionName", o.ociMetadataHandler([]byte(o.Region)))
+	mux.HandleFunc(ociFederationPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(o.FederationResponseCode)
+		fmt.Fprintf(w, `{"token": %q}`, o.Token)
+	})
+
+	return httptest.NewServer(mux), nil
+}
+
+func (o *OCIServerConfig) ociMetadataHandler(resp []byte) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != ociMetadataAuthHdr {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if o.MetadataDelay > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(o.MetadataDelay):
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(resp)
+	}
+}
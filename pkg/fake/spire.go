@@ -8,6 +8,9 @@
 package fake
 
 import (
+	"context"
+	"sync"
+
 	"github.com/spiffe/spire/proto/spire/server/upstreamauthority"
 	"google.golang.org/grpc"
 )
@@ -16,8 +19,30 @@ type UpstreamAuthorityMintX509CAServer struct {
 	grpc.ServerStream
 
 	WantError error
+	// Ctx is returned from Context(). If the value is nil, context.Background() is returned.
+	Ctx context.Context
+
+	mu        sync.Mutex
+	responses []*upstreamauthority.MintX509CAResponse
+}
+
+func (s *UpstreamAuthorityMintX509CAServer) Context() context.Context {
+	if s.Ctx != nil {
+		return s.Ctx
+	}
+	return context.Background()
 }
 
 func (s *UpstreamAuthorityMintX509CAServer) Send(response *upstreamauthority.MintX509CAResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses = append(s.responses, response)
 	return s.WantError
 }
+
+// Responses returns the responses sent to the stream in order.
+func (s *UpstreamAuthorityMintX509CAServer) Responses() []*upstreamauthority.MintX509CAResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*upstreamauthority.MintX509CAResponse(nil), s.responses...)
+}
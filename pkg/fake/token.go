@@ -0,0 +1,112 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package fake
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// tokenResponseWriter captures the status code and the body written by the handler.
+type tokenResponseWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (w *tokenResponseWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *tokenResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// issueToken wraps the login handler to accept the token in the successful response for TokenTTL.
+func (v *VaultServerConfig) issueToken(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if v.TokenTTL <= 0 {
+			next(w, r)
+			return
+		}
+		tw := &tokenResponseWriter{ResponseWriter: w}
+		next(tw, r)
+		if tw.code < 200 || tw.code >= 300 {
+			return
+		}
+		var resp struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		if err := json.Unmarshal(tw.body.Bytes(), &resp); err != nil || resp.Auth.ClientToken == "" {
+			return
+		}
+		v.setTokenExpiry(resp.Auth.ClientToken)
+	}
+}
+
+// extendToken wraps the renew handler to extend the token for TokenTTL if it is not expired yet.
+func (v *VaultServerConfig) extendToken(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return v.requireToken(func(w http.ResponseWriter, r *http.Request) {
+		if v.TokenTTL <= 0 {
+			next(w, r)
+			return
+		}
+		tw := &tokenResponseWriter{ResponseWriter: w}
+		next(tw, r)
+		if tw.code >= 200 && tw.code < 300 {
+			v.setTokenExpiry(r.Header.Get("X-Vault-Token"))
+		}
+	})
+}
+
+// requireToken wraps the handler to respond 403 unless the token is issued and not expired yet.
+func (v *VaultServerConfig) requireToken(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if v.TokenTTL > 0 && !v.isTokenValid(r.Header.Get("X-Vault-Token")) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors":["permission denied"]}`)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (v *VaultServerConfig) setTokenExpiry(token string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.tokens == nil {
+		v.tokens = make(map[string]time.Time)
+	}
+	v.tokens[token] = time.Now().Add(v.TokenTTL)
+}
+
+func (v *VaultServerConfig) isTokenValid(token string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	expiresAt, ok := v.tokens[token]
+	return ok && time.Now().Before(expiresAt)
+}
+
+// ExpireTokens expires all tokens issued so far, as if TokenTTL has passed.
+func (v *VaultServerConfig) ExpireTokens() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for token := range v.tokens {
+		v.tokens[token] = time.Time{}
+	}
+}
@@ -8,17 +8,42 @@
 package fake
 
 import (
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
 )
 
 const (
 	defaultCertAuthEndpoint         = "/v1/auth/cert/login"
 	defaultAppRoleAuthEndpoint      = "/v1/auth/approle/login"
+	defaultAliCloudAuthEndpoint     = "/v1/auth/alicloud/login"
+	defaultOCIAuthEndpoint          = "/v1/auth/oci/login/"
+	defaultCFAuthEndpoint           = "/v1/auth/cf/login"
+	defaultRADIUSAuthEndpoint       = "/v1/auth/radius/login/"
+	defaultJWTAuthEndpoint          = "/v1/auth/jwt/login"
+	defaultKerberosAuthEndpoint     = "/v1/auth/kerberos/login"
+	defaultAWSAuthEndpoint          = "/v1/auth/aws/login"
+	defaultGCPAuthEndpoint          = "/v1/auth/gcp/login"
+	defaultAzureAuthEndpoint        = "/v1/auth/azure/login"
 	defaultSignIntermediateEndpoint = "/v1/pki/root/sign-intermediate"
 	defaultRenewEndpoint            = "/v1/auth/token/renew-self"
+	defaultRevokeEndpoint           = "/v1/auth/token/revoke-self"
+	defaultTokenCreateEndpoint      = "/v1/auth/token/create"
+	defaultTokenLookupEndpoint      = "/v1/auth/token/lookup-self"
+	defaultKVEndpoint               = "/v1/secret/data/approle"
+	defaultHealthEndpoint           = "/v1/sys/health"
+	defaultCAChainEndpoint          = "/v1/pki/cert/ca_chain"
+	defaultMountEndpoint            = "/v1/sys/internal/ui/mounts/"
 
 	listenAddr = "127.0.0.1:0"
 )
@@ -27,6 +52,7 @@ type VaultServerConfig struct {
 	ListenAddr                   string
 	ServerCertificatePemPath     string
 	ServerKeyPemPath             string
+	ClientCAPemPath              string
 	CertAuthReqEndpoint          string
 	CertAuthReqHandler           func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
 	CertAuthResponseCode         int
@@ -35,6 +61,42 @@ type VaultServerConfig struct {
 	AppRoleAuthReqHandler        func(code int, resp []byte) func(w http.ResponseWriter, r *http.Request)
 	AppRoleAuthResponseCode      int
 	AppRoleAuthResponse          []byte
+	AliCloudAuthReqEndpoint      string
+	AliCloudAuthReqHandler       func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
+	AliCloudAuthResponseCode     int
+	AliCloudAuthResponse         []byte
+	OCIAuthReqEndpoint           string
+	OCIAuthReqHandler            func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
+	OCIAuthResponseCode          int
+	OCIAuthResponse              []byte
+	CFAuthReqEndpoint            string
+	CFAuthReqHandler             func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
+	CFAuthResponseCode           int
+	CFAuthResponse               []byte
+	RADIUSAuthReqEndpoint        string
+	RADIUSAuthReqHandler         func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
+	RADIUSAuthResponseCode       int
+	RADIUSAuthResponse           []byte
+	JWTAuthReqEndpoint           string
+	JWTAuthReqHandler            func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
+	JWTAuthResponseCode          int
+	JWTAuthResponse              []byte
+	KerberosAuthReqEndpoint      string
+	KerberosAuthReqHandler       func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
+	KerberosAuthResponseCode     int
+	KerberosAuthResponse         []byte
+	AWSAuthReqEndpoint           string
+	AWSAuthReqHandler            func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
+	AWSAuthResponseCode          int
+	AWSAuthResponse              []byte
+	GCPAuthReqEndpoint           string
+	GCPAuthReqHandler            func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
+	GCPAuthResponseCode          int
+	GCPAuthResponse              []byte
+	AzureAuthReqEndpoint         string
+	AzureAuthReqHandler          func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
+	AzureAuthResponseCode        int
+	AzureAuthResponse            []byte
 	SignIntermediateReqEndpoint  string
 	SignIntermediateReqHandler   func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
 	SignIntermediateResponseCode int
@@ -43,8 +105,83 @@ type VaultServerConfig struct {
 	RenewReqHandler              func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
 	RenewResponseCode            int
 	RenewResponse                []byte
+	RevokeReqEndpoint            string
+	RevokeReqHandler             func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
+	RevokeResponseCode           int
+	RevokeResponse               []byte
+	TokenCreateReqEndpoint       string
+	TokenCreateReqHandler        func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
+	TokenCreateResponseCode      int
+	TokenCreateResponse          []byte
+	TokenLookupReqEndpoint       string
+	TokenLookupReqHandler        func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
+	TokenLookupResponseCode      int
+	TokenLookupResponse          []byte
+	KVReqEndpoint                string
+	KVReqHandler                 func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
+	KVResponseCode               int
+	KVResponse                   []byte
+	HealthReqEndpoint            string
+	HealthReqHandler             func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
+	HealthResponseCode           int
+	HealthResponse               []byte
+	CAChainReqEndpoint           string
+	CAChainReqHandler            func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
+	CAChainResponseCode          int
+	CAChainResponse              []byte
+	MountReqEndpoint             string
+	MountReqHandler              func(code int, resp []byte) func(http.ResponseWriter, *http.Request)
+	MountResponseCode            int
+	MountResponse                []byte
+	// TokenTTL enables the token lifecycle if it's positive. A token issued by a login is accepted
+	// only for TokenTTL, and a renew extends it. Once expired, sign and renew requests with the token
+	// return 403 until a login issues it again.
+	TokenTTL time.Duration
+	// CipherSuites restricts the cipher suites the server accepts if it's not empty.
+	// The server also limits the TLS version to 1.2, since cipher suites of TLS 1.3 can't be configured.
+	CipherSuites []uint16
+
+	mu           sync.Mutex
+	lastRequests map[string]*Request
+	tokens       map[string]time.Time
+}
+
+// Request is a request that the fake server received.
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	// PeerCertificates is the certificate chain presented by the client, or nil if none.
+	PeerCertificates []*x509.Certificate
+	// Body is the decoded JSON body. It is nil if the body is empty or not JSON.
+	Body map[string]interface{}
+	// Form is the decoded body if it is form-encoded, otherwise nil.
+	Form url.Values
 }
 
+const (
+	certAuthRequest         = "cert-auth"
+	appRoleAuthRequest      = "approle-auth"
+	aliCloudAuthRequest     = "alicloud-auth"
+	ociAuthRequest          = "oci-auth"
+	cfAuthRequest           = "cf-auth"
+	radiusAuthRequest       = "radius-auth"
+	jwtAuthRequest          = "jwt-auth"
+	kerberosAuthRequest     = "kerberos-auth"
+	awsAuthRequest          = "aws-auth"
+	gcpAuthRequest          = "gcp-auth"
+	azureAuthRequest        = "azure-auth"
+	signIntermediateRequest = "sign-intermediate"
+	renewRequest            = "renew"
+	revokeRequest           = "revoke"
+	tokenCreateRequest      = "token-create"
+	tokenLookupRequest      = "token-lookup"
+	kvRequest               = "kv"
+	healthRequest           = "health"
+	caChainRequest          = "ca-chain"
+	mountRequest            = "mount"
+)
+
 // NewVaultServerConfig returns VaultServerConfig with default values
 func NewVaultServerConfig() *VaultServerConfig {
 	return &VaultServerConfig{
@@ -53,10 +190,42 @@ func NewVaultServerConfig() *VaultServerConfig {
 		CertAuthReqHandler:          defaultReqHandler,
 		AppRoleAuthReqEndpoint:      defaultAppRoleAuthEndpoint,
 		AppRoleAuthReqHandler:       defaultReqHandler,
+		AliCloudAuthReqEndpoint:     defaultAliCloudAuthEndpoint,
+		AliCloudAuthReqHandler:      defaultReqHandler,
+		OCIAuthReqEndpoint:          defaultOCIAuthEndpoint,
+		OCIAuthReqHandler:           defaultReqHandler,
+		CFAuthReqEndpoint:           defaultCFAuthEndpoint,
+		CFAuthReqHandler:            defaultReqHandler,
+		RADIUSAuthReqEndpoint:       defaultRADIUSAuthEndpoint,
+		RADIUSAuthReqHandler:        defaultReqHandler,
+		JWTAuthReqEndpoint:          defaultJWTAuthEndpoint,
+		JWTAuthReqHandler:           defaultReqHandler,
+		KerberosAuthReqEndpoint:     defaultKerberosAuthEndpoint,
+		KerberosAuthReqHandler:      defaultReqHandler,
+		AWSAuthReqEndpoint:          defaultAWSAuthEndpoint,
+		AWSAuthReqHandler:           defaultReqHandler,
+		GCPAuthReqEndpoint:          defaultGCPAuthEndpoint,
+		GCPAuthReqHandler:           defaultReqHandler,
+		AzureAuthReqEndpoint:        defaultAzureAuthEndpoint,
+		AzureAuthReqHandler:         defaultReqHandler,
 		SignIntermediateReqEndpoint: defaultSignIntermediateEndpoint,
 		SignIntermediateReqHandler:  defaultReqHandler,
 		RenewReqEndpoint:            defaultRenewEndpoint,
 		RenewReqHandler:             defaultReqHandler,
+		RevokeReqEndpoint:           defaultRevokeEndpoint,
+		RevokeReqHandler:            defaultReqHandler,
+		TokenCreateReqEndpoint:      defaultTokenCreateEndpoint,
+		TokenCreateReqHandler:       defaultReqHandler,
+		TokenLookupReqEndpoint:      defaultTokenLookupEndpoint,
+		TokenLookupReqHandler:       defaultReqHandler,
+		KVReqEndpoint:               defaultKVEndpoint,
+		KVReqHandler:                defaultReqHandler,
+		HealthReqEndpoint:           defaultHealthEndpoint,
+		HealthReqHandler:            defaultReqHandler,
+		CAChainReqEndpoint:          defaultCAChainEndpoint,
+		CAChainReqHandler:           defaultReqHandler,
+		MountReqEndpoint:            defaultMountEndpoint,
+		MountReqHandler:             defaultReqHandler,
 	}
 }
 
@@ -75,19 +244,210 @@ func (v *VaultServerConfig) NewTLSServer() (srv *httptest.Server, addr string, e
 	config := &tls.Config{
 		Certificates: []tls.Certificate{cert},
 	}
+	if len(v.CipherSuites) != 0 {
+		config.CipherSuites = v.CipherSuites
+		config.MaxVersion = tls.VersionTLS12
+	}
+	if v.ClientCAPemPath != "" {
+		b, err := ioutil.ReadFile(v.ClientCAPemPath)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to load client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, "", errors.New("failed to parse client CA")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
 
 	l, err := tls.Listen("tcp", v.ListenAddr, config)
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to listen test server: %v", err)
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc(v.CertAuthReqEndpoint, v.CertAuthReqHandler(v.CertAuthResponseCode, v.CertAuthResponse))
-	mux.HandleFunc(v.AppRoleAuthReqEndpoint, v.AppRoleAuthReqHandler(v.AppRoleAuthResponseCode, v.AppRoleAuthResponse))
-	mux.HandleFunc(v.SignIntermediateReqEndpoint, v.SignIntermediateReqHandler(v.SignIntermediateResponseCode, v.SignIntermediateResponse))
-	mux.HandleFunc(v.RenewReqEndpoint, v.RenewReqHandler(v.RenewResponseCode, v.RenewResponse))
+	srv = httptest.NewUnstartedServer(v.newMux())
+	srv.Listener = l
+	return srv, l.Addr().String(), nil
+}
+
+// NewServer returns a new fake server which listens on plain HTTP.
+func (v *VaultServerConfig) NewServer() (srv *httptest.Server, addr string, err error) {
+	l, err := net.Listen("tcp", v.ListenAddr)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to listen test server: %v", err)
+	}
 
-	srv = httptest.NewUnstartedServer(mux)
+	srv = httptest.NewUnstartedServer(v.newMux())
+	srv.Listener.Close()
 	srv.Listener = l
 	return srv, l.Addr().String(), nil
 }
+
+func (v *VaultServerConfig) newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(v.CertAuthReqEndpoint, v.record(certAuthRequest, v.issueToken(v.CertAuthReqHandler(v.CertAuthResponseCode, v.CertAuthResponse))))
+	mux.HandleFunc(v.AppRoleAuthReqEndpoint, v.record(appRoleAuthRequest, v.issueToken(v.AppRoleAuthReqHandler(v.AppRoleAuthResponseCode, v.AppRoleAuthResponse))))
+	mux.HandleFunc(v.AliCloudAuthReqEndpoint, v.record(aliCloudAuthRequest, v.issueToken(v.AliCloudAuthReqHandler(v.AliCloudAuthResponseCode, v.AliCloudAuthResponse))))
+	mux.HandleFunc(v.OCIAuthReqEndpoint, v.record(ociAuthRequest, v.issueToken(v.OCIAuthReqHandler(v.OCIAuthResponseCode, v.OCIAuthResponse))))
+	mux.HandleFunc(v.CFAuthReqEndpoint, v.record(cfAuthRequest, v.issueToken(v.CFAuthReqHandler(v.CFAuthResponseCode, v.CFAuthResponse))))
+	mux.HandleFunc(v.RADIUSAuthReqEndpoint, v.record(radiusAuthRequest, v.issueToken(v.RADIUSAuthReqHandler(v.RADIUSAuthResponseCode, v.RADIUSAuthResponse))))
+	mux.HandleFunc(v.JWTAuthReqEndpoint, v.record(jwtAuthRequest, v.issueToken(v.JWTAuthReqHandler(v.JWTAuthResponseCode, v.JWTAuthResponse))))
+	mux.HandleFunc(v.KerberosAuthReqEndpoint, v.record(kerberosAuthRequest, v.issueToken(v.KerberosAuthReqHandler(v.KerberosAuthResponseCode, v.KerberosAuthResponse))))
+	mux.HandleFunc(v.AWSAuthReqEndpoint, v.record(awsAuthRequest, v.issueToken(v.AWSAuthReqHandler(v.AWSAuthResponseCode, v.AWSAuthResponse))))
+	mux.HandleFunc(v.GCPAuthReqEndpoint, v.record(gcpAuthRequest, v.issueToken(v.GCPAuthReqHandler(v.GCPAuthResponseCode, v.GCPAuthResponse))))
+	mux.HandleFunc(v.AzureAuthReqEndpoint, v.record(azureAuthRequest, v.issueToken(v.AzureAuthReqHandler(v.AzureAuthResponseCode, v.AzureAuthResponse))))
+	mux.HandleFunc(v.SignIntermediateReqEndpoint, v.record(signIntermediateRequest, v.requireToken(v.SignIntermediateReqHandler(v.SignIntermediateResponseCode, v.SignIntermediateResponse))))
+	mux.HandleFunc(v.RenewReqEndpoint, v.record(renewRequest, v.extendToken(v.RenewReqHandler(v.RenewResponseCode, v.RenewResponse))))
+	mux.HandleFunc(v.RevokeReqEndpoint, v.record(revokeRequest, v.RevokeReqHandler(v.RevokeResponseCode, v.RevokeResponse)))
+	mux.HandleFunc(v.TokenCreateReqEndpoint, v.record(tokenCreateRequest, v.issueToken(v.TokenCreateReqHandler(v.TokenCreateResponseCode, v.TokenCreateResponse))))
+	mux.HandleFunc(v.TokenLookupReqEndpoint, v.record(tokenLookupRequest, v.TokenLookupReqHandler(v.TokenLookupResponseCode, v.TokenLookupResponse)))
+	mux.HandleFunc(v.KVReqEndpoint, v.record(kvRequest, v.KVReqHandler(v.KVResponseCode, v.KVResponse)))
+	mux.HandleFunc(v.HealthReqEndpoint, v.record(healthRequest, v.HealthReqHandler(v.HealthResponseCode, v.HealthResponse)))
+	mux.HandleFunc(v.CAChainReqEndpoint, v.record(caChainRequest, v.CAChainReqHandler(v.CAChainResponseCode, v.CAChainResponse)))
+	mux.HandleFunc(v.MountReqEndpoint, v.record(mountRequest, v.MountReqHandler(v.MountResponseCode, v.MountResponse)))
+	return mux
+}
+
+// record wraps the handler to capture the last request for the given name.
+func (v *VaultServerConfig) record(name string, next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+		req := &Request{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Header: r.Header.Clone(),
+		}
+		if r.TLS != nil && len(r.TLS.PeerCertificates) != 0 {
+			req.PeerCertificates = r.TLS.PeerCertificates
+		}
+		if len(b) != 0 {
+			var body map[string]interface{}
+			if err := json.Unmarshal(b, &body); err == nil {
+				req.Body = body
+			}
+		}
+		if r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+			if form, err := url.ParseQuery(string(b)); err == nil {
+				req.Form = form
+			}
+		}
+
+		v.mu.Lock()
+		if v.lastRequests == nil {
+			v.lastRequests = make(map[string]*Request)
+		}
+		v.lastRequests[name] = req
+		v.mu.Unlock()
+
+		next(w, r)
+	}
+}
+
+func (v *VaultServerConfig) lastRequest(name string) *Request {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.lastRequests[name]
+}
+
+// LastCertAuthRequest returns the last request to the cert auth endpoint, or nil if none.
+func (v *VaultServerConfig) LastCertAuthRequest() *Request {
+	return v.lastRequest(certAuthRequest)
+}
+
+// LastAppRoleAuthRequest returns the last request to the AppRole auth endpoint, or nil if none.
+func (v *VaultServerConfig) LastAppRoleAuthRequest() *Request {
+	return v.lastRequest(appRoleAuthRequest)
+}
+
+// LastAliCloudAuthRequest returns the last request to the AliCloud auth endpoint, or nil if none.
+func (v *VaultServerConfig) LastAliCloudAuthRequest() *Request {
+	return v.lastRequest(aliCloudAuthRequest)
+}
+
+// LastOCIAuthRequest returns the last request to the OCI auth endpoint, or nil if none.
+func (v *VaultServerConfig) LastOCIAuthRequest() *Request {
+	return v.lastRequest(ociAuthRequest)
+}
+
+// LastCFAuthRequest returns the last request to the CF auth endpoint, or nil if none.
+func (v *VaultServerConfig) LastCFAuthRequest() *Request {
+	return v.lastRequest(cfAuthRequest)
+}
+
+// LastRADIUSAuthRequest returns the last request to the RADIUS auth endpoint, or nil if none.
+func (v *VaultServerConfig) LastRADIUSAuthRequest() *Request {
+	return v.lastRequest(radiusAuthRequest)
+}
+
+// LastJWTAuthRequest returns the last request to the JWT auth endpoint, or nil if none.
+func (v *VaultServerConfig) LastJWTAuthRequest() *Request {
+	return v.lastRequest(jwtAuthRequest)
+}
+
+// LastKerberosAuthRequest returns the last request to the Kerberos auth endpoint, or nil if none.
+func (v *VaultServerConfig) LastKerberosAuthRequest() *Request {
+	return v.lastRequest(kerberosAuthRequest)
+}
+
+// LastAWSAuthRequest returns the last request to the AWS auth endpoint, or nil if none.
+func (v *VaultServerConfig) LastAWSAuthRequest() *Request {
+	return v.lastRequest(awsAuthRequest)
+}
+
+// LastGCPAuthRequest returns the last request to the GCP auth endpoint, or nil if none.
+func (v *VaultServerConfig) LastGCPAuthRequest() *Request {
+	return v.lastRequest(gcpAuthRequest)
+}
+
+// LastAzureAuthRequest returns the last request to the Azure auth endpoint, or nil if none.
+func (v *VaultServerConfig) LastAzureAuthRequest() *Request {
+	return v.lastRequest(azureAuthRequest)
+}
+
+// LastSignIntermediateRequest returns the last request to the sign-intermediate endpoint, or nil if none.
+func (v *VaultServerConfig) LastSignIntermediateRequest() *Request {
+	return v.lastRequest(signIntermediateRequest)
+}
+
+// LastTokenCreateRequest returns the last request to the token create endpoint, or nil if none.
+func (v *VaultServerConfig) LastTokenCreateRequest() *Request {
+	return v.lastRequest(tokenCreateRequest)
+}
+
+// LastTokenLookupRequest returns the last request to the token lookup endpoint, or nil if none.
+func (v *VaultServerConfig) LastTokenLookupRequest() *Request {
+	return v.lastRequest(tokenLookupRequest)
+}
+
+// LastRenewRequest returns the last request to the token renew endpoint, or nil if none.
+func (v *VaultServerConfig) LastRenewRequest() *Request {
+	return v.lastRequest(renewRequest)
+}
+
+// LastRevokeRequest returns the last request to the token revoke endpoint, or nil if none.
+func (v *VaultServerConfig) LastRevokeRequest() *Request {
+	return v.lastRequest(revokeRequest)
+}
+
+// LastKVRequest returns the last request to the KV endpoint, or nil if none.
+func (v *VaultServerConfig) LastKVRequest() *Request {
+	return v.lastRequest(kvRequest)
+}
+
+// LastHealthRequest returns the last request to the health endpoint, or nil if none.
+func (v *VaultServerConfig) LastHealthRequest() *Request {
+	return v.lastRequest(healthRequest)
+}
+
+// LastCAChainRequest returns the last request to the CA chain endpoint, or nil if none.
+func (v *VaultServerConfig) LastCAChainRequest() *Request {
+	return v.lastRequest(caChainRequest)
+}
+
+// LastMountRequest returns the last request to the mount endpoint, or nil if none.
+func (v *VaultServerConfig) LastMountRequest() *Request {
+	return v.lastRequest(mountRequest)
+}
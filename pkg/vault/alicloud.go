@@ -0,0 +1,134 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package vault
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAliCloudSTSEndpoint = "sts.aliyuncs.com"
+	aliCloudSTSAPIVersion      = "2015-04-01"
+)
+
+// aliCloudSource logs in with the signed GetCallerIdentity request of the AliCloud credentials.
+type aliCloudSource struct {
+	params *ClientParams
+}
+
+func (s *aliCloudSource) Authenticate(ctx context.Context, client *http.Client) (*Token, time.Duration, error) {
+	body, err := aliCloudLoginData(s.params, time.Now())
+	if err != nil {
+		return nil, 0, err
+	}
+	path := fmt.Sprintf("auth/%v/login", s.params.AliCloudAuthMountPoint)
+	sec, err := vaultLogin(ctx, client, s.params, path, body, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sec == nil {
+		return nil, 0, errors.New("alicloud authentication response is nil")
+	}
+	return issuedToken(sec)
+}
+
+// aliCloudLoginData returns the request body to login with alicloud auth method.
+// The body has a signed GetCallerIdentity request of Alibaba Cloud STS,
+// and Vault sends the request to confirm the identity of the caller.
+// see: https://www.vaultproject.io/api/auth/alicloud/index.html#login
+func aliCloudLoginData(p *ClientParams, now time.Time) (map[string]interface{}, error) {
+	if p.AliCloudAccessKeyID == "" || p.AliCloudAccessKeySecret == "" {
+		return nil, errors.New("access key id and access key secret of alicloud are required")
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	params := url.Values{}
+	params.Set("Action", "GetCallerIdentity")
+	params.Set("Format", "JSON")
+	params.Set("Version", aliCloudSTSAPIVersion)
+	params.Set("AccessKeyId", p.AliCloudAccessKeyID)
+	params.Set("SignatureMethod", "HMAC-SHA1")
+	params.Set("SignatureVersion", "1.0")
+	params.Set("SignatureNonce", hex.EncodeToString(nonce))
+	params.Set("Timestamp", now.UTC().Format("2006-01-02T15:04:05Z"))
+	if p.AliCloudSecurityToken != "" {
+		params.Set("SecurityToken", p.AliCloudSecurityToken)
+	}
+	params.Set("Signature", aliCloudSignature(http.MethodGet, params, p.AliCloudAccessKeySecret))
+
+	endpoint := defaultAliCloudSTSEndpoint
+	if p.AliCloudRegion != "" {
+		endpoint = fmt.Sprintf("sts.%v.aliyuncs.com", p.AliCloudRegion)
+	}
+	u := url.URL{
+		Scheme:   "https",
+		Host:     endpoint,
+		Path:     "/",
+		RawQuery: aliCloudCanonicalQuery(params),
+	}
+
+	headers, err := json.Marshal(http.Header{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode identity request headers: %v", err)
+	}
+
+	return map[string]interface{}{
+		"role":                     p.AliCloudRole,
+		"identity_request_url":     base64.StdEncoding.EncodeToString([]byte(u.String())),
+		"identity_request_headers": base64.StdEncoding.EncodeToString(headers),
+	}, nil
+}
+
+// aliCloudSignature signs the RPC style request of Alibaba Cloud.
+// see: https://www.alibabacloud.com/help/doc-detail/28761.htm
+func aliCloudSignature(method string, params url.Values, secret string) string {
+	stringToSign := method + "&" + aliCloudPercentEncode("/") + "&" + aliCloudPercentEncode(aliCloudCanonicalQuery(params))
+	mac := hmac.New(sha1.New, []byte(secret+"&"))
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// aliCloudCanonicalQuery returns the query string sorted by the parameter name.
+func aliCloudCanonicalQuery(params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, aliCloudPercentEncode(k)+"="+aliCloudPercentEncode(params.Get(k)))
+	}
+	return strings.Join(pairs, "&")
+}
+
+func aliCloudPercentEncode(v string) string {
+	v = url.QueryEscape(v)
+	v = strings.Replace(v, "+", "%20", -1)
+	v = strings.Replace(v, "*", "%2A", -1)
+	v = strings.Replace(v, "%7E", "~", -1)
+	return v
+}
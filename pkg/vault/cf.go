@@ -0,0 +1,88 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package vault
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/spiffe/spire/pkg/common/pemutil"
+)
+
+const cfSigningTimeFormat = "2006-01-02T15:04:05Z"
+
+// cfSource logs in with the signature of the CF instance identity credentials.
+type cfSource struct {
+	params *ClientParams
+}
+
+func (s *cfSource) Authenticate(ctx context.Context, client *http.Client) (*Token, time.Duration, error) {
+	body, err := cfLoginData(s.params, time.Now())
+	if err != nil {
+		return nil, 0, err
+	}
+	path := fmt.Sprintf("auth/%v/login", s.params.CFAuthMountPoint)
+	sec, err := vaultLogin(ctx, client, s.params, path, body, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sec == nil {
+		return nil, 0, errors.New("cf authentication response is nil")
+	}
+	return issuedToken(sec)
+}
+
+// cfLoginData returns the request body to login with cf auth method.
+// The body is signed with the private key of the CF instance identity.
+// see: https://www.vaultproject.io/api/auth/cf/index.html#login
+func cfLoginData(p *ClientParams, now time.Time) (map[string]interface{}, error) {
+	if p.CFInstanceCertPath == "" || p.CFInstanceKeyPath == "" {
+		return nil, errors.New("instance cert and instance key of cf are required")
+	}
+
+	cert, err := ioutil.ReadFile(p.CFInstanceCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read instance certificate: %v", err)
+	}
+	key, err := pemutil.LoadRSAPrivateKey(p.CFInstanceKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load instance private key: %v", err)
+	}
+
+	signingTime := now.UTC().Format(cfSigningTimeFormat)
+	signature, err := cfSignature(key, signingTime, string(cert), p.CFRole)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign login request: %v", err)
+	}
+
+	return map[string]interface{}{
+		"role":             p.CFRole,
+		"cf_instance_cert": string(cert),
+		"signing_time":     signingTime,
+		"signature":        signature,
+	}, nil
+}
+
+// cfSignature signs the concatenation of signing time, instance certificate and role with RSA-PSS.
+func cfSignature(key *rsa.PrivateKey, signingTime, cert, role string) (string, error) {
+	sum := sha256.Sum256([]byte(signingTime + cert + role))
+	sig, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, sum[:], nil)
+	if err != nil {
+		return "", err
+	}
+	return "v1:" + base64.URLEncoding.EncodeToString(sig), nil
+}
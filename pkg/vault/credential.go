@@ -0,0 +1,305 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	vapi "github.com/hashicorp/vault/api"
+)
+
+// CredentialSource authenticates to Vault with the credentials of an auth method.
+type CredentialSource interface {
+	// Authenticate logs in to Vault with the HTTP client, and returns the issued token and its lease.
+	// The token is nil if no token is issued (e.g., token auth method uses the given token as it is).
+	// The requests are canceled once ctx is done.
+	Authenticate(ctx context.Context, client *http.Client) (token *Token, lease time.Duration, err error)
+}
+
+// Token is the Vault token issued by a CredentialSource.
+type Token struct {
+	// ID is the token sent in X-Vault-Token header.
+	ID string
+	// Renewable is true if the token can be renewed with renew-self.
+	Renewable bool
+}
+
+// NewCredentialSource returns the CredentialSource of the auth method.
+func NewCredentialSource(method AuthMethod, p *ClientParams) (CredentialSource, error) {
+	switch method {
+	case TOKEN:
+		return &tokenSource{params: p}, nil
+	case CERT:
+		return &certSource{params: p}, nil
+	case APPROLE:
+		return &appRoleSource{params: p}, nil
+	case ALICLOUD:
+		return &aliCloudSource{params: p}, nil
+	case OCI:
+		return &ociSource{params: p}, nil
+	case CF:
+		return &cfSource{params: p}, nil
+	case RADIUS:
+		return &radiusSource{params: p}, nil
+	case JWT:
+		return &jwtSource{params: p}, nil
+	case KERBEROS:
+		return &kerberosSource{params: p}, nil
+	case AWS:
+		s, err := newAWSSource(p)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case GCP:
+		return &gcpSource{params: p}, nil
+	case AZURE:
+		return &azureSource{params: p}, nil
+	default:
+		return nil, fmt.Errorf("auth method %v doesn't support login", method)
+	}
+}
+
+// tokenSource uses the configured token as it is.
+// If lookup is true, the token is looked up to check that Vault accepts it.
+type tokenSource struct {
+	params *ClientParams
+	lookup bool
+}
+
+func (s *tokenSource) Authenticate(ctx context.Context, client *http.Client) (*Token, time.Duration, error) {
+	if s.lookup {
+		header := make(http.Header)
+		header.Set(vaultTokenHeader, s.params.Token)
+		if _, err := vaultRequest(ctx, client, s.params, http.MethodGet, "auth/token/lookup-self", nil, header); err != nil {
+			return nil, 0, fmt.Errorf("token lookup failed: %w", classifyError(err))
+		}
+	}
+	return nil, 0, nil
+}
+
+// certSource logs in with the client certificate of the TLS connection.
+type certSource struct {
+	params *ClientParams
+}
+
+func (s *certSource) Authenticate(ctx context.Context, client *http.Client) (*Token, time.Duration, error) {
+	path := fmt.Sprintf("auth/%v/login", s.params.CertAuthMountPoint)
+	sec, err := vaultLogin(ctx, client, s.params, path, map[string]interface{}{}, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sec == nil {
+		return nil, 0, errors.New("tls cert authentication response is nil")
+	}
+	return issuedToken(sec)
+}
+
+// appRoleSource logs in with the role ID and the secret ID.
+// If AppRoleKVPath is set, these are read from the KV secret engine with the token on each login.
+type appRoleSource struct {
+	params *ClientParams
+}
+
+func (s *appRoleSource) Authenticate(ctx context.Context, client *http.Client) (*Token, time.Duration, error) {
+	roleID, secretID := s.params.AppRoleID, s.params.AppRoleSecretID
+	if s.params.AppRoleKVPath != "" {
+		var err error
+		roleID, secretID, err = readAppRoleCredentials(ctx, client, s.params, s.params.AppRoleKVPath)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	path := fmt.Sprintf("auth/%v/login", s.params.AppRoleAuthMountPoint)
+	body := map[string]interface{}{
+		"role_id":   roleID,
+		"secret_id": secretID,
+	}
+	sec, err := vaultLogin(ctx, client, s.params, path, body, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sec == nil {
+		return nil, 0, errors.New("approle authentication response is nil")
+	}
+	return issuedToken(sec)
+}
+
+// readAppRoleCredentials reads 'role_id' and 'secret_id' of AppRole from the given KV path with the configured token.
+// Both KV version 1 and version 2 data layouts are supported.
+func readAppRoleCredentials(ctx context.Context, client *http.Client, p *ClientParams, path string) (roleID, secretID string, err error) {
+	header := make(http.Header)
+	header.Set(vaultTokenHeader, p.Token)
+	s, err := vaultRequest(ctx, client, p, http.MethodGet, path, nil, header)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read approle credentials from %v: %w", path, classifyError(err))
+	}
+	if s == nil || s.Data == nil {
+		return "", "", fmt.Errorf("approle credentials are not found in %v", path)
+	}
+
+	data := s.Data
+	// KV version 2 wraps the secret with 'data' and 'metadata'.
+	if v2Data, ok := s.Data["data"].(map[string]interface{}); ok {
+		if _, ok := s.Data["metadata"]; ok {
+			data = v2Data
+		}
+	}
+
+	roleID, ok := data["role_id"].(string)
+	if !ok || roleID == "" {
+		return "", "", fmt.Errorf("'role_id' is not found in %v", path)
+	}
+	secretID, ok = data["secret_id"].(string)
+	if !ok || secretID == "" {
+		return "", "", fmt.Errorf("'secret_id' is not found in %v", path)
+	}
+	return roleID, secretID, nil
+}
+
+// vaultLogin writes the body to the login path of the auth method, and returns the login response.
+// The header, if any, is added to the request. (e.g., Authorization of SPNEGO)
+func vaultLogin(ctx context.Context, client *http.Client, p *ClientParams, path string, body map[string]interface{}, header http.Header) (*vapi.Secret, error) {
+	sec, err := vaultRequest(ctx, client, p, http.MethodPut, path, body, header)
+	if err != nil {
+		return nil, fmt.Errorf("authentication failed %v: %w", path, classifyError(err))
+	}
+	return sec, nil
+}
+
+// issuedToken returns the token and its lease of the login response.
+func issuedToken(sec *vapi.Secret) (*Token, time.Duration, error) {
+	id, err := sec.TokenID()
+	if err != nil {
+		return nil, 0, fmt.Errorf("authentication is successful, but could not get token: %v", err)
+	}
+	renewable, err := sec.TokenIsRenewable()
+	if err != nil {
+		return nil, 0, fmt.Errorf("authentication is successful, but could not get token: %v", err)
+	}
+	return &Token{ID: id, Renewable: renewable}, leaseDuration(sec), nil
+}
+
+// vaultRequest sends the request to the path of the Vault API, and returns the secret of the response.
+// The data is encoded by RequestEncoding. Same as Logical().Read, the secret is nil if the path is not found.
+// Errors are same as the ones of hashicorp/vault/api, so that classifyError can classify them.
+func vaultRequest(ctx context.Context, client *http.Client, p *ClientParams, method, path string, data map[string]interface{}, header http.Header) (*vapi.Secret, error) {
+	var body io.Reader
+	contentType := ""
+	if data != nil {
+		if p.RequestEncoding == RequestEncodingForm {
+			body = strings.NewReader(encodeForm(data).Encode())
+			contentType = contentTypeForm
+		} else {
+			b, err := json.Marshal(data)
+			if err != nil {
+				return nil, err
+			}
+			body = bytes.NewReader(b)
+			contentType = contentTypeJSON
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, vaultURL(p.VaultAddr, path), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	httpResp, err := client.Do(req)
+	if err != nil {
+		// The error of vaultTransport is url.Error already, so it isn't wrapped by http.Client twice.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			var inner *url.Error
+			if errors.As(uerr.Err, &inner) {
+				return nil, inner
+			}
+		}
+		return nil, err
+	}
+	resp := &vapi.Response{Response: httpResp}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodGet {
+		return nil, nil
+	}
+	if err := resp.Error(); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, newTooManyRequestsError(resp)
+	}
+	return vapi.ParseSecret(resp.Body)
+}
+
+// vaultURL returns the URL of the path of the Vault API. The path of the address is dropped, as hashicorp/vault/api does.
+func vaultURL(addr, path string) string {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "/v1/" + path
+	}
+	return fmt.Sprintf("%v://%v/v1/%v", u.Scheme, u.Host, path)
+}
+
+// vaultTransport sends the requests of CredentialSource with the Vault client, so that these have
+// the address, headers, namespace, retries and timeouts of the client. The token is the one in X-Vault-Token
+// header of the request, and no token is sent without it.
+type vaultTransport struct {
+	client *vapi.Client
+}
+
+func (t *vaultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := t.client.NewRequest(req.Method, req.URL.EscapedPath())
+	r.Params = req.URL.Query()
+	r.ClientToken = req.Header.Get(vaultTokenHeader)
+	// The headers are shared with the client, so they are copied before adding the ones of the request.
+	headers := make(http.Header, len(r.Headers)+len(req.Header))
+	for k, v := range r.Headers {
+		headers[k] = v
+	}
+	for k, v := range req.Header {
+		if k != vaultTokenHeader {
+			headers[k] = v
+		}
+	}
+	r.Headers = headers
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		r.BodyBytes = b
+		if headers.Get("Content-Type") == contentTypeJSON {
+			// hashicorp/vault/api encodes Obj again if the request is redirected.
+			r.Obj = json.RawMessage(b)
+		}
+	}
+
+	resp, err := t.client.RawRequestWithContext(req.Context(), r)
+	var respErr *vapi.ResponseError
+	if err != nil && !errors.As(err, &respErr) {
+		return nil, err
+	}
+	// The error of the status code is built again from the response by vaultRequest.
+	return resp.Response, nil
+}
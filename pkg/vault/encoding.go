@@ -0,0 +1,102 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package vault
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	vapi "github.com/hashicorp/vault/api"
+)
+
+const (
+	RequestEncodingJSON = "json"
+	RequestEncodingForm = "form"
+
+	contentTypeJSON = "application/json"
+	contentTypeForm = "application/x-www-form-urlencoded"
+)
+
+// RequestEncodings is a set of encodings of the request body to write to Vault.
+var RequestEncodings = []string{RequestEncodingJSON, RequestEncodingForm}
+
+// logicalWrite is same as Logical().Write of vc, but encodes data by RequestEncoding with its Content-Type.
+// The header, if any, is added to the request. The address of the node which served the request is recorded
+// to ctx of withServedAddr. ctx doesn't cancel the request, which is bounded by the timeouts of vc.
+func (c *Client) logicalWrite(ctx context.Context, vc *vapi.Client, path string, data map[string]interface{}, header http.Header) (*vapi.Secret, error) {
+	r := vc.NewRequest(http.MethodPut, "/v1/"+path)
+	// The headers are shared with the client, so they are copied before adding Content-Type.
+	headers := make(http.Header, len(r.Headers)+len(header)+1)
+	for k, v := range r.Headers {
+		headers[k] = v
+	}
+	for k, v := range header {
+		headers[k] = v
+	}
+	r.Headers = headers
+	if c.clientParams != nil && c.clientParams.RequestEncoding == RequestEncodingForm {
+		r.BodyBytes = []byte(encodeForm(data).Encode())
+		r.Headers.Set("Content-Type", contentTypeForm)
+	} else {
+		if err := r.SetJSONBody(data); err != nil {
+			return nil, err
+		}
+		r.Headers.Set("Content-Type", contentTypeJSON)
+	}
+
+	resp, err := vc.RawRequestWithContext(context.Background(), r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	// Same as Logical().Write, a 404 with data or warnings is returned as the secret.
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		secret, parseErr := vapi.ParseSecret(resp.Body)
+		switch parseErr {
+		case nil:
+		case io.EOF:
+			return nil, nil
+		default:
+			return nil, err
+		}
+		if secret != nil && (len(secret.Warnings) > 0 || len(secret.Data) > 0) {
+			return secret, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, newTooManyRequestsError(resp)
+	}
+	setServedAddr(ctx, resp.Request.URL)
+	return vapi.ParseSecret(resp.Body)
+}
+
+// encodeForm encodes data as the form values. Lists are joined with commas, which Vault accepts for list parameters.
+func encodeForm(data map[string]interface{}) url.Values {
+	values := make(url.Values, len(data))
+	for k, v := range data {
+		switch v := v.(type) {
+		case []string:
+			values.Set(k, strings.Join(v, ","))
+		case []interface{}:
+			elems := make([]string, 0, len(v))
+			for _, e := range v {
+				elems = append(elems, fmt.Sprint(e))
+			}
+			values.Set(k, strings.Join(elems, ","))
+		default:
+			values.Set(k, fmt.Sprint(v))
+		}
+	}
+	return values
+}
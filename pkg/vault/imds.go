@@ -0,0 +1,273 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package vault
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultAWSIMDSEndpoint is the address of the instance metadata service of EC2.
+	DefaultAWSIMDSEndpoint = "http://169.254.169.254"
+	// DefaultGCPIMDSEndpoint is the address of the metadata server of GCE.
+	DefaultGCPIMDSEndpoint = "http://metadata.google.internal"
+	// DefaultAzureIMDSEndpoint is the address of the instance metadata service of Azure VMs.
+	DefaultAzureIMDSEndpoint = "http://169.254.169.254"
+	// DefaultAzureResource is the resource of the managed identity token that Azure auth method expects by default.
+	DefaultAzureResource = "https://management.azure.com/"
+
+	awsIMDSTokenTTL          = "21600"
+	gcpDefaultSA             = "default"
+	azureIMDSTokenVersion    = "2018-02-01"
+	azureIMDSInstanceVersion = "2021-02-01"
+)
+
+// awsSource logs in with the PKCS#7 signature of the EC2 instance identity document (ec2 type of AWS auth method).
+type awsSource struct {
+	params *ClientParams
+	// nonce is sent on each login, since Vault rejects the logins after the first one with another nonce.
+	nonce string
+}
+
+func newAWSSource(p *ClientParams) (*awsSource, error) {
+	nonce := p.AWSNonce
+	if nonce == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate nonce of aws auth method: %v", err)
+		}
+		nonce = hex.EncodeToString(b)
+	}
+	return &awsSource{params: p, nonce: nonce}, nil
+}
+
+func (s *awsSource) Authenticate(ctx context.Context, client *http.Client) (*Token, time.Duration, error) {
+	if s.params.AWSRole == "" {
+		return nil, 0, errors.New("role of aws is required")
+	}
+	pkcs7, err := awsIdentitySignature(ctx, imdsEndpoint(s.params, DefaultAWSIMDSEndpoint))
+	if err != nil {
+		return nil, 0, err
+	}
+	path := fmt.Sprintf("auth/%v/login", s.params.AWSAuthMountPoint)
+	body := map[string]interface{}{
+		"role":  s.params.AWSRole,
+		"pkcs7": pkcs7,
+		"nonce": s.nonce,
+	}
+	sec, err := vaultLogin(ctx, client, s.params, path, body, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sec == nil {
+		return nil, 0, errors.New("aws authentication response is nil")
+	}
+	return issuedToken(sec)
+}
+
+// awsIdentitySignature reads the PKCS#7 signature of the instance identity document with a session token of IMDSv2.
+// The newlines are removed, as Vault expects.
+// see: https://www.vaultproject.io/api/auth/aws#login
+func awsIdentitySignature(ctx context.Context, endpoint string) (string, error) {
+	header := make(http.Header)
+	header.Set("X-aws-ec2-metadata-token-ttl-seconds", awsIMDSTokenTTL)
+	token, err := imdsRead(ctx, http.MethodPut, endpoint+"/latest/api/token", header)
+	if err != nil {
+		return "", err
+	}
+
+	header = make(http.Header)
+	header.Set("X-aws-ec2-metadata-token", strings.TrimSpace(string(token)))
+	pkcs7, err := imdsRead(ctx, http.MethodGet, endpoint+"/latest/dynamic/instance-identity/pkcs7", header)
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(strings.TrimSpace(string(pkcs7)), "\n", "", -1), nil
+}
+
+// gcpSource logs in with the identity token of the service account of the GCE instance (gce type of GCP auth method).
+type gcpSource struct {
+	params *ClientParams
+}
+
+func (s *gcpSource) Authenticate(ctx context.Context, client *http.Client) (*Token, time.Duration, error) {
+	if s.params.GCPRole == "" {
+		return nil, 0, errors.New("role of gcp is required")
+	}
+	jwt, err := gcpIdentityToken(ctx, imdsEndpoint(s.params, DefaultGCPIMDSEndpoint), s.params.GCPServiceAccount, s.params.GCPRole)
+	if err != nil {
+		return nil, 0, err
+	}
+	path := fmt.Sprintf("auth/%v/login", s.params.GCPAuthMountPoint)
+	body := map[string]interface{}{
+		"role": s.params.GCPRole,
+		"jwt":  jwt,
+	}
+	sec, err := vaultLogin(ctx, client, s.params, path, body, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sec == nil {
+		return nil, 0, errors.New("gcp authentication response is nil")
+	}
+	return issuedToken(sec)
+}
+
+// gcpIdentityToken reads the identity token of the service account, whose audience is the one Vault expects for the role.
+// The full format is requested, so that the token has the claims of the instance which Vault verifies.
+// see: https://www.vaultproject.io/docs/auth/gcp#gce-login
+func gcpIdentityToken(ctx context.Context, endpoint, serviceAccount, role string) (string, error) {
+	if serviceAccount == "" {
+		serviceAccount = gcpDefaultSA
+	}
+	query := url.Values{}
+	query.Set("audience", fmt.Sprintf("http://vault/%v", role))
+	query.Set("format", "full")
+	u := fmt.Sprintf("%v/computeMetadata/v1/instance/service-accounts/%v/identity?%v", endpoint, url.PathEscape(serviceAccount), query.Encode())
+
+	header := make(http.Header)
+	header.Set("Metadata-Flavor", "Google")
+	jwt, err := imdsRead(ctx, http.MethodGet, u, header)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(jwt)), nil
+}
+
+// azureSource logs in with the token of the managed identity of the Azure VM.
+type azureSource struct {
+	params *ClientParams
+}
+
+func (s *azureSource) Authenticate(ctx context.Context, client *http.Client) (*Token, time.Duration, error) {
+	body, err := azureLoginData(ctx, s.params)
+	if err != nil {
+		return nil, 0, err
+	}
+	path := fmt.Sprintf("auth/%v/login", s.params.AzureAuthMountPoint)
+	sec, err := vaultLogin(ctx, client, s.params, path, body, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sec == nil {
+		return nil, 0, errors.New("azure authentication response is nil")
+	}
+	return issuedToken(sec)
+}
+
+// azureLoginData returns the request body to login with azure auth method.
+// The token of the managed identity and the metadata of the VM, which Vault verifies with the claims of the token,
+// are read from the instance metadata service.
+// see: https://www.vaultproject.io/api/auth/azure#login
+func azureLoginData(ctx context.Context, p *ClientParams) (map[string]interface{}, error) {
+	if p.AzureRole == "" {
+		return nil, errors.New("role of azure is required")
+	}
+	endpoint := imdsEndpoint(p, DefaultAzureIMDSEndpoint)
+	resource := p.AzureResource
+	if resource == "" {
+		resource = DefaultAzureResource
+	}
+	header := make(http.Header)
+	header.Set("Metadata", "true")
+
+	query := url.Values{}
+	query.Set("api-version", azureIMDSTokenVersion)
+	query.Set("resource", resource)
+	b, err := imdsRead(ctx, http.MethodGet, endpoint+"/metadata/identity/oauth2/token?"+query.Encode(), header)
+	if err != nil {
+		return nil, err
+	}
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(b, &tokenResp); err != nil {
+		return nil, fmt.Errorf("failed to decode managed identity token: %v", err)
+	}
+	if tokenResp.AccessToken == "" {
+		return nil, errors.New("managed identity token is empty")
+	}
+
+	query = url.Values{}
+	query.Set("api-version", azureIMDSInstanceVersion)
+	query.Set("format", "json")
+	b, err = imdsRead(ctx, http.MethodGet, endpoint+"/metadata/instance?"+query.Encode(), header)
+	if err != nil {
+		return nil, err
+	}
+	var instance struct {
+		Compute struct {
+			SubscriptionID    string `json:"subscriptionId"`
+			ResourceGroupName string `json:"resourceGroupName"`
+			Name              string `json:"name"`
+			VMScaleSetName    string `json:"vmScaleSetName"`
+		} `json:"compute"`
+	}
+	if err := json.Unmarshal(b, &instance); err != nil {
+		return nil, fmt.Errorf("failed to decode instance metadata: %v", err)
+	}
+
+	body := map[string]interface{}{
+		"role":                p.AzureRole,
+		"jwt":                 tokenResp.AccessToken,
+		"subscription_id":     instance.Compute.SubscriptionID,
+		"resource_group_name": instance.Compute.ResourceGroupName,
+		"vm_name":             instance.Compute.Name,
+	}
+	if instance.Compute.VMScaleSetName != "" {
+		body["vmss_name"] = instance.Compute.VMScaleSetName
+	}
+	return body, nil
+}
+
+// imdsEndpoint returns IMDSEndpoint without the trailing slash, or the default endpoint if it is empty.
+func imdsEndpoint(p *ClientParams, defaultEndpoint string) string {
+	if p.IMDSEndpoint == "" {
+		return defaultEndpoint
+	}
+	return strings.TrimSuffix(p.IMDSEndpoint, "/")
+}
+
+// imdsRead reads a value from the instance metadata service. The request is canceled once ctx is done.
+func imdsRead(ctx context.Context, method, url string, header http.Header) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := imdsHTTPClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read instance metadata: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response from instance metadata %v: %v", req.URL.Path, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read instance metadata: %v", err)
+	}
+	return b, nil
+}
+
+func imdsHTTPClient() *http.Client {
+	return &http.Client{Timeout: 10 * time.Second}
+}
@@ -0,0 +1,113 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package vault
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jwtSource logs in with the JWT read from JWTPath.
+type jwtSource struct {
+	params *ClientParams
+}
+
+func (s *jwtSource) Authenticate(ctx context.Context, client *http.Client) (*Token, time.Duration, error) {
+	body, err := jwtLoginData(s.params)
+	if err != nil {
+		return nil, 0, err
+	}
+	path := fmt.Sprintf("auth/%v/login", s.params.JWTAuthMountPoint)
+	sec, err := vaultLogin(ctx, client, s.params, path, body, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sec == nil {
+		return nil, 0, errors.New("jwt authentication response is nil")
+	}
+	return issuedToken(sec)
+}
+
+// jwtLoginData returns the request body to login with jwt auth method.
+// The JWT is read from JWTPath on each login, since projected service account tokens are rotated.
+// Vault verifies the audience with bound_audiences of the role, and the login request has no audience parameter,
+// so that JWTAudience is checked here to tell the mismatch before the login is rejected.
+// see: https://www.vaultproject.io/api/auth/jwt/index.html#jwt-login
+func jwtLoginData(p *ClientParams) (map[string]interface{}, error) {
+	if p.JWTRole == "" {
+		return nil, errors.New("role of jwt is required")
+	}
+	if p.JWTPath == "" {
+		return nil, errors.New("path to the jwt is required")
+	}
+	b, err := ioutil.ReadFile(p.JWTPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwt: %v", err)
+	}
+	jwt := strings.TrimSpace(string(b))
+
+	if p.JWTAudience != "" {
+		aud, err := jwtAudience(jwt)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, a := range aud {
+			if a == p.JWTAudience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("aud claim of the jwt %v doesn't have the audience %q", aud, p.JWTAudience)
+		}
+	}
+
+	return map[string]interface{}{
+		"role": p.JWTRole,
+		"jwt":  jwt,
+	}, nil
+}
+
+// jwtAudience returns the aud claim of the JWT without verifying the signature, which is done by Vault.
+// The aud claim is either a string or an array of strings.
+func jwtAudience(jwt string) ([]string, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("jwt must have 3 parts")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode payload of jwt: %v", err)
+	}
+	var claims struct {
+		Audience json.RawMessage `json:"aud"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("failed to parse claims of jwt: %v", err)
+	}
+	if len(claims.Audience) == 0 {
+		return nil, nil
+	}
+	var aud string
+	if err := json.Unmarshal(claims.Audience, &aud); err == nil {
+		return []string{aud}, nil
+	}
+	var auds []string
+	if err := json.Unmarshal(claims.Audience, &auds); err != nil {
+		return nil, fmt.Errorf("failed to parse aud claim of jwt: %v", err)
+	}
+	return auds, nil
+}
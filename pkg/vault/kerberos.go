@@ -0,0 +1,99 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package vault
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+// kerberosSource logs in with the SPNEGO token of the service, which is obtained with the keytab.
+type kerberosSource struct {
+	params *ClientParams
+}
+
+// negotiateToken returns the SPNEGO token to login with kerberos auth method.
+// It is replaced in tests, since obtaining the token needs a KDC.
+var negotiateToken = kerberosNegotiateToken
+
+func (s *kerberosSource) Authenticate(ctx context.Context, client *http.Client) (*Token, time.Duration, error) {
+	if err := validateKerberosParams(s.params); err != nil {
+		return nil, 0, err
+	}
+	token, err := negotiateToken(s.params)
+	if err != nil {
+		return nil, 0, err
+	}
+	header := make(http.Header)
+	header.Set("Authorization", "Negotiate "+token)
+	path := fmt.Sprintf("auth/%v/login", s.params.KerberosAuthMountPoint)
+	sec, err := vaultLogin(ctx, client, s.params, path, map[string]interface{}{}, header)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sec == nil {
+		return nil, 0, errors.New("kerberos authentication response is nil")
+	}
+	return issuedToken(sec)
+}
+
+func validateKerberosParams(p *ClientParams) error {
+	switch {
+	case p.KerberosUsername == "":
+		return errors.New("username of kerberos is required")
+	case p.KerberosRealm == "":
+		return errors.New("realm of kerberos is required")
+	case p.KerberosService == "":
+		return errors.New("service of kerberos is required")
+	case p.KerberosKeytabPath == "":
+		return errors.New("path to the kerberos keytab is required")
+	}
+	return nil
+}
+
+// kerberosNegotiateToken logs in to the KDC with the keytab, and builds the SPNEGO token for the service.
+// The keytab and krb5.conf are loaded on each login, so that the keytab can be rotated.
+// see: https://www.vaultproject.io/docs/auth/kerberos
+func kerberosNegotiateToken(p *ClientParams) (string, error) {
+	kt, err := keytab.Load(p.KerberosKeytabPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to load kerberos keytab: %v", err)
+	}
+	conf, err := config.Load(p.KerberosKrb5ConfPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to load krb5.conf: %v", err)
+	}
+
+	cl := client.NewWithKeytab(p.KerberosUsername, p.KerberosRealm, kt, conf, client.DisablePAFXFAST(p.KerberosDisableFAST))
+	defer cl.Destroy()
+	if err := cl.Login(); err != nil {
+		return "", fmt.Errorf("failed to login to kerberos KDC: %v", err)
+	}
+	s := spnego.SPNEGOClient(cl, p.KerberosService)
+	if err := s.AcquireCred(); err != nil {
+		return "", fmt.Errorf("failed to acquire kerberos service ticket: %v", err)
+	}
+	st, err := s.InitSecContext()
+	if err != nil {
+		return "", fmt.Errorf("failed to initialize SPNEGO context: %v", err)
+	}
+	b, err := st.Marshal()
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal SPNEGO token: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,76 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package vault
+
+import (
+	"github.com/spiffe/spire/pkg/common/telemetry"
+)
+
+// Metrics is the interface to emit metrics of the vault client.
+// telemetry.Metrics of SPIRE satisfies the interface.
+type Metrics interface {
+	IncrCounter(key []string, val float32)
+	IncrCounterWithLabels(key []string, val float32, labels []telemetry.Label)
+	SetGauge(key []string, val float32)
+}
+
+var (
+	metricTokenRenewSuccess     = []string{"vault", "token", "renew", "success"}
+	metricTokenRenewFailure     = []string{"vault", "token", "renew", "failure"}
+	metricTokenLeaseRemaining   = []string{"vault", "token", "lease_remaining_seconds"}
+	metricReauthenticateSuccess = []string{"vault", "reauthenticate", "success"}
+	metricReauthenticateFailure = []string{"vault", "reauthenticate", "failure"}
+	metricSignNonCACertificate  = []string{"vault", "sign", "non_ca_certificate"}
+	metricSignSuccess           = []string{"vault", "sign", "success"}
+	metricBundleCacheRootChange = []string{"vault", "bundle_cache", "root_change"}
+)
+
+const (
+	// labelVaultAddr is the label of the Vault address which served the request.
+	labelVaultAddr = "vault_addr"
+	// otherVaultAddr is the value of labelVaultAddr when the request is served by another address than VaultAddr
+	// (e.g., the active node redirected from a standby), which keeps the cardinality bounded.
+	otherVaultAddr = "other"
+)
+
+// nopMetrics discards all metrics.
+type nopMetrics struct{}
+
+func (nopMetrics) IncrCounter([]string, float32)                              {}
+func (nopMetrics) IncrCounterWithLabels([]string, float32, []telemetry.Label) {}
+func (nopMetrics) SetGauge([]string, float32)                                 {}
+
+// NamespacedMetrics returns the metrics whose keys are prefixed with the namespace, so that the metrics
+// of multiple plugin instances in one process don't collide. It returns m as is if the namespace is empty.
+func NamespacedMetrics(m Metrics, namespace string) Metrics {
+	if namespace == "" {
+		return m
+	}
+	return &namespacedMetrics{namespace: namespace, next: m}
+}
+
+type namespacedMetrics struct {
+	namespace string
+	next      Metrics
+}
+
+func (m *namespacedMetrics) key(key []string) []string {
+	return append([]string{m.namespace}, key...)
+}
+
+func (m *namespacedMetrics) IncrCounter(key []string, val float32) {
+	m.next.IncrCounter(m.key(key), val)
+}
+
+func (m *namespacedMetrics) IncrCounterWithLabels(key []string, val float32, labels []telemetry.Label) {
+	m.next.IncrCounterWithLabels(m.key(key), val, labels)
+}
+
+func (m *namespacedMetrics) SetGauge(key []string, val float32) {
+	m.next.SetGauge(m.key(key), val)
+}
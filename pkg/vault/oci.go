@@ -0,0 +1,278 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spiffe/spire/pkg/common/pemutil"
+)
+
+const (
+	// DefaultOCIMetadataEndpoint is the endpoint of OCI instance metadata service (v2).
+	DefaultOCIMetadataEndpoint = "http://169.254.169.254/opc/v2"
+
+	ociFederationEndpointFormat = "https://auth.%v.oraclecloud.com/v1/x509"
+	ociTenancyPrefix            = "opc-tenant:"
+	ociIdentityPrefix           = "opc-identity:"
+)
+
+// ociSource logs in with the signed request of the OCI instance principal.
+type ociSource struct {
+	params *ClientParams
+}
+
+func (s *ociSource) Authenticate(ctx context.Context, client *http.Client) (*Token, time.Duration, error) {
+	path := fmt.Sprintf("auth/%v/login/%v", s.params.OCIAuthMountPoint, s.params.OCIRole)
+	loginURL := strings.TrimSuffix(s.params.VaultAddr, "/") + "/v1/" + path
+	body, err := ociLoginData(ctx, s.params, loginURL, time.Now())
+	if err != nil {
+		return nil, 0, err
+	}
+	sec, err := vaultLogin(ctx, client, s.params, path, body, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sec == nil {
+		return nil, 0, errors.New("oci authentication response is nil")
+	}
+	return issuedToken(sec)
+}
+
+// ociLoginData returns the request body to login with oci auth method using instance principal.
+// The instance principal is federated to a security token, and the token signs
+// the login request to Vault. Vault verifies the signed headers with OCI Identity.
+// see: https://www.vaultproject.io/api/auth/oci/index.html#login
+func ociLoginData(ctx context.Context, p *ClientParams, loginURL string, now time.Time) (map[string]interface{}, error) {
+	if p.OCIMetadataTimeout > 0 {
+		// The instance metadata service may be slow, and the login must not block the caller on it.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.OCIMetadataTimeout)
+		defer cancel()
+	}
+	token, sessionKey, err := ociFederate(ctx, p, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get security token of instance principal: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, loginURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := ociSignRequest(req, nil, "ST$"+token, sessionKey, now); err != nil {
+		return nil, fmt.Errorf("failed to sign login request: %v", err)
+	}
+	headers := req.Header
+	headers.Set("Host", req.URL.Host)
+
+	return map[string]interface{}{
+		"request_headers": headers,
+	}, nil
+}
+
+// ociFederate exchanges the instance certificate for a security token which is bound to a new session key.
+// The requests are canceled once ctx is done.
+func ociFederate(ctx context.Context, p *ClientParams, now time.Time) (string, *rsa.PrivateKey, error) {
+	metadata := p.OCIMetadataEndpoint
+	if metadata == "" {
+		metadata = DefaultOCIMetadataEndpoint
+	}
+	metadata = strings.TrimSuffix(metadata, "/")
+
+	certPEM, err := ociReadMetadata(ctx, metadata+"/identity/cert.pem")
+	if err != nil {
+		return "", nil, err
+	}
+	keyPEM, err := ociReadMetadata(ctx, metadata+"/identity/key.pem")
+	if err != nil {
+		return "", nil, err
+	}
+	intermediatePEM, err := ociReadMetadata(ctx, metadata+"/identity/intermediate.pem")
+	if err != nil {
+		return "", nil, err
+	}
+
+	cert, err := pemutil.ParseCertificate(certPEM)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse instance certificate: %v", err)
+	}
+	key, err := pemutil.ParseRSAPrivateKey(keyPEM)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse instance private key: %v", err)
+	}
+	intermediate, err := pemutil.ParseCertificate(intermediatePEM)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse intermediate certificate: %v", err)
+	}
+	tenancyID, err := ociTenancyID(cert)
+	if err != nil {
+		return "", nil, err
+	}
+
+	endpoint := p.OCIFederationEndpoint
+	if endpoint == "" {
+		region := p.OCIRegion
+		if region == "" {
+			r, err := ociReadMetadata(ctx, metadata+"/instance/canonicalRegionName")
+			if err != nil {
+				return "", nil, err
+			}
+			region = strings.TrimSpace(string(r))
+		}
+		endpoint = fmt.Sprintf(ociFederationEndpointFormat, region)
+	}
+
+	sessionKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate session key: %v", err)
+	}
+	sessionPub, err := x509.MarshalPKIXPublicKey(&sessionKey.PublicKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal session public key: %v", err)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"certificate":              base64.StdEncoding.EncodeToString(cert.Raw),
+		"publicKey":                base64.StdEncoding.EncodeToString(sessionPub),
+		"intermediateCertificates": []string{base64.StdEncoding.EncodeToString(intermediate.Raw)},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	keyID := fmt.Sprintf("%v/fed-x509/%v", tenancyID, ociFingerprint(cert))
+	if err := ociSignRequest(req, body, keyID, key, now); err != nil {
+		return "", nil, fmt.Errorf("failed to sign federation request: %v", err)
+	}
+
+	resp, err := ociHTTPClient().Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to request federation endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("unexpected response from federation endpoint: %v", resp.Status)
+	}
+	var tokenResp struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", nil, fmt.Errorf("failed to decode federation response: %v", err)
+	}
+	if tokenResp.Token == "" {
+		return "", nil, errors.New("security token is empty")
+	}
+
+	return tokenResp.Token, sessionKey, nil
+}
+
+// ociSignRequest signs the request with OCI request signature.
+// see: https://docs.cloud.oracle.com/iaas/Content/API/Concepts/signingrequests.htm
+func ociSignRequest(req *http.Request, body []byte, keyID string, key *rsa.PrivateKey, now time.Time) error {
+	req.Header.Set("Date", now.UTC().Format(http.TimeFormat))
+	names := []string{"date", "(request-target)", "host"}
+	if req.Method == http.MethodPost || req.Method == http.MethodPut {
+		sum := sha256.Sum256(body)
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		req.Header.Set("X-Content-Sha256", base64.StdEncoding.EncodeToString(sum[:]))
+		names = append(names, "content-length", "content-type", "x-content-sha256")
+	}
+
+	var lines []string
+	for _, n := range names {
+		var v string
+		switch n {
+		case "(request-target)":
+			v = strings.ToLower(req.Method) + " " + req.URL.RequestURI()
+		case "host":
+			v = req.URL.Host
+		default:
+			v = req.Header.Get(n)
+		}
+		lines = append(lines, n+": "+v)
+	}
+
+	digest := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(`Signature version="1",keyId="%v",algorithm="rsa-sha256",headers="%v",signature="%v"`,
+		keyID, strings.Join(names, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// ociTenancyID returns the OCID of the tenancy from the subject of the instance certificate.
+func ociTenancyID(cert *x509.Certificate) (string, error) {
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if strings.HasPrefix(ou, ociTenancyPrefix) {
+			return strings.TrimPrefix(ou, ociTenancyPrefix), nil
+		}
+		if strings.HasPrefix(ou, ociIdentityPrefix) {
+			return strings.TrimPrefix(ou, ociIdentityPrefix), nil
+		}
+	}
+	return "", errors.New("tenancy id is not found in the instance certificate")
+}
+
+// ociFingerprint returns SHA1 fingerprint of the certificate. (e.g., AB:CD:...)
+func ociFingerprint(cert *x509.Certificate) string {
+	sum := sha1.Sum(cert.Raw)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+// ociReadMetadata reads a value from OCI instance metadata service.
+func ociReadMetadata(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer Oracle")
+
+	resp, err := ociHTTPClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read instance metadata: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response from instance metadata %v: %v", url, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read instance metadata: %v", err)
+	}
+	return b, nil
+}
+
+func ociHTTPClient() *http.Client {
+	return &http.Client{Timeout: 10 * time.Second}
+}
@@ -0,0 +1,87 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package vault
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	vapi "github.com/hashicorp/vault/api"
+)
+
+// configureProxyTLS makes the transport verify the certificate of an HTTPS proxy with the CA certificates
+// in ProxyCACertPath. The certificate of Vault is still verified with the TLS config of the transport,
+// since the TLS connection to Vault is established through the tunnel of the proxy.
+func (c *Config) configureProxyTLS(vc *vapi.Config) error {
+	transport, ok := vc.HttpClient.Transport.(*http.Transport)
+	if !ok {
+		return nil
+	}
+	certs, err := c.loadCACertificates(c.clientParams.ProxyCACertPath)
+	if err != nil {
+		return fmt.Errorf("failed to load proxy CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	vaultURL, err := url.Parse(c.clientParams.VaultAddr)
+	if err != nil {
+		return err
+	}
+
+	// The custom TLS dialer is used for the HTTPS proxy if any, otherwise for Vault.
+	transport.DialTLS = func(network, addr string) (net.Conn, error) {
+		config := c.vaultTLSConfig(transport)
+		if isProxyAddr(transport, vaultURL, addr) {
+			// The client certificate for Vault is never presented to the proxy.
+			config = &tls.Config{RootCAs: pool}
+		}
+		return dialVaultTLS(transport, network, addr, config)
+	}
+	return nil
+}
+
+// isProxyAddr returns true if addr is the address of the HTTPS proxy that the transport uses for Vault.
+func isProxyAddr(transport *http.Transport, vaultURL *url.URL, addr string) bool {
+	if transport.Proxy == nil {
+		return false
+	}
+	proxyURL, err := transport.Proxy(&http.Request{URL: vaultURL})
+	if err != nil || proxyURL == nil || proxyURL.Scheme != "https" {
+		return false
+	}
+	port := proxyURL.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port) == addr
+}
+
+func dialTLS(dial func(context.Context, string, string) (net.Conn, error), network, addr string, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	conn, err := dial(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
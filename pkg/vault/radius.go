@@ -0,0 +1,64 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// radiusSource logs in with the username and the password of RADIUS.
+type radiusSource struct {
+	params *ClientParams
+}
+
+func (s *radiusSource) Authenticate(ctx context.Context, client *http.Client) (*Token, time.Duration, error) {
+	body, err := radiusLoginData(s.params)
+	if err != nil {
+		return nil, 0, err
+	}
+	path := fmt.Sprintf("auth/%v/login/%v", s.params.RADIUSAuthMountPoint, url.PathEscape(s.params.RADIUSUsername))
+	sec, err := vaultLogin(ctx, client, s.params, path, body, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sec == nil {
+		return nil, 0, errors.New("radius authentication response is nil")
+	}
+	return issuedToken(sec)
+}
+
+// radiusLoginData returns the request body to login with radius auth method.
+// The password is read from RADIUSPasswordFile on each login if it is set, so that the file can be rotated.
+// see: https://www.vaultproject.io/api/auth/radius/index.html#login
+func radiusLoginData(p *ClientParams) (map[string]interface{}, error) {
+	if p.RADIUSUsername == "" {
+		return nil, errors.New("username of radius is required")
+	}
+	password := p.RADIUSPassword
+	if p.RADIUSPasswordFile != "" {
+		b, err := ioutil.ReadFile(p.RADIUSPasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read radius password file: %v", err)
+		}
+		password = strings.TrimSpace(string(b))
+	}
+	if password == "" {
+		return nil, errors.New("password of radius is required")
+	}
+
+	return map[string]interface{}{
+		"password": password,
+	}, nil
+}
@@ -0,0 +1,107 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	vapi "github.com/hashicorp/vault/api"
+)
+
+const (
+	// DefaultRateLimitRetries is the number of times to retry the request failed with 429.
+	DefaultRateLimitRetries = 3
+	// DefaultMaxRetryAfter is the maximum delay before retrying the request failed with 429.
+	DefaultMaxRetryAfter = 30 * time.Second
+)
+
+// tooManyRequestsError is returned when Vault rejects the request with 429 by a rate limit quota.
+// hashicorp/vault/api doesn't treat 429 as an error, since sys/health of a standby node returns it.
+type tooManyRequestsError struct {
+	err *vapi.ResponseError
+	// retryAfter is the delay in Retry-After header. It is 0 if the header is missing or invalid.
+	retryAfter time.Duration
+}
+
+func (e *tooManyRequestsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *tooManyRequestsError) Unwrap() error {
+	return e.err
+}
+
+// newTooManyRequestsError builds the error from the 429 response in the same way as hashicorp/vault/api.
+func newTooManyRequestsError(resp *vapi.Response) error {
+	var body bytes.Buffer
+	if _, err := io.Copy(&body, resp.Body); err != nil {
+		return err
+	}
+	respErr := &vapi.ResponseError{
+		HTTPMethod: resp.Request.Method,
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+	}
+	var errResp vapi.ErrorResponse
+	if err := json.Unmarshal(body.Bytes(), &errResp); err != nil {
+		respErr.RawError = true
+		respErr.Errors = []string{body.String()}
+	} else {
+		respErr.Errors = errResp.Errors
+	}
+	return &tooManyRequestsError{
+		err:        respErr,
+		retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// parseRetryAfter parses the value of Retry-After header, which is either seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// rateLimitDelay returns the delay before the n-th retry of the request failed with 429.
+// Retry-After is honored if Vault sets it, otherwise the delay grows exponentially from the retry delay.
+// Both are capped by MaxRetryAfter.
+func (c *Client) rateLimitDelay(err *tooManyRequestsError, n int) time.Duration {
+	max := c.clientParams.MaxRetryAfter
+	if max <= 0 {
+		max = DefaultMaxRetryAfter
+	}
+	delay := err.retryAfter
+	if delay <= 0 {
+		delay = c.retryDelay
+		if delay <= 0 {
+			delay = defaultRetryDelay
+		}
+		for i := 1; i < n && delay < max; i++ {
+			delay *= 2
+		}
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
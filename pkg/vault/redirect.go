@@ -0,0 +1,110 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package vault
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// maxRedirects is the maximum number of redirects followed for a request
+	maxRedirects = 10
+
+	vaultTokenHeader = "X-Vault-Token"
+)
+
+// checkRedirect is the redirect policy of the client, which follows the redirect of Vault
+// (e.g., a standby node redirects to the active node with 307) while preserving the token.
+// The error ends with "stopped after N redirects" so that the request is not retried.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	for _, v := range via {
+		if v.URL.String() == req.URL.String() {
+			return fmt.Errorf("redirect loop to %v is detected, stopped after %d redirects", req.URL, len(via))
+		}
+	}
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("redirect to %v is not followed, stopped after %d redirects", req.URL, len(via))
+	}
+	if via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+		return fmt.Errorf("redirect to %v would cause protocol downgrade", req.URL)
+	}
+	if req.Header.Get(vaultTokenHeader) == "" {
+		if token := via[0].Header.Get(vaultTokenHeader); token != "" {
+			req.Header.Set(vaultTokenHeader, token)
+		}
+	}
+	return nil
+}
+
+// redirectTransport follows 307 and 308 redirects of the requests with a body by checkRedirect.
+// http.Client doesn't follow them since the body of the requests built by vault/api can't be rewound.
+type redirectTransport struct {
+	next http.RoundTripper
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return t.next.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var via []*http.Request
+	for {
+		r := req.Clone(req.Context())
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp, err := t.next.RoundTrip(r)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusTemporaryRedirect && resp.StatusCode != http.StatusPermanentRedirect {
+			return resp, nil
+		}
+		loc, err := resp.Location()
+		if err != nil {
+			// Leave the response to the caller as it is
+			return resp, nil
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		via = append(via, req)
+		req = req.Clone(req.Context())
+		req.URL = loc
+		req.Host = ""
+		if err := checkRedirect(req, via); err != nil {
+			return nil, err
+		}
+	}
+}
+
+type servedAddrKey struct{}
+
+// withServedAddr returns the context to record the address of the Vault node which served the request,
+// which may differ from VaultAddr after redirects. The address is set to the returned pointer.
+func withServedAddr(ctx context.Context) (context.Context, *string) {
+	addr := new(string)
+	return context.WithValue(ctx, servedAddrKey{}, addr), addr
+}
+
+// setServedAddr records the scheme and host of the URL to the context of withServedAddr, if any.
+// The path and the query are dropped, so that nothing but the address is exposed.
+func setServedAddr(ctx context.Context, u *url.URL) {
+	if addr, ok := ctx.Value(servedAddrKey{}).(*string); ok && u != nil {
+		*addr = (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+	}
+}
@@ -1,42 +1,171 @@
 package vault
 
 import (
-	"fmt"
+	"errors"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 	vapi "github.com/hashicorp/vault/api"
 )
 
+const (
+	// defaultLeaseGaugeInterval is the interval to update the gauge of the remaining lease.
+	defaultLeaseGaugeInterval = 10 * time.Second
+
+	// defaultRenewalGraceRatio is the ratio of the lease used as the grace if it is not configured.
+	defaultRenewalGraceRatio = 0.1
+	// minDefaultRenewalGrace is the lower bound of the default grace.
+	minDefaultRenewalGrace = time.Minute
+
+	// defaultRenewRetryBackoff is the first wait to retry a failed renewal, and it is doubled on each failure.
+	defaultRenewRetryBackoff = time.Second
+	// maxRenewRetryBackoff is the upper bound of the wait to retry a failed renewal.
+	maxRenewRetryBackoff = time.Minute
+)
+
 type Renew struct {
 	Logger  hclog.Logger
-	renewer *vapi.Renewer
+	Metrics Metrics
+	// TokenSink receives the token after each successful renewal.
+	TokenSink TokenSink
+	// Grace is the remaining lease at which the token is renewed.
+	// If zero, 10% of the lease (at least 1m) is used.
+	Grace time.Duration
+
+	client *vapi.Client
+	token  string
+
+	gaugeInterval time.Duration
+	retryBackoff  time.Duration
+	stopCh        chan struct{}
 }
 
 func NewRenew(client *vapi.Client, secret *vapi.Secret) (*Renew, error) {
-	renewer, err := client.NewRenewer(&vapi.RenewerInput{
-		Secret: secret,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize Renewer: %v", err)
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, errors.New("failed to initialize Renewer: secret has no auth token")
 	}
 	return &Renew{
-		Logger:  hclog.New(hclog.DefaultOptions),
-		renewer: renewer,
+		Logger:        hclog.New(hclog.DefaultOptions),
+		Metrics:       nopMetrics{},
+		TokenSink:     nopTokenSink{},
+		client:        client,
+		token:         secret.Auth.ClientToken,
+		gaugeInterval: defaultLeaseGaugeInterval,
+		retryBackoff:  defaultRenewRetryBackoff,
+		stopCh:        make(chan struct{}),
 	}, nil
 }
 
 func (r *Renew) Run() {
-	go r.renewer.Renew()
-	defer r.renewer.Stop()
+	// The token is renewed at once, and then each time the remaining lease reaches the grace.
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	ticker := time.NewTicker(r.gaugeInterval)
+	defer ticker.Stop()
 
+	var (
+		renewedAt time.Time
+		lease     time.Duration
+		failures  int
+	)
 	for {
 		select {
-		case err := <-r.renewer.DoneCh():
+		case <-timer.C:
+			renewal, err := r.renew()
 			if err != nil {
 				r.Logger.Warn("Failed to renew auth token", "err", err.Error())
+				r.Metrics.IncrCounter(metricTokenRenewFailure, 1)
+				remaining := lease - time.Since(renewedAt)
+				if isPermissionDenied(err) || (!renewedAt.IsZero() && remaining <= 0) {
+					// Retries never succeed for the revoked or expired token, and the client authenticates again
+					// on the next request rejected with the token.
+					r.Logger.Warn("auth token is expired or revoked, so it is no longer renewed")
+					return
+				}
+				failures++
+				timer.Reset(r.retryDelay(failures, remaining))
+				continue
 			}
-		case renewal := <-r.renewer.RenewCh():
-			r.Logger.Debug("Successfully renew auth token", "request_id", renewal.Secret.RequestID)
+			failures = 0
+			r.Logger.Debug("Successfully renew auth token", "request_id", renewal.RequestID)
+			r.Metrics.IncrCounter(metricTokenRenewSuccess, 1)
+			renewedAt = time.Now()
+			lease = leaseDuration(renewal)
+			r.TokenSink.Store(r.token, lease)
+			r.Metrics.SetGauge(metricTokenLeaseRemaining, float32(lease.Seconds()))
+			if !renewal.Auth.Renewable || lease <= 0 {
+				r.Logger.Debug("auth token is no longer renewable")
+				continue
+			}
+			timer.Reset(r.renewalDelay(lease))
+		case <-ticker.C:
+			if renewedAt.IsZero() {
+				continue
+			}
+			remaining := lease - time.Since(renewedAt)
+			if remaining < 0 {
+				remaining = 0
+			}
+			r.Metrics.SetGauge(metricTokenLeaseRemaining, float32(remaining.Seconds()))
+		case <-r.stopCh:
+			return
 		}
 	}
 }
+
+// Stop stops renewing the token.
+func (r *Renew) Stop() {
+	close(r.stopCh)
+}
+
+func (r *Renew) renew() (*vapi.Secret, error) {
+	renewal, err := r.client.Auth().Token().RenewTokenAsSelf(r.token, 0)
+	if err != nil {
+		return nil, err
+	}
+	if renewal == nil || renewal.Auth == nil {
+		return nil, vapi.ErrRenewerNoSecretData
+	}
+	return renewal, nil
+}
+
+// renewalDelay returns the time to wait until the remaining lease reaches the grace.
+func (r *Renew) renewalDelay(lease time.Duration) time.Duration {
+	grace := r.Grace
+	if grace <= 0 {
+		grace = time.Duration(float64(lease) * defaultRenewalGraceRatio)
+		if grace < minDefaultRenewalGrace {
+			grace = minDefaultRenewalGrace
+		}
+	}
+	if grace >= lease {
+		// Renewing at once would never end, so wait for the half of the lease.
+		return lease / 2
+	}
+	return lease - grace
+}
+
+// retryDelay returns the time to wait until the failed renewal is retried.
+// The backoff is doubled on each failure, and it doesn't exceed the remaining lease so that the token is
+// retried before it expires. If the lease is unknown (remaining <= 0), the backoff is used as it is.
+func (r *Renew) retryDelay(failures int, remaining time.Duration) time.Duration {
+	delay := r.retryBackoff
+	for i := 1; i < failures && delay < maxRenewRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRenewRetryBackoff {
+		delay = maxRenewRetryBackoff
+	}
+	if remaining > 0 && remaining < delay {
+		delay = remaining
+	}
+	return delay
+}
+
+func leaseDuration(secret *vapi.Secret) time.Duration {
+	if secret.Auth != nil {
+		return time.Duration(secret.Auth.LeaseDuration) * time.Second
+	}
+	return time.Duration(secret.LeaseDuration) * time.Second
+}
@@ -0,0 +1,26 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package vault
+
+import "time"
+
+// TokenSink receives the Vault token each time it is obtained by authentication or renewed,
+// e.g., to persist it to an external secure store for observability or revocation.
+// The token allows signing intermediate CAs, so implementations must never log it
+// or write it anywhere in plain text, such as logs, metrics and error messages.
+type TokenSink interface {
+	// Store is called after each successful authentication and renewal with the token and its lease.
+	// It is called from the renewal goroutine as well, so it must be safe for concurrent use.
+	// The lease is 0 if the token never expires.
+	Store(token string, lease time.Duration)
+}
+
+// nopTokenSink discards all tokens.
+type nopTokenSink struct{}
+
+func (nopTokenSink) Store(string, time.Duration) {}
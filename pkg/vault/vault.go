@@ -8,35 +8,155 @@
 package vault
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 	vapi "github.com/hashicorp/vault/api"
 	"github.com/imdario/mergo"
 	"github.com/spiffe/spire/pkg/common/pemutil"
+	"github.com/spiffe/spire/pkg/common/telemetry"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+
+	"github.com/zlabjp/spire-vault-plugin/pkg/common"
 )
 
 const (
-	envVaultAddr            = "VAULT_ADDR"
-	envVaultToken           = "VAULT_TOKEN"
-	envVaultClientCert      = "VAULT_CLIENT_CERT"
-	envVaultClientKey       = "VAULT_CLIENT_KEY"
-	envVaultCACert          = "VAULT_CACERT"
-	envVaultAppRoleID       = "VAULT_APPROLE_ID"
-	envVaultAppRoleSecretID = "VAULT_APPROLE_SECRET_ID"
-
-	DefaultCertMountPoint    = "cert"
-	DefaultPKIMountPoint     = "pki"
-	DefaultAppRoleMountPoint = "approle"
+	envVaultAddr             = "VAULT_ADDR"
+	envVaultToken            = "VAULT_TOKEN"
+	envVaultClientCert       = "VAULT_CLIENT_CERT"
+	envVaultClientKey        = "VAULT_CLIENT_KEY"
+	envVaultCACert           = "VAULT_CACERT"
+	envVaultAppRoleID        = "VAULT_APPROLE_ID"
+	envVaultAppRoleSecretID  = "VAULT_APPROLE_SECRET_ID"
+	envVaultTLSServerName    = "VAULT_TLS_SERVER_NAME"
+	envVaultNamespace        = "VAULT_NAMESPACE"
+	envAliCloudAccessKey     = "ALICLOUD_ACCESS_KEY"
+	envAliCloudSecretKey     = "ALICLOUD_SECRET_KEY"
+	envAliCloudSecurityToken = "ALICLOUD_SECURITY_TOKEN"
+	envCFInstanceCert        = "CF_INSTANCE_CERT"
+	envCFInstanceKey         = "CF_INSTANCE_KEY"
+
+	DefaultCertMountPoint     = "cert"
+	DefaultPKIMountPoint      = "pki"
+	DefaultAppRoleMountPoint  = "approle"
+	DefaultAliCloudMountPoint = "alicloud"
+	DefaultOCIMountPoint      = "oci"
+	DefaultCFMountPoint       = "cf"
+	DefaultRADIUSMountPoint   = "radius"
+	DefaultJWTMountPoint      = "jwt"
+	DefaultKerberosMountPoint = "kerberos"
+	DefaultAWSMountPoint      = "aws"
+	DefaultGCPMountPoint      = "gcp"
+	DefaultAzureMountPoint    = "azure"
+	// DefaultKrb5ConfPath is the path to krb5.conf which tells the KDC of the realm.
+	DefaultKrb5ConfPath = "/etc/krb5.conf"
+
+	// DefaultStandbyRetries is the number of times to retry the request failed with 412.
+	DefaultStandbyRetries = 3
+	// DefaultStandbyRetryDelay is the delay before retrying the request failed with 412.
+	DefaultStandbyRetryDelay = 500 * time.Millisecond
+	// defaultRetryDelay is the base delay before retrying the sign request failed with a server error.
+	// It is same as the minimum wait of hashicorp/vault/api.
+	defaultRetryDelay = time.Second
+
+	// DefaultDialTimeout, DefaultKeepAlive and DefaultTLSHandshakeTimeout are same as the defaults of hashicorp/vault/api.
+	DefaultDialTimeout         = 30 * time.Second
+	DefaultKeepAlive           = 30 * time.Second
+	DefaultTLSHandshakeTimeout = 10 * time.Second
+
+	// DefaultMaxChainLength is the maximum number of CA certificates accepted from sign-intermediate response.
+	DefaultMaxChainLength = 10
+	// DefaultMaxResponseBytes is the maximum size of a response body read from Vault.
+	DefaultMaxResponseBytes = 4 << 20
+
+	SignFormatPEM       = "pem"
+	SignFormatPEMBundle = "pem_bundle"
+	SignFormatDER       = "der"
+
+	SANTypeDNS   = "dns"
+	SANTypeEmail = "email"
+
+	TokenTypeService = "service"
+	TokenTypeBatch   = "batch"
+	TokenTypeDefault = "default"
 )
 
+// SignFormats is a set of formats that sign-intermediate endpoint accepts.
+var SignFormats = []string{SignFormatPEM, SignFormatPEMBundle, SignFormatDER}
+
+// SANTypes is a set of SAN types that can be stripped from the CSR.
+// Vault copies IP and URI SANs of the CSR only with use_csr_values, and has no parameter to strip them, so these aren't included.
+var SANTypes = []string{SANTypeDNS, SANTypeEmail}
+
+// TokenTypes is a set of token types that token create endpoint accepts.
+var TokenTypes = []string{TokenTypeService, TokenTypeBatch, TokenTypeDefault}
+
+// reservedHeaders are set by the vault client itself, so these can not be overridden by VaultHeaders.
+var reservedHeaders = []string{
+	"X-Vault-Token",
+	"X-Vault-Namespace",
+	"X-Vault-Wrap-Ttl",
+	"X-Vault-Mfa",
+	"X-Vault-Policy-Override",
+}
+
+var (
+	// ErrVaultSealed is returned when the request is rejected because Vault is sealed.
+	ErrVaultSealed = errors.New("vault is sealed")
+	// ErrUntrustedServer is wrapped by errors caused by the untrusted server certificate.
+	ErrUntrustedServer = errors.New("vault server certificate is not trusted")
+	// ErrUnreachable is wrapped by errors caused by the failure of the connection to Vault.
+	ErrUnreachable = errors.New("vault server is unreachable")
+	// ErrAuthRejected is wrapped by errors caused by Vault rejecting the credentials.
+	ErrAuthRejected = errors.New("vault rejected the credentials")
+	// ErrInvalidCertificate is wrapped by errors caused by the signed certificate in the response.
+	ErrInvalidCertificate = errors.New("signed certificate is invalid")
+	// ErrInvalidCAChain is wrapped by errors caused by issuing_ca or ca_chain in the response.
+	ErrInvalidCAChain = errors.New("CA certificate chain is invalid")
+	// ErrSignEndpointNotFound is wrapped by errors caused by Vault returning 404 to the sign request,
+	// which usually means the PKI mount point or the issuer is wrong.
+	ErrSignEndpointNotFound = errors.New("sign endpoint is not found in vault")
+)
+
+// classifiedError marks an error with one of the errors above (e.g., ErrUntrustedServer).
+// It can be tested by errors.Is() and keeps the original error message.
+type classifiedError struct {
+	kind error
+	err  error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
 type AuthMethod int
 
 const (
@@ -44,50 +164,385 @@ const (
 	CERT
 	TOKEN
 	APPROLE
+	ALICLOUD
+	OCI
+	CF
+	RADIUS
+	JWT
+	KERBEROS
+	AWS
+	GCP
+	AZURE
 )
 
+var authMethodNames = map[AuthMethod]string{
+	CERT:     "cert",
+	TOKEN:    "token",
+	APPROLE:  "approle",
+	ALICLOUD: "alicloud",
+	OCI:      "oci",
+	CF:       "cf",
+	RADIUS:   "radius",
+	JWT:      "jwt",
+	KERBEROS: "kerberos",
+	AWS:      "aws",
+	GCP:      "gcp",
+	AZURE:    "azure",
+}
+
+// String returns the name of the auth method in the configuration (e.g., "cert").
+func (m AuthMethod) String() string {
+	if name, ok := authMethodNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", int(m))
+}
+
 // Config represents configuration parameters for vault client
 type Config struct {
 	Logger hclog.Logger
+	// Metrics receives metrics of token renewals and re-authentications.
+	Metrics Metrics
+	// TokenSink receives the token after each successful authentication and renewal.
+	TokenSink TokenSink
+	// Proxy selects the proxy of each request to Vault.
+	// If the value is nil, the proxy is selected by HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+	Proxy func(*http.Request) (*url.URL, error)
 	// Name of method to use authenticate to vault. value must be upper case.
 	method AuthMethod
+	// Auth method to try when the login with method fails. The zero value disables the fallback.
+	fallbackMethod AuthMethod
 	// vault client parameters
 	clientParams *ClientParams
+	// Root CA pool reloaded by the watcher of CACertPath, or nil if it is not watched.
+	rootCAs *caPool
 }
 
 type ClientParams struct {
 	// A URL of Vault server. (e.g., https://vault.example.com:8443/)
 	VaultAddr string
+	// Path prefix of the Vault API, which replaces "/v1" in the request URLs (e.g., /vault/v1)
+	// for Vault served under a path of a reverse proxy. If the value is empty, "/v1" is used.
+	APIPrefix string
 	// Name of mount point where PKI secret engine is mounted. (e.e., /<mount_point>/ca/pem )
 	PKIMountPoint string
+	// Name of mount point of PKI secret engine to read the CA chain of the upstream bundle from.
+	// If the value is empty, PKIMountPoint is used.
+	BundlePKIMountPoint string
 	// token string to use when auth method is 'token'
 	Token string
 	// Name of mount point where TLS Cert auth method is mounted. (e.g., /auth/<mount_point>/login )
 	CertAuthMountPoint string
 	// Path to a client certificate file to be used when auth method is 'cert'
+	// The file may have intermediates after the client certificate.
 	ClientCertPath string
 	// Path to a client private key file to be used when auth method is 'cert'
 	ClientKeyPath string
+	// Path to a file that has both the client certificate and private key to be used when auth method is 'cert'
+	// It takes precedence over ClientCertPath and ClientKeyPath.
+	ClientCertKeyPath string
 	// Path to a CA certificate file to be used when client verifies a server certificate
+	// If the path is a directory, every .pem and .crt file in it is loaded.
+	// If the value is empty, the system trust store is used.
 	CACertPath string
+	// If true, the CA certificates in CACertPath are added to the system trust store
+	// instead of replacing it.
+	AppendCAToSystemPool bool
+	// If true, CACertPath is watched, and the new connections to Vault are verified with the reloaded CA certificates.
+	WatchCACert bool
+	// Path to a CA certificate file to be used when client verifies the certificate of an HTTPS proxy.
+	// If the path is a directory, every .pem and .crt file in it is loaded.
+	// If the value is empty, the proxy is verified in the same way as Vault.
+	ProxyCACertPath string
 	// Name of mount point where AppRole auth method is mounted. (e.g., /auth/<mount_point>/login )
 	AppRoleAuthMountPoint string
 	// An identifier of AppRole
 	AppRoleID string
 	// A credential set of AppRole
 	AppRoleSecretID string
+	// Name of mount point where AliCloud auth method is mounted. (e.g., /auth/<mount_point>/login )
+	AliCloudAuthMountPoint string
+	// Name of the role in AliCloud auth method
+	AliCloudRole string
+	// Access key ID of the RAM user or role
+	AliCloudAccessKeyID string
+	// Access key secret of the RAM user or role
+	AliCloudAccessKeySecret string
+	// Security token of STS, which is required if the access key is temporary
+	AliCloudSecurityToken string
+	// Region of STS endpoint. If the value is empty, the global endpoint is used.
+	AliCloudRegion string
+	// Name of mount point where OCI auth method is mounted. (e.g., /auth/<mount_point>/login/<role> )
+	OCIAuthMountPoint string
+	// Name of the role in OCI auth method
+	OCIRole string
+	// Region of the federation endpoint. If the value is empty, the region of the instance is used.
+	OCIRegion string
+	// Endpoint of OCI instance metadata service. If the value is empty, DefaultOCIMetadataEndpoint is used.
+	OCIMetadataEndpoint string
+	// Maximum amount of time to get a security token from the instance metadata service and the federation endpoint
+	// on each login. If the value is 0, only each of the requests times out after 10 seconds.
+	OCIMetadataTimeout time.Duration
+	// URL of the federation endpoint to get a security token. (e.g., https://auth.<region>.oraclecloud.com/v1/x509)
+	// If the value is empty, it is built from OCIRegion.
+	OCIFederationEndpoint string
+	// Name of mount point where CF auth method is mounted. (e.g., /auth/<mount_point>/login )
+	CFAuthMountPoint string
+	// Name of the role in CF auth method
+	CFRole string
+	// Path to the instance identity certificate of CF
+	CFInstanceCertPath string
+	// Path to the instance identity private key of CF
+	CFInstanceKeyPath string
+	// Name of mount point where RADIUS auth method is mounted. (e.g., /auth/<mount_point>/login/<username> )
+	RADIUSAuthMountPoint string
+	// Name of the user in RADIUS auth method
+	RADIUSUsername string
+	// Password of the user in RADIUS auth method
+	RADIUSPassword string
+	// Path to a file that holds the password of the user. It takes precedence over RADIUSPassword.
+	RADIUSPasswordFile string
+	// Name of mount point where JWT auth method is mounted. (e.g., /auth/<mount_point>/login )
+	JWTAuthMountPoint string
+	// Name of the role in JWT auth method
+	JWTRole string
+	// Path to a file that holds the JWT (e.g., a projected service account token). It is read on each login.
+	JWTPath string
+	// Audience that the aud claim of the JWT must have. If the value is empty, it is not checked.
+	JWTAudience string
+	// Name of mount point where Kerberos auth method is mounted. (e.g., /auth/<mount_point>/login )
+	KerberosAuthMountPoint string
+	// Path to the keytab which has the key of KerberosUsername
+	KerberosKeytabPath string
+	// Path to krb5.conf which tells the KDC of KerberosRealm
+	KerberosKrb5ConfPath string
+	// Name of the user in the keytab (e.g., spire-server)
+	KerberosUsername string
+	// Kerberos realm of the user (e.g., EXAMPLE.COM)
+	KerberosRealm string
+	// Service principal name of Vault (e.g., HTTP/vault.example.com)
+	KerberosService string
+	// If true, FAST negotiation is disabled, which Active Directory doesn't support.
+	KerberosDisableFAST bool
+	// Name of mount point where AWS auth method is mounted. (e.g., /auth/<mount_point>/login )
+	AWSAuthMountPoint string
+	// Name of the role in AWS auth method, which logs in with the PKCS#7 signature of the EC2 instance identity document.
+	AWSRole string
+	// Nonce of the EC2 instance, which Vault requires on each login after the first one.
+	// If the value is empty, a random nonce is generated for the client.
+	AWSNonce string
+	// Name of mount point where GCP auth method is mounted. (e.g., /auth/<mount_point>/login )
+	GCPAuthMountPoint string
+	// Name of the role in GCP auth method, which logs in with the identity token of the GCE instance.
+	GCPRole string
+	// Service account of the instance to get the identity token. If the value is empty, "default" is used.
+	GCPServiceAccount string
+	// Name of mount point where Azure auth method is mounted. (e.g., /auth/<mount_point>/login )
+	AzureAuthMountPoint string
+	// Name of the role in Azure auth method, which logs in with the token of the managed identity of the VM.
+	AzureRole string
+	// Resource of the managed identity token, which must be the one configured in Azure auth method.
+	// If the value is empty, DefaultAzureResource is used.
+	AzureResource string
+	// Address of the instance metadata service of AWS, GCP and Azure auth methods. (e.g., http://169.254.169.254)
+	// If the value is empty, the default one of each cloud is used.
+	IMDSEndpoint string
+	// Path to a KV secret that holds 'role_id' and 'secret_id' of AppRole. (e.g., secret/data/<path> )
+	// If the value is set, AppRoleID and AppRoleSecretID are read from the path before login.
+	// The read request uses Token as a bootstrap token.
+	AppRoleKVPath string
+	// If true, a child token is created with ChildTokenPolicies and ChildTokenTTL after authentication,
+	// and the child token is used for the subsequent requests instead of the token of the auth method.
+	CreateChildToken bool
+	// Policies of the child token. (e.g., a policy which allows only to sign intermediate certificates)
+	// If the value is empty, the child token inherits the policies of the parent token.
+	ChildTokenPolicies []string
+	// TTL of the child token. (e.g., 1h)
+	// If the value is empty, the default TTL of the token auth method is used.
+	ChildTokenTTL string
+	// Type of the token. (service, batch or default)
+	// It is requested on creating the child token, since login endpoints decide it by the role.
+	// If the value is batch, the token is never renewed because batch tokens can not be renewed.
+	TokenType string
 	// If true, client accepts any certificates.
 	// It should be used only test environment so on.
 	TLSSKipVerify bool
+	// Name to use as the SNI host and to verify the server certificate,
+	// instead of the host in VaultAddr.
+	TLSServerName string
+	// IDs of the cipher suites that the client offers to Vault, which only affect TLS 1.2.
+	// See ParseCipherSuites. If the value is empty, the default of crypto/tls is used.
+	TLSCipherSuites []uint16
 	// MaxRetries controls the number of times to retry to connect
 	// Set to 0 to disable retrying.
 	// If the value is nil, to use the default in hashicorp/vault/api.
 	MaxRetries *int
+	// StandbyRetries controls the number of times to retry the request
+	// when Vault returns 412 (e.g., a performance standby has not replicated the state yet).
+	// Set to 0 to disable retrying.
+	// If the value is nil, DefaultStandbyRetries is used.
+	StandbyRetries *int
+	// Delay before retrying the request which is failed with 412.
+	// If the value is 0, DefaultStandbyRetryDelay is used.
+	StandbyRetryDelay time.Duration
+	// RateLimitRetries controls the number of times to retry the sign request
+	// when Vault returns 429 by a rate limit quota.
+	// Set to 0 to disable retrying.
+	// If the value is nil, DefaultRateLimitRetries is used.
+	RateLimitRetries *int
+	// Maximum delay before retrying the request which is failed with 429, which caps Retry-After of Vault.
+	// If the value is 0, DefaultMaxRetryAfter is used.
+	MaxRetryAfter time.Duration
+	// Maximum amount of time to spend retrying a sign request, including retries for 412, 429 and server errors.
+	// Once the next retry would exceed it, the last error is returned even if attempts remain.
+	// If the value is 0, the number of retries is the only limit.
+	RetryDeadline time.Duration
+	// If true, sign requests which timed out after being sent are also retried.
+	// Vault may have issued the certificate for the request, so a retry may waste a serial number.
+	// Connection errors before the request is sent and server errors are retried regardless.
+	RetryOnTimeout bool
+	// Maximum number of idle (keep-alive) connections to Vault, which are shared by concurrent requests.
+	// If the value is 0, the default in hashicorp/vault/api is used.
+	MaxIdleConns int
+	// Maximum amount of time an idle connection to Vault remains open.
+	// If the value is 0, the default in hashicorp/vault/api is used.
+	IdleConnTimeout time.Duration
+	// Maximum amount of time a dial to Vault waits for the connection to complete.
+	// If the value is 0, DefaultDialTimeout is used.
+	DialTimeout time.Duration
+	// Interval between TCP keep-alive probes of the connections to Vault.
+	// It detects connections silently dropped by load balancers. If the value is 0, DefaultKeepAlive is used.
+	KeepAlive time.Duration
+	// Maximum amount of time to wait for the TLS handshake with Vault.
+	// If the value is 0, DefaultTLSHandshakeTimeout is used.
+	TLSHandshakeTimeout time.Duration
+	// Maximum amount of time for a request to Vault, including reading the response.
+	// If the value is 0, the default in hashicorp/vault/api (VAULT_CLIENT_TIMEOUT or 60s) is used.
+	RequestTimeout time.Duration
+	// Maximum amount of time for a login request to the auth method.
+	// If the value is 0, RequestTimeout is used.
+	AuthTimeout time.Duration
+	// Maximum amount of time for each login, including the requests to get the credentials (e.g., IMDS).
+	// If the value is 0, the login is bounded only by the timeouts of each request.
+	LoginTimeout time.Duration
+	// Maximum amount of time for each attempt of a sign request.
+	// If the value is 0, RequestTimeout is used.
+	SignTimeout time.Duration
+	// Maximum size of a response body read from Vault, in bytes.
+	// If the value is 0, DefaultMaxResponseBytes is used.
+	MaxResponseBytes int64
+	// Remaining lease of the token at which the token is renewed.
+	// If the value is 0, 10% of the lease (at least 1m) is used.
+	RenewalGrace time.Duration
+	// Static HTTP headers to set on every request to Vault. (e.g., X-Api-Gateway-Key)
+	// Headers used by Vault itself (e.g., X-Vault-Token) can not be set.
+	VaultHeaders map[string]string
+	// Name of the header to identify the SPIRE server on sign requests for audit correlation. (e.g., X-Spire-Identity)
+	// If the value is empty, no header is added.
+	ForwardIdentityHeader string
+	// Value of ForwardIdentityHeader. (e.g., example.org)
+	// If the value is empty, the SPIFFE ID in the URI SAN of the CSR is used.
+	ForwardIdentityValue string
+	// Vault Enterprise namespace to send requests to. (e.g., team-a/)
+	// It is set to X-Vault-Namespace header of every request.
+	Namespace string
+	// Format of certificates in the sign-intermediate response. (pem, pem_bundle or der)
+	// If the value is empty, Vault uses its default (pem).
+	SignFormat string
+	// Encoding of the body of sign-intermediate and login requests. (json or form)
+	// If the value is empty, the body is encoded in JSON.
+	RequestEncoding string
+	// Maximum number of sign requests per second to Vault.
+	// Set to 0 to disable rate limiting.
+	RequestsPerSecond float64
+	// Maximum number of sign requests that can be sent at once.
+	// If the value is 0, 1 is used.
+	RequestsBurst int
+	// Maximum path length of the basic constraints of the intermediate certificate.
+	// Set to 0 to prevent the intermediate from issuing further CA certificates.
+	// If the value is nil, the path length is decided by Vault.
+	MaxPathLength *int
+	// Duration by which to backdate notBefore of the intermediate certificate, to tolerate clock skew.
+	// If the value is 0, the default of Vault is used.
+	NotBeforeDuration time.Duration
+	// URLs of CRL distribution points to set into the intermediate certificate
+	CRLDistributionPoints []string
+	// URLs of OCSP servers to set into the intermediate certificate
+	OCSPServers []string
+	// DNS domains to set into the name constraints of the intermediate certificate
+	PermittedDNSDomains []string
+	// Metadata to stamp on the intermediate certificate, if the PKI secret engine accepts cert_metadata.
+	// It is sent as base64-encoded JSON.
+	CertMetadata map[string]string
+	// URI SAN to set into the intermediate certificate (e.g., spiffe://example.org)
+	URISAN string
+	// If true, method and path of each request to Vault are logged at debug level.
+	LogRequests bool
+	// Common name of the intermediate certificate.
+	// If the value is empty, the common name in the CSR is used.
+	CommonName string
+	// If true, the common name in the CSR is used and CommonName is used only if the CSR has no common name.
+	CommonNameFromCSR bool
+	// If true, Vault uses the subject and SANs in the CSR instead of the values of the PKI role.
+	// CommonName and CommonNameFromCSR are ignored since the subject comes from the CSR.
+	UseCSRValues bool
+	// SAN types (SANTypes) of the CSR that must not be forwarded to the intermediate certificate.
+	// Vault copies the SANs of the CSR only if UseCSRValues is true, so the common name added as
+	// DNS or email SAN by Vault is excluded (exclude_cn_from_sans). It can't be used with UseCSRValues.
+	StripCSRSANs []string
+	// Reference (name or ID) of the issuer that signs the intermediate certificate.
+	// If the value is empty, the default issuer of the PKI secret engine is used.
+	IssuerRef string
+	// User-Agent header to set on every request to Vault.
+	// If the value is empty, DefaultUserAgent() is used.
+	UserAgent string
+	// If true, certificates are requested in DER format and parsed directly without PEM encoding.
+	// SignFormat is ignored.
+	ResponseDER bool
+	// If true, a sign-intermediate response without both issuing_ca and ca_chain is accepted,
+	// and the response has no CA certificate.
+	AllowEmptyCAChain bool
+	// If true, certificates in ca_chain of a sign-intermediate response which can't be parsed are skipped
+	// instead of failing the response. The skipped ones are reported in SkippedCAChainErrors.
+	SkipInvalidChainCerts bool
+	// Time to serve the CA chain read by GetBundle from the cache without reading Vault again.
+	// If the value is 0, the CA chain is read from Vault on each call.
+	BundleCacheTTL time.Duration
 }
 
 type Client struct {
 	vaultClient  *vapi.Client
 	clientParams *ClientParams
+	limiter      *rate.Limiter
+	metrics      Metrics
+
+	// login authenticates to Vault again. It is nil if the auth method is token and no child token is created.
+	login      func() error
+	loginGroup singleflight.Group
+	// mu protects the token from being swapped while requests are in flight.
+	mu sync.RWMutex
+	// renew renews the current token in background. It is nil if the token is not renewable.
+	renew *Renew
+
+	// retryClient sends sign requests without retries of hashicorp/vault/api,
+	// so that the client retries them by the kind of the failure and within RetryDeadline instead.
+	retryClient *vapi.Client
+	maxRetries  int
+	retryDelay  time.Duration
+	// authClient sends login requests with AuthTimeout. It is nil if the client is not built by NewAuthenticatedClient.
+	authClient *vapi.Client
+	// caWatcher reloads the CA certificates of WatchCACert. It is nil if CACertPath is not watched.
+	caWatcher *caWatcher
+
+	// bundleMu protects the cached CA chain, and is held while the chain is read on a miss
+	// so that concurrent callers share one read.
+	bundleMu        sync.Mutex
+	bundleCache     []*x509.Certificate
+	bundleExpiresAt time.Time
+
+	// signMu protects signTarget, which overrides PKIMountPoint and IssuerRef of ClientParams once SetSignTarget is called.
+	signMu     sync.RWMutex
+	signTarget *SignTarget
 }
 
 // SignCSRResponse includes certificates which are generates by Vault
@@ -98,17 +553,207 @@ type SignCSRResponse struct {
 	CACertPEM string
 	// Set of Upstream CA certificates
 	CACertChainPEM []string
+
+	// Parsed certificates, which are set instead of the PEM fields if the response is parsed as DER.
+	Cert        *x509.Certificate
+	CACert      *x509.Certificate
+	CACertChain []*x509.Certificate
+
+	// Errors of the certificates in ca_chain which are skipped with SkipInvalidChainCerts.
+	SkippedCAChainErrors []error
+	// Address of the Vault node which signed the certificate (e.g., https://vault-1.example.org:8200).
+	// It differs from VaultAddr if the request is redirected, e.g., from a standby to the active node.
+	VaultAddr string
+}
+
+// ParseCertificate parses the signed certificate.
+// The returned error wraps ErrInvalidCertificate.
+func (r *SignCSRResponse) ParseCertificate() (*x509.Certificate, error) {
+	cert := r.Cert
+	if cert == nil {
+		var err error
+		if cert, err = pemutil.ParseCertificate([]byte(r.CertPEM)); err != nil {
+			return nil, &classifiedError{kind: ErrInvalidCertificate, err: fmt.Errorf("failed to parse signed certificate: %v", err)}
+		}
+	}
+	// x509.ParseCertificate accepts a certificate whose key algorithm is unknown, but SPIRE server can't use it.
+	if !isSupportedPublicKeyAlgorithm(cert.PublicKeyAlgorithm) {
+		return nil, &classifiedError{kind: ErrInvalidCertificate, err: fmt.Errorf("signed certificate has unsupported public key algorithm %v", cert.PublicKeyAlgorithm)}
+	}
+	return cert, nil
+}
+
+// isSupportedPublicKeyAlgorithm returns true if the key algorithm is one that SPIRE server can handle.
+// The CSR is passed through to Vault as is, so the signed certificate has the key type of the CSR.
+func isSupportedPublicKeyAlgorithm(alg x509.PublicKeyAlgorithm) bool {
+	switch alg {
+	case x509.RSA, x509.ECDSA, x509.Ed25519:
+		return true
+	default:
+		return false
+	}
+}
+
+// ParseCACertificates parses issuing_ca followed by the certificates in ca_chain.
+// It returns no certificate if both are empty, which is accepted only with AllowEmptyCAChain.
+// The returned error wraps ErrInvalidCAChain.
+func (r *SignCSRResponse) ParseCACertificates() ([]*x509.Certificate, error) {
+	if r.Cert != nil {
+		if r.CACert == nil {
+			// Both issuing_ca and ca_chain are empty
+			return nil, nil
+		}
+		return append([]*x509.Certificate{r.CACert}, r.CACertChain...), nil
+	}
+	if r.CACertPEM == "" {
+		return nil, nil
+	}
+	caCert, err := pemutil.ParseCertificate([]byte(r.CACertPEM))
+	if err != nil {
+		return nil, &classifiedError{kind: ErrInvalidCAChain, err: fmt.Errorf("failed to parse CA certificate: %v", err)}
+	}
+	certs := []*x509.Certificate{caCert}
+	for i, c := range r.CACertChainPEM {
+		cert, err := pemutil.ParseCertificate([]byte(c))
+		if err != nil {
+			return nil, &classifiedError{kind: ErrInvalidCAChain, err: fmt.Errorf("failed to parse certificate #%d of CA chain: %v", i, err)}
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// CAChainLength returns the number of certificates in ca_chain.
+func (r *SignCSRResponse) CAChainLength() int {
+	if r.Cert != nil {
+		return len(r.CACertChain)
+	}
+	return len(r.CACertChainPEM)
+}
+
+// OrderCAChain removes duplicated certificates by raw bytes (e.g., issuing_ca is also in ca_chain),
+// and orders them from the issuer of the leaf to the root, so that the upstream bundle is stable.
+// Certificates which are not in the chain of the leaf (e.g., cross-signed roots) follow in the given order.
+func OrderCAChain(leaf *x509.Certificate, certs []*x509.Certificate) []*x509.Certificate {
+	var rest []*x509.Certificate
+	for _, c := range certs {
+		dup := false
+		for _, r := range rest {
+			if bytes.Equal(c.Raw, r.Raw) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			rest = append(rest, c)
+		}
+	}
+
+	ordered := make([]*x509.Certificate, 0, len(rest))
+	current := leaf
+	for current != nil {
+		var issuer *x509.Certificate
+		for i, c := range rest {
+			if bytes.Equal(current.RawIssuer, c.RawSubject) && current.CheckSignatureFrom(c) == nil {
+				issuer = c
+				rest = append(rest[:i], rest[i+1:]...)
+				break
+			}
+		}
+		if issuer != nil {
+			ordered = append(ordered, issuer)
+		}
+		current = issuer
+	}
+	return append(ordered, rest...)
+}
+
+// VerifyChain verifies that the signed certificate chains to issuing_ca or ca_chain in the response.
+func (r *SignCSRResponse) VerifyChain() error {
+	cert, err := r.ParseCertificate()
+	if err != nil {
+		return err
+	}
+	caCerts, err := r.ParseCACertificates()
+	if err != nil {
+		return err
+	}
+	return VerifyCertificateChain(cert, caCerts, 0)
+}
+
+// VerifyCertificateChain verifies that the parsed certificate chains to the parsed CA certificates.
+// It is VerifyChain for callers which have already parsed the response.
+// The validity period of the certificate is extended by clockSkew, so that a certificate whose NotBefore is
+// slightly in the future due to the clock of Vault is accepted.
+func VerifyCertificateChain(cert *x509.Certificate, caCerts []*x509.Certificate, clockSkew time.Duration) error {
+	roots := x509.NewCertPool()
+	for _, caCert := range caCerts {
+		roots.AddCert(caCert)
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:       roots,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		CurrentTime: verificationTime(cert, time.Now(), clockSkew),
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		return fmt.Errorf("certificate does not chain to the CA certificates returned from Vault: %v", err)
+	}
+	return nil
+}
+
+// verificationTime returns now moved into the validity period of the certificate if it is out of the period within the skew.
+func verificationTime(cert *x509.Certificate, now time.Time, skew time.Duration) time.Time {
+	switch {
+	case now.Before(cert.NotBefore) && cert.NotBefore.Sub(now) <= skew:
+		return cert.NotBefore
+	case now.After(cert.NotAfter) && now.Sub(cert.NotAfter) <= skew:
+		return cert.NotAfter
+	default:
+		return now
+	}
+}
+
+// VerifyCA verifies that the signed certificate is a valid CA certificate.
+// A certificate signed with the sign endpoint instead of sign-intermediate is not a CA.
+func (r *SignCSRResponse) VerifyCA() error {
+	cert, err := r.ParseCertificate()
+	if err != nil {
+		return err
+	}
+	return VerifyCACertificate(cert)
+}
+
+// VerifyCACertificate verifies that the parsed certificate is a valid CA certificate.
+// It is VerifyCA for callers which have already parsed the response.
+func VerifyCACertificate(cert *x509.Certificate) error {
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return errors.New("certificate is not a CA certificate (check that the sign-intermediate endpoint is used)")
+	}
+	return nil
 }
 
 // New returns a new *Config with default parameters.
 func New(authMethod AuthMethod) *Config {
 	return &Config{
-		Logger: hclog.New(hclog.DefaultOptions),
-		method: authMethod,
+		Logger:    hclog.New(hclog.DefaultOptions),
+		Metrics:   nopMetrics{},
+		TokenSink: nopTokenSink{},
+		method:    authMethod,
 		clientParams: &ClientParams{
-			CertAuthMountPoint:    DefaultCertMountPoint,
-			AppRoleAuthMountPoint: DefaultAppRoleMountPoint,
-			PKIMountPoint:         DefaultPKIMountPoint,
+			CertAuthMountPoint:     DefaultCertMountPoint,
+			AppRoleAuthMountPoint:  DefaultAppRoleMountPoint,
+			AliCloudAuthMountPoint: DefaultAliCloudMountPoint,
+			OCIAuthMountPoint:      DefaultOCIMountPoint,
+			CFAuthMountPoint:       DefaultCFMountPoint,
+			RADIUSAuthMountPoint:   DefaultRADIUSMountPoint,
+			JWTAuthMountPoint:      DefaultJWTMountPoint,
+			KerberosAuthMountPoint: DefaultKerberosMountPoint,
+			KerberosKrb5ConfPath:   DefaultKrb5ConfPath,
+			AWSAuthMountPoint:      DefaultAWSMountPoint,
+			GCPAuthMountPoint:      DefaultGCPMountPoint,
+			AzureAuthMountPoint:    DefaultAzureMountPoint,
+			PKIMountPoint:          DefaultPKIMountPoint,
 		},
 	}
 }
@@ -125,6 +770,19 @@ func (c *Config) WithEnvVar() *Config {
 	c.clientParams.ClientKeyPath = os.Getenv(envVaultClientKey)
 	c.clientParams.AppRoleID = os.Getenv(envVaultAppRoleID)
 	c.clientParams.AppRoleSecretID = os.Getenv(envVaultAppRoleSecretID)
+	c.clientParams.TLSServerName = os.Getenv(envVaultTLSServerName)
+	c.clientParams.Namespace = os.Getenv(envVaultNamespace)
+	c.clientParams.AliCloudAccessKeyID = os.Getenv(envAliCloudAccessKey)
+	c.clientParams.AliCloudAccessKeySecret = os.Getenv(envAliCloudSecretKey)
+	c.clientParams.AliCloudSecurityToken = os.Getenv(envAliCloudSecurityToken)
+	c.clientParams.CFInstanceCertPath = os.Getenv(envCFInstanceCert)
+	c.clientParams.CFInstanceKeyPath = os.Getenv(envCFInstanceKey)
+	return c
+}
+
+// WithFallback sets the auth method to try when the login with the primary auth method fails.
+func (c *Config) WithFallback(method AuthMethod) *Config {
+	c.fallbackMethod = method
 	return c
 }
 
@@ -133,6 +791,19 @@ func (c *Config) SetClientParams(p *ClientParams) error {
 	if c.clientParams == nil {
 		c.clientParams = &ClientParams{}
 	}
+	p.PKIMountPoint = normalizeMountPoint(p.PKIMountPoint)
+	p.BundlePKIMountPoint = normalizeMountPoint(p.BundlePKIMountPoint)
+	p.CertAuthMountPoint = normalizeMountPoint(p.CertAuthMountPoint)
+	p.AppRoleAuthMountPoint = normalizeMountPoint(p.AppRoleAuthMountPoint)
+	p.AliCloudAuthMountPoint = normalizeMountPoint(p.AliCloudAuthMountPoint)
+	p.OCIAuthMountPoint = normalizeMountPoint(p.OCIAuthMountPoint)
+	p.CFAuthMountPoint = normalizeMountPoint(p.CFAuthMountPoint)
+	p.RADIUSAuthMountPoint = normalizeMountPoint(p.RADIUSAuthMountPoint)
+	p.JWTAuthMountPoint = normalizeMountPoint(p.JWTAuthMountPoint)
+	p.KerberosAuthMountPoint = normalizeMountPoint(p.KerberosAuthMountPoint)
+	p.AWSAuthMountPoint = normalizeMountPoint(p.AWSAuthMountPoint)
+	p.GCPAuthMountPoint = normalizeMountPoint(p.GCPAuthMountPoint)
+	p.AzureAuthMountPoint = normalizeMountPoint(p.AzureAuthMountPoint)
 	if err := mergo.Merge(p, c.clientParams); err != nil {
 		return err
 	}
@@ -140,8 +811,26 @@ func (c *Config) SetClientParams(p *ClientParams) error {
 	return nil
 }
 
+// isPlainHTTP reports whether the vault address uses http scheme.
+func isPlainHTTP(addr string) bool {
+	u, err := url.Parse(addr)
+	return err == nil && strings.ToLower(u.Scheme) == "http"
+}
+
+// normalizeMountPoint trims leading, trailing and duplicated slashes from the mount point.
+// (e.g., "/team//pki/" -> "team/pki")
+func normalizeMountPoint(mountPoint string) string {
+	var elems []string
+	for _, e := range strings.Split(mountPoint, "/") {
+		if e != "" {
+			elems = append(elems, e)
+		}
+	}
+	return strings.Join(elems, "/")
+}
+
 // NewAuthenticatedClient returns a new authenticated vault client
-func (c *Config) NewAuthenticatedClient() (*Client, error) {
+func (c *Config) NewAuthenticatedClient() (client *Client, err error) {
 	config := vapi.DefaultConfig()
 	config.Address = c.clientParams.VaultAddr
 
@@ -149,219 +838,1432 @@ func (c *Config) NewAuthenticatedClient() (*Client, error) {
 		config.MaxRetries = *c.clientParams.MaxRetries
 	}
 
-	if err := c.ConfigureTLS(config); err != nil {
+	if isPlainHTTP(c.clientParams.VaultAddr) {
+		if c.method == CERT || c.fallbackMethod == CERT {
+			return nil, errors.New("cert auth method requires https scheme in vault address")
+		}
+		c.Logger.Warn("Vault address uses plain HTTP scheme, so requests to Vault are not encrypted. This is insecure and only for development", "vault_addr", c.clientParams.VaultAddr)
+	} else if err := c.ConfigureTLS(config); err != nil {
 		return nil, err
 	}
+	if c.clientParams.ProxyCACertPath != "" {
+		if err := c.configureProxyTLS(config); err != nil {
+			return nil, err
+		}
+	}
+	var watcher *caWatcher
+	if c.clientParams.WatchCACert && c.clientParams.CACertPath != "" && !isPlainHTTP(c.clientParams.VaultAddr) {
+		if watcher, err = c.configureCAWatch(config); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil && watcher != nil {
+				watcher.stop()
+			}
+		}()
+	}
+	c.configureTransport(config)
 	vc, err := vapi.NewClient(config)
 	if err != nil {
 		return nil, err
 	}
-
-	client := &Client{
-		vaultClient:  vc,
-		clientParams: c.clientParams,
+	// NewClient reads VAULT_NAMESPACE by itself, but the namespace is set explicitly
+	// so that the inline namespace takes precedence over the environment variable.
+	if c.clientParams.Namespace != "" {
+		vc.SetNamespace(c.clientParams.Namespace)
 	}
-
-	switch c.method {
-	case TOKEN:
-		client.SetToken(c.clientParams.Token)
-	case CERT:
-		path := fmt.Sprintf("auth/%v/login", c.clientParams.CertAuthMountPoint)
-		sec, err := client.Auth(path, map[string]interface{}{})
+	if c.clientParams.LogRequests {
+		config.HttpClient.Transport = &loggingTransport{
+			logger: c.Logger,
+			next:   config.HttpClient.Transport,
+		}
+	}
+	if c.clientParams.APIPrefix != "" {
+		// vault/api builds the path of each request with the path of the address and "/v1"
+		addr, err := url.Parse(c.clientParams.VaultAddr)
 		if err != nil {
 			return nil, err
 		}
-		if sec == nil {
-			return nil, errors.New("tls cert authentication response is nil")
+		base := strings.TrimSuffix(addr.Path, "/")
+		config.HttpClient.Transport = &prefixTransport{
+			host:   addr.Host,
+			from:   base + "/v1/",
+			prefix: base + strings.TrimSuffix(c.clientParams.APIPrefix, "/") + "/",
+			next:   config.HttpClient.Transport,
 		}
-		if sec.Auth.Renewable {
-			c.Logger.Debug("token will be renewed")
-			if err := renewToken(vc, sec, c.Logger); err != nil {
-				return nil, err
-			}
-		} else {
-			c.Logger.Debug("token never renew")
+	}
+	// vault/api follows only a single redirect by itself, so follow them by the client instead.
+	config.HttpClient.CheckRedirect = checkRedirect
+	config.HttpClient.Transport = &redirectTransport{next: config.HttpClient.Transport}
+	maxResponseBytes := c.clientParams.MaxResponseBytes
+	if maxResponseBytes <= 0 {
+		maxResponseBytes = DefaultMaxResponseBytes
+	}
+	config.HttpClient.Transport = &limitTransport{limit: maxResponseBytes, next: config.HttpClient.Transport}
+	if err := c.configureHeaders(vc); err != nil {
+		return nil, err
+	}
+
+	client = &Client{
+		vaultClient:  vc,
+		clientParams: c.clientParams,
+		metrics:      c.Metrics,
+		caWatcher:    watcher,
+	}
+	rc, err := vc.Clone()
+	if err != nil {
+		return nil, err
+	}
+	rc.SetMaxRetries(0)
+	rc.SetHeaders(vc.Headers())
+	client.retryClient = rc
+	client.maxRetries = config.MaxRetries
+	ac, err := vc.Clone()
+	if err != nil {
+		return nil, err
+	}
+	ac.SetHeaders(vc.Headers())
+	client.authClient = ac
+	c.configureTimeouts(config, client)
+	client.retryDelay = defaultRetryDelay
+	if c.clientParams.RequestsPerSecond > 0 {
+		burst := c.clientParams.RequestsBurst
+		if burst <= 0 {
+			burst = 1
 		}
-	case APPROLE:
-		path := fmt.Sprintf("auth/%v/login", c.clientParams.AppRoleAuthMountPoint)
-		body := map[string]interface{}{
-			"role_id":   c.clientParams.AppRoleID,
-			"secret_id": c.clientParams.AppRoleSecretID,
+		client.limiter = rate.NewLimiter(rate.Limit(c.clientParams.RequestsPerSecond), burst)
+	}
+
+	if c.method == TOKEN && !c.clientParams.CreateChildToken && c.fallbackMethod == 0 {
+		client.SetToken(c.clientParams.Token)
+		return client, nil
+	}
+	source, err := c.credentialSource(c.method)
+	if err != nil {
+		return nil, err
+	}
+	if c.fallbackMethod == 0 {
+		client.login = func() error {
+			return c.login(client, source)
 		}
-		sec, err := client.Auth(path, body)
+	} else {
+		fallback, err := c.credentialSource(c.fallbackMethod)
 		if err != nil {
 			return nil, err
 		}
-		if sec == nil {
-			return nil, errors.New("approle authentication response is nil")
-		}
-		if sec.Auth.Renewable {
-			c.Logger.Debug("token will be renewed")
-			if err := renewToken(vc, sec, c.Logger); err != nil {
-				return nil, err
-			}
-		} else {
-			c.Logger.Debug("token never renew")
+		client.login = func() error {
+			return c.loginWithFallback(client, source, fallback)
 		}
 	}
+	if err := client.login(); err != nil {
+		return nil, err
+	}
 
 	return client, nil
 }
 
-func renewToken(vc *vapi.Client, sec *vapi.Secret, logger hclog.Logger) error {
-	renew, err := NewRenew(vc, sec)
-	if err != nil {
-		return err
+// credentialSource returns the CredentialSource of the auth method.
+// The token of token auth method is looked up on login, so that a revoked or expired token falls back.
+func (c *Config) credentialSource(method AuthMethod) (CredentialSource, error) {
+	if method == TOKEN && c.fallbackMethod != 0 {
+		return &tokenSource{params: c.clientParams, lookup: true}, nil
 	}
-	renew.Logger = logger
-	go renew.Run()
-	return nil
+	return NewCredentialSource(method, c.clientParams)
 }
 
-// ConfigureTLS Configures TLS for Vault Client
-func (c *Config) ConfigureTLS(vc *vapi.Config) error {
-	if vc.HttpClient == nil {
-		vc.HttpClient = vapi.DefaultConfig().HttpClient
+// loginWithFallback logs in with the primary source, and with the fallback source if the primary login fails.
+// The primary auth method is tried first on each login, so the client returns to it once it recovers.
+func (c *Config) loginWithFallback(client *Client, primary, fallback CredentialSource) error {
+	err := c.login(client, primary)
+	if err == nil {
+		c.Logger.Info("Authenticated to Vault with the primary auth method", "auth_method", c.method.String())
+		return nil
 	}
-	clientTLSConfig := vc.HttpClient.Transport.(*http.Transport).TLSClientConfig
+	c.Logger.Warn("Failed to authenticate to Vault with the primary auth method, so trying the fallback auth method", "auth_method", c.method.String(), "fallback_auth_method", c.fallbackMethod.String(), "err", err)
+	if fallbackErr := c.login(client, fallback); fallbackErr != nil {
+		return fmt.Errorf("fallback auth method %v also failed: %w (primary auth method %v: %v)", c.fallbackMethod, fallbackErr, c.method, err)
+	}
+	c.Logger.Info("Authenticated to Vault with the fallback auth method", "auth_method", c.fallbackMethod.String())
+	return nil
+}
 
-	var clientCert tls.Certificate
-	foundClientCert := false
+// login authenticates to Vault with the credential source, creates a child token if configured,
+// and renews the token in background if it is renewable.
+func (c *Config) login(client *Client, source CredentialSource) error {
+	// The previous token is never sent with the login requests.
+	client.vaultClient.ClearToken()
+	// The login isn't bound to the context of a request, since concurrent requests share it on reauthentication.
+	ctx := context.Background()
+	if c.clientParams.LoginTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.clientParams.LoginTimeout)
+		defer cancel()
+	}
+	token, lease, err := source.Authenticate(ctx, client.authHTTPClient())
+	if err != nil {
+		return err
+	}
+	var sec *vapi.Secret
+	if token != nil {
+		client.SetToken(token.ID)
+		sec = &vapi.Secret{Auth: &vapi.SecretAuth{
+			ClientToken:   token.ID,
+			Renewable:     token.Renewable,
+			LeaseDuration: int(lease / time.Second),
+		}}
+	} else {
+		client.SetToken(c.clientParams.Token)
+	}
 
-	switch {
-	case c.method == TOKEN:
-	case c.clientParams.ClientCertPath != "" && c.clientParams.ClientKeyPath != "":
-		keyObj, err := pemutil.LoadPrivateKey(c.clientParams.ClientKeyPath)
+	if c.clientParams.CreateChildToken {
+		sec, err = client.CreateChildToken(c.clientParams.ChildTokenPolicies, c.clientParams.ChildTokenTTL, c.clientParams.TokenType)
 		if err != nil {
-			return fmt.Errorf("failed to load client private-key: %v", err)
-		}
-		Key, err := pemutil.EncodePKCS8PrivateKey(keyObj)
-		if err != nil {
-			return fmt.Errorf("failed to encode client private-key: %v", err)
+			return err
 		}
-
-		certObj, err := pemutil.LoadCertificate(c.clientParams.ClientCertPath)
-		if err != nil {
-			return fmt.Errorf("failed to load client certificate: %v", err)
+		if sec == nil {
+			return errors.New("token create response is nil")
 		}
-		cert := pemutil.EncodeCertificate(certObj)
-
-		c, err := tls.X509KeyPair(cert, Key)
-		if err != nil {
-			return fmt.Errorf("failed to parse client cert and private-key: %v", err)
+	}
+	if sec == nil {
+		// The given token is used as it is, and never renewed.
+		if client.renew != nil {
+			client.renew.Stop()
+			client.renew = nil
 		}
-		clientCert = c
-		foundClientCert = true
-	case c.clientParams.ClientCertPath != "" || c.clientParams.ClientKeyPath != "":
-		return fmt.Errorf("client cert and client key is required")
+		return nil
 	}
 
-	if c.clientParams.CACertPath != "" {
-		certs, err := pemutil.LoadCertificates(c.clientParams.CACertPath)
+	// The previous token is no longer used.
+	if client.renew != nil {
+		client.renew.Stop()
+		client.renew = nil
+	}
+	if sec.Auth.Renewable && !isBatchToken(sec, c.clientParams.TokenType) {
+		c.Logger.Debug("token will be renewed")
+		renew, err := renewToken(client.vaultClient, sec, c.clientParams.RenewalGrace, c.Logger, c.Metrics, c.TokenSink)
 		if err != nil {
-			return fmt.Errorf("failed to load CA certificate: %v", err)
-		}
-		pool := x509.NewCertPool()
-		for i := range certs {
-			cert := certs[i]
-			pool.AddCert(cert)
+			return err
 		}
-		clientTLSConfig.RootCAs = pool
+		client.renew = renew
+	} else {
+		c.Logger.Debug("token never renew")
 	}
+	if c.TokenSink != nil {
+		c.TokenSink.Store(sec.Auth.ClientToken, leaseDuration(sec))
+	}
+	return nil
+}
 
-	if c.clientParams.TLSSKipVerify {
-		clientTLSConfig.InsecureSkipVerify = true
+// configureHeaders sets User-Agent and VaultHeaders to the given vault client
+func (c *Config) configureHeaders(vc *vapi.Client) error {
+	headers := vc.Headers()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	userAgent := c.clientParams.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent()
 	}
+	headers.Set("User-Agent", userAgent)
 
-	if foundClientCert {
-		clientTLSConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
-			return &clientCert, nil
+	for k, v := range c.clientParams.VaultHeaders {
+		name := http.CanonicalHeaderKey(k)
+		for _, r := range reservedHeaders {
+			if name == r {
+				return fmt.Errorf("header %v is reserved and can not be overridden", k)
+			}
 		}
+		headers.Set(name, v)
 	}
-
+	if h := c.clientParams.ForwardIdentityHeader; h != "" {
+		name := http.CanonicalHeaderKey(h)
+		for _, r := range reservedHeaders {
+			if name == r {
+				return fmt.Errorf("header %v is reserved and can not be used as the identity header", h)
+			}
+		}
+	}
+	vc.SetHeaders(headers)
 	return nil
 }
 
-// SetToken wraps vapi.Client.SetToken()
-func (c *Client) SetToken(v string) {
-	c.vaultClient.SetToken(v)
+// DefaultUserAgent returns User-Agent header value which is used if user_agent is not configured.
+func DefaultUserAgent() string {
+	return fmt.Sprintf("spire-vault-plugin/%v", common.Version)
 }
 
-// TLSAuth authenticates to vault server with TLS certificate method
-func (c *Client) Auth(path string, body map[string]interface{}) (*vapi.Secret, error) {
-	c.vaultClient.ClearToken()
-	secret, err := c.vaultClient.Logical().Write(path, body)
-	if err != nil {
-		return nil, fmt.Errorf("authentication failed %v: %v", path, err)
-	}
+// loggingTransport logs method and path of each request to Vault.
+// Headers, query and body are never logged since they may carry tokens and secrets.
+type loggingTransport struct {
+	logger hclog.Logger
+	next   http.RoundTripper
+}
 
-	tokenId, err := secret.TokenID()
-	if err != nil {
-		return nil, fmt.Errorf("authentication is successful, but could not get token: %v", err)
-	}
-	c.vaultClient.SetToken(tokenId)
-	return secret, nil
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.logger.Debug("Sending request to Vault", "method", req.Method, "path", req.URL.Path)
+	return t.next.RoundTrip(req)
 }
 
-// SignIntermediate requests sign-intermediate endpoint to generate certificate.
-// ttl = Issue Intermediate CA Certificate by given TTL
-// csr = PEM format CSR
-// see: https://www.vaultproject.io/api/secret/pki/index.html#sign-intermediate
-func (c *Client) SignIntermediate(ttl string, csr []byte) (*SignCSRResponse, error) {
-	csrObj, err := pemutil.ParseCertificateRequest(csr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse CSR PEM data: %v", err)
-	}
+// prefixTransport replaces "/v1" of the requests to Vault with the API prefix.
+// The requests to other hosts (e.g., redirected to the active node) are sent as they are.
+type prefixTransport struct {
+	host   string
+	from   string
+	prefix string
+	next   http.RoundTripper
+}
 
-	reqData := map[string]interface{}{
-		"common_name":  csrObj.Subject.CommonName,
-		"organization": strings.Join(csrObj.Subject.Organization, ","),
-		"country":      strings.Join(csrObj.Subject.Country, ","),
-		"csr":          string(csr),
-		"ttl":          ttl,
+func (t *prefixTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host || !strings.HasPrefix(req.URL.Path, t.from) {
+		return t.next.RoundTrip(req)
 	}
+	r := req.Clone(req.Context())
+	r.URL.Path = t.prefix + strings.TrimPrefix(req.URL.Path, t.from)
+	r.URL.RawPath = ""
+	return t.next.RoundTrip(r)
+}
+
+// limitTransport bounds the size of the response bodies from Vault, so that a misbehaving endpoint
+// can't exhaust the memory with a huge body. Reading beyond the limit fails with errResponseTooLarge.
+type limitTransport struct {
+	limit int64
+	next  http.RoundTripper
+}
 
-	path := fmt.Sprintf("/%s/root/sign-intermediate", c.clientParams.PKIMountPoint)
-	s, err := c.vaultClient.Logical().Write(path, reqData)
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
 	if err != nil {
 		return nil, err
 	}
+	resp.Body = &limitedBody{
+		r:     io.LimitReader(resp.Body, t.limit+1),
+		c:     resp.Body,
+		limit: t.limit,
+	}
+	return resp, nil
+}
 
-	resp := &SignCSRResponse{}
+// errResponseTooLarge is returned when the response body from Vault exceeds MaxResponseBytes.
+var errResponseTooLarge = errors.New("response body from Vault exceeds the limit of max_response_bytes")
 
-	if certData, ok := s.Data["certificate"]; !ok {
-		return nil, errors.New("request is successful, but certificate data is empty")
-	} else {
-		if cert, ok := certData.(string); !ok {
-			return nil, errors.New("failed to type conversion for certificate")
-		} else {
-			resp.CertPEM = cert
-		}
-	}
+type limitedBody struct {
+	r     io.Reader
+	c     io.Closer
+	limit int64
+	read  int64
+}
 
-	if caCertData, ok := s.Data["issuing_ca"]; !ok {
-		return nil, errors.New("request is successful, but issuing_ca data is empty")
-	} else {
-		if caCert, ok := caCertData.(string); !ok {
-			return nil, errors.New("failed to type conversion for issuing_ca")
-		} else {
-			resp.CACertPEM = caCert
-		}
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.read > b.limit {
+		return 0, fmt.Errorf("%w (%d bytes)", errResponseTooLarge, b.limit)
 	}
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		// Drop the extra byte read to detect the excess
+		return n - 1, fmt.Errorf("%w (%d bytes)", errResponseTooLarge, b.limit)
+	}
+	return n, err
+}
 
-	if caChainData, ok := s.Data["ca_chain"]; !ok {
-		// empty is general use case when Vault is Root CA.
-	} else {
-		if caChainCertObj, ok := caChainData.([]interface{}); !ok {
-			return nil, fmt.Errorf("failed to type conversion for ca_chain, %v", reflect.TypeOf(caChainData))
-		} else {
-			var caChainCert []string
-			for i := range caChainCertObj {
-				caChainCert = append(caChainCert, caChainCertObj[i].(string))
+func (b *limitedBody) Close() error {
+	return b.c.Close()
+}
+
+// isBatchToken returns true if the token is configured or issued as a batch token.
+// Batch tokens have the prefix "b." (or "hvb." since Vault 1.10).
+func isBatchToken(sec *vapi.Secret, tokenType string) bool {
+	if tokenType == TokenTypeBatch {
+		return true
+	}
+	return strings.HasPrefix(sec.Auth.ClientToken, "b.") || strings.HasPrefix(sec.Auth.ClientToken, "hvb.")
+}
+
+func renewToken(vc *vapi.Client, sec *vapi.Secret, grace time.Duration, logger hclog.Logger, metrics Metrics, sink TokenSink) (*Renew, error) {
+	renew, err := NewRenew(vc, sec)
+	if err != nil {
+		return nil, err
+	}
+	renew.Grace = grace
+	renew.Logger = logger
+	if metrics != nil {
+		renew.Metrics = metrics
+	}
+	if sink != nil {
+		renew.TokenSink = sink
+	}
+	go renew.Run()
+	return renew, nil
+}
+
+// configureTransport tunes the connection pool of the transport.
+// All requests of the client share the transport, so TLS connections are reused by concurrent requests.
+func (c *Config) configureTransport(vc *vapi.Config) {
+	transport, ok := vc.HttpClient.Transport.(*http.Transport)
+	if !ok {
+		return
+	}
+	if c.clientParams.MaxIdleConns > 0 {
+		// All requests are sent to the single Vault host.
+		transport.MaxIdleConns = c.clientParams.MaxIdleConns
+		transport.MaxIdleConnsPerHost = c.clientParams.MaxIdleConns
+	}
+	if c.clientParams.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = c.clientParams.IdleConnTimeout
+	}
+	if c.clientParams.DialTimeout > 0 || c.clientParams.KeepAlive > 0 {
+		dialer := &net.Dialer{
+			Timeout:   DefaultDialTimeout,
+			KeepAlive: DefaultKeepAlive,
+		}
+		if c.clientParams.DialTimeout > 0 {
+			dialer.Timeout = c.clientParams.DialTimeout
+		}
+		if c.clientParams.KeepAlive > 0 {
+			dialer.KeepAlive = c.clientParams.KeepAlive
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	if c.clientParams.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = c.clientParams.TLSHandshakeTimeout
+	}
+	if c.Proxy != nil {
+		transport.Proxy = c.Proxy
+	}
+	vc.HttpClient.Transport = &pooledTransport{next: transport}
+}
+
+// configureTimeouts sets the timeouts of the login and sign requests, which fall back to RequestTimeout.
+// The http.Client is shared by the clones of the client, so its timeout is replaced with the context
+// timeout of each client, which hashicorp/vault/api applies to every request.
+func (c *Config) configureTimeouts(vc *vapi.Config, client *Client) {
+	p := c.clientParams
+	if p.RequestTimeout <= 0 && p.AuthTimeout <= 0 && p.SignTimeout <= 0 {
+		return
+	}
+	timeout := p.RequestTimeout
+	if timeout <= 0 {
+		timeout = vc.Timeout
+	}
+	if timeout <= 0 {
+		timeout = vc.HttpClient.Timeout
+	}
+	vc.HttpClient.Timeout = 0
+	client.vaultClient.SetClientTimeout(timeout)
+
+	authTimeout, signTimeout := timeout, timeout
+	if p.AuthTimeout > 0 {
+		authTimeout = p.AuthTimeout
+	}
+	if p.SignTimeout > 0 {
+		signTimeout = p.SignTimeout
+	}
+	client.authClient.SetClientTimeout(authTimeout)
+	client.retryClient.SetClientTimeout(signTimeout)
+}
+
+// pooledTransport keeps idle connections of the transport.
+// go-retryablehttp closes idle connections of the http.Client after every request,
+// which forces a new TLS handshake per request. http.Client closes idle connections
+// only if the transport has CloseIdleConnections(), so pooledTransport hides it.
+type pooledTransport struct {
+	next http.RoundTripper
+}
+
+func (t *pooledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.next.RoundTrip(req)
+}
+
+// loadCombinedKeyPair loads the client certificate and private key from a single PEM file.
+// The certificates are sent in the order in the file, so the leaf certificate must come first.
+func loadCombinedKeyPair(path string) (tls.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load client cert and private-key: %v", err)
+	}
+
+	var certPEM, keyPEM []byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY") && keyPEM == nil:
+			keyPEM = pem.EncodeToMemory(block)
+		}
+	}
+	if certPEM == nil {
+		return tls.Certificate{}, fmt.Errorf("client certificate is not found in %v", path)
+	}
+	if keyPEM == nil {
+		return tls.Certificate{}, fmt.Errorf("client private-key is not found in %v", path)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to parse client cert and private-key: %v", err)
+	}
+	return cert, nil
+}
+
+// ConfigureTLS Configures TLS for Vault Client
+func (c *Config) ConfigureTLS(vc *vapi.Config) error {
+	if vc.HttpClient == nil {
+		vc.HttpClient = vapi.DefaultConfig().HttpClient
+	}
+	clientTLSConfig := vc.HttpClient.Transport.(*http.Transport).TLSClientConfig
+
+	var clientCert tls.Certificate
+	foundClientCert := false
+
+	switch {
+	case c.method == TOKEN && c.fallbackMethod != CERT:
+	case c.clientParams.ClientCertKeyPath != "":
+		c, err := loadCombinedKeyPair(c.clientParams.ClientCertKeyPath)
+		if err != nil {
+			return err
+		}
+		clientCert = c
+		foundClientCert = true
+	case c.clientParams.ClientCertPath != "" && c.clientParams.ClientKeyPath != "":
+		keyObj, err := pemutil.LoadPrivateKey(c.clientParams.ClientKeyPath)
+		if err != nil {
+			return fmt.Errorf("failed to load client private-key: %v", err)
+		}
+		Key, err := pemutil.EncodePKCS8PrivateKey(keyObj)
+		if err != nil {
+			return fmt.Errorf("failed to encode client private-key: %v", err)
+		}
+
+		// The file may have intermediates after the client certificate, and the whole chain is presented.
+		certObjs, err := pemutil.LoadCertificates(c.clientParams.ClientCertPath)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		cert := pemutil.EncodeCertificates(certObjs)
+
+		c, err := tls.X509KeyPair(cert, Key)
+		if err != nil {
+			return fmt.Errorf("failed to parse client cert and private-key: %v", err)
+		}
+		clientCert = c
+		foundClientCert = true
+	case c.clientParams.ClientCertPath != "" || c.clientParams.ClientKeyPath != "":
+		return fmt.Errorf("client cert and client key is required")
+	}
+
+	switch {
+	case c.clientParams.CACertPath != "":
+		pool, err := c.loadRootCAs()
+		if err != nil {
+			return err
+		}
+		clientTLSConfig.RootCAs = pool
+	case clientTLSConfig.RootCAs == nil:
+		// Vault may use a publicly trusted certificate, so the system trust store is used.
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			c.Logger.Warn("Failed to load system cert pool", "err", err.Error())
+			break
+		}
+		clientTLSConfig.RootCAs = pool
+	}
+
+	if c.clientParams.TLSServerName != "" {
+		clientTLSConfig.ServerName = c.clientParams.TLSServerName
+	}
+
+	if len(c.clientParams.TLSCipherSuites) != 0 {
+		clientTLSConfig.CipherSuites = c.clientParams.TLSCipherSuites
+	}
+
+	if c.clientParams.TLSSKipVerify {
+		clientTLSConfig.InsecureSkipVerify = true
+	}
+
+	if foundClientCert {
+		clientTLSConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &clientCert, nil
+		}
+	}
+
+	return nil
+}
+
+// loadRootCAs returns the pool of the CA certificates in CACertPath, which is added to the system pool
+// if AppendCAToSystemPool is set.
+func (c *Config) loadRootCAs() (*x509.CertPool, error) {
+	certs, err := c.loadCACertificates(c.clientParams.CACertPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if c.clientParams.AppendCAToSystemPool {
+		pool, err = x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load system cert pool: %v", err)
+		}
+	}
+	for i := range certs {
+		cert := certs[i]
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+// ParseCipherSuites returns the IDs of the cipher suites by the names in crypto/tls. (e.g., TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+// Insecure cipher suites and the ones only for TLS 1.3, which can't be configured, are rejected.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := make(map[string]*tls.CipherSuite)
+	for _, s := range tls.CipherSuites() {
+		suites[s.Name] = s
+	}
+	insecure := make(map[string]bool)
+	for _, s := range tls.InsecureCipherSuites() {
+		insecure[s.Name] = true
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		if insecure[name] {
+			return nil, fmt.Errorf("insecure cipher suite %q", name)
+		}
+		s, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if onlyTLS13(s) {
+			return nil, fmt.Errorf("cipher suite %q of TLS 1.3, which can't be configured", name)
+		}
+		ids = append(ids, s.ID)
+	}
+	return ids, nil
+}
+
+// onlyTLS13 reports whether the cipher suite is supported only by TLS 1.3.
+func onlyTLS13(s *tls.CipherSuite) bool {
+	for _, v := range s.SupportedVersions {
+		if v != tls.VersionTLS13 {
+			return false
+		}
+	}
+	return true
+}
+
+// loadCACertificates loads the CA certificates from the PEM file, or from every .pem and .crt file in the directory.
+// Files in the directory which can't be read or have no certificate are skipped with a warning.
+func (c *Config) loadCACertificates(path string) ([]*x509.Certificate, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return pemutil.LoadCertificates(path)
+	}
+
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for _, f := range files {
+		ext := strings.ToLower(filepath.Ext(f.Name()))
+		if f.IsDir() || (ext != ".pem" && ext != ".crt") {
+			continue
+		}
+		name := filepath.Join(path, f.Name())
+		fileCerts, err := pemutil.LoadCertificates(name)
+		if err != nil {
+			c.Logger.Warn("Skipped a file in the CA certificate directory", "path", name, "err", err.Error())
+			continue
+		}
+		certs = append(certs, fileCerts...)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no CA certificate is found in %v", path)
+	}
+	return certs, nil
+}
+
+// SetToken wraps vapi.Client.SetToken()
+func (c *Client) SetToken(v string) {
+	c.vaultClient.SetToken(v)
+}
+
+// CreateChildToken creates a child token of the current token, and uses it for the subsequent requests.
+// see: https://www.vaultproject.io/api/auth/token/index.html#create-token
+func (c *Client) CreateChildToken(policies []string, ttl, tokenType string) (*vapi.Secret, error) {
+	body := map[string]interface{}{
+		"display_name": "spire-vault-plugin",
+	}
+	if len(policies) != 0 {
+		body["policies"] = policies
+	}
+	if ttl != "" {
+		body["ttl"] = ttl
+	}
+	if tokenType != "" {
+		body["type"] = tokenType
+	}
+	secret, err := c.logicalWrite(context.Background(), c.vaultClient, "auth/token/create", body, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create child token: %w", classifyError(err))
+	}
+	if secret == nil || secret.Auth == nil {
+		return nil, errors.New("child token is created, but the response has no auth data")
+	}
+
+	tokenId, err := secret.TokenID()
+	if err != nil {
+		return nil, fmt.Errorf("child token is created, but could not get token: %v", err)
+	}
+	c.vaultClient.SetToken(tokenId)
+	return secret, nil
+}
+
+// RevokeSelf stops renewing the token and revokes it, so that it doesn't linger until the TTL after the client is discarded.
+// The token given by token auth method is never revoked since it is not issued for the client.
+// see: https://www.vaultproject.io/api/auth/token/index.html#revoke-a-token-self
+func (c *Client) RevokeSelf(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.renew != nil {
+		c.renew.Stop()
+		c.renew = nil
+	}
+	if c.login == nil || c.vaultClient.Token() == "" {
+		return nil
+	}
+	r := c.vaultClient.NewRequest(http.MethodPut, "/v1/auth/token/revoke-self")
+	resp, err := c.vaultClient.RawRequestWithContext(ctx, r)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", classifyError(err))
+	}
+	defer resp.Body.Close()
+	c.vaultClient.ClearToken()
+	return nil
+}
+
+// Close stops watching CACertPath. The token is kept, so RevokeSelf has to be called to revoke it.
+func (c *Client) Close() {
+	if c.caWatcher != nil {
+		c.caWatcher.stop()
+	}
+}
+
+// authHTTPClient returns the HTTP client of CredentialSource, which sends the login requests with authClient.
+func (c *Client) authHTTPClient() *http.Client {
+	vc := c.vaultClient
+	if c.authClient != nil {
+		vc = c.authClient
+	}
+	return &http.Client{
+		Transport: &vaultTransport{client: vc},
+		// The client of vc follows the redirects of Vault.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// GetBundle reads the CA chain of the PKI secret engine, ordered from the issuing CA to the root CA.
+// If the CA chain is not configured, it reads the CA certificate instead.
+// see: https://www.vaultproject.io/api/secret/pki/index.html#read-certificate
+func (c *Client) GetBundle() ([]*x509.Certificate, error) {
+	if c.clientParams.BundleCacheTTL <= 0 {
+		return c.readBundle()
+	}
+
+	c.bundleMu.Lock()
+	defer c.bundleMu.Unlock()
+	if c.bundleCache != nil && time.Now().Before(c.bundleExpiresAt) {
+		return append([]*x509.Certificate(nil), c.bundleCache...), nil
+	}
+	certs, err := c.readBundle()
+	if err != nil {
+		return nil, err
+	}
+	c.bundleCache = certs
+	c.bundleExpiresAt = time.Now().Add(c.clientParams.BundleCacheTTL)
+	return append([]*x509.Certificate(nil), certs...), nil
+}
+
+// GetBundleWithTarget returns the CA chain to be the upstream bundle of the certificates signed with the target.
+// It is the CA chain of BundlePKIMountPoint if it is set, otherwise the one of the PKI mount point of the target.
+// Only the CA chain of BundlePKIMountPoint or the default PKI mount point is cached by BundleCacheTTL.
+func (c *Client) GetBundleWithTarget(target *SignTarget) ([]*x509.Certificate, error) {
+	if c.clientParams.BundlePKIMountPoint == "" && target != nil && target.PKIMountPoint != "" {
+		mountPoint := normalizeMountPoint(target.PKIMountPoint)
+		if defaultMount, _ := c.defaultSignTarget(); mountPoint != defaultMount {
+			return c.readBundleFrom(mountPoint)
+		}
+	}
+	return c.GetBundle()
+}
+
+// invalidateBundleOnRootChange drops the cached CA chain if the root CA in the sign response is not the one of the cache,
+// so that a rotation of the upstream CA is read on the next GetBundle without waiting for BundleCacheTTL.
+// Roots are compared by the subject key ID, or by the certificate if either has no subject key ID.
+// If the chain of either doesn't reach a self-signed root, the cache is kept since the roots can't be compared.
+func (c *Client) invalidateBundleOnRootChange(resp *SignCSRResponse) {
+	if c.clientParams.BundleCacheTTL <= 0 {
+		return
+	}
+	cert, err := resp.ParseCertificate()
+	if err != nil {
+		return
+	}
+	caCerts, err := resp.ParseCACertificates()
+	if err != nil || len(caCerts) == 0 {
+		return
+	}
+	caCerts = OrderCAChain(cert, caCerts)
+	root := caCerts[len(caCerts)-1]
+
+	c.bundleMu.Lock()
+	defer c.bundleMu.Unlock()
+	if len(c.bundleCache) == 0 {
+		return
+	}
+	cached := c.bundleCache[len(c.bundleCache)-1]
+	if !isSelfSigned(root) || !isSelfSigned(cached) || sameRoot(root, cached) {
+		return
+	}
+	c.bundleCache, c.bundleExpiresAt = nil, time.Time{}
+	c.incrCounter(metricBundleCacheRootChange)
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer)
+}
+
+func sameRoot(a, b *x509.Certificate) bool {
+	if len(a.SubjectKeyId) != 0 && len(b.SubjectKeyId) != 0 {
+		return bytes.Equal(a.SubjectKeyId, b.SubjectKeyId)
+	}
+	return bytes.Equal(a.Raw, b.Raw)
+}
+
+// MountType returns the type of the secret engine mounted at mountPoint (e.g., pki or kv).
+// It reads sys/internal/ui/mounts/<path>, which is allowed for a token with any capability on the mount.
+// see: https://www.vaultproject.io/api-docs/system/internal-ui-mounts
+func (c *Client) MountType(mountPoint string) (string, error) {
+	path := fmt.Sprintf("sys/internal/ui/mounts/%s", normalizeMountPoint(mountPoint))
+	s, err := c.vaultClient.Logical().Read(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %v: %w", path, classifyError(err))
+	}
+	if s == nil {
+		return "", fmt.Errorf("mount is not found in %v", path)
+	}
+	mountType, ok := s.Data["type"].(string)
+	if !ok || mountType == "" {
+		return "", fmt.Errorf("type of the mount is not found in %v", path)
+	}
+	return mountType, nil
+}
+
+// readBundle reads the CA chain from the PKI secret engine.
+func (c *Client) readBundle() ([]*x509.Certificate, error) {
+	mountPoint := c.clientParams.BundlePKIMountPoint
+	if mountPoint == "" {
+		mountPoint, _ = c.defaultSignTarget()
+	}
+	return c.readBundleFrom(mountPoint)
+}
+
+// readBundleFrom reads the CA chain of the PKI secret engine at the mount point, or the CA certificate if it has no chain.
+func (c *Client) readBundleFrom(mountPoint string) ([]*x509.Certificate, error) {
+	for _, serial := range []string{"ca_chain", "ca"} {
+		path := fmt.Sprintf("/%s/cert/%s", mountPoint, serial)
+		s, err := c.vaultClient.Logical().Read(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %v: %v", path, err)
+		}
+		if s == nil {
+			continue
+		}
+		certData, ok := s.Data["certificate"].(string)
+		if !ok || strings.TrimSpace(certData) == "" {
+			continue
+		}
+		certs, err := pemutil.ParseCertificates([]byte(certData))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificates from %v: %v", path, err)
+		}
+		return certs, nil
+	}
+	return nil, fmt.Errorf("CA certificate is not found in %v", mountPoint)
+}
+
+// SignTarget overrides the PKI secret engine and the issuer that signs the CSR.
+// Empty fields fall back to PKIMountPoint and IssuerRef of ClientParams.
+type SignTarget struct {
+	PKIMountPoint string
+	IssuerRef     string
+}
+
+// SetSignTarget replaces the PKI secret engine and the issuer that sign CSRs without target, without authenticating again.
+// If PKIMountPoint of target is empty, DefaultPKIMountPoint is used.
+// If the PKI secret engine is changed, the cached CA chain of the previous one is dropped.
+func (c *Client) SetSignTarget(target SignTarget) {
+	target.PKIMountPoint = normalizeMountPoint(target.PKIMountPoint)
+	if target.PKIMountPoint == "" {
+		target.PKIMountPoint = DefaultPKIMountPoint
+	}
+	c.signMu.Lock()
+	prev, _ := c.defaultSignTargetLocked()
+	c.signTarget = &target
+	c.signMu.Unlock()
+
+	if prev != target.PKIMountPoint {
+		c.bundleMu.Lock()
+		c.bundleCache, c.bundleExpiresAt = nil, time.Time{}
+		c.bundleMu.Unlock()
+	}
+}
+
+// defaultSignTarget returns the PKI mount point and the issuer that sign CSRs without target.
+func (c *Client) defaultSignTarget() (pkiMountPoint, issuerRef string) {
+	c.signMu.RLock()
+	defer c.signMu.RUnlock()
+	return c.defaultSignTargetLocked()
+}
+
+func (c *Client) defaultSignTargetLocked() (pkiMountPoint, issuerRef string) {
+	if c.signTarget != nil {
+		return c.signTarget.PKIMountPoint, c.signTarget.IssuerRef
+	}
+	return c.clientParams.PKIMountPoint, c.clientParams.IssuerRef
+}
+
+// SignIntermediate requests sign-intermediate endpoint to generate certificate.
+// ttl = Issue Intermediate CA Certificate by given TTL
+// csr = PEM format CSR
+// If RequestsPerSecond is set, it blocks until the request is allowed or ctx is done.
+// see: https://www.vaultproject.io/api/secret/pki/index.html#sign-intermediate
+func (c *Client) SignIntermediate(ctx context.Context, ttl string, csr []byte) (*SignCSRResponse, error) {
+	return c.SignIntermediateWithTarget(ctx, nil, ttl, csr)
+}
+
+// SignIntermediateWithTarget is same as SignIntermediate, but signs the CSR with the PKI secret engine and the issuer of target.
+// If target is nil, the ones of ClientParams (or SetSignTarget) are used.
+func (c *Client) SignIntermediateWithTarget(ctx context.Context, target *SignTarget, ttl string, csr []byte) (*SignCSRResponse, error) {
+	csrObj, err := pemutil.ParseCertificateRequest(csr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSR PEM data: %v", err)
+	}
+
+	if c.limiter != nil {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return nil, fmt.Errorf("failed to wait for rate limiter: %v", err)
+		}
+	}
+
+	commonName := csrObj.Subject.CommonName
+	if !c.clientParams.UseCSRValues && c.clientParams.CommonName != "" && (!c.clientParams.CommonNameFromCSR || commonName == "") {
+		commonName = c.clientParams.CommonName
+	}
+
+	reqData := map[string]interface{}{
+		"common_name":  commonName,
+		"organization": strings.Join(csrObj.Subject.Organization, ","),
+		"country":      strings.Join(csrObj.Subject.Country, ","),
+		"csr":          string(csr),
+		"ttl":          ttl,
+	}
+	if c.clientParams.UseCSRValues {
+		reqData["use_csr_values"] = true
+	}
+	for _, t := range c.clientParams.StripCSRSANs {
+		if t == SANTypeDNS || t == SANTypeEmail {
+			reqData["exclude_cn_from_sans"] = true
+		}
+	}
+	if c.clientParams.ResponseDER {
+		reqData["format"] = SignFormatDER
+	} else if c.clientParams.SignFormat != "" {
+		reqData["format"] = c.clientParams.SignFormat
+	}
+	if c.clientParams.MaxPathLength != nil {
+		reqData["max_path_length"] = *c.clientParams.MaxPathLength
+	}
+	if c.clientParams.NotBeforeDuration > 0 {
+		reqData["not_before_duration"] = fmt.Sprintf("%d", int64(c.clientParams.NotBeforeDuration/time.Second))
+	}
+	if len(c.clientParams.CRLDistributionPoints) != 0 {
+		reqData["crl_distribution_points"] = c.clientParams.CRLDistributionPoints
+	}
+	if len(c.clientParams.OCSPServers) != 0 {
+		reqData["ocsp_servers"] = c.clientParams.OCSPServers
+	}
+	if len(c.clientParams.PermittedDNSDomains) != 0 {
+		reqData["permitted_dns_domains"] = c.clientParams.PermittedDNSDomains
+	}
+	if len(c.clientParams.CertMetadata) != 0 {
+		// Vault expects base64-encoded metadata. Keys are sorted by json.Marshal, so the value is deterministic.
+		b, err := json.Marshal(c.clientParams.CertMetadata)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode cert_metadata: %v", err)
+		}
+		reqData["cert_metadata"] = base64.StdEncoding.EncodeToString(b)
+	}
+	if c.clientParams.URISAN != "" {
+		reqData["uri_sans"] = c.clientParams.URISAN
+	}
+
+	pkiMountPoint, issuerRef := c.defaultSignTarget()
+	if target != nil && target.PKIMountPoint != "" {
+		pkiMountPoint = normalizeMountPoint(target.PKIMountPoint)
+	}
+	if target != nil && target.IssuerRef != "" {
+		issuerRef = target.IssuerRef
+	}
+	path := fmt.Sprintf("/%s/root/sign-intermediate", pkiMountPoint)
+	if issuerRef != "" {
+		path = fmt.Sprintf("/%s/issuer/%s/sign-intermediate", pkiMountPoint, issuerRef)
+	}
+	ctx, servedAddr := withServedAddr(ctx)
+	s, err := c.writeWithHeader(ctx, path, reqData, c.identityHeader(csrObj))
+	if err != nil {
+		if isNotFound(err) {
+			return nil, &classifiedError{kind: ErrSignEndpointNotFound, err: fmt.Errorf("%v is not found (PKI mount point %q, issuer %q): %v", path, pkiMountPoint, issuerRef, err)}
+		}
+		return nil, err
+	}
+
+	resp, err := c.parseSignResponse(s)
+	if err != nil {
+		return nil, err
+	}
+	resp.VaultAddr = *servedAddr
+	c.incrCounterWithLabels(metricSignSuccess, telemetry.Label{Name: labelVaultAddr, Value: c.vaultAddrLabel(resp.VaultAddr)})
+
+	if err := resp.VerifyCA(); err != nil {
+		c.incrCounter(metricSignNonCACertificate)
+	}
+	if defaultMount, _ := c.defaultSignTarget(); pkiMountPoint == defaultMount {
+		// Other mounts of the sign targets may have their own roots
+		c.invalidateBundleOnRootChange(resp)
+	}
+
+	return resp, nil
+}
+
+// identityHeader returns the header identifying the SPIRE server for ForwardIdentityHeader.
+// It returns nil if the header is not configured or the CSR has no SPIFFE ID to derive the value from.
+func (c *Client) identityHeader(csr *x509.CertificateRequest) http.Header {
+	if c.clientParams == nil || c.clientParams.ForwardIdentityHeader == "" {
+		return nil
+	}
+	value := c.clientParams.ForwardIdentityValue
+	if value == "" {
+		for _, u := range csr.URIs {
+			if u.Scheme == "spiffe" {
+				value = u.String()
+				break
+			}
+		}
+	}
+	if value == "" {
+		return nil
+	}
+	header := make(http.Header)
+	header.Set(c.clientParams.ForwardIdentityHeader, value)
+	return header
+}
+
+// parseSignResponse reads the certificates in the sign-intermediate response.
+// If ResponseDER is set, the base64 DER fields are parsed into x509.Certificate directly without PEM encoding.
+func (c *Client) parseSignResponse(s *vapi.Secret) (*SignCSRResponse, error) {
+	cert, caCert, caChain, err := signResponseFields(s)
+	if err != nil {
+		return nil, err
+	}
+	resp := &SignCSRResponse{}
+
+	if c.clientParams.ResponseDER {
+		if resp.Cert, err = parseDERCertificate(cert); err != nil {
+			return nil, &classifiedError{kind: ErrInvalidCertificate, err: fmt.Errorf("failed to parse certificate: %v", err)}
+		}
+		if caCert != "" {
+			if resp.CACert, err = parseDERCertificate(caCert); err != nil {
+				return nil, &classifiedError{kind: ErrInvalidCAChain, err: fmt.Errorf("failed to parse issuing_ca: %v", err)}
 			}
-			resp.CACertChainPEM = caChainCert
 		}
+		for i, data := range caChain {
+			chainCert, err := parseDERCertificate(data)
+			if err != nil {
+				err = fmt.Errorf("failed to parse certificate #%d of ca_chain: %v", i, err)
+				if c.clientParams.SkipInvalidChainCerts {
+					resp.SkippedCAChainErrors = append(resp.SkippedCAChainErrors, err)
+					continue
+				}
+				return nil, &classifiedError{kind: ErrInvalidCAChain, err: err}
+			}
+			resp.CACertChain = append(resp.CACertChain, chainCert)
+		}
+
+		// Some PKI mounts return only one of them, so the other is filled with it.
+		switch {
+		case resp.CACert == nil && len(resp.CACertChain) == 0:
+			if !c.clientParams.AllowEmptyCAChain {
+				return nil, errors.New("request is successful, but both issuing_ca and ca_chain are empty")
+			}
+		case len(resp.CACertChain) == 0:
+			resp.CACertChain = []*x509.Certificate{resp.CACert}
+		case resp.CACert == nil:
+			resp.CACert = resp.CACertChain[0]
+		}
+		return resp, nil
 	}
 
+	if resp.CertPEM, err = c.toPEM(cert); err != nil {
+		return nil, fmt.Errorf("failed to convert certificate: %v", err)
+	}
+	if caCert != "" {
+		if resp.CACertPEM, err = c.toPEM(caCert); err != nil {
+			return nil, fmt.Errorf("failed to convert issuing_ca: %v", err)
+		}
+	}
+	for i, data := range caChain {
+		certPEM, err := c.toPEM(data)
+		if err == nil && c.clientParams.SkipInvalidChainCerts {
+			// The PEM certificates are parsed later by ParseCACertificates, so they are checked here to skip them.
+			_, err = pemutil.ParseCertificate([]byte(certPEM))
+		}
+		if err != nil {
+			if c.clientParams.SkipInvalidChainCerts {
+				resp.SkippedCAChainErrors = append(resp.SkippedCAChainErrors, fmt.Errorf("failed to parse certificate #%d of ca_chain: %v", i, err))
+				continue
+			}
+			return nil, fmt.Errorf("failed to convert ca_chain: %v", err)
+		}
+		resp.CACertChainPEM = append(resp.CACertChainPEM, certPEM)
+	}
+
+	// Some PKI mounts return only one of them, so the other is filled with it.
+	// ca_chain starts with the issuing CA.
+	switch {
+	case resp.CACertPEM == "" && len(resp.CACertChainPEM) == 0:
+		if !c.clientParams.AllowEmptyCAChain {
+			return nil, errors.New("request is successful, but both issuing_ca and ca_chain are empty")
+		}
+	case len(resp.CACertChainPEM) == 0:
+		resp.CACertChainPEM = []string{resp.CACertPEM}
+	case resp.CACertPEM == "":
+		resp.CACertPEM = resp.CACertChainPEM[0]
+	}
 	return resp, nil
 }
+
+// signResponseFields returns certificate, issuing_ca and ca_chain in the sign-intermediate response as they are.
+func signResponseFields(s *vapi.Secret) (cert, caCert string, caChain []string, err error) {
+	if certData, ok := s.Data["certificate"]; !ok {
+		return "", "", nil, errors.New("request is successful, but certificate data is empty")
+	} else if cert, ok = certData.(string); !ok {
+		return "", "", nil, errors.New("failed to type conversion for certificate")
+	}
+
+	if caCertData, ok := s.Data["issuing_ca"]; ok && caCertData != nil {
+		if caCert, ok = caCertData.(string); !ok {
+			return "", "", nil, errors.New("failed to type conversion for issuing_ca")
+		}
+	}
+
+	if caChainData, ok := s.Data["ca_chain"]; !ok || caChainData == nil {
+		// empty is general use case when Vault is Root CA.
+	} else {
+		caChainCertObj, ok := caChainData.([]interface{})
+		if !ok {
+			return "", "", nil, fmt.Errorf("failed to type conversion for ca_chain, %v", reflect.TypeOf(caChainData))
+		}
+		for i := range caChainCertObj {
+			data, ok := caChainCertObj[i].(string)
+			if !ok {
+				return "", "", nil, fmt.Errorf("failed to type conversion for ca_chain, %v", reflect.TypeOf(caChainCertObj[i]))
+			}
+			caChain = append(caChain, data)
+		}
+	}
+	return cert, caCert, caChain, nil
+}
+
+// parseDERCertificate parses a base64 encoded DER certificate.
+func parseDERCertificate(data string) (*x509.Certificate, error) {
+	der, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode DER data: %v", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+// write requests to Vault with the current token.
+// If the token is rejected, it authenticates to Vault again and retries the request once.
+func (c *Client) write(ctx context.Context, path string, data map[string]interface{}) (*vapi.Secret, error) {
+	return c.writeWithHeader(ctx, path, data, nil)
+}
+
+// writeWithHeader is same as write, but adds the header to the request.
+func (c *Client) writeWithHeader(ctx context.Context, path string, data map[string]interface{}, header http.Header) (*vapi.Secret, error) {
+	c.mu.RLock()
+	token := c.vaultClient.Token()
+	c.mu.RUnlock()
+	s, err := c.writeWithStandbyRetry(ctx, path, data, header)
+	if err == nil || c.login == nil || !isPermissionDenied(err) {
+		return s, err
+	}
+
+	if err := c.reauthenticate(token); err != nil {
+		return nil, fmt.Errorf("failed to re-authenticate: %v", err)
+	}
+
+	return c.writeWithStandbyRetry(ctx, path, data, header)
+}
+
+// writeWithStandbyRetry writes data to the path, and retries after a delay if Vault returns 412 or 429.
+// retryablehttp in hashicorp/vault/api doesn't retry 412 since it is not a server error.
+// 429 is retried after Retry-After of Vault, apart from the backoff of server errors.
+// Server errors and connection errors are also retried here instead of retryablehttp, so that ambiguous timeouts
+// are retried only if RetryOnTimeout is set. If RetryDeadline is set, retries are stopped at the deadline.
+// Sealed Vault is not retried, since it doesn't recover until it is unsealed, and ErrVaultSealed is returned.
+func (c *Client) writeWithStandbyRetry(ctx context.Context, path string, data map[string]interface{}, header http.Header) (*vapi.Secret, error) {
+	retries := DefaultStandbyRetries
+	if c.clientParams.StandbyRetries != nil {
+		retries = *c.clientParams.StandbyRetries
+	}
+	delay := c.clientParams.StandbyRetryDelay
+	if delay <= 0 {
+		delay = DefaultStandbyRetryDelay
+	}
+
+	rateLimitRetries := DefaultRateLimitRetries
+	if c.clientParams.RateLimitRetries != nil {
+		rateLimitRetries = *c.clientParams.RateLimitRetries
+	}
+
+	start := time.Now()
+	for standbyRetried, serverRetried, rateLimitRetried := 0, 0, 0; ; {
+		c.mu.RLock()
+		s, err := c.writeOnce(ctx, path, data, header)
+		c.mu.RUnlock()
+		if err == nil {
+			return s, err
+		}
+		if c.isSealed(err) {
+			return nil, ErrVaultSealed
+		}
+
+		var (
+			wait            time.Duration
+			tooManyRequests *tooManyRequestsError
+		)
+		switch {
+		case errors.As(err, &tooManyRequests) && rateLimitRetried < rateLimitRetries:
+			rateLimitRetried++
+			wait = c.rateLimitDelay(tooManyRequests, rateLimitRetried)
+		case isPreconditionFailed(err) && standbyRetried < retries:
+			standbyRetried++
+			wait = delay
+		case c.retryClient != nil && c.isRetryable(err) && serverRetried < c.maxRetries:
+			serverRetried++
+			wait = c.retryDelay * time.Duration(serverRetried)
+		default:
+			return s, err
+		}
+		if c.clientParams.RetryDeadline > 0 && time.Since(start)+wait > c.clientParams.RetryDeadline {
+			return s, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// writeOnce writes data to the path with the current token. It must be called with mu held.
+func (c *Client) writeOnce(ctx context.Context, path string, data map[string]interface{}, header http.Header) (*vapi.Secret, error) {
+	if c.retryClient == nil {
+		return c.logicalWrite(ctx, c.vaultClient, path, data, header)
+	}
+	// Concurrent callers set the same token, since the token is swapped only with mu locked.
+	c.retryClient.SetToken(c.vaultClient.Token())
+	return c.logicalWrite(ctx, c.retryClient, path, data, header)
+}
+
+// reauthenticate authenticates to Vault again if the token is still staleToken.
+// Concurrent callers share one login attempt.
+func (c *Client) reauthenticate(staleToken string) error {
+	_, err, _ := c.loginGroup.Do("login", func() (interface{}, error) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.vaultClient.Token() != staleToken {
+			// Another caller has already authenticated again.
+			return nil, nil
+		}
+		if err := c.login(); err != nil {
+			c.incrCounter(metricReauthenticateFailure)
+			return nil, err
+		}
+		c.incrCounter(metricReauthenticateSuccess)
+		return nil, nil
+	})
+	return err
+}
+
+func (c *Client) incrCounter(key []string) {
+	if c.metrics != nil {
+		c.metrics.IncrCounter(key, 1)
+	}
+}
+
+func (c *Client) incrCounterWithLabels(key []string, labels ...telemetry.Label) {
+	if c.metrics != nil {
+		c.metrics.IncrCounterWithLabels(key, 1, labels)
+	}
+}
+
+// vaultAddrLabel returns the value of labelVaultAddr for the address which served a request.
+// The value is VaultAddr without the path if it served the request, otherwise otherVaultAddr.
+func (c *Client) vaultAddrLabel(addr string) string {
+	u, err := url.Parse(c.clientParams.VaultAddr)
+	if err != nil {
+		return otherVaultAddr
+	}
+	configured := (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+	if addr != configured {
+		return otherVaultAddr
+	}
+	return configured
+}
+
+func isPermissionDenied(err error) bool {
+	respErr, ok := err.(*vapi.ResponseError)
+	return ok && respErr.StatusCode == http.StatusForbidden
+}
+
+func isNotFound(err error) bool {
+	respErr, ok := err.(*vapi.ResponseError)
+	return ok && respErr.StatusCode == http.StatusNotFound
+}
+
+// isServerError returns true if the error is worth retrying as retryablehttp does.
+func isServerError(err error) bool {
+	if respErr, ok := err.(*vapi.ResponseError); ok {
+		return respErr.StatusCode >= 500 && respErr.StatusCode != http.StatusNotImplemented
+	}
+	return errors.Is(classifyError(err), ErrUnreachable)
+}
+
+// IsTemporary reports whether the error is caused by Vault not being ready yet (e.g., unreachable or unavailable),
+// so that retrying the request later may succeed.
+func IsTemporary(err error) bool {
+	var respErr *vapi.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode >= 500 && respErr.StatusCode != http.StatusNotImplemented
+	}
+	return errors.Is(err, ErrUnreachable)
+}
+
+// isRetryable reports whether the failed sign request is retried.
+// A timeout after the request is sent is ambiguous since Vault may have issued the certificate,
+// so that it is retried only if RetryOnTimeout is set.
+func (c *Client) isRetryable(err error) bool {
+	if isResponseTimeout(err) {
+		return c.clientParams.RetryOnTimeout
+	}
+	return isServerError(err)
+}
+
+// isResponseTimeout reports whether the request timed out after the connection is established.
+func isResponseTimeout(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func isPreconditionFailed(err error) bool {
+	respErr, ok := err.(*vapi.ResponseError)
+	return ok && respErr.StatusCode == http.StatusPreconditionFailed
+}
+
+// toPEM converts a certificate in the sign-intermediate response into a PEM format.
+// In case of pem_bundle, only the first certificate is returned since the issuing CA
+// is also returned as issuing_ca.
+func (c *Client) toPEM(data string) (string, error) {
+	switch c.clientParams.SignFormat {
+	case SignFormatDER:
+		der, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode DER data: %v", err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), nil
+	case SignFormatPEMBundle:
+		block, _ := pem.Decode([]byte(data))
+		if block == nil {
+			return "", errors.New("no PEM data is found in pem_bundle")
+		}
+		return string(pem.EncodeToMemory(block)), nil
+	default:
+		return data, nil
+	}
+}
+
+// classifyError wraps the given error to tell its cause.
+// If the cause is unknown, the error is returned as it is.
+func classifyError(err error) error {
+	var (
+		respErr     *vapi.ResponseError
+		unknownErr  x509.UnknownAuthorityError
+		hostnameErr x509.HostnameError
+		invalidErr  x509.CertificateInvalidError
+		opErr       *net.OpError
+		dnsErr      *net.DNSError
+	)
+
+	switch {
+	case errors.As(err, &respErr):
+		switch respErr.StatusCode {
+		case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+			return &classifiedError{kind: ErrAuthRejected, err: err}
+		}
+	case errors.As(err, &unknownErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return &classifiedError{kind: ErrUntrustedServer, err: err}
+	case errors.As(err, &opErr), errors.As(err, &dnsErr):
+		return &classifiedError{kind: ErrUnreachable, err: err}
+	}
+	return err
+}
+
+// isSealed reports whether the given error is caused by sealed Vault.
+// If the response body doesn't tell, ask sys/health endpoint.
+func (c *Client) isSealed(err error) bool {
+	respErr, ok := err.(*vapi.ResponseError)
+	if !ok || respErr.StatusCode != http.StatusServiceUnavailable {
+		return false
+	}
+	for _, e := range respErr.Errors {
+		if strings.Contains(e, "sealed") {
+			return true
+		}
+	}
+
+	// sys/health is checked once per failed request, so it is not retried by hashicorp/vault/api.
+	hc := c.vaultClient
+	if c.retryClient != nil {
+		hc = c.retryClient
+	}
+	health, err := hc.Sys().Health()
+	if err != nil {
+		return false
+	}
+	return health.Sealed
+}
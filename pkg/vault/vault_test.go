@@ -9,17 +9,41 @@ package vault
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 	vapi "github.com/hashicorp/vault/api"
+	"github.com/spiffe/spire/pkg/common/pemutil"
+	"github.com/spiffe/spire/pkg/common/telemetry"
 
 	"github.com/zlabjp/spire-vault-plugin/pkg/common"
 	"github.com/zlabjp/spire-vault-plugin/pkg/fake"
@@ -29,6 +53,7 @@ const (
 	caCert     = "../fake/_test_data/ca.pem"
 	serverCert = "../fake/_test_data/server.pem"
 	serverKey  = "../fake/_test_data/server-key.pem"
+	sniCert    = "../fake/_test_data/sni-server.pem"
 	clientCert = "../fake/_test_data/client.pem"
 	clientKey  = "../fake/_test_data/client-key.pem"
 	testReqCSR = "../fake/_test_data/test-req.csr"
@@ -142,6 +167,65 @@ func TestNewAuthenticatedClientWithCertAuthError(t *testing.T) {
 	}
 }
 
+func TestNewAuthenticatedClientWithCertAuthChain(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	// The server trusts only the root, so the handshake fails unless the intermediate is presented.
+	vc.ClientCAPemPath = "../fake/_test_data/client-root-ca.pem"
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(CERT)
+	c.Logger = getTestLogger()
+	retry := 0
+	cp := &ClientParams{
+		MaxRetries:     &retry,
+		VaultAddr:      fmt.Sprintf("https://%v/", addr),
+		CACertPath:     caCert,
+		ClientCertPath: "../fake/_test_data/client-chain.pem",
+		ClientKeyPath:  "../fake/_test_data/client-chain-key.pem",
+	}
+	if err := c.SetClientParams(cp); err != nil {
+		t.Errorf("failed to prepare test client: %v", err)
+	}
+
+	if _, err := c.NewAuthenticatedClient(); err != nil {
+		t.Fatalf("unexpected error from NewAuthenticatedClient(): %v", err)
+	}
+
+	req := vc.LastCertAuthRequest()
+	if req == nil {
+		t.Fatalf("login request is not sent to cert auth endpoint")
+	}
+	var got []string
+	for _, cert := range req.PeerCertificates {
+		got = append(got, cert.Subject.CommonName)
+	}
+	want := []string{"test client", "test client intermediate ca"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got presented chain %v, want %v", got, want)
+	}
+}
+
 func TestNewAuthenticatedClientWithTokenAuth(t *testing.T) {
 	vc := fake.NewVaultServerConfig()
 
@@ -172,6 +256,298 @@ func TestNewAuthenticatedClientWithTokenAuth(t *testing.T) {
 	}
 }
 
+func TestNewAuthenticatedClientWithFallbackAuth(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	lookupResp, err := ioutil.ReadFile("../fake/_test_data/token-lookup-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name           string
+		lookupCode     int
+		certAuthCode   int
+		expectToken    string
+		expectCertAuth bool
+		expectError    bool
+	}{
+		{
+			name:         "Token is accepted",
+			lookupCode:   200,
+			certAuthCode: 200,
+			expectToken:  "test-token",
+		},
+		{
+			name:           "Token is rejected and falls back to cert",
+			lookupCode:     403,
+			certAuthCode:   200,
+			expectToken:    "cf95f87d-f95b-47ff-b1f5-ba7bff850425",
+			expectCertAuth: true,
+		},
+		{
+			name:           "Both are rejected",
+			lookupCode:     403,
+			certAuthCode:   400,
+			expectCertAuth: true,
+			expectError:    true,
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.TokenLookupResponseCode = tc.lookupCode
+		vc.TokenLookupResponse = lookupResp
+		vc.CertAuthResponseCode = tc.certAuthCode
+		vc.CertAuthResponse = certAuthResp
+		if tc.certAuthCode != 200 {
+			vc.CertAuthResponse = []byte(`{"errors":["invalid certificate or no client certificate supplied"]}`)
+		}
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		c := New(TOKEN).WithFallback(CERT)
+		c.Logger = getTestLogger()
+		cp := &ClientParams{
+			VaultAddr:      fmt.Sprintf("https://%v/", addr),
+			CACertPath:     caCert,
+			Token:          "test-token",
+			ClientCertPath: clientCert,
+			ClientKeyPath:  clientKey,
+		}
+		if err := c.SetClientParams(cp); err != nil {
+			t.Errorf("%v: failed to prepare test client: %v", tc.name, err)
+		}
+
+		client, err := c.NewAuthenticatedClient()
+		if tc.expectError {
+			if err == nil {
+				t.Errorf("%v: expected got an error", tc.name)
+			} else if !errors.Is(err, ErrAuthRejected) {
+				t.Errorf("%v: got %v, want %v", tc.name, err, ErrAuthRejected)
+			}
+		} else if err != nil {
+			t.Errorf("%v: unexpected error from NewAuthenticatedClient(): %v", tc.name, err)
+		} else if got := client.vaultClient.Token(); got != tc.expectToken {
+			t.Errorf("%v: got token %v, want %v", tc.name, got, tc.expectToken)
+		}
+
+		lookupReq := vc.LastTokenLookupRequest()
+		if lookupReq == nil {
+			t.Errorf("%v: token lookup request is not sent", tc.name)
+		} else if got := lookupReq.Header.Get("X-Vault-Token"); got != "test-token" {
+			t.Errorf("%v: got token %v in the lookup request, want test-token", tc.name, got)
+		}
+		if got := vc.LastCertAuthRequest() != nil; got != tc.expectCertAuth {
+			t.Errorf("%v: got cert auth request %v, want %v", tc.name, got, tc.expectCertAuth)
+		}
+		s.Close()
+	}
+}
+
+func TestCredentialSourceWithTokenAuth(t *testing.T) {
+	lookupResp, err := ioutil.ReadFile("../fake/_test_data/token-lookup-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name         string
+		lookup       bool
+		responseCode int
+		response     []byte
+		wantLookup   bool
+		wantErr      string
+	}{
+		{
+			name: "Without lookup",
+		},
+		{
+			name:         "With lookup",
+			lookup:       true,
+			responseCode: 200,
+			response:     lookupResp,
+			wantLookup:   true,
+		},
+		{
+			name:         "Lookup rejected",
+			lookup:       true,
+			responseCode: 403,
+			response:     []byte(`{"errors":["permission denied"]}`),
+			wantLookup:   true,
+			wantErr:      "token lookup failed",
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.TokenLookupResponseCode = tc.responseCode
+		vc.TokenLookupResponse = tc.response
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		params := &ClientParams{
+			VaultAddr: fmt.Sprintf("https://%v/", addr),
+			Token:     "test-token",
+		}
+		source := &tokenSource{params: params, lookup: tc.lookup}
+		token, lease, err := source.Authenticate(context.Background(), getTestHTTPClient(t, false))
+		if tc.wantErr != "" {
+			if err == nil {
+				t.Errorf("%v: expected got an error", tc.name)
+			} else if !strings.HasPrefix(err.Error(), tc.wantErr) {
+				t.Errorf("%v: got %v, want prefix %v", tc.name, err, tc.wantErr)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("%v: unexpected error from Authenticate(): %v", tc.name, err)
+			}
+			if token != nil || lease != 0 {
+				t.Errorf("%v: got %v and %v, want nil since token auth method issues no token", tc.name, token, lease)
+			}
+		}
+
+		req := vc.LastTokenLookupRequest()
+		switch {
+		case !tc.wantLookup && req != nil:
+			t.Errorf("%v: token must not be looked up", tc.name)
+		case tc.wantLookup && req == nil:
+			t.Errorf("%v: token lookup request is not recorded", tc.name)
+		case tc.wantLookup && req.Header.Get("X-Vault-Token") != "test-token":
+			t.Errorf("%v: got token %q, want %q", tc.name, req.Header.Get("X-Vault-Token"), "test-token")
+		}
+
+		s.Close()
+	}
+}
+
+func TestCredentialSourceWithCertAuth(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name         string
+		responseCode int
+		response     []byte
+		wantToken    *Token
+		wantLease    time.Duration
+		wantErr      string
+	}{
+		{
+			name:         "Success",
+			responseCode: 200,
+			response:     certAuthResp,
+			wantToken:    &Token{ID: "cf95f87d-f95b-47ff-b1f5-ba7bff850425", Renewable: true},
+			wantLease:    time.Hour,
+		},
+		{
+			name:         "Empty response",
+			responseCode: 204,
+			wantErr:      "tls cert authentication response is nil",
+		},
+		{
+			name:         "Rejected",
+			responseCode: 403,
+			response:     []byte(`{"errors":["permission denied"]}`),
+			wantErr:      "authentication failed auth/test-cert/login",
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		// The handshake fails unless the client certificate is presented.
+		vc.ClientCAPemPath = caCert
+		vc.CertAuthReqEndpoint = "/v1/auth/test-cert/login"
+		vc.CertAuthResponseCode = tc.responseCode
+		vc.CertAuthResponse = tc.response
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		params := &ClientParams{
+			VaultAddr:          fmt.Sprintf("https://%v/", addr),
+			CertAuthMountPoint: "test-cert",
+		}
+		source, err := NewCredentialSource(CERT, params)
+		if err != nil {
+			t.Fatalf("%v: unexpected error from NewCredentialSource(): %v", tc.name, err)
+		}
+		token, lease, err := source.Authenticate(context.Background(), getTestHTTPClient(t, true))
+		if tc.wantErr != "" {
+			if err == nil {
+				t.Errorf("%v: expected got an error", tc.name)
+			} else if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%v: got %v, want %v", tc.name, err, tc.wantErr)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("%v: unexpected error from Authenticate(): %v", tc.name, err)
+			}
+			if !reflect.DeepEqual(token, tc.wantToken) {
+				t.Errorf("%v: got token %v, want %v", tc.name, token, tc.wantToken)
+			}
+			if lease != tc.wantLease {
+				t.Errorf("%v: got lease %v, want %v", tc.name, lease, tc.wantLease)
+			}
+		}
+
+		s.Close()
+	}
+}
+
+// getTestHTTPClient returns the plain HTTP client which trusts the CA of the test server.
+// If withClientCert is true, it presents the client certificate.
+func getTestHTTPClient(t *testing.T, withClientCert bool) *http.Client {
+	caPEM, err := ioutil.ReadFile(caCert)
+	if err != nil {
+		t.Fatalf("failed to load CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		t.Fatalf("failed to parse CA certificate")
+	}
+	tlsConfig := &tls.Config{RootCAs: pool}
+	if withClientCert {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			t.Fatalf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+}
+
+func TestNewCredentialSourceError(t *testing.T) {
+	_, err := NewCredentialSource(AuthMethod(0), &ClientParams{})
+	want := "auth method 0 doesn't support login"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if err.Error() != want {
+		t.Errorf("got %v, want %v", err, want)
+	}
+}
+
 func TestNewAuthenticatedClientWithAppRoleAuth(t *testing.T) {
 	vc := fake.NewVaultServerConfig()
 
@@ -244,126 +620,123 @@ func TestNewAuthenticatedClientWithAppRoleAuthError(t *testing.T) {
 	}
 }
 
-func TestSetClientParams(t *testing.T) {
-	c := New(CERT)
-	c.Logger = getTestLogger()
-	c.clientParams.VaultAddr = "https://example.org/vault"
-	c.clientParams.CACertPath = "path/to/test-ca.pem"
-	c.clientParams.ClientCertPath = "path/to/client-cert.pem"
-	c.clientParams.ClientKeyPath = "path/to/client-key.pem"
+func TestNewAuthenticatedClientWithAliCloudAuth(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
 
-	cp := &ClientParams{
-		VaultAddr:      "test-addr",
-		CACertPath:     "test-ca.pem",
-		ClientCertPath: "test-client.pem",
-		ClientKeyPath:  "test-client-key.pem",
+	aliCloudAuthResp, err := ioutil.ReadFile("../fake/_test_data/alicloud-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
 	}
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
 
-	if err := c.SetClientParams(cp); err != nil {
-		t.Errorf("error from SetClientParams(): %v", err)
-	}
-	if c.clientParams.VaultAddr != "test-addr" {
-		t.Errorf("got %v, want %v", c.clientParams.VaultAddr, "test-addr")
-	}
-	if c.clientParams.CACertPath != "test-ca.pem" {
-		t.Errorf("got %v, want %v", c.clientParams.VaultAddr, "test-ca.pem")
-	}
-	if c.clientParams.ClientCertPath != "test-client.pem" {
-		t.Errorf("got %v, want %v", c.clientParams.VaultAddr, "test-client.pem")
+	var body map[string]string
+	vc.AliCloudAuthReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Errorf("failed to decode login request: %v", err)
+			}
+			w.WriteHeader(200)
+			w.Write(aliCloudAuthResp)
+		}
 	}
-	if c.clientParams.ClientKeyPath != "test-client-key.pem" {
-		t.Errorf("got %v, want %v", c.clientParams.VaultAddr, "test-client-key.pem")
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
 	}
-}
+	s.Start()
+	defer s.Close()
 
-func TestConfigureTLSWithCertAuth(t *testing.T) {
-	c := New(CERT)
+	c := New(ALICLOUD)
 	c.Logger = getTestLogger()
-	c.clientParams.CACertPath = caCert
-	c.clientParams.ClientCertPath = clientCert
-	c.clientParams.ClientKeyPath = clientKey
-	vConfig := vapi.DefaultConfig()
-
-	if err := c.ConfigureTLS(vConfig); err != nil {
-		t.Errorf("error from ConfigureTLS() %v", err)
+	cp := &ClientParams{
+		VaultAddr:               fmt.Sprintf("https://%v/", addr),
+		CACertPath:              caCert,
+		AliCloudRole:            "test-role",
+		AliCloudRegion:          "ap-northeast-1",
+		AliCloudAccessKeyID:     "test-access-key-id",
+		AliCloudAccessKeySecret: "test-access-key-secret",
+		AliCloudSecurityToken:   "test-security-token",
+	}
+	if err := c.SetClientParams(cp); err != nil {
+		t.Errorf("failed to prepare test client: %v", err)
 	}
 
-	wantPool, err := getTestCertPool(caCert)
+	_, err = c.NewAuthenticatedClient()
 	if err != nil {
-		t.Errorf("failed to prepare cert pool: %v", err)
+		t.Fatalf("unexpected error from NewAuthenticatedClient(): %v", err)
 	}
-	certPemBlock, keyPemBlock, err := getCertAndKeyPemBlock(clientCert, clientKey)
-	if err != nil {
-		t.Errorf("failed to load client cert/key: %v", err)
+
+	if body["role"] != "test-role" {
+		t.Errorf("got role %v, want test-role", body["role"])
 	}
-	wantCert, err := tls.X509KeyPair(certPemBlock, keyPemBlock)
+	rawURL, err := base64.StdEncoding.DecodeString(body["identity_request_url"])
 	if err != nil {
-		t.Errorf("failed to prepare certificate: %v", err)
+		t.Fatalf("failed to decode identity_request_url: %v", err)
 	}
-
-	tp := vConfig.HttpClient.Transport.(*http.Transport).TLSClientConfig
-	cert, err := tp.GetClientCertificate(&tls.CertificateRequestInfo{})
+	u, err := url.Parse(string(rawURL))
 	if err != nil {
-		t.Errorf("failed to get client cert: %v", err)
+		t.Fatalf("failed to parse identity_request_url: %v", err)
 	}
-
-	if !reflect.DeepEqual(tp.RootCAs, wantPool) {
-		t.Errorf("got %v,\n want %v", tp.RootCAs, wantPool)
+	if u.Host != "sts.ap-northeast-1.aliyuncs.com" {
+		t.Errorf("got host %v, want sts.ap-northeast-1.aliyuncs.com", u.Host)
 	}
-	if !reflect.DeepEqual(cert.Certificate, wantCert.Certificate) {
-		t.Errorf("got %v,\n want %v", cert.Certificate, wantCert.Certificate)
+	q := u.Query()
+	if q.Get("Action") != "GetCallerIdentity" || q.Get("AccessKeyId") != "test-access-key-id" || q.Get("SecurityToken") != "test-security-token" {
+		t.Errorf("unexpected identity request query: %v", u.RawQuery)
+	}
+	sig := q.Get("Signature")
+	q.Del("Signature")
+	if want := aliCloudSignature(http.MethodGet, q, "test-access-key-secret"); sig != want {
+		t.Errorf("got signature %v, want %v", sig, want)
+	}
+	if _, err := base64.StdEncoding.DecodeString(body["identity_request_headers"]); err != nil {
+		t.Errorf("failed to decode identity_request_headers: %v", err)
 	}
 }
 
-func TestConfigureTLSWithTokenAuth(t *testing.T) {
-	c := New(TOKEN)
+func TestNewAuthenticatedClientWithAliCloudAuthErrorNoAccessKey(t *testing.T) {
+	c := New(ALICLOUD)
 	c.Logger = getTestLogger()
-	c.clientParams.CACertPath = caCert
-	vConfig := vapi.DefaultConfig()
-
-	if err := c.ConfigureTLS(vConfig); err != nil {
-		t.Errorf("error from ConfigureTLS() %v", err)
-	}
-
-	wantPool, err := getTestCertPool(caCert)
-	if err != nil {
-		t.Errorf("failed to prepare cert pool: %v", err)
+	cp := &ClientParams{
+		VaultAddr:    "https://127.0.0.1:8200/",
+		CACertPath:   caCert,
+		AliCloudRole: "test-role",
 	}
-
-	if err := c.ConfigureTLS(vConfig); err != nil {
-		t.Errorf("error from ConfigureTLS(): %v", err)
+	if err := c.SetClientParams(cp); err != nil {
+		t.Errorf("failed to prepare test client: %v", err)
 	}
-	tp := vConfig.HttpClient.Transport.(*http.Transport).TLSClientConfig
 
-	if !reflect.DeepEqual(tp.RootCAs, wantPool) {
-		t.Errorf("got %v,\n want %v", tp.RootCAs, wantPool)
+	_, err := c.NewAuthenticatedClient()
+	if err == nil {
+		t.Errorf("expected error from NewAuthenticatedClient()")
 	}
 }
 
-func TestSignIntermediate(t *testing.T) {
+func TestNewAuthenticatedClientWithOCIAuth(t *testing.T) {
 	vc := fake.NewVaultServerConfig()
 
-	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
-	if err != nil {
-		t.Errorf("failed to load fixture: %v", err)
-	}
-	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
-	if err != nil {
-		t.Errorf("failed to load fixture: %v", err)
-	}
-	renewResp, err := ioutil.ReadFile("../fake/_test_data/renew-response.json")
+	ociAuthResp, err := ioutil.ReadFile("../fake/_test_data/oci-auth-response.json")
 	if err != nil {
 		t.Errorf("failed to load fixture: %v", err)
 	}
-
 	vc.ServerCertificatePemPath = serverCert
 	vc.ServerKeyPemPath = serverKey
-	vc.CertAuthResponseCode = 200
-	vc.CertAuthResponse = certAuthResp
-	vc.SignIntermediateResponseCode = 200
-	vc.SignIntermediateResponse = signResp
-	vc.RenewResponseCode = 200
-	vc.RenewResponse = renewResp
+
+	var body struct {
+		RequestHeaders http.Header `json:"request_headers"`
+	}
+	vc.OCIAuthReqEndpoint = "/v1/auth/oci/login/test-role"
+	vc.OCIAuthReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Errorf("failed to decode login request: %v", err)
+			}
+			w.WriteHeader(200)
+			w.Write(ociAuthResp)
+		}
+	}
 
 	s, addr, err := vc.NewTLSServer()
 	if err != nil {
@@ -372,40 +745,4891 @@ func TestSignIntermediate(t *testing.T) {
 	s.Start()
 	defer s.Close()
 
-	c := New(CERT)
-	c.Logger = getTestLogger()
-	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
-	c.clientParams.CACertPath = caCert
-	c.clientParams.ClientCertPath = clientCert
-	c.clientParams.ClientKeyPath = clientKey
-
-	vClient, err := c.NewAuthenticatedClient()
+	oc := fake.NewOCIServerConfig()
+	oc.InstanceCertPemPath = "../fake/_test_data/oci-instance.pem"
+	oc.InstanceKeyPemPath = "../fake/_test_data/oci-instance-key.pem"
+	oc.IntermediatePemPath = "../fake/_test_data/intermediate-ca.pem"
+	ociServer, err := oc.NewServer()
 	if err != nil {
-		t.Errorf("failed to prepare vault client: %v", err)
+		t.Errorf("failed to prepare fake OCI server: %v", err)
 	}
+	defer ociServer.Close()
 
-	csrPEM, err := ioutil.ReadFile(testReqCSR)
-	if err != nil {
-		t.Errorf("failed to read csr data: %v", err)
+	c := New(OCI)
+	c.Logger = getTestLogger()
+	cp := &ClientParams{
+		VaultAddr:             fmt.Sprintf("https://%v/", addr),
+		CACertPath:            caCert,
+		OCIRole:               "test-role",
+		OCIMetadataEndpoint:   ociServer.URL + "/opc/v2",
+		OCIFederationEndpoint: ociServer.URL + "/v1/x509",
+	}
+	if err := c.SetClientParams(cp); err != nil {
+		t.Errorf("failed to prepare test client: %v", err)
 	}
 
-	resp, err := vClient.SignIntermediate(testTTL, csrPEM)
+	_, err = c.NewAuthenticatedClient()
 	if err != nil {
-		t.Errorf("error from SignIntermediate(): %v", err)
-	} else if resp == nil {
-		t.Error("response is empty")
-	} else {
-		if resp.CertPEM == "" {
-			t.Error("CertPEM is empty")
-		}
-		if resp.CACertPEM == "" {
-			t.Errorf("CACertPEM is empty")
-		}
-		if resp.CACertChainPEM == nil {
-			t.Errorf("CACertChainPEM is empty")
-		}
+		t.Fatalf("unexpected error from NewAuthenticatedClient(): %v", err)
 	}
-}
+
+	authz := body.RequestHeaders.Get("Authorization")
+	if !strings.Contains(authz, `keyId="ST$fake-security-token"`) {
+		t.Errorf("Authorization header doesn't have the security token: %v", authz)
+	}
+	if !strings.Contains(authz, `headers="date (request-target) host"`) {
+		t.Errorf("Authorization header doesn't have the signed headers: %v", authz)
+	}
+	if got := body.RequestHeaders.Get("Host"); got != addr {
+		t.Errorf("got Host %v, want %v", got, addr)
+	}
+}
+
+func TestNewAuthenticatedClientWithOCIAuthMetadataTimeout(t *testing.T) {
+	ociAuthResp, err := ioutil.ReadFile("../fake/_test_data/oci-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name          string
+		metadataDelay time.Duration
+		expectError   bool
+	}{
+		{
+			name:          "Within the timeout",
+			metadataDelay: 10 * time.Millisecond,
+		},
+		{
+			name:          "Slow metadata service",
+			metadataDelay: 5 * time.Second,
+			expectError:   true,
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.OCIAuthReqEndpoint = "/v1/auth/oci/login/test-role"
+		vc.OCIAuthResponseCode = 200
+		vc.OCIAuthResponse = ociAuthResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		// The fake instance metadata service is reached with the overridden endpoint
+		oc := fake.NewOCIServerConfig()
+		oc.InstanceCertPemPath = "../fake/_test_data/oci-instance.pem"
+		oc.InstanceKeyPemPath = "../fake/_test_data/oci-instance-key.pem"
+		oc.IntermediatePemPath = "../fake/_test_data/intermediate-ca.pem"
+		oc.MetadataDelay = tc.metadataDelay
+		ociServer, err := oc.NewServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare fake OCI server: %v", tc.name, err)
+		}
+
+		c := New(OCI)
+		c.Logger = getTestLogger()
+		cp := &ClientParams{
+			VaultAddr:             fmt.Sprintf("https://%v/", addr),
+			CACertPath:            caCert,
+			OCIRole:               "test-role",
+			OCIMetadataEndpoint:   ociServer.URL + "/opc/v2",
+			OCIMetadataTimeout:    time.Second,
+			OCIFederationEndpoint: ociServer.URL + "/v1/x509",
+		}
+		if err := c.SetClientParams(cp); err != nil {
+			t.Errorf("%v: failed to prepare test client: %v", tc.name, err)
+		}
+
+		start := time.Now()
+		_, err = c.NewAuthenticatedClient()
+		elapsed := time.Since(start)
+		if tc.expectError {
+			if err == nil {
+				t.Errorf("%v: expected got an error", tc.name)
+			}
+			if elapsed >= tc.metadataDelay {
+				t.Errorf("%v: login took %v, want less than the delay of the metadata service %v", tc.name, elapsed, tc.metadataDelay)
+			}
+		} else if err != nil {
+			t.Errorf("%v: unexpected error from NewAuthenticatedClient(): %v", tc.name, err)
+		}
+
+		ociServer.Close()
+		s.Close()
+	}
+}
+
+func TestNewAuthenticatedClientWithIMDSAuth(t *testing.T) {
+	tCases := []struct {
+		name     string
+		method   AuthMethod
+		params   *ClientParams
+		fixture  string
+		lastReq  func(*fake.VaultServerConfig) *fake.Request
+		wantBody map[string]interface{}
+		wantIMDS map[string]string
+	}{
+		{
+			name:    "AWS",
+			method:  AWS,
+			params:  &ClientParams{AWSRole: "test-role", AWSNonce: "test-nonce"},
+			fixture: "../fake/_test_data/aws-auth-response.json",
+			lastReq: (*fake.VaultServerConfig).LastAWSAuthRequest,
+			wantBody: map[string]interface{}{
+				"role":  "test-role",
+				"pkcs7": "ZmFrZS1wa2NzNy1zaWduYXR1cmUtb2YtaW5zdGFuY2UtaWRlbnRpdHk=",
+				"nonce": "test-nonce",
+			},
+		},
+		{
+			name:    "GCP",
+			method:  GCP,
+			params:  &ClientParams{GCPRole: "test-role", GCPServiceAccount: "spire@test-project.iam.gserviceaccount.com"},
+			fixture: "../fake/_test_data/gcp-auth-response.json",
+			lastReq: (*fake.VaultServerConfig).LastGCPAuthRequest,
+			wantBody: map[string]interface{}{
+				"role": "test-role",
+				"jwt":  "fake-gcp-identity-token",
+			},
+			wantIMDS: map[string]string{
+				"gcp_path":     "/computeMetadata/v1/instance/service-accounts/spire@test-project.iam.gserviceaccount.com/identity",
+				"gcp_audience": "http://vault/test-role",
+				"gcp_format":   "full",
+			},
+		},
+		{
+			name:    "Azure",
+			method:  AZURE,
+			params:  &ClientParams{AzureRole: "test-role"},
+			fixture: "../fake/_test_data/azure-auth-response.json",
+			lastReq: (*fake.VaultServerConfig).LastAzureAuthRequest,
+			wantBody: map[string]interface{}{
+				"role":                "test-role",
+				"jwt":                 "fake-azure-access-token",
+				"subscription_id":     "test-subscription",
+				"resource_group_name": "test-group",
+				"vm_name":             "test-vm",
+			},
+			wantIMDS: map[string]string{
+				"azure_resource": DefaultAzureResource,
+			},
+		},
+	}
+
+	for _, tc := range tCases {
+		authResp, err := ioutil.ReadFile(tc.fixture)
+		if err != nil {
+			t.Errorf("%v: failed to load fixture: %v", tc.name, err)
+		}
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.AWSAuthResponseCode, vc.AWSAuthResponse = 200, authResp
+		vc.GCPAuthResponseCode, vc.GCPAuthResponse = 200, authResp
+		vc.AzureAuthResponseCode, vc.AzureAuthResponse = 200, authResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		// The fake instance metadata service is reached with the overridden endpoint
+		ic := fake.NewIMDSServerConfig()
+		imdsServer := ic.NewServer()
+
+		c := New(tc.method)
+		c.Logger = getTestLogger()
+		cp := tc.params
+		cp.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		cp.CACertPath = caCert
+		cp.IMDSEndpoint = imdsServer.URL + "/"
+		if err := c.SetClientParams(cp); err != nil {
+			t.Errorf("%v: failed to prepare test client: %v", tc.name, err)
+		}
+
+		client, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: unexpected error from NewAuthenticatedClient(): %v", tc.name, err)
+		}
+		if client.renew == nil {
+			t.Errorf("%v: the renewable token is not renewed", tc.name)
+		}
+
+		req := tc.lastReq(vc)
+		if req == nil {
+			t.Fatalf("%v: login request is not recorded", tc.name)
+		}
+		if !reflect.DeepEqual(req.Body, tc.wantBody) {
+			t.Errorf("%v: got login request %v, want %v", tc.name, req.Body, tc.wantBody)
+		}
+		for k, want := range tc.wantIMDS {
+			if got := ic.LastQuery(k); got != want {
+				t.Errorf("%v: got %v %q, want %q", tc.name, k, got, want)
+			}
+		}
+
+		imdsServer.Close()
+		s.Close()
+	}
+}
+
+func TestNewAuthenticatedClientWithLoginTimeout(t *testing.T) {
+	gcpAuthResp, err := ioutil.ReadFile("../fake/_test_data/gcp-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name        string
+		imdsDelay   time.Duration
+		expectError bool
+	}{
+		{
+			name:      "Within the timeout",
+			imdsDelay: 10 * time.Millisecond,
+		},
+		{
+			name:        "Slow metadata service",
+			imdsDelay:   5 * time.Second,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.GCPAuthResponseCode = 200
+		vc.GCPAuthResponse = gcpAuthResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		ic := fake.NewIMDSServerConfig()
+		ic.Delay = tc.imdsDelay
+		imdsServer := ic.NewServer()
+
+		c := New(GCP)
+		c.Logger = getTestLogger()
+		cp := &ClientParams{
+			VaultAddr:    fmt.Sprintf("https://%v/", addr),
+			CACertPath:   caCert,
+			GCPRole:      "test-role",
+			IMDSEndpoint: imdsServer.URL,
+			LoginTimeout: time.Second,
+		}
+		if err := c.SetClientParams(cp); err != nil {
+			t.Errorf("%v: failed to prepare test client: %v", tc.name, err)
+		}
+
+		start := time.Now()
+		_, err = c.NewAuthenticatedClient()
+		elapsed := time.Since(start)
+		if tc.expectError {
+			if err == nil {
+				t.Errorf("%v: expected got an error", tc.name)
+			} else if !strings.Contains(err.Error(), "context deadline exceeded") {
+				t.Errorf("%v: got %v, want the error of the login timeout", tc.name, err)
+			}
+			if elapsed >= tc.imdsDelay {
+				t.Errorf("%v: login took %v, want less than the delay of the metadata service %v", tc.name, elapsed, tc.imdsDelay)
+			}
+			if req := vc.LastGCPAuthRequest(); req != nil {
+				t.Errorf("%v: login request must not be sent without the identity token", tc.name)
+			}
+		} else if err != nil {
+			t.Errorf("%v: unexpected error from NewAuthenticatedClient(): %v", tc.name, err)
+		}
+
+		imdsServer.Close()
+		s.Close()
+	}
+}
+
+func TestNewAuthenticatedClientWithCFAuth(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+
+	cfAuthResp, err := ioutil.ReadFile("../fake/_test_data/cf-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.CFAuthResponseCode = 200
+	vc.CFAuthResponse = cfAuthResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(CF)
+	c.Logger = getTestLogger()
+	cp := &ClientParams{
+		VaultAddr:          fmt.Sprintf("https://%v/", addr),
+		CACertPath:         caCert,
+		CFRole:             "test-role",
+		CFInstanceCertPath: "../fake/_test_data/cf-instance.pem",
+		CFInstanceKeyPath:  "../fake/_test_data/cf-instance-key.pem",
+	}
+	if err := c.SetClientParams(cp); err != nil {
+		t.Errorf("failed to prepare test client: %v", err)
+	}
+
+	_, err = c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("unexpected error from NewAuthenticatedClient(): %v", err)
+	}
+
+	req := vc.LastCFAuthRequest()
+	if req == nil {
+		t.Fatal("login request is not sent to cf auth endpoint")
+	}
+	certPEM, err := ioutil.ReadFile("../fake/_test_data/cf-instance.pem")
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+	if req.Body["role"] != "test-role" || req.Body["cf_instance_cert"] != string(certPEM) {
+		t.Errorf("unexpected login request: %v", req.Body)
+	}
+	signingTime, _ := req.Body["signing_time"].(string)
+	if _, err := time.Parse(cfSigningTimeFormat, signingTime); err != nil {
+		t.Errorf("failed to parse signing_time: %v", err)
+	}
+	signature, _ := req.Body["signature"].(string)
+	if !strings.HasPrefix(signature, "v1:") {
+		t.Fatalf("signature doesn't have version prefix: %v", signature)
+	}
+	sig, err := base64.URLEncoding.DecodeString(strings.TrimPrefix(signature, "v1:"))
+	if err != nil {
+		t.Fatalf("failed to decode signature: %v", err)
+	}
+	cert, err := pemutil.LoadCertificate("../fake/_test_data/cf-instance.pem")
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+	sum := sha256.Sum256([]byte(signingTime + string(certPEM) + "test-role"))
+	if err := rsa.VerifyPSS(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, sum[:], sig, nil); err != nil {
+		t.Errorf("failed to verify signature: %v", err)
+	}
+}
+
+func TestNewAuthenticatedClientWithRADIUSAuth(t *testing.T) {
+	f, err := ioutil.TempFile("", "radius-password")
+	if err != nil {
+		t.Fatalf("failed to create password file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("file-password\n"); err != nil {
+		t.Fatalf("failed to write password file: %v", err)
+	}
+	f.Close()
+	passwordFile := f.Name()
+
+	tCases := []struct {
+		name         string
+		password     string
+		passwordFile string
+		wantPassword string
+	}{
+		{
+			name:         "Password",
+			password:     "test-password",
+			wantPassword: "test-password",
+		},
+		{
+			name:         "PasswordFile",
+			passwordFile: passwordFile,
+			wantPassword: "file-password",
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+
+		radiusAuthResp, err := ioutil.ReadFile("../fake/_test_data/radius-auth-response.json")
+		if err != nil {
+			t.Errorf("%v: failed to load fixture: %v", tc.name, err)
+		}
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.RADIUSAuthResponseCode = 200
+		vc.RADIUSAuthResponse = radiusAuthResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		c := New(RADIUS)
+		c.Logger = getTestLogger()
+		cp := &ClientParams{
+			VaultAddr:          fmt.Sprintf("https://%v/", addr),
+			CACertPath:         caCert,
+			RADIUSUsername:     "test-user",
+			RADIUSPassword:     tc.password,
+			RADIUSPasswordFile: tc.passwordFile,
+		}
+		if err := c.SetClientParams(cp); err != nil {
+			t.Errorf("%v: failed to prepare test client: %v", tc.name, err)
+		}
+
+		if _, err := c.NewAuthenticatedClient(); err != nil {
+			t.Errorf("%v: unexpected error from NewAuthenticatedClient(): %v", tc.name, err)
+		}
+
+		req := vc.LastRADIUSAuthRequest()
+		if req == nil {
+			t.Errorf("%v: login request is not sent to radius auth endpoint", tc.name)
+		} else {
+			if req.Path != "/v1/auth/radius/login/test-user" {
+				t.Errorf("%v: got path %v, want /v1/auth/radius/login/test-user", tc.name, req.Path)
+			}
+			if req.Body["password"] != tc.wantPassword {
+				t.Errorf("%v: got password %v, want %v", tc.name, req.Body["password"], tc.wantPassword)
+			}
+		}
+
+		s.Close()
+	}
+}
+
+func TestNewAuthenticatedClientWithRADIUSAuthErrorNoPassword(t *testing.T) {
+	c := New(RADIUS)
+	c.Logger = getTestLogger()
+	cp := &ClientParams{
+		VaultAddr:      "https://127.0.0.1:8200/",
+		CACertPath:     caCert,
+		RADIUSUsername: "test-user",
+	}
+	if err := c.SetClientParams(cp); err != nil {
+		t.Errorf("failed to prepare test client: %v", err)
+	}
+
+	_, err := c.NewAuthenticatedClient()
+	want := "password of radius is required"
+	if err == nil {
+		t.Errorf("expected got an error")
+	} else if !strings.Contains(err.Error(), want) {
+		t.Errorf("got %v, want %v", err, want)
+	}
+}
+
+func TestNewAuthenticatedClientWithJWTAuth(t *testing.T) {
+	jwt, err := ioutil.ReadFile("../fake/_test_data/jwt")
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name     string
+		audience string
+		wantErr  string
+	}{
+		{
+			name: "NoAudience",
+		},
+		{
+			name:     "Audience",
+			audience: "vault",
+		},
+		{
+			name:     "AudienceMismatch",
+			audience: "spire",
+			wantErr:  `aud claim of the jwt [vault] doesn't have the audience "spire"`,
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+
+		jwtAuthResp, err := ioutil.ReadFile("../fake/_test_data/jwt-auth-response.json")
+		if err != nil {
+			t.Errorf("%v: failed to load fixture: %v", tc.name, err)
+		}
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.JWTAuthResponseCode = 200
+		vc.JWTAuthResponse = jwtAuthResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		c := New(JWT)
+		c.Logger = getTestLogger()
+		cp := &ClientParams{
+			VaultAddr:   fmt.Sprintf("https://%v/", addr),
+			CACertPath:  caCert,
+			JWTRole:     "test-role",
+			JWTPath:     "../fake/_test_data/jwt",
+			JWTAudience: tc.audience,
+		}
+		if err := c.SetClientParams(cp); err != nil {
+			t.Errorf("%v: failed to prepare test client: %v", tc.name, err)
+		}
+
+		_, err = c.NewAuthenticatedClient()
+		req := vc.LastJWTAuthRequest()
+		if tc.wantErr != "" {
+			if err == nil {
+				t.Errorf("%v: expected got an error", tc.name)
+			} else if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%v: got %v, want %v", tc.name, err, tc.wantErr)
+			}
+			if req != nil {
+				t.Errorf("%v: login request must not be sent", tc.name)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("%v: unexpected error from NewAuthenticatedClient(): %v", tc.name, err)
+			}
+			if req == nil {
+				t.Errorf("%v: login request is not sent to jwt auth endpoint", tc.name)
+			} else {
+				if req.Body["role"] != "test-role" {
+					t.Errorf("%v: got role %v, want test-role", tc.name, req.Body["role"])
+				}
+				if req.Body["jwt"] != strings.TrimSpace(string(jwt)) {
+					t.Errorf("%v: got jwt %v, want %v", tc.name, req.Body["jwt"], strings.TrimSpace(string(jwt)))
+				}
+			}
+		}
+
+		s.Close()
+	}
+}
+
+func TestNewAuthenticatedClientWithJWTAuthRotatedToken(t *testing.T) {
+	jwtAuthResp, err := ioutil.ReadFile("../fake/_test_data/jwt-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "vault-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	jwtPath := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(jwtPath, []byte("first-token\n"), 0600); err != nil {
+		t.Fatalf("failed to write jwt: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.JWTAuthResponseCode = 200
+	vc.JWTAuthResponse = jwtAuthResp
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(JWT)
+	c.Logger = getTestLogger()
+	cp := &ClientParams{
+		VaultAddr:  fmt.Sprintf("https://%v/", addr),
+		CACertPath: caCert,
+		JWTRole:    "test-role",
+		JWTPath:    jwtPath,
+	}
+	if err := c.SetClientParams(cp); err != nil {
+		t.Errorf("failed to prepare test client: %v", err)
+	}
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("unexpected error from NewAuthenticatedClient(): %v", err)
+	}
+	if got := vc.LastJWTAuthRequest().Body["jwt"]; got != "first-token" {
+		t.Errorf("got jwt %v on the first login, want first-token", got)
+	}
+
+	// The projected token is rotated by kubelet
+	if err := ioutil.WriteFile(jwtPath, []byte("rotated-token\n"), 0600); err != nil {
+		t.Fatalf("failed to write jwt: %v", err)
+	}
+	if err := vClient.reauthenticate(vClient.vaultClient.Token()); err != nil {
+		t.Fatalf("unexpected error from reauthenticate(): %v", err)
+	}
+	if got := vc.LastJWTAuthRequest().Body["jwt"]; got != "rotated-token" {
+		t.Errorf("got jwt %v on the re-authentication, want rotated-token", got)
+	}
+}
+
+func TestNewAuthenticatedClientWithKerberosAuth(t *testing.T) {
+	kerberosAuthResp, err := ioutil.ReadFile("../fake/_test_data/kerberos-auth-response.json")
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+
+	// Obtaining the SPNEGO token needs a KDC, so the token is replaced with a fixed one
+	defer func(f func(*ClientParams) (string, error)) { negotiateToken = f }(negotiateToken)
+	var gotParams *ClientParams
+	negotiateToken = func(p *ClientParams) (string, error) {
+		gotParams = p
+		return "dGVzdC1zcG5lZ28tdG9rZW4=", nil
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.KerberosAuthResponseCode = 200
+	vc.KerberosAuthResponse = kerberosAuthResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(KERBEROS)
+	c.Logger = getTestLogger()
+	cp := &ClientParams{
+		VaultAddr:          fmt.Sprintf("https://%v/", addr),
+		CACertPath:         caCert,
+		KerberosUsername:   "spire-server",
+		KerberosRealm:      "EXAMPLE.ORG",
+		KerberosService:    "HTTP/vault.example.org",
+		KerberosKeytabPath: "../fake/_test_data/kerberos.keytab",
+	}
+	if err := c.SetClientParams(cp); err != nil {
+		t.Errorf("failed to prepare test client: %v", err)
+	}
+
+	client, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("unexpected error from NewAuthenticatedClient(): %v", err)
+	}
+	req := vc.LastKerberosAuthRequest()
+	if req == nil {
+		t.Fatalf("login request is not sent to kerberos auth endpoint")
+	}
+	if got, want := req.Header.Get("Authorization"), "Negotiate dGVzdC1zcG5lZ28tdG9rZW4="; got != want {
+		t.Errorf("got Authorization %v, want %v", got, want)
+	}
+	if gotParams == nil || gotParams.KerberosKrb5ConfPath != DefaultKrb5ConfPath {
+		t.Errorf("krb5.conf must default to %v", DefaultKrb5ConfPath)
+	}
+	if got, want := client.vaultClient.Token(), "5d7f9b1c-3e5a-4c8d-9f2b-4a6c8e0d2f7a"; got != want {
+		t.Errorf("got token %v, want %v", got, want)
+	}
+}
+
+func TestKerberosNegotiateToken(t *testing.T) {
+	tCases := []struct {
+		name       string
+		keytabPath string
+		wantErr    string
+	}{
+		{
+			name:       "No keytab",
+			keytabPath: "../fake/_test_data/no-such.keytab",
+			wantErr:    "failed to load kerberos keytab",
+		},
+		{
+			// The keytab is loaded, but the KDC in krb5.conf is not reachable
+			name:       "Unreachable KDC",
+			keytabPath: "../fake/_test_data/kerberos.keytab",
+			wantErr:    "failed to login to kerberos KDC",
+		},
+	}
+
+	for _, tc := range tCases {
+		p := &ClientParams{
+			KerberosUsername:     "spire-server",
+			KerberosRealm:        "EXAMPLE.ORG",
+			KerberosService:      "HTTP/vault.example.org",
+			KerberosKeytabPath:   tc.keytabPath,
+			KerberosKrb5ConfPath: "../fake/_test_data/krb5.conf",
+		}
+		_, err := kerberosNegotiateToken(p)
+		if err == nil {
+			t.Errorf("%v: expected got an error", tc.name)
+		} else if !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%v: got %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestNewAuthenticatedClientWithCFAuthErrorNoInstanceCert(t *testing.T) {
+	c := New(CF)
+	c.Logger = getTestLogger()
+	cp := &ClientParams{
+		VaultAddr:  "https://127.0.0.1:8200/",
+		CACertPath: caCert,
+		CFRole:     "test-role",
+	}
+	if err := c.SetClientParams(cp); err != nil {
+		t.Errorf("failed to prepare test client: %v", err)
+	}
+
+	_, err := c.NewAuthenticatedClient()
+	if err == nil {
+		t.Errorf("expected error from NewAuthenticatedClient()")
+	}
+}
+
+func TestNewAuthenticatedClientWithAppRoleKVAuth(t *testing.T) {
+	appRoleAuthResp, err := ioutil.ReadFile("../fake/_test_data/approle-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		kvResponseFile string
+		wantErr        string
+	}{
+		// 0. KV version 1 layout
+		{
+			kvResponseFile: "../fake/_test_data/kv-v1-approle-response.json",
+		},
+		// 1. KV version 2 layout
+		{
+			kvResponseFile: "../fake/_test_data/kv-v2-approle-response.json",
+		},
+		// 2. 'secret_id' is missing
+		{
+			kvResponseFile: "../fake/_test_data/kv-v2-approle-missing-response.json",
+			wantErr:        "'secret_id' is not found in secret/data/approle",
+		},
+	}
+
+	for i, tc := range tCases {
+		kvResp, err := ioutil.ReadFile(tc.kvResponseFile)
+		if err != nil {
+			t.Errorf("#%v: failed to load fixture: %v", i, err)
+		}
+
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.AppRoleAuthResponseCode = 200
+		vc.AppRoleAuthResponse = appRoleAuthResp
+		vc.KVResponseCode = 200
+		vc.KVResponse = kvResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("#%v: failed to prepare test server: %v", i, err)
+		}
+		s.Start()
+
+		c := New(APPROLE)
+		c.Logger = getTestLogger()
+		cp := &ClientParams{
+			VaultAddr:     fmt.Sprintf("https://%v/", addr),
+			CACertPath:    caCert,
+			Token:         "test-bootstrap-token",
+			AppRoleKVPath: "secret/data/approle",
+		}
+		if err := c.SetClientParams(cp); err != nil {
+			t.Errorf("#%v: failed to prepare test client: %v", i, err)
+		}
+
+		_, err = c.NewAuthenticatedClient()
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("#%v: unexpected error from NewAuthenticatedClient(): %v", i, err)
+			}
+		} else {
+			if err == nil {
+				t.Errorf("#%v: expect an error but got nil", i)
+			} else if err.Error() != tc.wantErr {
+				t.Errorf("#%v: got %v, want %v", i, err, tc.wantErr)
+			}
+		}
+
+		s.Close()
+	}
+}
+
+func TestSignIntermediateWithMountPoint(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+
+	tCases := []struct {
+		name         string
+		certMount    string
+		pkiMount     string
+		certEndpoint string
+		signEndpoint string
+	}{
+		{
+			name:         "leading slash",
+			certMount:    "/test-auth",
+			pkiMount:     "/test-pki",
+			certEndpoint: "/v1/auth/test-auth/login",
+			signEndpoint: "/v1/test-pki/root/sign-intermediate",
+		},
+		{
+			name:         "trailing slash",
+			certMount:    "test-auth/",
+			pkiMount:     "test-pki/",
+			certEndpoint: "/v1/auth/test-auth/login",
+			signEndpoint: "/v1/test-pki/root/sign-intermediate",
+		},
+		{
+			name:         "nested path",
+			certMount:    "/team/cert/",
+			pkiMount:     "/team//pki/",
+			certEndpoint: "/v1/auth/team/cert/login",
+			signEndpoint: "/v1/team/pki/root/sign-intermediate",
+		},
+		{
+			name:         "only slash",
+			certMount:    "/",
+			pkiMount:     "/",
+			certEndpoint: "/v1/auth/cert/login",
+			signEndpoint: "/v1/pki/root/sign-intermediate",
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.CertAuthReqEndpoint = tc.certEndpoint
+		vc.CertAuthResponseCode = 200
+		vc.CertAuthResponse = certAuthResp
+		vc.SignIntermediateReqEndpoint = tc.signEndpoint
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = signResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		retry := 0
+		c := New(CERT)
+		c.Logger = getTestLogger()
+		cp := &ClientParams{
+			MaxRetries:         &retry,
+			VaultAddr:          fmt.Sprintf("https://%v/", addr),
+			CACertPath:         caCert,
+			ClientCertPath:     clientCert,
+			ClientKeyPath:      clientKey,
+			CertAuthMountPoint: tc.certMount,
+			PKIMountPoint:      tc.pkiMount,
+		}
+		if err := c.SetClientParams(cp); err != nil {
+			t.Errorf("%v: failed to prepare test client: %v", tc.name, err)
+		}
+
+		client, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Errorf("%v: unexpected error from NewAuthenticatedClient(): %v", tc.name, err)
+			s.Close()
+			continue
+		}
+		if _, err := client.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+			t.Errorf("%v: unexpected error from SignIntermediate(): %v", tc.name, err)
+		}
+		s.Close()
+	}
+}
+
+func TestSignIntermediateWithIssuerRef(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateReqEndpoint = "/v1/pki/issuer/test-issuer/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	retry := 0
+	c := New(CERT)
+	c.Logger = getTestLogger()
+	cp := &ClientParams{
+		MaxRetries:     &retry,
+		VaultAddr:      fmt.Sprintf("https://%v/", addr),
+		CACertPath:     caCert,
+		ClientCertPath: clientCert,
+		ClientKeyPath:  clientKey,
+		IssuerRef:      "test-issuer",
+	}
+	if err := c.SetClientParams(cp); err != nil {
+		t.Errorf("failed to prepare test client: %v", err)
+	}
+
+	client, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("unexpected error from NewAuthenticatedClient(): %v", err)
+	}
+
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+	if _, err := client.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+		t.Errorf("unexpected error from SignIntermediate(): %v", err)
+	}
+}
+
+func TestNewAuthenticatedClientWithUserAgent(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name      string
+		userAgent string
+		expected  string
+	}{
+		{
+			name:     "default",
+			expected: "spire-vault-plugin/" + common.Version,
+		},
+		{
+			name:      "override",
+			userAgent: "custom-agent/1.0",
+			expected:  "custom-agent/1.0",
+		},
+	}
+
+	for _, tc := range tCases {
+		var got string
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.CertAuthReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+			return func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get("User-Agent")
+				w.WriteHeader(code)
+				w.Write(resp)
+			}
+		}
+		vc.CertAuthResponseCode = 200
+		vc.CertAuthResponse = certAuthResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		c := New(CERT)
+		c.Logger = getTestLogger()
+		cp := &ClientParams{
+			VaultAddr:      fmt.Sprintf("https://%v/", addr),
+			CACertPath:     caCert,
+			ClientCertPath: clientCert,
+			ClientKeyPath:  clientKey,
+			UserAgent:      tc.userAgent,
+		}
+		if err := c.SetClientParams(cp); err != nil {
+			t.Errorf("%v: failed to prepare test client: %v", tc.name, err)
+		}
+
+		if _, err := c.NewAuthenticatedClient(); err != nil {
+			t.Errorf("%v: unexpected error from NewAuthenticatedClient(): %v", tc.name, err)
+		}
+		s.Close()
+
+		if got != tc.expected {
+			t.Errorf("%v: got User-Agent %v, want %v", tc.name, got, tc.expected)
+		}
+	}
+}
+
+func TestNewAuthenticatedClientWithVaultHeaders(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	var gotHeaders []string
+	headerRecorder := func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			gotHeaders = append(gotHeaders, r.Header.Get("X-Api-Gateway-Key"))
+			w.WriteHeader(code)
+			w.Write(resp)
+		}
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.CertAuthReqHandler = headerRecorder
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateReqHandler = headerRecorder
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(CERT)
+	c.Logger = getTestLogger()
+	cp := &ClientParams{
+		VaultAddr:      fmt.Sprintf("https://%v/", addr),
+		CACertPath:     caCert,
+		ClientCertPath: clientCert,
+		ClientKeyPath:  clientKey,
+		VaultHeaders: map[string]string{
+			"x-api-gateway-key": "test-gateway-key",
+		},
+	}
+	if err := c.SetClientParams(cp); err != nil {
+		t.Errorf("failed to prepare test client: %v", err)
+	}
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("unexpected error from NewAuthenticatedClient(): %v", err)
+	}
+
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+	if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+		t.Errorf("error from SignIntermediate(): %v", err)
+	}
+
+	wantHeaders := []string{"test-gateway-key", "test-gateway-key"}
+	if !reflect.DeepEqual(gotHeaders, wantHeaders) {
+		t.Errorf("got %v, want %v", gotHeaders, wantHeaders)
+	}
+}
+
+func TestNewAuthenticatedClientWithNamespace(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name          string
+		envNamespace  string
+		namespace     string
+		wantNamespace string
+	}{
+		{
+			name: "No namespace",
+		},
+		{
+			name:          "Environment variable",
+			envNamespace:  "env-ns/",
+			wantNamespace: "env-ns/",
+		},
+		{
+			name:          "Inline",
+			namespace:     "inline-ns/",
+			wantNamespace: "inline-ns/",
+		},
+		{
+			name:          "Inline takes precedence",
+			envNamespace:  "env-ns/",
+			namespace:     "inline-ns/",
+			wantNamespace: "inline-ns/",
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.CertAuthResponseCode = 200
+		vc.CertAuthResponse = certAuthResp
+		vc.RenewResponseCode = 200
+		vc.RenewResponse = renewResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		if tc.envNamespace != "" {
+			os.Setenv("VAULT_NAMESPACE", tc.envNamespace)
+		}
+
+		c := New(CERT).WithEnvVar()
+		c.Logger = getTestLogger()
+		cp := &ClientParams{
+			VaultAddr:      fmt.Sprintf("https://%v/", addr),
+			CACertPath:     caCert,
+			ClientCertPath: clientCert,
+			ClientKeyPath:  clientKey,
+			Namespace:      tc.namespace,
+		}
+		if err := c.SetClientParams(cp); err != nil {
+			t.Errorf("%v: failed to prepare test client: %v", tc.name, err)
+		}
+
+		if _, err := c.NewAuthenticatedClient(); err != nil {
+			t.Errorf("%v: unexpected error from NewAuthenticatedClient(): %v", tc.name, err)
+		}
+		os.Unsetenv("VAULT_NAMESPACE")
+
+		req := vc.LastCertAuthRequest()
+		if req == nil {
+			t.Errorf("%v: login request is not sent to cert auth endpoint", tc.name)
+		} else if got := req.Header.Get("X-Vault-Namespace"); got != tc.wantNamespace {
+			t.Errorf("%v: got namespace %q, want %q", tc.name, got, tc.wantNamespace)
+		}
+
+		s.Close()
+	}
+}
+
+func TestNewAuthenticatedClientWithReservedVaultHeaders(t *testing.T) {
+	for _, h := range []string{"X-Vault-Token", "x-vault-namespace"} {
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		cp := &ClientParams{
+			VaultAddr: "https://127.0.0.1:8200/",
+			Token:     "test-token",
+			VaultHeaders: map[string]string{
+				h: "overridden",
+			},
+		}
+		if err := c.SetClientParams(cp); err != nil {
+			t.Errorf("failed to prepare test client: %v", err)
+		}
+
+		_, err := c.NewAuthenticatedClient()
+		wantErr := fmt.Sprintf("header %v is reserved and can not be overridden", h)
+		if err == nil {
+			t.Errorf("%v: expect an error but got nil", h)
+		} else if err.Error() != wantErr {
+			t.Errorf("%v: got %v, want %v", h, err, wantErr)
+		}
+	}
+}
+
+func TestSignIntermediateWithAPIPrefix(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name      string
+		addrPath  string
+		apiPrefix string
+		wantPath  string
+	}{
+		{
+			name:      "Custom prefix",
+			apiPrefix: "/vault/api",
+			wantPath:  "/vault/api",
+		},
+		{
+			name:      "Custom prefix with trailing slash",
+			apiPrefix: "/vault/v1/",
+			wantPath:  "/vault/v1",
+		},
+		{
+			name:      "Custom prefix after the path of the address",
+			addrPath:  "/proxy/",
+			apiPrefix: "/vault/api",
+			wantPath:  "/proxy/vault/api",
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.CertAuthReqEndpoint = tc.wantPath + "/auth/cert/login"
+		vc.CertAuthResponseCode = 200
+		vc.CertAuthResponse = certAuthResp
+		vc.SignIntermediateReqEndpoint = tc.wantPath + "/pki/root/sign-intermediate"
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = signResp
+		vc.RenewReqEndpoint = tc.wantPath + "/auth/token/renew-self"
+		vc.RenewResponseCode = 200
+		vc.RenewResponse = renewResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		c := New(CERT)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v%v", addr, tc.addrPath)
+		c.clientParams.APIPrefix = tc.apiPrefix
+		c.clientParams.CACertPath = caCert
+		c.clientParams.ClientCertPath = clientCert
+		c.clientParams.ClientKeyPath = clientKey
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		csrPEM, err := ioutil.ReadFile(testReqCSR)
+		if err != nil {
+			t.Errorf("%v: failed to read csr data: %v", tc.name, err)
+		}
+		if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+			t.Errorf("%v: error from SignIntermediate(): %v", tc.name, err)
+		}
+		if req := vc.LastSignIntermediateRequest(); req == nil {
+			t.Errorf("%v: sign-intermediate request is not sent to %v", tc.name, vc.SignIntermediateReqEndpoint)
+		}
+
+		s.Close()
+	}
+}
+
+func TestSignIntermediateWithRequestEncoding(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	ttl := "3600"
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+
+	tCases := []struct {
+		name            string
+		requestEncoding string
+		wantContentType string
+	}{
+		{
+			name:            "Default",
+			wantContentType: "application/json",
+		},
+		{
+			name:            "JSON",
+			requestEncoding: RequestEncodingJSON,
+			wantContentType: "application/json",
+		},
+		{
+			name:            "Form",
+			requestEncoding: RequestEncodingForm,
+			wantContentType: "application/x-www-form-urlencoded",
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.CertAuthResponseCode = 200
+		vc.CertAuthResponse = certAuthResp
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = signResp
+		vc.RenewResponseCode = 200
+		vc.RenewResponse = renewResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		c := New(CERT)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.ClientCertPath = clientCert
+		c.clientParams.ClientKeyPath = clientKey
+		c.clientParams.CRLDistributionPoints = []string{"http://crl1.example.org", "http://crl2.example.org"}
+		c.clientParams.CertMetadata = map[string]string{"team": "platform"}
+		c.clientParams.RequestEncoding = tc.requestEncoding
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+		if _, err := vClient.SignIntermediate(context.Background(), ttl, csrPEM); err != nil {
+			t.Errorf("%v: error from SignIntermediate(): %v", tc.name, err)
+		}
+
+		loginReq := vc.LastCertAuthRequest()
+		signReq := vc.LastSignIntermediateRequest()
+		if loginReq == nil || signReq == nil {
+			t.Fatalf("%v: login or sign-intermediate request is not sent", tc.name)
+		}
+		for _, req := range []*fake.Request{loginReq, signReq} {
+			if got := req.Header.Get("Content-Type"); got != tc.wantContentType {
+				t.Errorf("%v: got Content-Type %q of %v, want %q", tc.name, got, req.Path, tc.wantContentType)
+			}
+		}
+
+		if tc.requestEncoding == RequestEncodingForm {
+			if signReq.Body != nil {
+				t.Errorf("%v: got JSON body %v, want a form body", tc.name, signReq.Body)
+			}
+			if got := signReq.Form.Get("csr"); got != string(csrPEM) {
+				t.Errorf("%v: got csr %q, want %q", tc.name, got, csrPEM)
+			}
+			if got := signReq.Form.Get("ttl"); got != ttl {
+				t.Errorf("%v: got ttl %q, want %q", tc.name, got, ttl)
+			}
+			if got, want := signReq.Form.Get("crl_distribution_points"), "http://crl1.example.org,http://crl2.example.org"; got != want {
+				t.Errorf("%v: got crl_distribution_points %q, want %q", tc.name, got, want)
+			}
+			// base64 of {"team":"platform"}
+			if got, want := signReq.Form.Get("cert_metadata"), "eyJ0ZWFtIjoicGxhdGZvcm0ifQ=="; got != want {
+				t.Errorf("%v: got cert_metadata %q, want %q", tc.name, got, want)
+			}
+		} else {
+			if signReq.Form != nil {
+				t.Errorf("%v: got form body %v, want a JSON body", tc.name, signReq.Form)
+			}
+			if got := signReq.Body["csr"]; got != string(csrPEM) {
+				t.Errorf("%v: got csr %q, want %q", tc.name, got, csrPEM)
+			}
+			if got := signReq.Body["ttl"]; got != ttl {
+				t.Errorf("%v: got ttl %q, want %q", tc.name, got, ttl)
+			}
+		}
+
+		s.Close()
+	}
+}
+
+func TestNewAuthenticatedClientWithTLSServerName(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		tlsServerName string
+		wantErr       bool
+	}{
+		// 0. Server certificate matches the overridden name
+		{
+			tlsServerName: "vault.test.internal",
+		},
+		// 1. Server certificate doesn't match the host in the address
+		{
+			tlsServerName: "",
+			wantErr:       true,
+		},
+		// 2. Server certificate doesn't match the overridden name
+		{
+			tlsServerName: "vault.example.org",
+			wantErr:       true,
+		},
+	}
+
+	for i, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = sniCert
+		vc.ServerKeyPemPath = serverKey
+		vc.CertAuthResponseCode = 200
+		vc.CertAuthResponse = certAuthResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("#%v: failed to prepare test server: %v", i, err)
+		}
+		s.Start()
+
+		c := New(CERT)
+		c.Logger = getTestLogger()
+		retry := 0
+		cp := &ClientParams{
+			MaxRetries:     &retry,
+			VaultAddr:      fmt.Sprintf("https://%v/", addr),
+			CACertPath:     caCert,
+			ClientCertPath: clientCert,
+			ClientKeyPath:  clientKey,
+			TLSServerName:  tc.tlsServerName,
+		}
+		if err := c.SetClientParams(cp); err != nil {
+			t.Errorf("#%v: failed to prepare test client: %v", i, err)
+		}
+
+		_, err = c.NewAuthenticatedClient()
+		if tc.wantErr && err == nil {
+			t.Errorf("#%v: expect an error but got nil", i)
+		}
+		if !tc.wantErr && err != nil {
+			t.Errorf("#%v: unexpected error from NewAuthenticatedClient(): %v", i, err)
+		}
+
+		s.Close()
+	}
+}
+
+func TestNewAuthenticatedClientWithTLSCipherSuites(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name         string
+		cipherSuites []string
+		wantErr      bool
+	}{
+		{
+			name:         "Cipher suite allowed by the server",
+			cipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+		},
+		{
+			name:         "Cipher suite allowed by the server among others",
+			cipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+		},
+		{
+			name:         "Default cipher suites",
+			cipherSuites: nil,
+		},
+		{
+			name:         "Cipher suite not allowed by the server",
+			cipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+			wantErr:      true,
+		},
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	for _, tc := range tCases {
+		suites, err := ParseCipherSuites(tc.cipherSuites)
+		if err != nil {
+			t.Fatalf("%v: failed to parse cipher suites: %v", tc.name, err)
+		}
+
+		c := New(CERT)
+		c.Logger = getTestLogger()
+		retry := 0
+		cp := &ClientParams{
+			MaxRetries:      &retry,
+			VaultAddr:       fmt.Sprintf("https://%v/", addr),
+			CACertPath:      caCert,
+			ClientCertPath:  clientCert,
+			ClientKeyPath:   clientKey,
+			TLSCipherSuites: suites,
+		}
+		if err := c.SetClientParams(cp); err != nil {
+			t.Errorf("%v: failed to prepare test client: %v", tc.name, err)
+		}
+
+		_, err = c.NewAuthenticatedClient()
+		if tc.wantErr && err == nil {
+			t.Errorf("%v: expected got an error", tc.name)
+		}
+		if !tc.wantErr && err != nil {
+			t.Errorf("%v: unexpected error from NewAuthenticatedClient(): %v", tc.name, err)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	got, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"})
+	if err != nil {
+		t.Errorf("unexpected error from ParseCipherSuites(): %v", err)
+	}
+	want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	tCases := []struct {
+		name    string
+		wantErr string
+	}{
+		{name: "TLS_UNKNOWN", wantErr: `unknown cipher suite "TLS_UNKNOWN"`},
+		{name: "TLS_RSA_WITH_RC4_128_SHA", wantErr: `insecure cipher suite "TLS_RSA_WITH_RC4_128_SHA"`},
+		{name: "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256", wantErr: `insecure cipher suite "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256"`},
+		{name: "TLS_AES_128_GCM_SHA256", wantErr: `cipher suite "TLS_AES_128_GCM_SHA256" of TLS 1.3, which can't be configured`},
+	}
+	for _, tc := range tCases {
+		_, err := ParseCipherSuites([]string{tc.name})
+		if err == nil {
+			t.Errorf("%v: expected got an error", tc.name)
+		} else if err.Error() != tc.wantErr {
+			t.Errorf("%v: got %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestNewAuthenticatedClientErrorCause(t *testing.T) {
+	tCases := []struct {
+		name                 string
+		caCertPath           string
+		certAuthResponseCode int
+		closeServer          bool
+		wantErr              error
+	}{
+		{
+			name:                 "untrusted server certificate",
+			caCertPath:           clientCert,
+			certAuthResponseCode: 200,
+			wantErr:              ErrUntrustedServer,
+		},
+		{
+			name:        "unreachable server",
+			caCertPath:  caCert,
+			closeServer: true,
+			wantErr:     ErrUnreachable,
+		},
+		{
+			name:                 "rejected credentials",
+			caCertPath:           caCert,
+			certAuthResponseCode: 403,
+			wantErr:              ErrAuthRejected,
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.CertAuthResponseCode = tc.certAuthResponseCode
+		vc.CertAuthResponse = []byte(`{"errors":["permission denied"]}`)
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+		if tc.closeServer {
+			s.Close()
+		}
+
+		c := New(CERT)
+		c.Logger = getTestLogger()
+		retry := 0
+		cp := &ClientParams{
+			MaxRetries:     &retry,
+			VaultAddr:      fmt.Sprintf("https://%v/", addr),
+			CACertPath:     tc.caCertPath,
+			ClientCertPath: clientCert,
+			ClientKeyPath:  clientKey,
+		}
+		if err := c.SetClientParams(cp); err != nil {
+			t.Errorf("%v: failed to prepare test client: %v", tc.name, err)
+		}
+
+		_, err = c.NewAuthenticatedClient()
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%v: got %v, want %v", tc.name, err, tc.wantErr)
+		}
+
+		if !tc.closeServer {
+			s.Close()
+		}
+	}
+}
+
+func TestSetClientParams(t *testing.T) {
+	c := New(CERT)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = "https://example.org/vault"
+	c.clientParams.CACertPath = "path/to/test-ca.pem"
+	c.clientParams.ClientCertPath = "path/to/client-cert.pem"
+	c.clientParams.ClientKeyPath = "path/to/client-key.pem"
+
+	cp := &ClientParams{
+		VaultAddr:      "test-addr",
+		CACertPath:     "test-ca.pem",
+		ClientCertPath: "test-client.pem",
+		ClientKeyPath:  "test-client-key.pem",
+	}
+
+	if err := c.SetClientParams(cp); err != nil {
+		t.Errorf("error from SetClientParams(): %v", err)
+	}
+	if c.clientParams.VaultAddr != "test-addr" {
+		t.Errorf("got %v, want %v", c.clientParams.VaultAddr, "test-addr")
+	}
+	if c.clientParams.CACertPath != "test-ca.pem" {
+		t.Errorf("got %v, want %v", c.clientParams.VaultAddr, "test-ca.pem")
+	}
+	if c.clientParams.ClientCertPath != "test-client.pem" {
+		t.Errorf("got %v, want %v", c.clientParams.VaultAddr, "test-client.pem")
+	}
+	if c.clientParams.ClientKeyPath != "test-client-key.pem" {
+		t.Errorf("got %v, want %v", c.clientParams.VaultAddr, "test-client-key.pem")
+	}
+}
+
+func TestConfigureTLSWithCertAuth(t *testing.T) {
+	c := New(CERT)
+	c.Logger = getTestLogger()
+	c.clientParams.CACertPath = caCert
+	c.clientParams.ClientCertPath = clientCert
+	c.clientParams.ClientKeyPath = clientKey
+	vConfig := vapi.DefaultConfig()
+
+	if err := c.ConfigureTLS(vConfig); err != nil {
+		t.Errorf("error from ConfigureTLS() %v", err)
+	}
+
+	wantPool, err := getTestCertPool(caCert)
+	if err != nil {
+		t.Errorf("failed to prepare cert pool: %v", err)
+	}
+	certPemBlock, keyPemBlock, err := getCertAndKeyPemBlock(clientCert, clientKey)
+	if err != nil {
+		t.Errorf("failed to load client cert/key: %v", err)
+	}
+	wantCert, err := tls.X509KeyPair(certPemBlock, keyPemBlock)
+	if err != nil {
+		t.Errorf("failed to prepare certificate: %v", err)
+	}
+
+	tp := vConfig.HttpClient.Transport.(*http.Transport).TLSClientConfig
+	cert, err := tp.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil {
+		t.Errorf("failed to get client cert: %v", err)
+	}
+
+	if !reflect.DeepEqual(tp.RootCAs.Subjects(), wantPool.Subjects()) {
+		t.Errorf("got %v,\n want %v", tp.RootCAs, wantPool)
+	}
+	if !reflect.DeepEqual(cert.Certificate, wantCert.Certificate) {
+		t.Errorf("got %v,\n want %v", cert.Certificate, wantCert.Certificate)
+	}
+}
+
+func TestConfigureTLSWithCombinedCertKey(t *testing.T) {
+	c := New(CERT)
+	c.Logger = getTestLogger()
+	c.clientParams.CACertPath = caCert
+	c.clientParams.ClientCertKeyPath = "../fake/_test_data/client-cert-key.pem"
+	vConfig := vapi.DefaultConfig()
+
+	if err := c.ConfigureTLS(vConfig); err != nil {
+		t.Fatalf("error from ConfigureTLS() %v", err)
+	}
+
+	certPemBlock, keyPemBlock, err := getCertAndKeyPemBlock(clientCert, clientKey)
+	if err != nil {
+		t.Errorf("failed to load client cert/key: %v", err)
+	}
+	wantCert, err := tls.X509KeyPair(certPemBlock, keyPemBlock)
+	if err != nil {
+		t.Errorf("failed to prepare certificate: %v", err)
+	}
+
+	tp := vConfig.HttpClient.Transport.(*http.Transport).TLSClientConfig
+	cert, err := tp.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil {
+		t.Errorf("failed to get client cert: %v", err)
+	}
+	if !reflect.DeepEqual(cert.Certificate, wantCert.Certificate) {
+		t.Errorf("got %v,\n want %v", cert.Certificate, wantCert.Certificate)
+	}
+}
+
+func TestConfigureTLSWithCombinedCertKeyError(t *testing.T) {
+	tCases := []struct {
+		name    string
+		path    string
+		wantErr string
+	}{
+		{
+			name:    "no private key",
+			path:    clientCert,
+			wantErr: "client private-key is not found",
+		},
+		{
+			name:    "no certificate",
+			path:    clientKey,
+			wantErr: "client certificate is not found",
+		},
+	}
+
+	for _, tc := range tCases {
+		c := New(CERT)
+		c.Logger = getTestLogger()
+		c.clientParams.CACertPath = caCert
+		c.clientParams.ClientCertKeyPath = tc.path
+
+		err := c.ConfigureTLS(vapi.DefaultConfig())
+		if err == nil {
+			t.Errorf("%v: expected got an error", tc.name)
+		} else if !strings.HasPrefix(err.Error(), tc.wantErr) {
+			t.Errorf("%v: got %v, want prefix %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestConfigureTLSWithTokenAuth(t *testing.T) {
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	c.clientParams.CACertPath = caCert
+	vConfig := vapi.DefaultConfig()
+
+	if err := c.ConfigureTLS(vConfig); err != nil {
+		t.Errorf("error from ConfigureTLS() %v", err)
+	}
+
+	wantPool, err := getTestCertPool(caCert)
+	if err != nil {
+		t.Errorf("failed to prepare cert pool: %v", err)
+	}
+
+	if err := c.ConfigureTLS(vConfig); err != nil {
+		t.Errorf("error from ConfigureTLS(): %v", err)
+	}
+	tp := vConfig.HttpClient.Transport.(*http.Transport).TLSClientConfig
+
+	if !reflect.DeepEqual(tp.RootCAs.Subjects(), wantPool.Subjects()) {
+		t.Errorf("got %v,\n want %v", tp.RootCAs, wantPool)
+	}
+}
+
+func TestConfigureTLSWithSystemCertPool(t *testing.T) {
+	systemPool, err := x509.SystemCertPool()
+	if err != nil {
+		t.Skipf("system cert pool is not available: %v", err)
+	}
+	testPool, err := getTestCertPool(caCert)
+	if err != nil {
+		t.Fatalf("failed to prepare cert pool: %v", err)
+	}
+
+	tCases := []struct {
+		name                 string
+		caCertPath           string
+		appendCAToSystemPool bool
+		wantSubjects         [][]byte
+	}{
+		{
+			name:         "system trust store is used if CA certificate is not set",
+			wantSubjects: systemPool.Subjects(),
+		},
+		{
+			name:                 "CA certificate is appended to system trust store",
+			caCertPath:           caCert,
+			appendCAToSystemPool: true,
+			wantSubjects:         append(systemPool.Subjects(), testPool.Subjects()...),
+		},
+	}
+
+	for _, tc := range tCases {
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.clientParams.CACertPath = tc.caCertPath
+		c.clientParams.AppendCAToSystemPool = tc.appendCAToSystemPool
+		vConfig := vapi.DefaultConfig()
+
+		if err := c.ConfigureTLS(vConfig); err != nil {
+			t.Errorf("%v: error from ConfigureTLS(): %v", tc.name, err)
+			continue
+		}
+		tp := vConfig.HttpClient.Transport.(*http.Transport).TLSClientConfig
+		if tp.RootCAs == nil {
+			t.Errorf("%v: RootCAs is not set", tc.name)
+			continue
+		}
+		if !reflect.DeepEqual(tp.RootCAs.Subjects(), tc.wantSubjects) {
+			t.Errorf("%v: got %v subjects, want %v", tc.name, len(tp.RootCAs.Subjects()), len(tc.wantSubjects))
+		}
+	}
+}
+
+func TestNewAuthenticatedClientWithAppendCAToSystemPool(t *testing.T) {
+	caChainResp, err := ioutil.ReadFile("../fake/_test_data/ca-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.CAChainResponseCode = 200
+	vc.CAChainResponse = caChainResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	// The test server is not trusted by the system trust store
+	retry := 0
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.Token = "test-token"
+	c.clientParams.MaxRetries = &retry
+	client, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+	if _, err := client.GetBundle(); err == nil {
+		t.Errorf("expected got an error")
+	}
+
+	c.clientParams.CACertPath = caCert
+	c.clientParams.AppendCAToSystemPool = true
+	client, err = c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+	if _, err := client.GetBundle(); err != nil {
+		t.Errorf("error from GetBundle(): %v", err)
+	}
+}
+
+func TestNewAuthenticatedClientWithCACertDir(t *testing.T) {
+	caChainResp, err := ioutil.ReadFile("../fake/_test_data/ca-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "vault-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"vault-ca.pem": caCert,
+		"other-ca.crt": "../fake/_test_data/client-root-ca.pem",
+		// Skipped since these are not certificates
+		"broken.pem": "../fake/_test_data/jwt",
+		"key.pem":    "../fake/_test_data/ca-key.pem",
+		// Ignored by the extension
+		"README.txt": "../fake/_test_data/README.md",
+	}
+	for name, src := range files {
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatalf("failed to load fixture: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			t.Fatalf("failed to write %v: %v", name, err)
+		}
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.CAChainResponseCode = 200
+	vc.CAChainResponse = caChainResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = dir
+	c.clientParams.Token = "test-token"
+
+	vConfig := vapi.DefaultConfig()
+	if err := c.ConfigureTLS(vConfig); err != nil {
+		t.Fatalf("error from ConfigureTLS(): %v", err)
+	}
+	if got := len(vConfig.HttpClient.Transport.(*http.Transport).TLSClientConfig.RootCAs.Subjects()); got != 2 {
+		t.Errorf("got %v CA certificates, want %v", got, 2)
+	}
+
+	client, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+	if _, err := client.GetBundle(); err != nil {
+		t.Errorf("error from GetBundle(): %v", err)
+	}
+}
+
+func TestNewAuthenticatedClientWithProxyCACert(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "vault-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The proxy has a certificate signed by another CA than Vault
+	proxyCAKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	proxyCATmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test proxy ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	proxyCADER, err := x509.CreateCertificate(rand.Reader, proxyCATmpl, proxyCATmpl, proxyCAKey.Public(), proxyCAKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	proxyCA, err := x509.ParseCertificate(proxyCADER)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	proxyKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	proxyTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test proxy"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	proxyDER, err := x509.CreateCertificate(rand.Reader, proxyTmpl, proxyCA, proxyKey.Public(), proxyCAKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	proxyCAPath := filepath.Join(dir, "proxy-ca.pem")
+	if err := ioutil.WriteFile(proxyCAPath, pemutil.EncodeCertificate(proxyCA), 0600); err != nil {
+		t.Fatalf("failed to write proxy CA: %v", err)
+	}
+
+	var tunnels int32
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		atomic.AddInt32(&tunnels, 1)
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	}))
+	proxy.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{proxyDER}, PrivateKey: proxyKey}},
+	}
+	proxy.StartTLS()
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatalf("failed to parse proxy URL: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	tCases := []struct {
+		name            string
+		proxyCACertPath string
+		wantErr         bool
+		wantTunnels     int32
+	}{
+		{
+			name:            "Proxy is verified with proxy CA",
+			proxyCACertPath: proxyCAPath,
+			wantTunnels:     1,
+		},
+		{
+			name:    "Proxy is verified with Vault CA",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tCases {
+		atomic.StoreInt32(&tunnels, 0)
+		retry := 0
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.Proxy = http.ProxyURL(proxyURL)
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.ProxyCACertPath = tc.proxyCACertPath
+		c.clientParams.Token = "test-token"
+		c.clientParams.MaxRetries = &retry
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		csrPEM, err := ioutil.ReadFile(testReqCSR)
+		if err != nil {
+			t.Errorf("%v: failed to read csr data: %v", tc.name, err)
+		}
+
+		_, err = vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+		if tc.wantErr && err == nil {
+			t.Errorf("%v: expected got an error", tc.name)
+		} else if !tc.wantErr && err != nil {
+			t.Errorf("%v: unexpected error from SignIntermediate(): %v", tc.name, err)
+		}
+		if got := atomic.LoadInt32(&tunnels); got != tc.wantTunnels {
+			t.Errorf("%v: got %v tunnels through the proxy, want %v", tc.name, got, tc.wantTunnels)
+		}
+	}
+}
+
+func TestGetBundle(t *testing.T) {
+	caChainResp, err := ioutil.ReadFile("../fake/_test_data/ca-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.CAChainResponseCode = 200
+	vc.CAChainResponse = caChainResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.Token = "test-token"
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+
+	certs, err := vClient.GetBundle()
+	if err != nil {
+		t.Fatalf("error from GetBundle(): %v", err)
+	}
+
+	wantSubjects := []string{"test intermediate ca", ""}
+	if len(certs) != len(wantSubjects) {
+		t.Fatalf("got %v certificates, want %v", len(certs), len(wantSubjects))
+	}
+	for i := range certs {
+		if certs[i].Subject.CommonName != wantSubjects[i] {
+			t.Errorf("#%v: got %q, want %q", i, certs[i].Subject.CommonName, wantSubjects[i])
+		}
+	}
+	if err := certs[0].CheckSignatureFrom(certs[1]); err != nil {
+		t.Errorf("certificates are not chained: %v", err)
+	}
+}
+
+func TestGetBundleWithBundleCacheTTL(t *testing.T) {
+	caChainResp, err := ioutil.ReadFile("../fake/_test_data/ca-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	var reqCount int32
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.CAChainResponseCode = 200
+	vc.CAChainResponse = caChainResp
+	vc.CAChainReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&reqCount, 1)
+			w.WriteHeader(code)
+			_, _ = w.Write(resp)
+		}
+	}
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.Token = "test-token"
+	c.clientParams.BundleCacheTTL = 200 * time.Millisecond
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			certs, err := vClient.GetBundle()
+			if err != nil {
+				t.Errorf("error from GetBundle(): %v", err)
+			} else if len(certs) != 2 {
+				t.Errorf("got %v certificates, want 2", len(certs))
+			}
+		}()
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&reqCount); got != 1 {
+		t.Errorf("got %v requests within the TTL, want 1", got)
+	}
+
+	// Modifying the returned slice must not affect the cache
+	certs, err := vClient.GetBundle()
+	if err != nil {
+		t.Fatalf("error from GetBundle(): %v", err)
+	}
+	certs[0] = nil
+	certs, err = vClient.GetBundle()
+	if err != nil {
+		t.Fatalf("error from GetBundle(): %v", err)
+	}
+	if certs[0] == nil {
+		t.Errorf("cached certificate is modified by the caller")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if _, err := vClient.GetBundle(); err != nil {
+		t.Fatalf("error from GetBundle(): %v", err)
+	}
+	if got := atomic.LoadInt32(&reqCount); got != 2 {
+		t.Errorf("got %v requests after the TTL, want 2", got)
+	}
+}
+
+func TestMountType(t *testing.T) {
+	kvMountResp, err := ioutil.ReadFile("../fake/_test_data/mount-kv-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.MountResponseCode = 200
+	vc.MountResponse = kvMountResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.Token = "test-token"
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+	got, err := vClient.MountType("/secret/")
+	if err != nil {
+		t.Errorf("error from MountType(): %v", err)
+	}
+	if got != "kv" {
+		t.Errorf("got type %v, want kv", got)
+	}
+	if req := vc.LastMountRequest(); req == nil || req.Path != "/v1/sys/internal/ui/mounts/secret" {
+		t.Errorf("got mount request %v, want the one to /v1/sys/internal/ui/mounts/secret", req)
+	}
+}
+
+func TestGetBundleWithBundleCacheTTLRootChange(t *testing.T) {
+	caChainResp, err := ioutil.ReadFile("../fake/_test_data/ca-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	rotatedCAChainResp, err := ioutil.ReadFile("../fake/_test_data/ca-chain-rotated-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	rotatedSignResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-rotated-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	rotatedCA, err := pemutil.LoadCertificate("../fake/_test_data/rotated-ca.pem")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+
+	var (
+		mu       sync.Mutex
+		rotated  bool
+		reqCount int32
+	)
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	// The upstream CA rotates once rotated is set
+	vc.CAChainReqHandler = func(int, []byte) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&reqCount, 1)
+			mu.Lock()
+			resp := caChainResp
+			if rotated {
+				resp = rotatedCAChainResp
+			}
+			mu.Unlock()
+			_, _ = w.Write(resp)
+		}
+	}
+	vc.SignIntermediateReqHandler = func(int, []byte) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			resp := signResp
+			if rotated {
+				resp = rotatedSignResp
+			}
+			mu.Unlock()
+			_, _ = w.Write(resp)
+		}
+	}
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.Token = "test-token"
+	c.clientParams.BundleCacheTTL = time.Hour
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+	if _, err := vClient.GetBundle(); err != nil {
+		t.Fatalf("error from GetBundle(): %v", err)
+	}
+
+	// The root in the sign response is the cached one
+	if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+		t.Fatalf("error from SignIntermediate(): %v", err)
+	}
+	if _, err := vClient.GetBundle(); err != nil {
+		t.Fatalf("error from GetBundle(): %v", err)
+	}
+	if got := atomic.LoadInt32(&reqCount); got != 1 {
+		t.Errorf("got %v requests with the same root, want 1", got)
+	}
+
+	mu.Lock()
+	rotated = true
+	mu.Unlock()
+	if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+		t.Fatalf("error from SignIntermediate(): %v", err)
+	}
+	certs, err := vClient.GetBundle()
+	if err != nil {
+		t.Fatalf("error from GetBundle(): %v", err)
+	}
+	if got := atomic.LoadInt32(&reqCount); got != 2 {
+		t.Errorf("got %v requests after the root changed, want 2", got)
+	}
+	if len(certs) != 1 || !certs[0].Equal(rotatedCA) {
+		t.Errorf("got %v certificates, want the rotated root CA", len(certs))
+	}
+}
+
+func TestSetSignTarget(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	caChainResp, err := ioutil.ReadFile("../fake/_test_data/ca-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.SignIntermediateReqEndpoint = "/v1/next-pki/issuer/next-issuer/sign-intermediate"
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+	vc.CAChainReqEndpoint = "/v1/next-pki/cert/ca_chain"
+	vc.CAChainResponseCode = 200
+	vc.CAChainResponse = caChainResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	retry := 0
+	c.clientParams.MaxRetries = &retry
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.Token = "test-token"
+	c.clientParams.PKIMountPoint = "test-pki"
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+	if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err == nil {
+		t.Errorf("expected got an error before SetSignTarget()")
+	}
+
+	vClient.SetSignTarget(SignTarget{PKIMountPoint: "/next-pki/", IssuerRef: "next-issuer"})
+	if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+		t.Errorf("error from SignIntermediate(): %v", err)
+	}
+	if req := vc.LastSignIntermediateRequest(); req == nil {
+		t.Errorf("sign-intermediate request is not sent to %v", vc.SignIntermediateReqEndpoint)
+	}
+	if _, err := vClient.GetBundle(); err != nil {
+		t.Errorf("error from GetBundle(): %v", err)
+	}
+}
+
+func TestVerifyCertificateChainWithClockSkew(t *testing.T) {
+	caCert, err := pemutil.LoadCertificate("../fake/_test_data/intermediate-ca.pem")
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+	caKey, err := pemutil.LoadSigner("../fake/_test_data/intermediate-ca-key.pem")
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+	key, err := pemutil.LoadSigner("../fake/_test_data/test-req-key.pem")
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+
+	// The clock of Vault is 30s ahead
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "skewed intermediate ca"},
+		NotBefore:             now.Add(30 * time.Second),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, key.Public(), caKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+
+	tCases := []struct {
+		name      string
+		clockSkew time.Duration
+		wantErr   bool
+	}{
+		{
+			name:    "No skew",
+			wantErr: true,
+		},
+		{
+			name:      "Within the skew",
+			clockSkew: time.Minute,
+		},
+		{
+			name:      "Beyond the skew",
+			clockSkew: 10 * time.Second,
+			wantErr:   true,
+		},
+	}
+
+	for _, tc := range tCases {
+		err := VerifyCertificateChain(cert, []*x509.Certificate{caCert}, tc.clockSkew)
+		if tc.wantErr && err == nil {
+			t.Errorf("%v: expected got an error", tc.name)
+		} else if !tc.wantErr && err != nil {
+			t.Errorf("%v: unexpected error from VerifyCertificateChain(): %v", tc.name, err)
+		}
+	}
+}
+
+func TestOrderCAChain(t *testing.T) {
+	load := func(path string) []*x509.Certificate {
+		certs, err := pemutil.LoadCertificates(path)
+		if err != nil {
+			t.Fatalf("failed to load %v: %v", path, err)
+		}
+		return certs
+	}
+	root := load("../fake/_test_data/ca.pem")[0]
+	intermediate := load("../fake/_test_data/intermediate-ca.pem")[0]
+	subIntermediate := load("../fake/_test_data/sub-intermediate-ca.pem")[0]
+	otherRoot := load("../fake/_test_data/client-root-ca.pem")[0]
+
+	tCases := []struct {
+		name  string
+		leaf  *x509.Certificate
+		certs []*x509.Certificate
+		want  []*x509.Certificate
+	}{
+		{
+			name:  "Ordered",
+			leaf:  subIntermediate,
+			certs: []*x509.Certificate{intermediate, root},
+			want:  []*x509.Certificate{intermediate, root},
+		},
+		{
+			name:  "Reversed with duplicates",
+			leaf:  subIntermediate,
+			certs: []*x509.Certificate{intermediate, root, intermediate, root},
+			want:  []*x509.Certificate{intermediate, root},
+		},
+		{
+			name:  "Not in the chain of the leaf",
+			leaf:  subIntermediate,
+			certs: []*x509.Certificate{otherRoot, root, intermediate, otherRoot},
+			want:  []*x509.Certificate{intermediate, root, otherRoot},
+		},
+		{
+			name:  "Empty",
+			leaf:  subIntermediate,
+			certs: nil,
+			want:  []*x509.Certificate{},
+		},
+	}
+
+	for _, tc := range tCases {
+		got := OrderCAChain(tc.leaf, tc.certs)
+		if len(got) != len(tc.want) {
+			t.Errorf("%v: got %d certificates, want %d", tc.name, len(got), len(tc.want))
+			continue
+		}
+		for i := range got {
+			if !got[i].Equal(tc.want[i]) {
+				t.Errorf("%v: #%d: got %q, want %q", tc.name, i, got[i].Subject, tc.want[i].Subject)
+			}
+		}
+	}
+}
+
+func TestSignIntermediate(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(CERT)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.ClientCertPath = clientCert
+	c.clientParams.ClientKeyPath = clientKey
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Errorf("failed to prepare vault client: %v", err)
+	}
+
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+
+	resp, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+	if err != nil {
+		t.Errorf("error from SignIntermediate(): %v", err)
+	} else if resp == nil {
+		t.Error("response is empty")
+	} else {
+		if resp.CertPEM == "" {
+			t.Error("CertPEM is empty")
+		}
+		if resp.CACertPEM == "" {
+			t.Errorf("CACertPEM is empty")
+		}
+		if resp.CACertChainPEM == nil {
+			t.Errorf("CACertChainPEM is empty")
+		}
+	}
+}
+
+func TestSignIntermediateWithResponseDER(t *testing.T) {
+	pemResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	derResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-der-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name                     string
+		responseDER              bool
+		signIntermediateResponse []byte
+		wantFormat               interface{}
+	}{
+		{
+			name:                     "PEM",
+			signIntermediateResponse: pemResp,
+		},
+		{
+			name:                     "DER",
+			responseDER:              true,
+			signIntermediateResponse: derResp,
+			wantFormat:               SignFormatDER,
+		},
+	}
+
+	var certs [][]*x509.Certificate
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = tc.signIntermediateResponse
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+		c.clientParams.ResponseDER = tc.responseDER
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		csrPEM, err := ioutil.ReadFile(testReqCSR)
+		if err != nil {
+			t.Errorf("%v: failed to read csr data: %v", tc.name, err)
+		}
+
+		resp, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+		if err != nil {
+			t.Fatalf("%v: error from SignIntermediate(): %v", tc.name, err)
+		}
+		if got := vc.LastSignIntermediateRequest().Body["format"]; got != tc.wantFormat {
+			t.Errorf("%v: got format %v, want %v", tc.name, got, tc.wantFormat)
+		}
+		if tc.responseDER && (resp.Cert == nil || resp.CertPEM != "") {
+			t.Errorf("%v: certificate is not parsed directly from DER", tc.name)
+		}
+		cert, err := resp.ParseCertificate()
+		if err != nil {
+			t.Errorf("%v: failed to parse certificate: %v", tc.name, err)
+		}
+		caCerts, err := resp.ParseCACertificates()
+		if err != nil {
+			t.Errorf("%v: failed to parse CA certificates: %v", tc.name, err)
+		}
+		if err := resp.VerifyChain(); err != nil {
+			t.Errorf("%v: failed to verify chain: %v", tc.name, err)
+		}
+		certs = append(certs, append([]*x509.Certificate{cert}, caCerts...))
+
+		s.Close()
+	}
+
+	// Both paths produce identical certificates
+	if len(certs) == 2 {
+		if len(certs[0]) != len(certs[1]) {
+			t.Fatalf("got %v certificates from DER, want %v", len(certs[1]), len(certs[0]))
+		}
+		for i := range certs[0] {
+			if !bytes.Equal(certs[0][i].Raw, certs[1][i].Raw) {
+				t.Errorf("certificate #%d from DER is different from PEM", i)
+			}
+		}
+	}
+}
+
+// BenchmarkParseSignResponse compares parsing the response as PEM, as DER encoded into PEM (sign_format = der),
+// and as DER directly (response_der).
+func BenchmarkParseSignResponse(b *testing.B) {
+	pemResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		b.Fatalf("failed to load fixture: %v", err)
+	}
+	derResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-der-response.json")
+	if err != nil {
+		b.Fatalf("failed to load fixture: %v", err)
+	}
+
+	bCases := []struct {
+		name   string
+		params *ClientParams
+		resp   []byte
+	}{
+		{name: "PEM", params: &ClientParams{}, resp: pemResp},
+		{name: "DERToPEM", params: &ClientParams{SignFormat: SignFormatDER}, resp: derResp},
+		{name: "DER", params: &ClientParams{ResponseDER: true}, resp: derResp},
+	}
+	for _, bc := range bCases {
+		secret, err := vapi.ParseSecret(bytes.NewReader(bc.resp))
+		if err != nil {
+			b.Fatalf("%v: failed to parse secret: %v", bc.name, err)
+		}
+		c := &Client{clientParams: bc.params}
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				resp, err := c.parseSignResponse(secret)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := resp.ParseCertificate(); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := resp.ParseCACertificates(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSignIntermediateWithEmptyCAChain(t *testing.T) {
+	emptyChainResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-empty-ca-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	var want struct {
+		Data struct {
+			IssuingCA string `json:"issuing_ca"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(emptyChainResp, &want); err != nil {
+		t.Fatalf("failed to parse fixture: %v", err)
+	}
+	// issuing_ca is also empty
+	emptyCAResp := bytes.Replace(emptyChainResp, []byte(strconv.Quote(want.Data.IssuingCA)), []byte(`""`), 1)
+
+	tCases := []struct {
+		name                     string
+		signIntermediateResponse []byte
+		wantErr                  string
+	}{
+		{
+			name:                     "issuing_ca is used as the CA chain",
+			signIntermediateResponse: emptyChainResp,
+		},
+		{
+			name:                     "Both are empty",
+			signIntermediateResponse: emptyCAResp,
+			wantErr:                  "request is successful, but both issuing_ca and ca_chain are empty",
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = tc.signIntermediateResponse
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		csrPEM, err := ioutil.ReadFile(testReqCSR)
+		if err != nil {
+			t.Errorf("%v: failed to read csr data: %v", tc.name, err)
+		}
+
+		resp, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+		if tc.wantErr != "" {
+			if err == nil {
+				t.Errorf("%v: expected got an error", tc.name)
+			} else if err.Error() != tc.wantErr {
+				t.Errorf("%v: got %v, want %v", tc.name, err, tc.wantErr)
+			}
+		} else if err != nil {
+			t.Errorf("%v: error from SignIntermediate(): %v", tc.name, err)
+		} else {
+			if len(resp.CACertChainPEM) != 1 {
+				t.Errorf("%v: got %v certificates in chain, want %v", tc.name, len(resp.CACertChainPEM), 1)
+			} else if resp.CACertChainPEM[0] != want.Data.IssuingCA {
+				t.Errorf("%v: CA chain is not issuing_ca: %v", tc.name, resp.CACertChainPEM[0])
+			}
+			if certs, err := resp.ParseCACertificates(); err != nil {
+				t.Errorf("%v: failed to parse CA certificates: %v", tc.name, err)
+			} else if len(OrderCAChain(nil, certs)) != 1 {
+				t.Errorf("%v: got %v certificates in bundle, want %v", tc.name, len(OrderCAChain(nil, certs)), 1)
+			}
+		}
+
+		s.Close()
+	}
+}
+
+func TestSignIntermediateConcurrent(t *testing.T) {
+	vc := fake.NewVaultServerConfig()
+
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	var conns int32
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	s.Start()
+	defer s.Close()
+
+	const (
+		workers  = 10
+		requests = 5
+	)
+
+	c := New(CERT)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.ClientCertPath = clientCert
+	c.clientParams.ClientKeyPath = clientKey
+	c.clientParams.MaxIdleConns = workers
+	c.clientParams.IdleConnTimeout = time.Minute
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, workers*requests)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				resp, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+				if err == nil && resp.CertPEM == "" {
+					err = errors.New("CertPEM is empty")
+				}
+				if err != nil {
+					errCh <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		t.Errorf("error from SignIntermediate(): %v", err)
+	}
+	// The transport may dial a few extra connections while the workers start at once,
+	// but it must not dial a connection per request.
+	if got := atomic.LoadInt32(&conns); got > 2*workers {
+		t.Errorf("connections are not reused: got %d connections for %d workers", got, workers)
+	}
+}
+
+func TestNewAuthenticatedClientWithDialTimeout(t *testing.T) {
+	retries := 0
+	c := New(CERT)
+	c.Logger = getTestLogger()
+	// 192.0.2.0/24 (TEST-NET-1) is not routable, so the dial hangs until the timeout unless it is rejected immediately.
+	c.clientParams.VaultAddr = "https://192.0.2.1:8200/"
+	c.clientParams.CACertPath = caCert
+	c.clientParams.ClientCertPath = clientCert
+	c.clientParams.ClientKeyPath = clientKey
+	c.clientParams.MaxRetries = &retries
+	c.clientParams.DialTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err := c.NewAuthenticatedClient()
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatal("expected got an error")
+	}
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("got %v, want %v", err, ErrUnreachable)
+	}
+	if elapsed > 5*time.Second {
+		t.Errorf("dial took %v, want it to fail fast", elapsed)
+	}
+}
+
+func TestNewAuthenticatedClientWithAuthAndSignTimeout(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+
+	// Both the login and the sign request take delay to respond
+	delay := 300 * time.Millisecond
+	slowHandler := func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+			w.WriteHeader(code)
+			w.Write(resp)
+		}
+	}
+
+	tCases := []struct {
+		name           string
+		requestTimeout time.Duration
+		authTimeout    time.Duration
+		signTimeout    time.Duration
+		wantAuthErr    bool
+		wantSignErr    bool
+	}{
+		{
+			name:        "Auth timed out",
+			authTimeout: 100 * time.Millisecond,
+			signTimeout: 5 * time.Second,
+			wantAuthErr: true,
+		},
+		{
+			name:        "Sign timed out",
+			authTimeout: 5 * time.Second,
+			signTimeout: 100 * time.Millisecond,
+			wantSignErr: true,
+		},
+		{
+			name:           "Fallback to the request timeout",
+			requestTimeout: 100 * time.Millisecond,
+			wantAuthErr:    true,
+		},
+		{
+			name:           "Override the request timeout",
+			requestTimeout: 100 * time.Millisecond,
+			authTimeout:    5 * time.Second,
+			signTimeout:    5 * time.Second,
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.CertAuthReqHandler = slowHandler
+		vc.CertAuthResponseCode = 200
+		vc.CertAuthResponse = certAuthResp
+		vc.SignIntermediateReqHandler = slowHandler
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = signResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		retries := 0
+		c := New(CERT)
+		c.Logger = getTestLogger()
+		cp := &ClientParams{
+			VaultAddr:      fmt.Sprintf("https://%v/", addr),
+			CACertPath:     caCert,
+			ClientCertPath: clientCert,
+			ClientKeyPath:  clientKey,
+			MaxRetries:     &retries,
+			RequestTimeout: tc.requestTimeout,
+			AuthTimeout:    tc.authTimeout,
+			SignTimeout:    tc.signTimeout,
+		}
+		if err := c.SetClientParams(cp); err != nil {
+			t.Errorf("%v: failed to prepare test client: %v", tc.name, err)
+		}
+
+		vClient, err := c.NewAuthenticatedClient()
+		if tc.wantAuthErr {
+			if err == nil {
+				t.Errorf("%v: expected got an error", tc.name)
+			}
+			s.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error from NewAuthenticatedClient(): %v", tc.name, err)
+			s.Close()
+			continue
+		}
+
+		_, err = vClient.SignIntermediate(context.Background(), "3600", csrPEM)
+		if tc.wantSignErr && err == nil {
+			t.Errorf("%v: expected got an error", tc.name)
+		} else if !tc.wantSignErr && err != nil {
+			t.Errorf("%v: unexpected error from SignIntermediate(): %v", tc.name, err)
+		}
+		s.Close()
+	}
+}
+
+func TestSignIntermediateWithForwardIdentityHeader(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name          string
+		header        string
+		value         string
+		csrPath       string
+		expected      string
+		wantClientErr bool
+	}{
+		{
+			name:     "Derived from the SPIFFE ID of the CSR",
+			header:   "X-Spire-Identity",
+			csrPath:  "../fake/_test_data/spiffe-example-org.csr",
+			expected: "spiffe://example.org",
+		},
+		{
+			name:     "Configured value",
+			header:   "X-Spire-Identity",
+			value:    "example.org",
+			csrPath:  "../fake/_test_data/spiffe-example-org.csr",
+			expected: "example.org",
+		},
+		{
+			name:    "CSR without SPIFFE ID",
+			header:  "X-Spire-Identity",
+			csrPath: testReqCSR,
+		},
+		{
+			name:    "Not configured",
+			csrPath: "../fake/_test_data/spiffe-example-org.csr",
+		},
+		{
+			name:          "Reserved header",
+			header:        "x-vault-token",
+			wantClientErr: true,
+		},
+	}
+
+	for _, tc := range tCases {
+		var got string
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.SignIntermediateReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+			return func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get("X-Spire-Identity")
+				w.WriteHeader(code)
+				w.Write(resp)
+			}
+		}
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = signResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+		c.clientParams.ForwardIdentityHeader = tc.header
+		c.clientParams.ForwardIdentityValue = tc.value
+
+		vClient, err := c.NewAuthenticatedClient()
+		if tc.wantClientErr {
+			if err == nil {
+				t.Errorf("%v: expected got an error", tc.name)
+			}
+			s.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		csrPEM, err := ioutil.ReadFile(tc.csrPath)
+		if err != nil {
+			t.Errorf("%v: failed to read csr data: %v", tc.name, err)
+		}
+
+		if _, err := vClient.SignIntermediate(context.Background(), "3600", csrPEM); err != nil {
+			t.Errorf("%v: error from SignIntermediate(): %v", tc.name, err)
+		}
+		s.Close()
+
+		if got != tc.expected {
+			t.Errorf("%v: got header %q, want %q", tc.name, got, tc.expected)
+		}
+	}
+}
+
+func TestSignIntermediateWithSignFormat(t *testing.T) {
+	pemResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	pemBundleResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-pem-bundle-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	derResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-der-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	var want struct {
+		Data struct {
+			Certificate string   `json:"certificate"`
+			IssuingCA   string   `json:"issuing_ca"`
+			CAChain     []string `json:"ca_chain"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(pemResp, &want); err != nil {
+		t.Errorf("failed to parse fixture: %v", err)
+	}
+
+	tCases := []struct {
+		signFormat               string
+		signIntermediateResponse []byte
+	}{
+		{signFormat: SignFormatPEM, signIntermediateResponse: pemResp},
+		{signFormat: SignFormatPEMBundle, signIntermediateResponse: pemBundleResp},
+		{signFormat: SignFormatDER, signIntermediateResponse: derResp},
+	}
+
+	for _, tc := range tCases {
+		var gotFormat interface{}
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.SignIntermediateReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+			return func(w http.ResponseWriter, r *http.Request) {
+				body := make(map[string]interface{})
+				json.NewDecoder(r.Body).Decode(&body)
+				gotFormat = body["format"]
+				w.WriteHeader(code)
+				w.Write(resp)
+			}
+		}
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = tc.signIntermediateResponse
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.signFormat, err)
+		}
+		s.Start()
+
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+		c.clientParams.SignFormat = tc.signFormat
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Errorf("%v: failed to prepare vault client: %v", tc.signFormat, err)
+		}
+
+		csrPEM, err := ioutil.ReadFile(testReqCSR)
+		if err != nil {
+			t.Errorf("%v: failed to read csr data: %v", tc.signFormat, err)
+		}
+
+		resp, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+		if err != nil {
+			t.Errorf("%v: error from SignIntermediate(): %v", tc.signFormat, err)
+		} else {
+			if gotFormat != tc.signFormat {
+				t.Errorf("%v: got format %v, want %v", tc.signFormat, gotFormat, tc.signFormat)
+			}
+			assertSameCertificate(t, tc.signFormat, resp.CertPEM, want.Data.Certificate)
+			assertSameCertificate(t, tc.signFormat, resp.CACertPEM, want.Data.IssuingCA)
+			if len(resp.CACertChainPEM) != len(want.Data.CAChain) {
+				t.Errorf("%v: got %v certificates in chain, want %v", tc.signFormat, len(resp.CACertChainPEM), len(want.Data.CAChain))
+			} else {
+				for i := range resp.CACertChainPEM {
+					assertSameCertificate(t, tc.signFormat, resp.CACertChainPEM[i], want.Data.CAChain[i])
+				}
+			}
+		}
+
+		s.Close()
+	}
+}
+
+func assertSameCertificate(t *testing.T, name, got, want string) {
+	gotCert, err := pemutil.ParseCertificate([]byte(got))
+	if err != nil {
+		t.Errorf("%v: failed to parse certificate: %v", name, err)
+		return
+	}
+	wantCert, err := pemutil.ParseCertificate([]byte(want))
+	if err != nil {
+		t.Errorf("%v: failed to parse certificate: %v", name, err)
+		return
+	}
+	if !gotCert.Equal(wantCert) {
+		t.Errorf("%v: got %v, want %v", name, gotCert.Subject, wantCert.Subject)
+	}
+}
+
+func TestSignIntermediateWithRateLimit(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.Token = "test-token"
+	c.clientParams.RequestsPerSecond = 20
+	c.clientParams.RequestsBurst = 2
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+
+	// 2 requests are allowed at once, and the rest 10 requests take at least 10/20 seconds.
+	const requests = 12
+	minDuration := 500 * time.Millisecond
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+				t.Errorf("error from SignIntermediate(): %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Allow a little jitter of the timer
+	if elapsed := time.Since(start); elapsed < minDuration-50*time.Millisecond {
+		t.Errorf("%v requests finished in %v, want at least %v", requests, elapsed, minDuration)
+	}
+
+	// Waiting for the limiter must be interrupted by the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := vClient.SignIntermediate(ctx, testTTL, csrPEM); err == nil {
+		t.Error("expect an error but got nil")
+	}
+}
+
+func TestSignIntermediateRequest(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.Token = "test-token"
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+	if _, err := vClient.SignIntermediate(context.Background(), "3600", csrPEM); err != nil {
+		t.Errorf("error from SignIntermediate(): %v", err)
+	}
+
+	req := vc.LastSignIntermediateRequest()
+	if req == nil {
+		t.Fatal("sign-intermediate request is not recorded")
+	}
+	if req.Method != http.MethodPut {
+		t.Errorf("got method %v, want %v", req.Method, http.MethodPut)
+	}
+	if got := req.Header.Get("X-Vault-Token"); got != "test-token" {
+		t.Errorf("got token %v, want test-token", got)
+	}
+	if req.Body["ttl"] != "3600" {
+		t.Errorf("got ttl %v, want 3600", req.Body["ttl"])
+	}
+	if req.Body["csr"] != string(csrPEM) {
+		t.Errorf("got csr %v, want %v", req.Body["csr"], string(csrPEM))
+	}
+	if _, ok := req.Body["format"]; ok {
+		t.Errorf("format must not be set if sign_format is not configured: %v", req.Body["format"])
+	}
+	if _, ok := req.Body["cert_metadata"]; ok {
+		t.Errorf("cert_metadata must not be set if it is not configured: %v", req.Body["cert_metadata"])
+	}
+	if _, ok := req.Body["uri_sans"]; ok {
+		t.Errorf("uri_sans must not be set if uri_san is not configured: %v", req.Body["uri_sans"])
+	}
+}
+
+func TestSignIntermediateWithPlainHTTP(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("http://%v/", addr)
+	// CA certificate is ignored since TLS is not used.
+	c.clientParams.CACertPath = "invalid/path/to/ca.pem"
+	c.clientParams.Token = "test-token"
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+	if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+		t.Errorf("error from SignIntermediate(): %v", err)
+	}
+}
+
+func TestNewAuthenticatedClientWithPlainHTTPErrorCertAuth(t *testing.T) {
+	c := New(CERT)
+	c.Logger = getTestLogger()
+	cp := &ClientParams{
+		VaultAddr:      "http://127.0.0.1:8200/",
+		ClientCertPath: clientCert,
+		ClientKeyPath:  clientKey,
+	}
+	if err := c.SetClientParams(cp); err != nil {
+		t.Errorf("failed to prepare test client: %v", err)
+	}
+
+	_, err := c.NewAuthenticatedClient()
+	wantErr := "cert auth method requires https scheme in vault address"
+	if err == nil {
+		t.Errorf("expected error from NewAuthenticatedClient()")
+	} else if err.Error() != wantErr {
+		t.Errorf("got %v, want %v", err, wantErr)
+	}
+}
+
+func TestSignIntermediateWithStandbyRetry(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+
+	tCases := []struct {
+		name          string
+		failures      int32
+		retries       int
+		wantErr       bool
+		wantAttempted int32
+	}{
+		{
+			name:          "success after retries",
+			failures:      2,
+			retries:       3,
+			wantAttempted: 3,
+		},
+		{
+			name:          "retries exceeded",
+			failures:      5,
+			retries:       2,
+			wantErr:       true,
+			wantAttempted: 3,
+		},
+		{
+			name:          "retry disabled",
+			failures:      1,
+			retries:       0,
+			wantErr:       true,
+			wantAttempted: 1,
+		},
+	}
+
+	for _, tc := range tCases {
+		var attempted int32
+		failures := tc.failures
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.SignIntermediateReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+			return func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&attempted, 1) <= failures {
+					w.WriteHeader(http.StatusPreconditionFailed)
+					w.Write([]byte(`{"errors":["required index state not present"]}`))
+					return
+				}
+				w.WriteHeader(code)
+				w.Write(resp)
+			}
+		}
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = signResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		retries := tc.retries
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+		c.clientParams.StandbyRetries = &retries
+		c.clientParams.StandbyRetryDelay = time.Millisecond
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		_, err = vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+		if tc.wantErr && err == nil {
+			t.Errorf("%v: expected error from SignIntermediate()", tc.name)
+		} else if !tc.wantErr && err != nil {
+			t.Errorf("%v: unexpected error from SignIntermediate(): %v", tc.name, err)
+		}
+		if got := atomic.LoadInt32(&attempted); got != tc.wantAttempted {
+			t.Errorf("%v: got %v attempts, want %v", tc.name, got, tc.wantAttempted)
+		}
+		s.Close()
+	}
+}
+
+func TestSignIntermediateWithRateLimitRetry(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+
+	two, zero := 2, 0
+	tCases := []struct {
+		name          string
+		failures      int32
+		retryAfter    string
+		retries       *int
+		maxRetryAfter time.Duration
+		wantErr       bool
+		wantAttempted int32
+		minElapsed    time.Duration
+		maxElapsed    time.Duration
+	}{
+		{
+			name:          "Retry-After is honored",
+			failures:      1,
+			retryAfter:    "1",
+			wantAttempted: 2,
+			minElapsed:    time.Second,
+			maxElapsed:    5 * time.Second,
+		},
+		{
+			name:          "Retry-After is capped",
+			failures:      1,
+			retryAfter:    "60",
+			maxRetryAfter: 100 * time.Millisecond,
+			wantAttempted: 2,
+			minElapsed:    100 * time.Millisecond,
+			maxElapsed:    5 * time.Second,
+		},
+		{
+			name:          "retries exceeded",
+			failures:      5,
+			retries:       &two,
+			maxRetryAfter: 10 * time.Millisecond,
+			wantErr:       true,
+			wantAttempted: 3,
+			maxElapsed:    5 * time.Second,
+		},
+		{
+			name:          "retry disabled",
+			failures:      1,
+			retryAfter:    "1",
+			retries:       &zero,
+			wantErr:       true,
+			wantAttempted: 1,
+			maxElapsed:    500 * time.Millisecond,
+		},
+	}
+
+	for _, tc := range tCases {
+		var attempted int32
+		failures, retryAfter := tc.failures, tc.retryAfter
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.SignIntermediateReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+			return func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&attempted, 1) <= failures {
+					if retryAfter != "" {
+						w.Header().Set("Retry-After", retryAfter)
+					}
+					w.WriteHeader(http.StatusTooManyRequests)
+					w.Write([]byte(`{"errors":["request path \"pki/root/sign-intermediate\": rate limit quota exceeded"]}`))
+					return
+				}
+				w.WriteHeader(code)
+				w.Write(resp)
+			}
+		}
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = signResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+		c.clientParams.RateLimitRetries = tc.retries
+		c.clientParams.MaxRetryAfter = tc.maxRetryAfter
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		start := time.Now()
+		_, err = vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+		elapsed := time.Since(start)
+		if tc.wantErr && err == nil {
+			t.Errorf("%v: expected error from SignIntermediate()", tc.name)
+		} else if !tc.wantErr && err != nil {
+			t.Errorf("%v: unexpected error from SignIntermediate(): %v", tc.name, err)
+		}
+		if got := atomic.LoadInt32(&attempted); got != tc.wantAttempted {
+			t.Errorf("%v: got %v attempts, want %v", tc.name, got, tc.wantAttempted)
+		}
+		if elapsed < tc.minElapsed || elapsed > tc.maxElapsed {
+			t.Errorf("%v: got elapsed %v, want between %v and %v", tc.name, elapsed, tc.minElapsed, tc.maxElapsed)
+		}
+		s.Close()
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tCases := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{value: "", expected: 0},
+		{value: "5", expected: 5 * time.Second},
+		{value: "-1", expected: 0},
+		{value: "Wed, 01 Jan 2020 00:00:10 GMT", expected: 10 * time.Second},
+		{value: "Tue, 31 Dec 2019 23:59:50 GMT", expected: 0},
+		{value: "soon", expected: 0},
+	}
+
+	for _, tc := range tCases {
+		if got := parseRetryAfter(tc.value, now); got != tc.expected {
+			t.Errorf("%q: got %v, want %v", tc.value, got, tc.expected)
+		}
+	}
+}
+
+func TestSignIntermediateWithRedirect(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	caChainResp, err := ioutil.ReadFile("../fake/_test_data/ca-chain-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	active := fake.NewVaultServerConfig()
+	active.ServerCertificatePemPath = serverCert
+	active.ServerKeyPemPath = serverKey
+	active.SignIntermediateResponseCode = 200
+	active.SignIntermediateResponse = signResp
+	active.CAChainResponseCode = 200
+	active.CAChainResponse = caChainResp
+
+	as, activeAddr, err := active.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	as.Start()
+	defer as.Close()
+
+	tCases := []struct {
+		name    string
+		loop    bool
+		wantErr string
+	}{
+		{
+			name: "Redirect to the active node",
+		},
+		{
+			name:    "Redirect loop",
+			loop:    true,
+			wantErr: "redirect loop to",
+		},
+	}
+
+	for _, tc := range tCases {
+		var standbyAddr string
+		redirect := func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+			return func(w http.ResponseWriter, r *http.Request) {
+				addr := activeAddr
+				if tc.loop {
+					addr = standbyAddr
+				}
+				http.Redirect(w, r, fmt.Sprintf("https://%v%v", addr, r.URL.Path), http.StatusTemporaryRedirect)
+			}
+		}
+		standby := fake.NewVaultServerConfig()
+		standby.ServerCertificatePemPath = serverCert
+		standby.ServerKeyPemPath = serverKey
+		standby.SignIntermediateReqHandler = redirect
+		standby.CAChainReqHandler = redirect
+
+		ss, addr, err := standby.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		standbyAddr = addr
+		ss.Start()
+
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", standbyAddr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		csrPEM, err := ioutil.ReadFile(testReqCSR)
+		if err != nil {
+			t.Errorf("%v: failed to read csr data: %v", tc.name, err)
+		}
+
+		_, signErr := vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+		_, bundleErr := vClient.GetBundle()
+		for _, err := range []error{signErr, bundleErr} {
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Errorf("%v: expected got an error", tc.name)
+				} else if !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("%v: got %v, want %v", tc.name, err, tc.wantErr)
+				}
+			} else if err != nil {
+				t.Errorf("%v: unexpected error: %v", tc.name, err)
+			}
+		}
+
+		if tc.wantErr == "" {
+			for _, req := range []*fake.Request{active.LastSignIntermediateRequest(), active.LastCAChainRequest()} {
+				if req == nil {
+					t.Errorf("%v: request is not redirected to the active node", tc.name)
+				} else if got := req.Header.Get("X-Vault-Token"); got != "test-token" {
+					t.Errorf("%v: got token %q on %v, want test-token", tc.name, got, req.Path)
+				}
+			}
+			if req := active.LastSignIntermediateRequest(); req != nil && req.Body["csr"] != string(csrPEM) {
+				t.Errorf("%v: body of the sign request is not preserved: %v", tc.name, req.Body)
+			}
+		}
+
+		ss.Close()
+	}
+}
+
+func TestSignIntermediateWithServedVaultAddr(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	active := fake.NewVaultServerConfig()
+	active.ServerCertificatePemPath = serverCert
+	active.ServerKeyPemPath = serverKey
+	active.SignIntermediateResponseCode = 200
+	active.SignIntermediateResponse = signResp
+
+	as, activeAddr, err := active.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	as.Start()
+	defer as.Close()
+
+	tCases := []struct {
+		name     string
+		redirect bool
+	}{
+		{
+			name: "Served by the configured node",
+		},
+		{
+			name:     "Redirected to the active node",
+			redirect: true,
+		},
+	}
+
+	for _, tc := range tCases {
+		standby := fake.NewVaultServerConfig()
+		standby.ServerCertificatePemPath = serverCert
+		standby.ServerKeyPemPath = serverKey
+		standby.SignIntermediateResponseCode = 200
+		standby.SignIntermediateResponse = signResp
+		if tc.redirect {
+			standby.SignIntermediateReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+				return func(w http.ResponseWriter, r *http.Request) {
+					http.Redirect(w, r, fmt.Sprintf("https://%v%v", activeAddr, r.URL.Path), http.StatusTemporaryRedirect)
+				}
+			}
+		}
+
+		ss, standbyAddr, err := standby.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		ss.Start()
+
+		metrics := newFakeMetrics()
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.Metrics = metrics
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", standbyAddr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		csrPEM, err := ioutil.ReadFile(testReqCSR)
+		if err != nil {
+			t.Errorf("%v: failed to read csr data: %v", tc.name, err)
+		}
+
+		resp, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+		if err != nil {
+			t.Fatalf("%v: error from SignIntermediate(): %v", tc.name, err)
+		}
+
+		wantAddr, wantLabel := "https://"+standbyAddr, "https://"+standbyAddr
+		if tc.redirect {
+			wantAddr, wantLabel = "https://"+activeAddr, "other"
+		}
+		if resp.VaultAddr != wantAddr {
+			t.Errorf("%v: got vault address %v, want %v", tc.name, resp.VaultAddr, wantAddr)
+		}
+		if got := metrics.labeledCounter(metricSignSuccess, telemetry.Label{Name: "vault_addr", Value: wantLabel}); got != 1 {
+			t.Errorf("%v: got %v of %v with vault_addr %v, want 1", tc.name, got, metricSignSuccess, wantLabel)
+		}
+
+		ss.Close()
+	}
+}
+
+func TestSignIntermediateWithMetricsNamespace(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Fatalf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Fatalf("failed to read csr data: %v", err)
+	}
+
+	// Two instances in one process share the metrics sink
+	metrics := newFakeMetrics()
+	namespaces := []string{"tenant_a", "tenant_b"}
+	for _, ns := range namespaces {
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.Metrics = NamespacedMetrics(metrics, ns)
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", ns, err)
+		}
+		if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+			t.Fatalf("%v: error from SignIntermediate(): %v", ns, err)
+		}
+	}
+
+	label := telemetry.Label{Name: "vault_addr", Value: "https://" + addr}
+	for _, ns := range namespaces {
+		key := append([]string{ns}, metricSignSuccess...)
+		if got := metrics.labeledCounter(key, label); got != 1 {
+			t.Errorf("got %v of %v, want 1", got, key)
+		}
+	}
+	if got := metrics.labeledCounter(metricSignSuccess, label); got != 0 {
+		t.Errorf("got %v of %v without namespace, want 0", got, metricSignSuccess)
+	}
+	if m := NamespacedMetrics(metrics, ""); m != Metrics(metrics) {
+		t.Errorf("expected the metrics are not wrapped without namespace")
+	}
+}
+
+func TestSignIntermediateWithCommonName(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name              string
+		csrPath           string
+		commonName        string
+		commonNameFromCSR bool
+		useCSRValues      bool
+		want              string
+	}{
+		{
+			name:    "common name in CSR",
+			csrPath: testReqCSR,
+			want:    "test request",
+		},
+		{
+			name:       "configured common name",
+			csrPath:    testReqCSR,
+			commonName: "configured ca",
+			want:       "configured ca",
+		},
+		{
+			name:              "common name from CSR is preferred",
+			csrPath:           testReqCSR,
+			commonName:        "configured ca",
+			commonNameFromCSR: true,
+			want:              "test request",
+		},
+		{
+			name:              "fallback to configured common name",
+			csrPath:           "../fake/_test_data/test-req-no-cn.csr",
+			commonName:        "configured ca",
+			commonNameFromCSR: true,
+			want:              "configured ca",
+		},
+		{
+			name:         "configured common name is ignored with use_csr_values",
+			csrPath:      testReqCSR,
+			commonName:   "configured ca",
+			useCSRValues: true,
+			want:         "test request",
+		},
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	for _, tc := range tCases {
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+		c.clientParams.CommonName = tc.commonName
+		c.clientParams.CommonNameFromCSR = tc.commonNameFromCSR
+		c.clientParams.UseCSRValues = tc.useCSRValues
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		csrPEM, err := ioutil.ReadFile(tc.csrPath)
+		if err != nil {
+			t.Errorf("%v: failed to read csr data: %v", tc.name, err)
+		}
+		if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+			t.Errorf("%v: error from SignIntermediate(): %v", tc.name, err)
+		}
+
+		req := vc.LastSignIntermediateRequest()
+		if req == nil {
+			t.Fatalf("%v: sign-intermediate request is not recorded", tc.name)
+		}
+		if req.Body["common_name"] != tc.want {
+			t.Errorf("%v: got common_name %v, want %v", tc.name, req.Body["common_name"], tc.want)
+		}
+		if got, _ := req.Body["use_csr_values"].(bool); got != tc.useCSRValues {
+			t.Errorf("%v: got use_csr_values %v, want %v", tc.name, req.Body["use_csr_values"], tc.useCSRValues)
+		}
+	}
+}
+
+func TestSignIntermediateNonCAMetrics(t *testing.T) {
+	tCases := []struct {
+		name        string
+		fixturePath string
+		want        float32
+	}{
+		{
+			name:        "CA certificate",
+			fixturePath: "../fake/_test_data/sign-intermediate-response.json",
+			want:        0,
+		},
+		{
+			name:        "non-CA certificate",
+			fixturePath: "../fake/_test_data/sign-intermediate-non-ca-response.json",
+			want:        1,
+		},
+	}
+
+	for _, tc := range tCases {
+		signResp, err := ioutil.ReadFile(tc.fixturePath)
+		if err != nil {
+			t.Errorf("%v: failed to load fixture: %v", tc.name, err)
+		}
+
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = signResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		m := newFakeMetrics()
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.Metrics = m
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		csrPEM, err := ioutil.ReadFile(testReqCSR)
+		if err != nil {
+			t.Errorf("%v: failed to read csr data: %v", tc.name, err)
+		}
+		resp, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+		if err != nil {
+			t.Errorf("%v: error from SignIntermediate(): %v", tc.name, err)
+		} else if err := resp.VerifyCA(); (err != nil) != (tc.want != 0) {
+			t.Errorf("%v: unexpected result from VerifyCA(): %v", tc.name, err)
+		}
+		if got := m.counter(metricSignNonCACertificate); got != tc.want {
+			t.Errorf("%v: got non_ca_certificate counter %v, want %v", tc.name, got, tc.want)
+		}
+
+		s.Close()
+	}
+}
+
+func TestSignIntermediateWithMaxPathLength(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	zero, one := 0, 1
+	tCases := []struct {
+		name          string
+		maxPathLength *int
+	}{
+		{name: "not set"},
+		{name: "zero", maxPathLength: &zero},
+		{name: "one", maxPathLength: &one},
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	for _, tc := range tCases {
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+		c.clientParams.MaxPathLength = tc.maxPathLength
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		csrPEM, err := ioutil.ReadFile(testReqCSR)
+		if err != nil {
+			t.Errorf("%v: failed to read csr data: %v", tc.name, err)
+		}
+		if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+			t.Errorf("%v: error from SignIntermediate(): %v", tc.name, err)
+		}
+
+		req := vc.LastSignIntermediateRequest()
+		if req == nil {
+			t.Fatalf("%v: sign-intermediate request is not recorded", tc.name)
+		}
+		got, ok := req.Body["max_path_length"]
+		switch {
+		case tc.maxPathLength == nil && ok:
+			t.Errorf("%v: max_path_length must not be set: %v", tc.name, got)
+		case tc.maxPathLength != nil && got != float64(*tc.maxPathLength):
+			t.Errorf("%v: got max_path_length %v, want %v", tc.name, got, *tc.maxPathLength)
+		}
+	}
+}
+
+func TestSignIntermediateWithStripCSRSANs(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name                  string
+		stripCSRSANs          []string
+		wantExcludeCNFromSANs bool
+	}{
+		{name: "not set"},
+		{name: "dns", stripCSRSANs: []string{"dns"}, wantExcludeCNFromSANs: true},
+		{name: "email", stripCSRSANs: []string{"email"}, wantExcludeCNFromSANs: true},
+		{name: "dns and email", stripCSRSANs: []string{"dns", "email"}, wantExcludeCNFromSANs: true},
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	for _, tc := range tCases {
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+		c.clientParams.StripCSRSANs = tc.stripCSRSANs
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		csrPEM, err := ioutil.ReadFile(testReqCSR)
+		if err != nil {
+			t.Errorf("%v: failed to read csr data: %v", tc.name, err)
+		}
+		if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+			t.Errorf("%v: error from SignIntermediate(): %v", tc.name, err)
+		}
+
+		req := vc.LastSignIntermediateRequest()
+		if req == nil {
+			t.Fatalf("%v: sign-intermediate request is not recorded", tc.name)
+		}
+		got, ok := req.Body["exclude_cn_from_sans"]
+		switch {
+		case !tc.wantExcludeCNFromSANs && ok:
+			t.Errorf("%v: exclude_cn_from_sans must not be set: %v", tc.name, got)
+		case tc.wantExcludeCNFromSANs && got != true:
+			t.Errorf("%v: got exclude_cn_from_sans %v, want true", tc.name, got)
+		}
+		for _, key := range []string{"use_csr_values", "alt_names", "ip_sans", "uri_sans"} {
+			if v, ok := req.Body[key]; ok {
+				t.Errorf("%v: %v must not be set: %v", tc.name, key, v)
+			}
+		}
+	}
+}
+
+func TestSignIntermediateWithNotBeforeDuration(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name              string
+		notBeforeDuration time.Duration
+		want              interface{}
+	}{
+		{name: "not set"},
+		{name: "5m", notBeforeDuration: 5 * time.Minute, want: "300"},
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	for _, tc := range tCases {
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+		c.clientParams.NotBeforeDuration = tc.notBeforeDuration
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		csrPEM, err := ioutil.ReadFile(testReqCSR)
+		if err != nil {
+			t.Errorf("%v: failed to read csr data: %v", tc.name, err)
+		}
+		if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+			t.Errorf("%v: error from SignIntermediate(): %v", tc.name, err)
+		}
+
+		req := vc.LastSignIntermediateRequest()
+		if req == nil {
+			t.Fatalf("%v: sign-intermediate request is not recorded", tc.name)
+		}
+		if got := req.Body["not_before_duration"]; got != tc.want {
+			t.Errorf("%v: got not_before_duration %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSignIntermediateWithChildToken(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	tokenCreateResp, err := ioutil.ReadFile("../fake/_test_data/token-create-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name        string
+		method      AuthMethod
+		parentToken string
+	}{
+		{
+			name:        "cert auth",
+			method:      CERT,
+			parentToken: "cf95f87d-f95b-47ff-b1f5-ba7bff850425",
+		},
+		{
+			name:        "token auth",
+			method:      TOKEN,
+			parentToken: "test-token",
+		},
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.TokenCreateResponseCode = 200
+	vc.TokenCreateResponse = tokenCreateResp
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	for _, tc := range tCases {
+		c := New(tc.method)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+		if tc.method == CERT {
+			c.clientParams.ClientCertPath = clientCert
+			c.clientParams.ClientKeyPath = clientKey
+		}
+		c.clientParams.CreateChildToken = true
+		c.clientParams.ChildTokenPolicies = []string{"pki-sign"}
+		c.clientParams.ChildTokenTTL = "10m"
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		createReq := vc.LastTokenCreateRequest()
+		if createReq == nil {
+			t.Fatalf("%v: token create request is not recorded", tc.name)
+		}
+		if got := createReq.Header.Get("X-Vault-Token"); got != tc.parentToken {
+			t.Errorf("%v: got parent token %v, want %v", tc.name, got, tc.parentToken)
+		}
+		if !reflect.DeepEqual(createReq.Body["policies"], []interface{}{"pki-sign"}) || createReq.Body["ttl"] != "10m" {
+			t.Errorf("%v: unexpected token create request: %v", tc.name, createReq.Body)
+		}
+
+		csrPEM, err := ioutil.ReadFile(testReqCSR)
+		if err != nil {
+			t.Errorf("%v: failed to read csr data: %v", tc.name, err)
+		}
+		if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+			t.Errorf("%v: error from SignIntermediate(): %v", tc.name, err)
+		}
+
+		signReq := vc.LastSignIntermediateRequest()
+		if signReq == nil {
+			t.Fatalf("%v: sign-intermediate request is not recorded", tc.name)
+		}
+		if got := signReq.Header.Get("X-Vault-Token"); got != "7c2a9e4b-1d3f-4a6e-9b8c-0f5e2d7a1c3b" {
+			t.Errorf("%v: got token %v, want the child token", tc.name, got)
+		}
+	}
+}
+
+func TestSignIntermediateWithMaxResponseBytes(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	// A valid JSON body which is larger than the default limit
+	oversizedResp := []byte(fmt.Sprintf(`{"warnings":["%v"]}`, strings.Repeat("a", DefaultMaxResponseBytes)))
+
+	tCases := []struct {
+		name             string
+		maxResponseBytes int64
+		response         []byte
+		expectError      bool
+	}{
+		{
+			name:     "Default limit",
+			response: signResp,
+		},
+		{
+			name:             "Within the limit",
+			maxResponseBytes: int64(len(signResp)),
+			response:         signResp,
+		},
+		{
+			name:             "Exceeds the limit",
+			maxResponseBytes: 1024,
+			response:         signResp,
+			expectError:      true,
+		},
+		{
+			name:        "Exceeds the default limit",
+			response:    oversizedResp,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = tc.response
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+		c.clientParams.MaxResponseBytes = tc.maxResponseBytes
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		csrPEM, err := ioutil.ReadFile(testReqCSR)
+		if err != nil {
+			t.Errorf("%v: failed to read csr data: %v", tc.name, err)
+		}
+
+		_, err = vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+		if tc.expectError {
+			if err == nil {
+				t.Errorf("%v: expected got an error", tc.name)
+			} else if !errors.Is(err, errResponseTooLarge) {
+				t.Errorf("%v: got %v, want %v", tc.name, err, errResponseTooLarge)
+			}
+		} else if err != nil {
+			t.Errorf("%v: error from SignIntermediate(): %v", tc.name, err)
+		}
+		s.Close()
+	}
+}
+
+func TestSignIntermediateWithWatchCACert(t *testing.T) {
+	rotatedCA, err := ioutil.ReadFile("../fake/_test_data/rotated-ca.pem")
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+	serverCA, err := ioutil.ReadFile(caCert)
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "vault-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// The server certificate is not signed by the CA at first
+	caPath := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caPath, rotatedCA, 0600); err != nil {
+		t.Fatalf("failed to write CA certificate: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse, err = ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Fatalf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caPath
+	c.clientParams.WatchCACert = true
+	c.clientParams.Token = "test-token"
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+	defer vClient.Close()
+
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Fatalf("failed to read csr data: %v", err)
+	}
+	if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err == nil {
+		t.Fatal("expected got an error")
+	}
+
+	// Replace the file by a rename, as the CA certificate would be rotated
+	tmpPath := filepath.Join(dir, "ca.pem.tmp")
+	if err := ioutil.WriteFile(tmpPath, serverCA, 0600); err != nil {
+		t.Fatalf("failed to write CA certificate: %v", err)
+	}
+	if err := os.Rename(tmpPath, caPath); err != nil {
+		t.Fatalf("failed to replace CA certificate: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("new connections are not verified with the reloaded CA certificate: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestSignIntermediateWithDistributionPoints(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	var gotBody map[string]interface{}
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.SignIntermediateReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&gotBody)
+			w.WriteHeader(code)
+			w.Write(resp)
+		}
+	}
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.Token = "test-token"
+	c.clientParams.CRLDistributionPoints = []string{"http://crl.example.org/ca.crl"}
+	c.clientParams.OCSPServers = []string{"http://ocsp1.example.org", "http://ocsp2.example.org"}
+	c.clientParams.PermittedDNSDomains = []string{"example.org", ".example.com"}
+	c.clientParams.CertMetadata = map[string]string{"team": "platform", "ticket": "SEC-1234"}
+	c.clientParams.URISAN = "spiffe://example.org"
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+
+	if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+		t.Errorf("error from SignIntermediate(): %v", err)
+	}
+
+	wantCRL := []interface{}{"http://crl.example.org/ca.crl"}
+	if !reflect.DeepEqual(gotBody["crl_distribution_points"], wantCRL) {
+		t.Errorf("got %v, want %v", gotBody["crl_distribution_points"], wantCRL)
+	}
+	wantOCSP := []interface{}{"http://ocsp1.example.org", "http://ocsp2.example.org"}
+	if !reflect.DeepEqual(gotBody["ocsp_servers"], wantOCSP) {
+		t.Errorf("got %v, want %v", gotBody["ocsp_servers"], wantOCSP)
+	}
+	wantDomains := []interface{}{"example.org", ".example.com"}
+	if !reflect.DeepEqual(gotBody["permitted_dns_domains"], wantDomains) {
+		t.Errorf("got %v, want %v", gotBody["permitted_dns_domains"], wantDomains)
+	}
+	// base64 of {"team":"platform","ticket":"SEC-1234"}
+	if got, want := gotBody["cert_metadata"], "eyJ0ZWFtIjoicGxhdGZvcm0iLCJ0aWNrZXQiOiJTRUMtMTIzNCJ9"; got != want {
+		t.Errorf("got cert_metadata %v, want %v", got, want)
+	}
+	if got, want := gotBody["uri_sans"], "spiffe://example.org"; got != want {
+		t.Errorf("got uri_sans %v, want %v", got, want)
+	}
+}
+
+func TestSignIntermediateWithReauthentication(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	// The token in cert-auth-response.json is regarded as expired.
+	const (
+		expiredToken = "cf95f87d-f95b-47ff-b1f5-ba7bff850425"
+		freshToken   = "1f3a7c2e-9b4d-4e8f-a6c5-0d2b8e7f9a13"
+	)
+	var logins int32
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.CertAuthReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+			if atomic.AddInt32(&logins, 1) == 1 {
+				w.Write(resp)
+				return
+			}
+			fmt.Fprintf(w, `{"auth":{"client_token":"%v","lease_duration":3600,"renewable":false}}`, freshToken)
+		}
+	}
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Vault-Token") == expiredToken {
+				w.WriteHeader(403)
+				fmt.Fprint(w, `{"errors":["permission denied"]}`)
+				return
+			}
+			w.WriteHeader(code)
+			w.Write(resp)
+		}
+	}
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	metrics := newFakeMetrics()
+	c := New(CERT)
+	c.Logger = getTestLogger()
+	c.Metrics = metrics
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.ClientCertPath = clientCert
+	c.clientParams.ClientKeyPath = clientKey
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+				t.Errorf("error from SignIntermediate(): %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The first login is by NewAuthenticatedClient()
+	if got := atomic.LoadInt32(&logins); got != 2 {
+		t.Errorf("got %v login requests, want %v", got, 2)
+	}
+	if got := metrics.counter(metricReauthenticateSuccess); got != 1 {
+		t.Errorf("got %v re-authentications, want %v", got, 1)
+	}
+}
+
+func TestSignIntermediateWithTokenExpiry(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
+	vc.SignIntermediateResponseCode = 200
+	vc.SignIntermediateResponse = signResp
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+	// The token issued by the login is accepted only for 200ms
+	vc.TokenTTL = 200 * time.Millisecond
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	metrics := newFakeMetrics()
+	c := New(CERT)
+	c.Logger = getTestLogger()
+	c.Metrics = metrics
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.ClientCertPath = clientCert
+	c.clientParams.ClientKeyPath = clientKey
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+
+	if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+		t.Errorf("error from SignIntermediate() before the expiry: %v", err)
+	}
+	if got := metrics.counter(metricReauthenticateSuccess); got != 0 {
+		t.Errorf("got %v re-authentications before the expiry, want 0", got)
+	}
+
+	// The sign request is rejected with the expired token, and succeeds after the re-authentication
+	time.Sleep(300 * time.Millisecond)
+	if _, err := vClient.SignIntermediate(context.Background(), testTTL, csrPEM); err != nil {
+		t.Errorf("error from SignIntermediate() after the expiry: %v", err)
+	}
+	if got := metrics.counter(metricReauthenticateSuccess); got != 1 {
+		t.Errorf("got %v re-authentications after the expiry, want 1", got)
+	}
+
+	// The renewal is also rejected with the expired token
+	vc.ExpireTokens()
+	if _, err := vClient.vaultClient.Auth().Token().RenewSelf(0); err == nil {
+		t.Errorf("expected got an error")
+	}
+}
 
 func TestSignIntermediateError(t *testing.T) {
 	vc := fake.NewVaultServerConfig()
@@ -423,7 +5647,749 @@ func TestSignIntermediateError(t *testing.T) {
 	vc.ServerKeyPemPath = serverKey
 	vc.CertAuthResponseCode = 200
 	vc.CertAuthResponse = certAuthResp
-	vc.SignIntermediateResponseCode = 404
+	vc.SignIntermediateResponseCode = 404
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(CERT)
+	c.Logger = getTestLogger()
+
+	retry := 0
+	c.clientParams.MaxRetries = &retry
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.ClientCertPath = clientCert
+	c.clientParams.ClientKeyPath = clientKey
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Errorf("failed to prepare vault client: %v", err)
+	}
+
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+
+	_, err = vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+	if err == nil {
+		t.Error("error is empty")
+	} else if !errors.Is(err, ErrSignEndpointNotFound) {
+		t.Errorf("got %v, want %v", err, ErrSignEndpointNotFound)
+	}
+}
+
+func TestSignIntermediateWithRetryDeadline(t *testing.T) {
+	unavailableResp, err := ioutil.ReadFile("../fake/_test_data/unavailable-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	var requests int32
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.SignIntermediateReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.WriteHeader(code)
+			w.Write(resp)
+		}
+	}
+	vc.SignIntermediateResponseCode = 503
+	vc.SignIntermediateResponse = unavailableResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	retry := 100
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.Token = "test-token"
+	c.clientParams.MaxRetries = &retry
+	c.clientParams.RetryDeadline = 500 * time.Millisecond
+
+	vClient, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+	// Retries wait for 50ms, 100ms and 150ms, and the next retry after 200ms would exceed the deadline
+	vClient.retryDelay = 50 * time.Millisecond
+
+	csrPEM, err := ioutil.ReadFile(testReqCSR)
+	if err != nil {
+		t.Errorf("failed to read csr data: %v", err)
+	}
+
+	start := time.Now()
+	_, err = vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+	elapsed := time.Since(start)
+
+	// The last error is returned even though retries remain
+	respErr, ok := err.(*vapi.ResponseError)
+	if !ok || respErr.StatusCode != 503 {
+		t.Errorf("got %v, want a response error with 503", err)
+	}
+	if elapsed > 800*time.Millisecond {
+		t.Errorf("gave up after %v, want within the deadline %v", elapsed, c.clientParams.RetryDeadline)
+	}
+	if got := atomic.LoadInt32(&requests); got != 4 {
+		t.Errorf("got %v requests, want %v", got, 4)
+	}
+}
+
+func TestSignIntermediateWithRetryOnTimeout(t *testing.T) {
+	signResp, err := ioutil.ReadFile("../fake/_test_data/sign-intermediate-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	// Each request times out after 200ms
+	os.Setenv("VAULT_CLIENT_TIMEOUT", "200ms")
+	defer os.Unsetenv("VAULT_CLIENT_TIMEOUT")
+
+	tCases := []struct {
+		name           string
+		retryOnTimeout bool
+		wantErr        bool
+		wantRequests   int32
+	}{
+		{
+			name:           "Timeout is not retried",
+			retryOnTimeout: false,
+			wantErr:        true,
+			wantRequests:   1,
+		},
+		{
+			name:           "Timeout is retried",
+			retryOnTimeout: true,
+			wantRequests:   2,
+		},
+	}
+
+	for _, tc := range tCases {
+		var requests int32
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.SignIntermediateReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+			return func(w http.ResponseWriter, r *http.Request) {
+				// Only the first request doesn't respond within the timeout
+				if atomic.AddInt32(&requests, 1) == 1 {
+					time.Sleep(500 * time.Millisecond)
+				}
+				w.WriteHeader(code)
+				w.Write(resp)
+			}
+		}
+		vc.SignIntermediateResponseCode = 200
+		vc.SignIntermediateResponse = signResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		retry := 2
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+		c.clientParams.MaxRetries = &retry
+		c.clientParams.RetryOnTimeout = tc.retryOnTimeout
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+		vClient.retryDelay = 10 * time.Millisecond
+
+		csrPEM, err := ioutil.ReadFile(testReqCSR)
+		if err != nil {
+			t.Errorf("%v: failed to read csr data: %v", tc.name, err)
+		}
+
+		_, err = vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+		if tc.wantErr && err == nil {
+			t.Errorf("%v: expected got an error", tc.name)
+		} else if !tc.wantErr && err != nil {
+			t.Errorf("%v: unexpected error from SignIntermediate(): %v", tc.name, err)
+		}
+		if got := atomic.LoadInt32(&requests); got != tc.wantRequests {
+			t.Errorf("%v: got %v requests, want %v", tc.name, got, tc.wantRequests)
+		}
+
+		s.Close()
+	}
+}
+
+func TestSignIntermediateErrorSealed(t *testing.T) {
+	sealedResp, err := ioutil.ReadFile("../fake/_test_data/sealed-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	unavailableResp, err := ioutil.ReadFile("../fake/_test_data/unavailable-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	healthResp, err := ioutil.ReadFile("../fake/_test_data/sys-health-sealed-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		signIntermediateResponse []byte
+		healthResponseCode       int
+		healthResponse           []byte
+	}{
+		// 0. Sign response tells Vault is sealed
+		{
+			signIntermediateResponse: sealedResp,
+		},
+		// 1. sys/health tells Vault is sealed
+		{
+			signIntermediateResponse: unavailableResp,
+			healthResponseCode:       200,
+			healthResponse:           healthResp,
+		},
+	}
+
+	for i, tc := range tCases {
+		var requests int32
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.SignIntermediateReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+			return func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				w.WriteHeader(code)
+				w.Write(resp)
+			}
+		}
+		vc.SignIntermediateResponseCode = 503
+		vc.SignIntermediateResponse = tc.signIntermediateResponse
+		vc.HealthResponseCode = tc.healthResponseCode
+		vc.HealthResponse = tc.healthResponse
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("#%v: failed to prepare test server: %v", i, err)
+		}
+		s.Start()
+
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+
+		vClient, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Errorf("#%v: failed to prepare vault client: %v", i, err)
+		}
+
+		csrPEM, err := ioutil.ReadFile(testReqCSR)
+		if err != nil {
+			t.Errorf("#%v: failed to read csr data: %v", i, err)
+		}
+
+		_, err = vClient.SignIntermediate(context.Background(), testTTL, csrPEM)
+		if err != ErrVaultSealed {
+			t.Errorf("#%v: got %v, want %v", i, err, ErrVaultSealed)
+		}
+		// Sealed Vault is not retried
+		if got := atomic.LoadInt32(&requests); got != 1 {
+			t.Errorf("#%v: got %v sign requests, want %v", i, got, 1)
+		}
+
+		s.Close()
+	}
+}
+
+func TestNewAuthenticatedClientWithBatchToken(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	tokenCreateResp, err := ioutil.ReadFile("../fake/_test_data/token-create-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name             string
+		method           AuthMethod
+		createChildToken bool
+		tokenType        string
+		wantRenew        bool
+	}{
+		{
+			name:      "service token is renewed",
+			method:    CERT,
+			tokenType: TokenTypeService,
+			wantRenew: true,
+		},
+		{
+			name:      "batch token is not renewed",
+			method:    CERT,
+			tokenType: TokenTypeBatch,
+		},
+		{
+			name:             "batch child token is not renewed",
+			method:           TOKEN,
+			createChildToken: true,
+			tokenType:        TokenTypeBatch,
+		},
+	}
+
+	for _, tc := range tCases {
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.CertAuthResponseCode = 200
+		vc.CertAuthResponse = certAuthResp
+		vc.TokenCreateResponseCode = 200
+		vc.TokenCreateResponse = tokenCreateResp
+		vc.RenewResponseCode = 200
+		vc.RenewResponse = renewResp
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		c := New(tc.method)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+		c.clientParams.ClientCertPath = clientCert
+		c.clientParams.ClientKeyPath = clientKey
+		c.clientParams.CreateChildToken = tc.createChildToken
+		c.clientParams.TokenType = tc.tokenType
+
+		if _, err := c.NewAuthenticatedClient(); err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+		if tc.createChildToken {
+			createReq := vc.LastTokenCreateRequest()
+			if createReq == nil {
+				t.Fatalf("%v: token create request is not recorded", tc.name)
+			}
+			if got := createReq.Body["type"]; got != tc.tokenType {
+				t.Errorf("%v: got token type %v, want %v", tc.name, got, tc.tokenType)
+			}
+		}
+
+		// The renewal goroutine renews the token at once
+		var renewed bool
+		for i := 0; i < 20 && !renewed; i++ {
+			time.Sleep(10 * time.Millisecond)
+			renewed = vc.LastRenewRequest() != nil
+		}
+		if renewed != tc.wantRenew {
+			t.Errorf("%v: got renewed %v, want %v", tc.name, renewed, tc.wantRenew)
+		}
+
+		s.Close()
+	}
+}
+
+func TestIsBatchToken(t *testing.T) {
+	tCases := []struct {
+		name      string
+		token     string
+		tokenType string
+		want      bool
+	}{
+		{name: "service token", token: "s.TQOFm1AbN2U6FyEIDcG6zwsU", want: false},
+		{name: "batch token", token: "b.AAAAAQLvfWbKPQzYoJ8Cp1xTAb3r", want: true},
+		{name: "batch token since Vault 1.10", token: "hvb.AAAAAQLvfWbKPQzYoJ8Cp1xTAb3r", want: true},
+		{name: "configured as batch", token: "cf95f87d-f95b-47ff-b1f5-ba7bff850425", tokenType: TokenTypeBatch, want: true},
+	}
+
+	for _, tc := range tCases {
+		sec := &vapi.Secret{Auth: &vapi.SecretAuth{ClientToken: tc.token}}
+		if got := isBatchToken(sec, tc.tokenType); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRenewMetrics(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.RenewResponseCode = 200
+	vc.RenewResponse = renewResp
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.Token = "test-token"
+	client, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+
+	secret, err := vapi.ParseSecret(bytes.NewReader(certAuthResp))
+	if err != nil {
+		t.Fatalf("failed to parse secret: %v", err)
+	}
+	metrics := newFakeMetrics()
+	renew, err := NewRenew(client.vaultClient, secret)
+	if err != nil {
+		t.Fatalf("failed to prepare renewer: %v", err)
+	}
+	renew.Logger = getTestLogger()
+	renew.Metrics = metrics
+	renew.gaugeInterval = 10 * time.Millisecond
+	go renew.Run()
+	defer renew.Stop()
+
+	// Wait for the renewal and some updates of the gauge
+	var gauges []float32
+	for i := 0; i < 100 && len(gauges) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		gauges = metrics.gauges(metricTokenLeaseRemaining)
+	}
+
+	if got := metrics.counter(metricTokenRenewSuccess); got != 1 {
+		t.Errorf("got %v successful renewals, want %v", got, 1)
+	}
+	if got := metrics.counter(metricTokenRenewFailure); got != 0 {
+		t.Errorf("got %v failed renewals, want %v", got, 0)
+	}
+	if len(gauges) < 3 {
+		t.Fatalf("gauge is updated only %v times", len(gauges))
+	}
+	// The first value is the lease duration in renew-response.json
+	if gauges[0] != 3600 {
+		t.Errorf("got %v as the first lease remaining, want %v", gauges[0], 3600)
+	}
+	if last := gauges[len(gauges)-1]; last >= gauges[0] {
+		t.Errorf("lease remaining is not decreased: %v", gauges)
+	}
+}
+
+func TestRenewWithGrace(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	var (
+		mu        sync.Mutex
+		renewedAt []time.Time
+	)
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.RenewReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			renewedAt = append(renewedAt, time.Now())
+			mu.Unlock()
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(`{"auth":{"client_token":"test-client-token","lease_duration":2,"renewable":true}}`))
+		}
+	}
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.Token = "test-token"
+	client, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+
+	secret, err := vapi.ParseSecret(bytes.NewReader(certAuthResp))
+	if err != nil {
+		t.Fatalf("failed to parse secret: %v", err)
+	}
+	renew, err := NewRenew(client.vaultClient, secret)
+	if err != nil {
+		t.Fatalf("failed to prepare renewer: %v", err)
+	}
+	renew.Logger = getTestLogger()
+	// The lease is 2s, so the token should be renewed 500ms after each renewal.
+	renew.Grace = 1500 * time.Millisecond
+	go renew.Run()
+	defer renew.Stop()
+
+	var got []time.Time
+	for i := 0; i < 300 && len(got) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		got = append([]time.Time(nil), renewedAt...)
+		mu.Unlock()
+	}
+	if len(got) < 2 {
+		t.Fatalf("token is renewed only %v times", len(got))
+	}
+	// The default grace would wait for 1s (the half of the lease)
+	if d := got[1].Sub(got[0]); d < 400*time.Millisecond || d > 900*time.Millisecond {
+		t.Errorf("got %v between renewals, want about %v", d, 500*time.Millisecond)
+	}
+}
+
+func TestRenewRetryAfterFailure(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	var requests int32
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.RenewReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			// The first renewal fails, and the next one succeeds
+			if atomic.AddInt32(&requests, 1) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(`{"errors":["internal error"]}`))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(renewResp)
+		}
+	}
+
+	s, addr, err := vc.NewTLSServer()
+	if err != nil {
+		t.Errorf("failed to prepare test server: %v", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	retry := 0
+	c := New(TOKEN)
+	c.Logger = getTestLogger()
+	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+	c.clientParams.CACertPath = caCert
+	c.clientParams.Token = "test-token"
+	c.clientParams.MaxRetries = &retry
+	client, err := c.NewAuthenticatedClient()
+	if err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
+	}
+
+	secret, err := vapi.ParseSecret(bytes.NewReader(certAuthResp))
+	if err != nil {
+		t.Fatalf("failed to parse secret: %v", err)
+	}
+	metrics := newFakeMetrics()
+	renew, err := NewRenew(client.vaultClient, secret)
+	if err != nil {
+		t.Fatalf("failed to prepare renewer: %v", err)
+	}
+	renew.Logger = getTestLogger()
+	renew.Metrics = metrics
+	renew.retryBackoff = 10 * time.Millisecond
+	go renew.Run()
+	defer renew.Stop()
+
+	for i := 0; i < 100 && metrics.counter(metricTokenRenewSuccess) < 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := metrics.counter(metricTokenRenewFailure); got != 1 {
+		t.Errorf("got %v failed renewals, want %v", got, 1)
+	}
+	if got := metrics.counter(metricTokenRenewSuccess); got != 1 {
+		t.Errorf("got %v successful renewals, want %v", got, 1)
+	}
+}
+
+func TestRenewStopsRetrying(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	tCases := []struct {
+		name string
+		// The renewal succeeds with the lease of 1s as many times, and fails with the code after that
+		successes int32
+		code      int
+		wait      time.Duration
+	}{
+		{name: "Permission denied", code: http.StatusForbidden, wait: 100 * time.Millisecond},
+		{name: "Lease has passed", successes: 1, code: http.StatusInternalServerError, wait: 1200 * time.Millisecond},
+	}
+
+	for _, tc := range tCases {
+		var requests int32
+		vc := fake.NewVaultServerConfig()
+		vc.ServerCertificatePemPath = serverCert
+		vc.ServerKeyPemPath = serverKey
+		vc.RenewReqHandler = func(code int, resp []byte) func(http.ResponseWriter, *http.Request) {
+			return func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) <= tc.successes {
+					w.WriteHeader(http.StatusOK)
+					_, _ = w.Write([]byte(`{"auth":{"client_token":"test-client-token","lease_duration":1,"renewable":true}}`))
+					return
+				}
+				w.WriteHeader(tc.code)
+				_, _ = w.Write([]byte(`{"errors":["renewal failed"]}`))
+			}
+		}
+
+		s, addr, err := vc.NewTLSServer()
+		if err != nil {
+			t.Errorf("%v: failed to prepare test server: %v", tc.name, err)
+		}
+		s.Start()
+
+		retry := 0
+		c := New(TOKEN)
+		c.Logger = getTestLogger()
+		c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
+		c.clientParams.CACertPath = caCert
+		c.clientParams.Token = "test-token"
+		c.clientParams.MaxRetries = &retry
+		client, err := c.NewAuthenticatedClient()
+		if err != nil {
+			t.Fatalf("%v: failed to prepare vault client: %v", tc.name, err)
+		}
+
+		secret, err := vapi.ParseSecret(bytes.NewReader(certAuthResp))
+		if err != nil {
+			t.Fatalf("%v: failed to parse secret: %v", tc.name, err)
+		}
+		renew, err := NewRenew(client.vaultClient, secret)
+		if err != nil {
+			t.Fatalf("%v: failed to prepare renewer: %v", tc.name, err)
+		}
+		renew.Logger = getTestLogger()
+		renew.retryBackoff = 10 * time.Millisecond
+		go renew.Run()
+
+		time.Sleep(tc.wait)
+		stopped := atomic.LoadInt32(&requests)
+		// Longer than the backoff of the retries so far
+		time.Sleep(500 * time.Millisecond)
+		if got := atomic.LoadInt32(&requests); got != stopped {
+			t.Errorf("%v: renewal is still retried: %v requests, then %v", tc.name, stopped, got)
+		}
+		if stopped <= tc.successes {
+			t.Errorf("%v: got %v requests, want a failed renewal", tc.name, stopped)
+		}
+
+		renew.Stop()
+		s.Close()
+	}
+}
+
+func TestRenewRetryDelay(t *testing.T) {
+	tCases := []struct {
+		name      string
+		failures  int
+		remaining time.Duration
+		want      time.Duration
+	}{
+		{name: "first failure", failures: 1, remaining: time.Hour, want: time.Second},
+		{name: "backoff is doubled", failures: 3, remaining: time.Hour, want: 4 * time.Second},
+		{name: "backoff is capped", failures: 20, remaining: time.Hour, want: time.Minute},
+		{name: "backoff is capped by the remaining lease", failures: 3, remaining: 2 * time.Second, want: 2 * time.Second},
+		{name: "no lease remains", failures: 1, remaining: -time.Second, want: time.Second},
+	}
+
+	for _, tc := range tCases {
+		r := &Renew{retryBackoff: defaultRenewRetryBackoff}
+		if got := r.retryDelay(tc.failures, tc.remaining); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRenewalDelay(t *testing.T) {
+	tCases := []struct {
+		name  string
+		grace time.Duration
+		lease time.Duration
+		want  time.Duration
+	}{
+		{name: "default grace is 10% of the lease", lease: time.Hour, want: 54 * time.Minute},
+		{name: "default grace is at least 1m", lease: 5 * time.Minute, want: 4 * time.Minute},
+		{name: "custom grace", grace: 15 * time.Minute, lease: time.Hour, want: 45 * time.Minute},
+		{name: "grace longer than the lease", grace: 2 * time.Hour, lease: time.Hour, want: 30 * time.Minute},
+	}
+
+	for _, tc := range tCases {
+		r := &Renew{Grace: tc.grace}
+		if got := r.renewalDelay(tc.lease); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestTokenSink(t *testing.T) {
+	certAuthResp, err := ioutil.ReadFile("../fake/_test_data/cert-auth-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+	renewResp, err := ioutil.ReadFile("../fake/_test_data/renew-response.json")
+	if err != nil {
+		t.Errorf("failed to load fixture: %v", err)
+	}
+
+	vc := fake.NewVaultServerConfig()
+	vc.ServerCertificatePemPath = serverCert
+	vc.ServerKeyPemPath = serverKey
+	vc.CertAuthResponseCode = 200
+	vc.CertAuthResponse = certAuthResp
 	vc.RenewResponseCode = 200
 	vc.RenewResponse = renewResp
 
@@ -434,28 +6400,113 @@ func TestSignIntermediateError(t *testing.T) {
 	s.Start()
 	defer s.Close()
 
+	sink := &fakeTokenSink{}
 	c := New(CERT)
 	c.Logger = getTestLogger()
-
-	retry := 0
-	c.clientParams.MaxRetries = &retry
+	c.TokenSink = sink
 	c.clientParams.VaultAddr = fmt.Sprintf("https://%v/", addr)
 	c.clientParams.CACertPath = caCert
 	c.clientParams.ClientCertPath = clientCert
 	c.clientParams.ClientKeyPath = clientKey
 
-	vClient, err := c.NewAuthenticatedClient()
-	if err != nil {
-		t.Errorf("failed to prepare vault client: %v", err)
+	if _, err := c.NewAuthenticatedClient(); err != nil {
+		t.Fatalf("failed to prepare vault client: %v", err)
 	}
 
-	csrPEM, err := ioutil.ReadFile(testReqCSR)
-	if err != nil {
-		t.Errorf("failed to read csr data: %v", err)
+	// The token is stored on the login, and then on the first renewal in background
+	var stored []storedToken
+	for i := 0; i < 100 && len(stored) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		stored = sink.tokens()
+	}
+	if len(stored) != 2 {
+		t.Fatalf("got %v stored tokens, want %v", len(stored), 2)
+	}
+	want := storedToken{token: "cf95f87d-f95b-47ff-b1f5-ba7bff850425", lease: time.Hour}
+	for i, got := range stored {
+		if got != want {
+			t.Errorf("got %v as the stored token %v, want %v", got, i, want)
+		}
 	}
+}
 
-	_, err = vClient.SignIntermediate(testTTL, csrPEM)
-	if err == nil {
-		t.Error("error is empty")
+type storedToken struct {
+	token string
+	lease time.Duration
+}
+
+// fakeTokenSink captures the stored tokens.
+type fakeTokenSink struct {
+	mu     sync.Mutex
+	stored []storedToken
+}
+
+func (s *fakeTokenSink) Store(token string, lease time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stored = append(s.stored, storedToken{token: token, lease: lease})
+}
+
+func (s *fakeTokenSink) tokens() []storedToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]storedToken(nil), s.stored...)
+}
+
+type fakeMetrics struct {
+	mu       sync.Mutex
+	counters map[string]float32
+	values   map[string][]float32
+}
+
+func newFakeMetrics() *fakeMetrics {
+	return &fakeMetrics{
+		counters: make(map[string]float32),
+		values:   make(map[string][]float32),
+	}
+}
+
+func (m *fakeMetrics) IncrCounter(key []string, val float32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[strings.Join(key, ".")] += val
+}
+
+func (m *fakeMetrics) IncrCounterWithLabels(key []string, val float32, labels []telemetry.Label) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[labeledKey(key, labels)] += val
+}
+
+func (m *fakeMetrics) SetGauge(key []string, val float32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := strings.Join(key, ".")
+	m.values[k] = append(m.values[k], val)
+}
+
+func (m *fakeMetrics) counter(key []string) float32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[strings.Join(key, ".")]
+}
+
+func (m *fakeMetrics) labeledCounter(key []string, labels ...telemetry.Label) float32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[labeledKey(key, labels)]
+}
+
+func labeledKey(key []string, labels []telemetry.Label) string {
+	k := strings.Join(key, ".")
+	for _, l := range labels {
+		k += fmt.Sprintf(";%v=%v", l.Name, l.Value)
 	}
+	return k
+}
+
+func (m *fakeMetrics) gauges(key []string) []float32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]float32(nil), m.values[strings.Join(key, ".")]...)
 }
@@ -0,0 +1,154 @@
+/**
+ * Copyright 2020, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package vault
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	vapi "github.com/hashicorp/vault/api"
+)
+
+// caPool is the root CA pool to verify Vault, which is replaced when ca_cert_path changes.
+type caPool struct {
+	mu   sync.RWMutex
+	pool *x509.CertPool
+}
+
+func (p *caPool) get() *x509.CertPool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.pool
+}
+
+func (p *caPool) set(pool *x509.CertPool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pool = pool
+}
+
+// caWatcher reloads the root CA pool on the changes of ca_cert_path.
+type caWatcher struct {
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (w *caWatcher) stop() {
+	w.once.Do(func() {
+		close(w.done)
+		w.watcher.Close()
+	})
+}
+
+// configureCAWatch watches CACertPath, and verifies the new TLS connections to Vault with the reloaded CA certificates.
+// The existing connections are closed once they are idle, so that subsequent requests use the new pool.
+// It must be called before the transport is wrapped.
+func (c *Config) configureCAWatch(vc *vapi.Config) (*caWatcher, error) {
+	transport, ok := vc.HttpClient.Transport.(*http.Transport)
+	if !ok {
+		return nil, nil
+	}
+	path := filepath.Clean(c.clientParams.CACertPath)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch CA certificate: %v", err)
+	}
+	dir := path
+	if !info.IsDir() {
+		// The directory is watched, since the file may be replaced by a rename.
+		dir = filepath.Dir(path)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch CA certificate: %v", err)
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch CA certificate: %v", err)
+	}
+
+	c.rootCAs = &caPool{pool: transport.TLSClientConfig.RootCAs}
+	if transport.DialTLS == nil {
+		// The custom TLS dialer of the proxy, if any, also verifies Vault with vaultTLSConfig.
+		transport.DialTLS = func(network, addr string) (net.Conn, error) {
+			return dialVaultTLS(transport, network, addr, c.vaultTLSConfig(transport))
+		}
+	}
+
+	w := &caWatcher{watcher: watcher, done: make(chan struct{})}
+	go c.watchCACert(w, path, !info.IsDir(), transport)
+	return w, nil
+}
+
+func (c *Config) watchCACert(w *caWatcher, path string, isFile bool, transport *http.Transport) {
+	for {
+		select {
+		case <-w.done:
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			// Kubernetes updates the mounted files by swapping the symlink of "..data".
+			name := filepath.Clean(event.Name)
+			if isFile && name != path && !strings.HasPrefix(filepath.Base(name), "..") {
+				continue
+			}
+			pool, err := c.loadRootCAs()
+			if err != nil {
+				c.Logger.Warn("Failed to reload the CA certificate, so the current one is still used", "ca_cert_path", path, "err", err.Error())
+				continue
+			}
+			c.rootCAs.set(pool)
+			transport.CloseIdleConnections()
+			c.Logger.Info("Reloaded the CA certificate of Vault", "ca_cert_path", path)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			c.Logger.Warn("Error from the watcher of the CA certificate", "ca_cert_path", path, "err", err.Error())
+		}
+	}
+}
+
+// vaultTLSConfig returns the TLS config of a new connection to Vault, which has the current root CA pool.
+func (c *Config) vaultTLSConfig(transport *http.Transport) *tls.Config {
+	config := transport.TLSClientConfig.Clone()
+	if c.rootCAs != nil && config != nil {
+		config.RootCAs = c.rootCAs.get()
+	}
+	return config
+}
+
+// dialVaultTLS establishes the TLS connection with the config, and defaults the server name to the host of addr.
+func dialVaultTLS(transport *http.Transport, network, addr string, config *tls.Config) (net.Conn, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: DefaultDialTimeout, KeepAlive: DefaultKeepAlive}).DialContext
+	}
+	return dialTLS(dial, network, addr, config, transport.TLSHandshakeTimeout)
+}